@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipAllowlist は送信元 IP が allowed のいずれかに含まれるリクエストだけを通す。
+// 直接の接続元が trusted に含まれる場合に限り X-Forwarded-For を右から辿り、
+// 最初の信頼できないアドレスをクライアント IP とみなす（偽装された左端は使わない）。
+type ipAllowlist struct {
+	allowed []netip.Prefix
+	trusted []netip.Prefix
+}
+
+// parsePrefixes は "10.0.0.0/8" や単一アドレス "192.0.2.1" を netip.Prefix にする。
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+			}
+			out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP は r の送信元 IP を返す（解釈できなければ ok=false）。
+func (l *ipAllowlist) clientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip = ip.Unmap()
+	if !containsAddr(l.trusted, ip) {
+		return ip, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := strings.TrimSpace(hops[i])
+		if h == "" {
+			continue
+		}
+		a, err := netip.ParseAddr(h)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = a.Unmap()
+		if !containsAddr(l.trusted, ip) {
+			break
+		}
+	}
+	return ip, true
+}
+
+// allowlistHandler は allowed が空なら next をそのまま返す。
+func allowlistHandler(allowed, trusted []netip.Prefix, next http.Handler) http.Handler {
+	if len(allowed) == 0 {
+		return next
+	}
+	l := &ipAllowlist{allowed: allowed, trusted: trusted}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ok := l.clientIP(r)
+		if !ok || !containsAddr(l.allowed, ip) {
+			log.Printf("allowlist: denied %s %s (client %v)", r.Method, r.URL.Path, ip)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
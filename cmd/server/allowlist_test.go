@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowlistHandler(t *testing.T) {
+	allowed, err := parsePrefixes([]string{"10.8.0.0/16", "192.0.2.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := parsePrefixes([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	h := allowlistHandler(allowed, trusted, ok)
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		want   int
+	}{
+		{"vpn direct", "10.8.1.2:5555", "", http.StatusOK},
+		{"single address", "192.0.2.7:1", "", http.StatusOK},
+		{"outside", "203.0.113.9:1", "", http.StatusForbidden},
+		{"ipv4-mapped ipv6", "[::ffff:10.8.3.4]:1", "", http.StatusOK},
+		{"untrusted xff ignored", "203.0.113.9:1", "10.8.1.2", http.StatusForbidden},
+		{"trusted proxy xff", "127.0.0.1:1", "10.8.1.2", http.StatusOK},
+		{"spoofed left-most", "127.0.0.1:1", "10.8.1.2, 203.0.113.9", http.StatusForbidden},
+		{"trusted proxy outside client", "127.0.0.1:1", "203.0.113.9", http.StatusForbidden},
+		{"garbage xff", "127.0.0.1:1", "not-an-ip", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("want %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAllowlistDisabledWhenEmpty(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.9:1"
+	rec := httptest.NewRecorder()
+	allowlistHandler(nil, nil, ok).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("empty allowlist must allow all: %d", rec.Code)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth は prefixes のいずれかで始まるパスに HTTP Basic 認証を要求する。
+// passHash（bcrypt）が指定されていればそれを、無ければ pass を平文比較（定数時間）で検証する。
+// user が空なら認証は無効で next をそのまま返す。
+func basicAuth(user, pass, passHash string, prefixes []string, next http.Handler) http.Handler {
+	if user == "" {
+		return next
+	}
+	wantUser := sha256.Sum256([]byte(user))
+	wantPass := sha256.Sum256([]byte(pass))
+	check := func(u, p string) bool {
+		gotUser := sha256.Sum256([]byte(u))
+		// ユーザ名が違っても パスワード検証は行い、応答時間で区別できないようにする
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:]) == 1
+		var passOK bool
+		if passHash != "" {
+			passOK = bcrypt.CompareHashAndPassword([]byte(passHash), []byte(p)) == nil
+		} else {
+			gotPass := sha256.Sum256([]byte(p))
+			passOK = subtle.ConstantTimeCompare(gotPass[:], wantPass[:]) == 1
+		}
+		return userOK && passOK
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasPrefix(r.URL.Path, prefixes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u, p, ok := r.BasicAuth(); ok && check(u, p) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="7dtd-stats", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+func hasPrefix(p string, prefixes []string) bool {
+	for _, pref := range prefixes {
+		if strings.HasPrefix(p, pref) {
+			return true
+		}
+	}
+	return false
+}
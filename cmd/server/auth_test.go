@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := []string{"/api/", "/metrics"}
+
+	for name, h := range map[string]http.Handler{
+		"plain":  basicAuth("admin", "s3cret", "", prefixes, ok),
+		"bcrypt": basicAuth("admin", "", string(hash), prefixes, ok),
+	} {
+		t.Run(name, func(t *testing.T) {
+			tests := []struct {
+				path       string
+				user, pass string
+				want       int
+			}{
+				{"/map/0/0/0.png", "", "", http.StatusOK},
+				{"/sse/live", "", "", http.StatusOK},
+				{"/api/players/current", "", "", http.StatusUnauthorized},
+				{"/metrics", "admin", "wrong", http.StatusUnauthorized},
+				{"/metrics", "root", "s3cret", http.StatusUnauthorized},
+				{"/api/history/events", "admin", "s3cret", http.StatusOK},
+			}
+			for _, tt := range tests {
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				if tt.user != "" {
+					req.SetBasicAuth(tt.user, tt.pass)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != tt.want {
+					t.Errorf("%s as %q: want %d, got %d", tt.path, tt.user, tt.want, rec.Code)
+				}
+				if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("%s: 401 without WWW-Authenticate", tt.path)
+				}
+			}
+		})
+	}
+}
+
+func TestBasicAuthDisabledWithoutUser(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	rec := httptest.NewRecorder()
+	basicAuth("", "", "", []string{"/api/"}, ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/x", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("auth should be disabled: %d", rec.Code)
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	envconfig "github.com/kelseyhightower/envconfig"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/masahide/7dtd-stats/pkg/poller"
+	"github.com/masahide/7dtd-stats/pkg/reqid"
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+// Config はサービス起動に必要な設定です。
+// 優先順位は デフォルト < 設定ファイル（-config） < 環境変数 < フラグ。
+type Config struct {
+	Listen             string        `yaml:"listen" envconfig:"LISTEN_ADDR"`                  // 例: ":8081"
+	UpstreamBaseURL    string        `yaml:"upstream_base_url" envconfig:"UPSTREAM_BASE_URL"` // 例: "http://game:8080"
+	StaticDir          string        `yaml:"static_dir" envconfig:"STATIC_DIR"`               // 例: "./web"（空なら無効）
+	SPA                bool          `yaml:"spa" envconfig:"SPA"`                             // 存在しないパスに index.html を返す（-static-dir と併用）
+	ShutdownTimeout    time.Duration `yaml:"-" ignored:"true"`                                // 例: 5s（実値。ShutdownTimeoutSec から導出）
+	ShutdownTimeoutSec int           `yaml:"shutdown_timeout_sec" envconfig:"SHUTDOWN_TIMEOUT_SEC"`
+	HistoryMaxRange    time.Duration `yaml:"history_max_range" envconfig:"HISTORY_MAX_RANGE"` // 履歴 API の最大期間
+	HistoryTZ          string        `yaml:"history_tz" envconfig:"HISTORY_TZ"`               // 履歴 API の日付だけの from/to と bucket の区切りの TZ
+	Metrics            bool          `yaml:"metrics" envconfig:"METRICS"`                     // /metrics（Prometheus）を公開する
+
+	// TLS（cert/key の両方指定時のみ HTTPS で待ち受け）
+	TLSCert       string `yaml:"tls_cert" envconfig:"TLS_CERT"`               // 証明書（PEM）
+	TLSKey        string `yaml:"tls_key" envconfig:"TLS_KEY"`                 // 秘密鍵（PEM）
+	TLSMinVersion string `yaml:"tls_min_version" envconfig:"TLS_MIN_VERSION"` // "1.2" / "1.3"（空なら Go の既定）
+
+	RequestIDHeader string `yaml:"request_id_header" envconfig:"REQUEST_ID_HEADER"` // リクエスト ID のヘッダ名
+
+	// IP 制限（allow_cidrs が空なら全許可）
+	AllowCIDRs     []string `yaml:"allow_cidrs" envconfig:"ALLOW_CIDRS"`         // 許可する送信元（カンマ区切り）
+	TrustedProxies []string `yaml:"trusted_proxies" envconfig:"TRUSTED_PROXIES"` // X-Forwarded-For を信用する直前のプロキシ
+
+	// Basic 認証（admin_user 指定時のみ。auth_prefixes 配下に適用）
+	AdminUser     string   `yaml:"admin_user" envconfig:"ADMIN_USER"`
+	AdminPass     string   `yaml:"admin_pass" envconfig:"ADMIN_PASS"`           // 平文（admin_pass_hash と排他）
+	AdminPassHash string   `yaml:"admin_pass_hash" envconfig:"ADMIN_PASS_HASH"` // bcrypt ハッシュ
+	AuthPrefixes  []string `yaml:"auth_prefixes" envconfig:"AUTH_PREFIXES"`     // 認証対象のパス（カンマ区切り）
+
+	// Map proxy
+	MapAccessLog       bool              `yaml:"map_access_log" envconfig:"MAP_ACCESS_LOG"`                         // タイル 1 リクエスト 1 行のアクセスログ
+	MapAllowedPrefixes []string          `yaml:"map_allowed_prefixes" envconfig:"MAP_ALLOWED_PREFIXES"`             // 転送を許可するパス（カンマ区切り）
+	MapRequestTimeout  time.Duration     `yaml:"map_request_timeout" envconfig:"MAP_REQUEST_TIMEOUT"`               // 上流への全体タイムアウト
+	MapCacheEntries    int               `yaml:"map_cache_entries" envconfig:"MAP_CACHE_ENTRIES"`                   // メモリキャッシュの件数（0 で無効）
+	MapCacheTTL        time.Duration     `yaml:"map_cache_ttl" envconfig:"MAP_CACHE_TTL"`                           // キャッシュの有効期間
+	MapCacheStale      bool              `yaml:"map_cache_serve_stale" envconfig:"MAP_CACHE_SERVE_STALE"`           // 上流の 5xx・接続失敗時は期限切れのキャッシュでも返す
+	MapFallbackDir     string            `yaml:"map_fallback_dir" envconfig:"MAP_FALLBACK_DIR"`                     // 上流停止時に返す低ズームタイル（z/x/y.png）
+	MapTileMaxAge      time.Duration     `yaml:"map_tile_max_age" envconfig:"MAP_TILE_MAX_AGE"`                     // 上流が付けない場合の Cache-Control max-age（0 で付けない）
+	MapStripSlash      bool              `yaml:"map_strip_trailing_slash" envconfig:"MAP_STRIP_TRAILING_SLASH"`     // 上流へ転送するパスの末尾 "/" を取り除く
+	MapMaxRedirects    int               `yaml:"map_follow_redirects" envconfig:"MAP_FOLLOW_REDIRECTS"`             // 上流のリダイレクトをたどる最大回数（0 で素通し）
+	MapCORSOrigins     []string          `yaml:"map_cors_origins" envconfig:"MAP_CORS_ORIGINS"`                     // タイルの CORS を許可するオリジン（カンマ区切り、"*" で全許可）
+	MapStripHeaders    []string          `yaml:"map_strip_response_headers" envconfig:"MAP_STRIP_RESPONSE_HEADERS"` // 上流の応答から取り除くヘッダ（例: Set-Cookie）
+	MapQueryParams     []string          `yaml:"map_allowed_query_params" envconfig:"MAP_ALLOWED_QUERY_PARAMS"`     // 上流へ転送するクエリパラメータ（空なら全て）
+	MapRespHeaders     map[string]string `yaml:"map_response_headers" envconfig:"MAP_RESPONSE_HEADERS"`             // タイルの応答に付ける（上流の値を置き換える）ヘッダ（例: Timing-Allow-Origin:*）
+
+	// SSE
+	SSEPingEvent    string        `yaml:"sse_ping_event" envconfig:"SSE_PING_EVENT"`                       // ping をこの名前のイベントで送る（空なら :ping コメント）
+	SSEGzip         bool          `yaml:"sse_gzip" envconfig:"SSE_GZIP"`                                   // Accept-Encoding: gzip のクライアントにはストリームを gzip で送る
+	SSEReplayMaxAge time.Duration `yaml:"sse_replay_max_age" envconfig:"SSE_REPLAY_MAX_AGE"`               // これより古いイベントはリプレイしない（0 で無制限）
+	SSEMaxReplay    int           `yaml:"sse_max_replay_on_connect" envconfig:"SSE_MAX_REPLAY_ON_CONNECT"` // 1 接続へのリプレイ件数の上限（新しい方から。0 で無制限）
+	SSEMaxClientBuf int           `yaml:"sse_max_client_buffer" envconfig:"SSE_MAX_CLIENT_BUFFER"`         // ?buffer= で指定できる送信バッファの上限（既定 1024）
+	SSEOverflow     string        `yaml:"sse_broadcast_overflow" envconfig:"SSE_BROADCAST_OVERFLOW"`       // Broadcast のキューが満杯のとき（block / drop_newest / drop_oldest）
+
+	// Poller
+	PollPlayersURL      string            `yaml:"poll_players_url" envconfig:"POLL_PLAYERS_URL"` // 例: "http://game:8080/api/players"
+	PollInterval        time.Duration     `yaml:"poll_interval" envconfig:"POLL_INTERVAL"`       // 例: 2s
+	PollTimeout         time.Duration     `yaml:"poll_timeout" envconfig:"POLL_TIMEOUT"`         // 1 回の取得のタイムアウト
+	PollUsername        string            `yaml:"poll_username" envconfig:"POLL_USERNAME"`       // 取得先の Basic 認証（空なら付けない）
+	PollPassword        string            `yaml:"poll_password" envconfig:"POLL_PASSWORD"`
+	PollArrayPath       string            `yaml:"poll_array_path" envconfig:"POLL_ARRAY_PATH"`                 // プレイヤー配列までのドット区切りのパス（例: result.players、空なら既定の候補）
+	PollNextPath        string            `yaml:"poll_next_path" envconfig:"POLL_NEXT_PATH"`                   // 次ページ URL のパス（例: links.next、空ならページングしない）
+	PollMinInterval     time.Duration     `yaml:"poll_min_interval" envconfig:"POLL_MIN_INTERVAL"`             // プレイヤーごとの位置出力の最短間隔（0 で毎回）
+	PollLargeMovement   float64           `yaml:"poll_large_movement" envconfig:"POLL_LARGE_MOVEMENT"`         // これを超える移動は poll_min_interval を待たない
+	PollDistanceMetric  string            `yaml:"poll_distance_metric" envconfig:"POLL_DISTANCE_METRIC"`       // 移動量の測り方（axis / euclidean、空なら axis）
+	PollHeartbeat       time.Duration     `yaml:"poll_heartbeat_interval" envconfig:"POLL_HEARTBEAT_INTERVAL"` // 動かないプレイヤーの位置も出す間隔（0 で無効）
+	PollSnapshot        time.Duration     `yaml:"poll_snapshot_interval" envconfig:"POLL_SNAPSHOT_INTERVAL"`   // 全プレイヤーのスナップショットを SSE に出す間隔（0 で無効）
+	PollDisconnectGrace int               `yaml:"poll_disconnect_grace" envconfig:"POLL_DISCONNECT_GRACE"`     // 一覧から消えても接続中とみなす連続回数
+	WebhookURL          string            `yaml:"webhook_url" envconfig:"WEBHOOK_URL"`                         // プレイヤーイベントを POST する先（空なら無効）
+	WebhookKinds        []string          `yaml:"webhook_kinds" envconfig:"WEBHOOK_KINDS"`                     // 送るイベント種別（カンマ区切り、空なら全種別）
+	PollTags            map[string]string `yaml:"poll_tags" envconfig:"POLL_TAGS"`                             // 全ての位置・イベントに付けるタグ（例: world:Navezgane,src:node1）
+	PollDryRun          bool              `yaml:"-" ignored:"true"`                                            // 1 回だけ取得して抽出結果を表示し、終了する（フラグのみ）
+
+	// Storage
+	DataDir         string        `yaml:"data_dir" envconfig:"DATA_DIR"`                   // 例: "./data"（空なら履歴 API 無効）
+	FlushInterval   time.Duration `yaml:"flush_interval" envconfig:"FLUSH_INTERVAL"`       // tsfile の定期フラッシュ間隔
+	StoreRateLimit  float64       `yaml:"store_rate_limit" envconfig:"STORE_RATE_LIMIT"`   // シリーズごとの書き込み数の上限（点/秒、0 で無制限）
+	StoreMinFreeMB  int           `yaml:"store_min_free_mb" envconfig:"STORE_MIN_FREE_MB"` // 空き容量の下限（MiB、0 で無効）。下回ると /readyz が 503、位置などの書き込みを止める
+	RetentionDays   int           `yaml:"retention_days" envconfig:"RETENTION_DAYS"`       // 保持日数（0 で削除しない）
+	RetentionTZ     string        `yaml:"retention_tz" envconfig:"RETENTION_TZ"`           // 日境界の TZ（例: "Asia/Tokyo"）
+	RetentionDryRun bool          `yaml:"retention_dry_run" envconfig:"RETENTION_DRY_RUN"` // 削除せず対象をログに出すだけ
+}
+
+// defaultConfig は何も指定されなかったときの値です。
+func defaultConfig() Config {
+	return Config{
+		ShutdownTimeoutSec: 5,
+		HistoryMaxRange:    24 * time.Hour,
+		RequestIDHeader:    reqid.DefaultHeader,
+		AuthPrefixes:       []string{"/api/", "/metrics"},
+		MapAllowedPrefixes: []string{"/map/"},
+		MapRequestTimeout:  15 * time.Second,
+		MapCacheTTL:        time.Minute,
+		SSEMaxClientBuf:    1024,
+		SSEOverflow:        "block",
+		PollInterval:       2 * time.Second,
+		PollTimeout:        5 * time.Second,
+		FlushInterval:      2 * time.Second,
+		RetentionTZ:        "UTC",
+		HistoryTZ:          "UTC",
+	}
+}
+
+// loadConfig は args（os.Args[1:] 相当）と環境変数から Config を組み立てて検証する。
+func loadConfig(args []string) (Config, error) {
+	// 1) フラグを先に解釈する（-config の場所を知るため）。値の反映は最後に行う。
+	var (
+		fv          Config
+		configPath  string
+		shutdownS   int
+		mapPrefixes string
+		mapOrigins  string
+		mapStrip    string
+		mapQuery    string
+		mapHeaders  string
+		authPrefix  string
+		allowCIDRs  []string
+		trusted     []string
+		hookKinds   string
+		pollTags    string
+	)
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", os.Getenv("CONFIG_FILE"), "path to config file (YAML or JSON)")
+	fs.StringVar(&fv.Listen, "listen", "", "listen address (e.g. :8081)")
+	fs.StringVar(&fv.UpstreamBaseURL, "upstream", "", "upstream base URL (e.g. http://host:8080)")
+	fs.StringVar(&fv.StaticDir, "static-dir", "", "path to static contents (optional)")
+	fs.BoolVar(&fv.SPA, "spa", false, "serve index.html for unknown non-API paths under -static-dir")
+	fs.StringVar(&mapPrefixes, "map-allowed-prefixes", "", "comma-separated path prefixes proxied to upstream (default /map/)")
+	fs.StringVar(&fv.RequestIDHeader, "request-id-header", "", "header carrying the request ID (default X-Request-ID)")
+	fs.Func("allow-cidr", "allowed client CIDR (repeatable; none allows all)", func(v string) error {
+		allowCIDRs = append(allowCIDRs, splitCSV(v)...)
+		return nil
+	})
+	fs.Func("trusted-proxy", "proxy CIDR whose X-Forwarded-For is trusted (repeatable)", func(v string) error {
+		trusted = append(trusted, splitCSV(v)...)
+		return nil
+	})
+	fs.StringVar(&fv.AdminUser, "admin-user", "", "Basic auth user for -auth-prefixes (empty disables auth)")
+	fs.StringVar(&fv.AdminPass, "admin-pass", "", "Basic auth password (plain text)")
+	fs.StringVar(&fv.AdminPassHash, "admin-pass-hash", "", "Basic auth password as bcrypt hash (instead of -admin-pass)")
+	fs.StringVar(&authPrefix, "auth-prefixes", "", "comma-separated path prefixes requiring auth (default /api/,/metrics)")
+	fs.BoolVar(&fv.MapAccessLog, "map-access-log", false, "log every proxied map request")
+	fs.DurationVar(&fv.MapRequestTimeout, "map-request-timeout", 0, "overall timeout of a proxied map request")
+	fs.IntVar(&fv.MapCacheEntries, "map-cache-entries", 0, "number of map responses cached in memory (0 disables)")
+	fs.DurationVar(&fv.MapCacheTTL, "map-cache-ttl", 0, "lifetime of a cached map response")
+	fs.BoolVar(&fv.MapCacheStale, "map-cache-serve-stale", false, "serve cached map responses, even expired ones, when the upstream fails or returns 5xx")
+	fs.DurationVar(&fv.MapTileMaxAge, "map-tile-max-age", 0, "Cache-Control max-age added to tiles when upstream sends none (0 disables)")
+	fs.BoolVar(&fv.MapStripSlash, "map-strip-trailing-slash", false, "strip trailing slashes from paths forwarded upstream")
+	fs.IntVar(&fv.MapMaxRedirects, "map-follow-redirects", 0, "follow up to this many upstream redirects server-side (0 passes them through)")
+	fs.StringVar(&mapHeaders, "map-response-headers", "", "comma-separated Name:value headers set on map tile responses, replacing upstream values (e.g. Timing-Allow-Origin:*,X-Tile-Source:node1)")
+	fs.StringVar(&mapQuery, "map-allowed-query-params", "", "comma-separated query parameters forwarded to the map upstream (default all, e.g. t,v)")
+	fs.StringVar(&mapStrip, "map-strip-response-headers", "", "comma-separated headers removed from upstream tile responses (e.g. Set-Cookie)")
+	fs.StringVar(&mapOrigins, "map-cors-origins", "", "comma-separated origins allowed to load map tiles via CORS (* allows any)")
+	fs.StringVar(&fv.MapFallbackDir, "map-fallback-dir", "", "directory of low-zoom tiles ({z}/{x}/{y}.png) served while upstream is down")
+	fs.StringVar(&fv.SSEPingEvent, "sse-ping-event", "", "send SSE pings as this named event instead of a comment")
+	fs.BoolVar(&fv.SSEGzip, "sse-gzip", false, "gzip the SSE stream for clients that accept it")
+	fs.DurationVar(&fv.SSEReplayMaxAge, "sse-replay-max-age", 0, "do not replay SSE events older than this to reconnecting clients (0 = no limit)")
+	fs.IntVar(&fv.SSEMaxClientBuf, "sse-max-client-buffer", 0, "upper bound of the per-connection send buffer requested with ?buffer=")
+	fs.StringVar(&fv.SSEOverflow, "sse-broadcast-overflow", "", "what to do when the SSE broadcast queue is full: block, drop_newest or drop_oldest")
+	fs.IntVar(&fv.SSEMaxReplay, "sse-max-replay-on-connect", 0, "replay at most this many (newest) SSE events to one connection (0 = no limit)")
+	fs.StringVar(&fv.PollPlayersURL, "poll-players-url", "", "players JSON endpoint (optional)")
+	fs.DurationVar(&fv.PollInterval, "poll-interval", 0, "poll interval for players (e.g. 2s)")
+	fs.DurationVar(&fv.PollTimeout, "poll-timeout", 0, "timeout of a single players fetch")
+	fs.StringVar(&fv.PollUsername, "poll-username", "", "Basic auth user for -poll-players-url")
+	fs.StringVar(&fv.PollPassword, "poll-password", "", "Basic auth password for -poll-players-url (prefer POLL_PASSWORD)")
+	fs.StringVar(&fv.PollArrayPath, "poll-array-path", "", "dotted path to the players array in the response (e.g. result.players)")
+	fs.StringVar(&fv.PollNextPath, "poll-next-path", "", "dotted path to the next page URL in the response (e.g. links.next)")
+	fs.BoolVar(&fv.PollDryRun, "poll-dry-run", false, "fetch -poll-players-url once, print the response shape and the extracted/skipped players, and exit")
+	fs.DurationVar(&fv.PollMinInterval, "poll-min-interval", 0, "minimum interval between position updates of one player (0 emits every poll)")
+	fs.Float64Var(&fv.PollLargeMovement, "poll-large-movement", 0, "movement that bypasses -poll-min-interval (0 disables)")
+	fs.StringVar(&fv.PollDistanceMetric, "poll-distance-metric", "", "how movement is measured against the thresholds: axis (larger of |dx|,|dz|) or euclidean")
+	fs.DurationVar(&fv.PollHeartbeat, "poll-heartbeat-interval", 0, "also emit positions of stationary players at this interval (0 disables)")
+	fs.DurationVar(&fv.PollSnapshot, "poll-snapshot-interval", 0, "broadcast a snapshot of all online players on the SSE snapshot topic at this interval (0 disables)")
+	fs.IntVar(&fv.PollDisconnectGrace, "poll-disconnect-grace", 0, "polls a missing player is still treated as connected (suppresses disconnect/connect flaps)")
+	fs.StringVar(&fv.WebhookURL, "webhook-url", "", "URL to POST player events to (requires -poll-players-url)")
+	fs.StringVar(&hookKinds, "webhook-kinds", "", "comma-separated event kinds sent to -webhook-url (default all)")
+	fs.StringVar(&pollTags, "poll-tags", "", "comma-separated key:value tags added to every stored point and SSE payload (e.g. world:Navezgane,src:node1)")
+	fs.IntVar(&shutdownS, "shutdown-timeout", 0, "graceful shutdown timeout seconds")
+	fs.StringVar(&fv.DataDir, "data-dir", "", "time-series data directory (optional; enables /api/history/*)")
+	fs.DurationVar(&fv.FlushInterval, "flush-interval", 0, "periodic flush interval of time-series files")
+	fs.IntVar(&fv.StoreMinFreeMB, "store-min-free-mb", 0, "free space (MiB) below which /readyz reports storage degraded and non-event series stop being written (0 = off)")
+	fs.Float64Var(&fv.StoreRateLimit, "store-rate-limit", 0, "maximum points per second written to one series; excess points are dropped (0 = no limit)")
+	fs.IntVar(&fv.RetentionDays, "retention-days", 0, "days of time-series data to keep (0 keeps everything)")
+	fs.BoolVar(&fv.RetentionDryRun, "retention-dry-run", false, "only log the day directories retention would delete")
+	fs.StringVar(&fv.RetentionTZ, "retention-tz", "", "time zone of the retention day boundary (e.g. Asia/Tokyo)")
+	fs.DurationVar(&fv.HistoryMaxRange, "history-max-range", 0, "maximum from/to range accepted by /api/history/*")
+	fs.StringVar(&fv.HistoryTZ, "history-tz", "", "time zone of date-only from/to and bucket boundaries in /api/history/* (e.g. Asia/Tokyo)")
+	fs.BoolVar(&fv.Metrics, "metrics", false, "expose Prometheus metrics at /metrics")
+	fs.StringVar(&fv.TLSCert, "tls-cert", "", "TLS certificate file (PEM); serves HTTPS together with -tls-key")
+	fs.StringVar(&fv.TLSKey, "tls-key", "", "TLS private key file (PEM)")
+	fs.StringVar(&fv.TLSMinVersion, "tls-min-version", "", "minimum TLS version (1.2 or 1.3)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// 2) デフォルト → 設定ファイル
+	cfg := defaultConfig()
+	if configPath != "" {
+		if err := loadConfigFile(configPath, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// 3) 環境変数（設定されているものだけ上書き）
+	if err := envconfig.Process("", &cfg); err != nil {
+		return Config{}, fmt.Errorf("env: %w", err)
+	}
+
+	// 4) 明示されたフラグだけ上書き
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = fv.Listen
+		case "upstream":
+			cfg.UpstreamBaseURL = fv.UpstreamBaseURL
+		case "static-dir":
+			cfg.StaticDir = fv.StaticDir
+		case "spa":
+			cfg.SPA = fv.SPA
+		case "map-allowed-prefixes":
+			cfg.MapAllowedPrefixes = splitCSV(mapPrefixes)
+		case "request-id-header":
+			cfg.RequestIDHeader = fv.RequestIDHeader
+		case "allow-cidr":
+			cfg.AllowCIDRs = allowCIDRs
+		case "trusted-proxy":
+			cfg.TrustedProxies = trusted
+		case "admin-user":
+			cfg.AdminUser = fv.AdminUser
+		case "admin-pass":
+			cfg.AdminPass = fv.AdminPass
+		case "admin-pass-hash":
+			cfg.AdminPassHash = fv.AdminPassHash
+		case "auth-prefixes":
+			cfg.AuthPrefixes = splitCSV(authPrefix)
+		case "map-access-log":
+			cfg.MapAccessLog = fv.MapAccessLog
+		case "map-request-timeout":
+			cfg.MapRequestTimeout = fv.MapRequestTimeout
+		case "map-cache-entries":
+			cfg.MapCacheEntries = fv.MapCacheEntries
+		case "map-cache-ttl":
+			cfg.MapCacheTTL = fv.MapCacheTTL
+		case "map-cache-serve-stale":
+			cfg.MapCacheStale = fv.MapCacheStale
+		case "map-fallback-dir":
+			cfg.MapFallbackDir = fv.MapFallbackDir
+		case "map-tile-max-age":
+			cfg.MapTileMaxAge = fv.MapTileMaxAge
+		case "map-strip-trailing-slash":
+			cfg.MapStripSlash = fv.MapStripSlash
+		case "map-follow-redirects":
+			cfg.MapMaxRedirects = fv.MapMaxRedirects
+		case "map-cors-origins":
+			cfg.MapCORSOrigins = splitCSV(mapOrigins)
+		case "map-strip-response-headers":
+			cfg.MapStripHeaders = splitCSV(mapStrip)
+		case "map-allowed-query-params":
+			cfg.MapQueryParams = splitCSV(mapQuery)
+		case "map-response-headers":
+			cfg.MapRespHeaders = parseTagList(mapHeaders)
+		case "sse-ping-event":
+			cfg.SSEPingEvent = fv.SSEPingEvent
+		case "sse-gzip":
+			cfg.SSEGzip = fv.SSEGzip
+		case "sse-replay-max-age":
+			cfg.SSEReplayMaxAge = fv.SSEReplayMaxAge
+		case "sse-max-client-buffer":
+			cfg.SSEMaxClientBuf = fv.SSEMaxClientBuf
+		case "sse-broadcast-overflow":
+			cfg.SSEOverflow = fv.SSEOverflow
+		case "sse-max-replay-on-connect":
+			cfg.SSEMaxReplay = fv.SSEMaxReplay
+		case "poll-players-url":
+			cfg.PollPlayersURL = fv.PollPlayersURL
+		case "poll-interval":
+			cfg.PollInterval = fv.PollInterval
+		case "poll-timeout":
+			cfg.PollTimeout = fv.PollTimeout
+		case "poll-username":
+			cfg.PollUsername = fv.PollUsername
+		case "poll-password":
+			cfg.PollPassword = fv.PollPassword
+		case "poll-dry-run":
+			cfg.PollDryRun = fv.PollDryRun
+		case "poll-array-path":
+			cfg.PollArrayPath = fv.PollArrayPath
+		case "poll-next-path":
+			cfg.PollNextPath = fv.PollNextPath
+		case "poll-min-interval":
+			cfg.PollMinInterval = fv.PollMinInterval
+		case "poll-large-movement":
+			cfg.PollLargeMovement = fv.PollLargeMovement
+		case "poll-distance-metric":
+			cfg.PollDistanceMetric = fv.PollDistanceMetric
+		case "poll-heartbeat-interval":
+			cfg.PollHeartbeat = fv.PollHeartbeat
+		case "poll-snapshot-interval":
+			cfg.PollSnapshot = fv.PollSnapshot
+		case "poll-disconnect-grace":
+			cfg.PollDisconnectGrace = fv.PollDisconnectGrace
+		case "webhook-url":
+			cfg.WebhookURL = fv.WebhookURL
+		case "webhook-kinds":
+			cfg.WebhookKinds = splitCSV(hookKinds)
+		case "poll-tags":
+			cfg.PollTags = parseTagList(pollTags)
+		case "shutdown-timeout":
+			cfg.ShutdownTimeoutSec = shutdownS
+		case "data-dir":
+			cfg.DataDir = fv.DataDir
+		case "flush-interval":
+			cfg.FlushInterval = fv.FlushInterval
+		case "store-rate-limit":
+			cfg.StoreRateLimit = fv.StoreRateLimit
+		case "store-min-free-mb":
+			cfg.StoreMinFreeMB = fv.StoreMinFreeMB
+		case "retention-days":
+			cfg.RetentionDays = fv.RetentionDays
+		case "retention-dry-run":
+			cfg.RetentionDryRun = fv.RetentionDryRun
+		case "retention-tz":
+			cfg.RetentionTZ = fv.RetentionTZ
+		case "history-max-range":
+			cfg.HistoryMaxRange = fv.HistoryMaxRange
+		case "history-tz":
+			cfg.HistoryTZ = fv.HistoryTZ
+		case "metrics":
+			cfg.Metrics = fv.Metrics
+		case "tls-cert":
+			cfg.TLSCert = fv.TLSCert
+		case "tls-key":
+			cfg.TLSKey = fv.TLSKey
+		case "tls-min-version":
+			cfg.TLSMinVersion = fv.TLSMinVersion
+		}
+	})
+
+	// 5) 派生値の確定と検証
+	cfg.ShutdownTimeout = time.Duration(cfg.ShutdownTimeoutSec) * time.Second
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadConfigFile は YAML（JSON も YAML として読める）を cfg に重ねる。
+// 未知のキーはタイプミスとみなしてエラーにする。
+func loadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate は起動に必須な値と値域を検証する。
+func (c Config) validate() error {
+	var errs []error
+	if c.UpstreamBaseURL == "" {
+		errs = append(errs, errors.New("upstream is required (-upstream, UPSTREAM_BASE_URL or upstream_base_url)"))
+	}
+	if c.RequestIDHeader == "" {
+		errs = append(errs, errors.New("request_id_header must not be empty"))
+	}
+	if _, err := parsePrefixes(c.AllowCIDRs); err != nil {
+		errs = append(errs, fmt.Errorf("allow_cidrs: %w", err))
+	}
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if c.AdminUser != "" {
+		switch {
+		case c.AdminPass == "" && c.AdminPassHash == "":
+			errs = append(errs, errors.New("admin_user requires admin_pass or admin_pass_hash"))
+		case c.AdminPass != "" && c.AdminPassHash != "":
+			errs = append(errs, errors.New("admin_pass and admin_pass_hash are mutually exclusive"))
+		case c.AdminPassHash != "":
+			if _, err := bcrypt.Cost([]byte(c.AdminPassHash)); err != nil {
+				errs = append(errs, fmt.Errorf("admin_pass_hash: %w", err))
+			}
+		}
+		if len(c.AuthPrefixes) == 0 {
+			errs = append(errs, errors.New("auth_prefixes must not be empty when admin_user is set"))
+		}
+	}
+	if len(c.MapAllowedPrefixes) == 0 {
+		errs = append(errs, errors.New("map_allowed_prefixes must not be empty"))
+	}
+	if c.MapTileMaxAge < 0 {
+		errs = append(errs, errors.New("map_tile_max_age must not be negative"))
+	}
+	if c.SSEReplayMaxAge < 0 {
+		errs = append(errs, errors.New("sse_replay_max_age must not be negative"))
+	}
+	if c.StoreRateLimit < 0 {
+		errs = append(errs, errors.New("store_rate_limit must not be negative"))
+	}
+	if c.StoreMinFreeMB < 0 {
+		errs = append(errs, errors.New("store_min_free_mb must not be negative"))
+	}
+	if c.SSEMaxClientBuf < 1 {
+		errs = append(errs, errors.New("sse_max_client_buffer must be at least 1"))
+	}
+	if _, err := sse.ParseOverflowPolicy(c.SSEOverflow); err != nil {
+		errs = append(errs, fmt.Errorf("sse_broadcast_overflow: %q must be block, drop_newest or drop_oldest", c.SSEOverflow))
+	}
+	if c.SSEMaxReplay < 0 {
+		errs = append(errs, errors.New("sse_max_replay_on_connect must not be negative"))
+	}
+	if c.MapMaxRedirects < 0 {
+		errs = append(errs, errors.New("map_follow_redirects must not be negative"))
+	}
+	for _, o := range c.MapCORSOrigins {
+		if o == "*" {
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("map_cors_origins: %q is not an origin like https://example.com", o))
+		}
+	}
+	if c.PollPlayersURL != "" && c.PollInterval <= 0 {
+		errs = append(errs, errors.New("poll_interval must be positive"))
+	}
+	if c.PollMinInterval < 0 || c.PollLargeMovement < 0 || c.PollHeartbeat < 0 || c.PollSnapshot < 0 {
+		errs = append(errs, errors.New("poll_min_interval, poll_large_movement, poll_heartbeat_interval and poll_snapshot_interval must not be negative"))
+	}
+	if _, err := poller.ParseDistanceMetric(c.PollDistanceMetric); err != nil {
+		errs = append(errs, fmt.Errorf("poll_distance_metric: %q must be axis or euclidean", c.PollDistanceMetric))
+	}
+	if c.PollDisconnectGrace < 0 {
+		errs = append(errs, errors.New("poll_disconnect_grace must not be negative"))
+	}
+	for k, v := range c.MapRespHeaders {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") || v == "" || strings.ContainsAny(v, "\r\n") {
+			errs = append(errs, fmt.Errorf("map_response_headers: invalid header %q: %q (want Name:value)", k, v))
+		}
+	}
+	if c.PollDryRun && c.PollPlayersURL == "" {
+		errs = append(errs, errors.New("poll_dry_run requires poll_players_url"))
+	}
+	if c.WebhookURL != "" && c.PollPlayersURL == "" {
+		errs = append(errs, errors.New("webhook_url requires poll_players_url"))
+	}
+	for _, k := range c.WebhookKinds {
+		if !slices.Contains(storage.PlayerEventKinds(), storage.EventKind(k)) {
+			errs = append(errs, fmt.Errorf("webhook_kinds: unknown kind %q", k))
+		}
+	}
+	for k, v := range c.PollTags {
+		if v == "" {
+			errs = append(errs, fmt.Errorf("poll_tags: %q has no value (want key:value)", k))
+		}
+	}
+	if err := tsfile.ValidateTags(c.PollTags); err != nil {
+		errs = append(errs, fmt.Errorf("poll_tags: %w", err))
+	}
+	if c.ShutdownTimeoutSec < 0 {
+		errs = append(errs, errors.New("shutdown_timeout_sec must not be negative"))
+	}
+	if c.RetentionDays < 0 {
+		errs = append(errs, errors.New("retention_days must not be negative"))
+	}
+	if _, err := time.LoadLocation(c.RetentionTZ); err != nil {
+		errs = append(errs, fmt.Errorf("retention_tz: %w", err))
+	}
+	if _, err := time.LoadLocation(c.HistoryTZ); err != nil {
+		errs = append(errs, fmt.Errorf("history_tz: %w", err))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls_cert and tls_key must be set together"))
+	}
+	if _, err := parseTLSVersion(c.TLSMinVersion); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// splitCSV はカンマ区切りを空要素を除いて分割する。
+func splitCSV(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseTagList は "k1:v1,k2:v2" をタグに変換する（envconfig の map と同じ形式）。
+// コロンの無い要素は値を空にしておき、validate で弾く。
+func parseTagList(s string) map[string]string {
+	var out map[string]string
+	for _, kv := range splitCSV(s) {
+		if out == nil {
+			out = make(map[string]string)
+		}
+		k, v, _ := strings.Cut(kv, ":")
+		out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return out
+}
+
+// TLSEnabled は HTTPS で待ち受けるかどうかを返す。
+func (c Config) TLSEnabled() bool { return c.TLSCert != "" && c.TLSKey != "" }
+
+// parseTLSVersion は "1.2" などを tls.VersionTLS12 などへ変換する（空なら 0 = Go の既定）。
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls_min_version: unsupported %q (want 1.2 or 1.3)", v)
+}
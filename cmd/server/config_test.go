@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	p := writeConfig(t, "server.yaml", `
+listen: ":9000"
+upstream_base_url: "http://file:8080"
+poll_interval: 5s
+data_dir: "/var/lib/7dtd"
+retention_days: 30
+retention_tz: "Asia/Tokyo"
+`)
+	t.Setenv("UPSTREAM_BASE_URL", "http://env:8080")
+	t.Setenv("POLL_INTERVAL", "3s")
+
+	cfg, err := loadConfig([]string{"-config", p, "-poll-interval", "1s"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Listen != ":9000" || cfg.DataDir != "/var/lib/7dtd" || cfg.RetentionDays != 30 {
+		t.Fatalf("file values not applied: %+v", cfg)
+	}
+	if cfg.UpstreamBaseURL != "http://env:8080" {
+		t.Fatalf("env should override file: %q", cfg.UpstreamBaseURL)
+	}
+	if cfg.PollInterval != time.Second {
+		t.Fatalf("flag should override env: %s", cfg.PollInterval)
+	}
+	// 未指定はデフォルト
+	if cfg.ShutdownTimeout != 5*time.Second || cfg.HistoryMaxRange != 24*time.Hour {
+		t.Fatalf("defaults not applied: %+v", cfg)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	p := writeConfig(t, "server.json", `{"upstream_base_url": "http://json:8080", "flush_interval": "10s"}`)
+	cfg, err := loadConfig([]string{"-config", p})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.UpstreamBaseURL != "http://json:8080" || cfg.FlushInterval != 10*time.Second {
+		t.Fatalf("json not applied: %+v", cfg)
+	}
+}
+
+func TestLoadConfigFlagsOnly(t *testing.T) {
+	cfg, err := loadConfig([]string{"-listen", ":8081", "-upstream", "http://flag:8080"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Listen != ":8081" || cfg.UpstreamBaseURL != "http://flag:8080" || cfg.PollInterval != 2*time.Second {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"missing upstream", nil, "upstream is required"},
+		{"unknown key", []string{"-config", writeConfig(t, "bad.yaml", "upstream_base_url: x\nlisten_addr: ':1'\n")}, "listen_addr"},
+		{"missing file", []string{"-config", filepath.Join(t.TempDir(), "nope.yaml")}, "config"},
+		{"bad tz", []string{"-upstream", "http://x", "-retention-tz", "Nowhere/City"}, "retention_tz"},
+		{"bad history tz", []string{"-upstream", "http://x", "-history-tz", "Nowhere/City"}, "history_tz"},
+		{"tls cert only", []string{"-upstream", "http://x", "-tls-cert", "cert.pem"}, "tls_cert and tls_key"},
+		{"admin without pass", []string{"-upstream", "http://x", "-admin-user", "admin"}, "admin_pass"},
+		{"bad bcrypt hash", []string{"-upstream", "http://x", "-admin-user", "admin", "-admin-pass-hash", "nope"}, "admin_pass_hash"},
+		{"bad cidr", []string{"-upstream", "http://x", "-allow-cidr", "10.0.0.0/8", "-allow-cidr", "10.0.0.300/8"}, "allow_cidrs"},
+		{"bad tls version", []string{"-upstream", "http://x", "-tls-min-version", "1.0"}, "tls_min_version"},
+		{"dry run without poller", []string{"-upstream", "http://x", "-poll-dry-run"}, "poll_dry_run requires"},
+		{"webhook without poller", []string{"-upstream", "http://x", "-webhook-url", "http://hook"}, "webhook_url requires"},
+		{"bad webhook kind", []string{"-upstream", "http://x", "-poll-players-url", "http://p", "-webhook-url", "http://hook", "-webhook-kinds", "player_connect,bogus"}, "webhook_kinds"},
+		{"poll tag without value", []string{"-upstream", "http://x", "-poll-tags", "world:W1,src"}, "poll_tags"},
+		{"poll tag with path separator", []string{"-upstream", "http://x", "-poll-tags", "world:a/b"}, "poll_tags"},
+		{"bad distance metric", []string{"-upstream", "http://x", "-poll-distance-metric", "manhattan"}, "poll_distance_metric"},
+		{"negative snapshot interval", []string{"-upstream", "http://x", "-poll-snapshot-interval", "-1s"}, "poll_snapshot_interval"},
+		{"negative store rate limit", []string{"-upstream", "http://x", "-store-rate-limit", "-5"}, "store_rate_limit"},
+		{"negative min free", []string{"-upstream", "http://x", "-store-min-free-mb", "-1"}, "store_min_free_mb"},
+		{"zero max client buffer", []string{"-upstream", "http://x", "-sse-max-client-buffer", "0"}, "sse_max_client_buffer"},
+		{"bad overflow policy", []string{"-upstream", "http://x", "-sse-broadcast-overflow", "drop_all"}, "sse_broadcast_overflow"},
+		{"negative max replay", []string{"-upstream", "http://x", "-sse-max-replay-on-connect", "-1"}, "sse_max_replay_on_connect"},
+		{"negative replay max-age", []string{"-upstream", "http://x", "-sse-replay-max-age", "-1m"}, "sse_replay_max_age"},
+		{"negative tile max-age", []string{"-upstream", "http://x", "-map-tile-max-age", "-1s"}, "map_tile_max_age"},
+		{"negative redirects", []string{"-upstream", "http://x", "-map-follow-redirects", "-1"}, "map_follow_redirects"},
+		{"response header without value", []string{"-upstream", "http://x", "-map-response-headers", "Timing-Allow-Origin:*,X-Tile-Source"}, "map_response_headers"},
+		{"cors origin with path", []string{"-upstream", "http://x", "-map-cors-origins", "https://viewer.example/app"}, "map_cors_origins"},
+		{"cors origin without scheme", []string{"-upstream", "http://x", "-map-cors-origins", "viewer.example"}, "map_cors_origins"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("want error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTLS(t *testing.T) {
+	t.Setenv("TLS_CERT", "/etc/7dtd/cert.pem")
+	t.Setenv("TLS_KEY", "/etc/7dtd/key.pem")
+	cfg, err := loadConfig([]string{"-upstream", "http://x", "-tls-min-version", "1.3"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.TLSEnabled() {
+		t.Fatalf("TLS should be enabled: %+v", cfg)
+	}
+	if v, _ := parseTLSVersion(cfg.TLSMinVersion); v != tls.VersionTLS13 {
+		t.Fatalf("min version: got %x", v)
+	}
+}
+
+func TestLoadConfigPollTags(t *testing.T) {
+	t.Setenv("POLL_TAGS", "world:FromEnv,src:env")
+	cfg, err := loadConfig([]string{"-upstream", "http://x", "-poll-tags", " world:Navezgane , src:node1 "})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.PollTags) != 2 || cfg.PollTags["world"] != "Navezgane" || cfg.PollTags["src"] != "node1" {
+		t.Fatalf("flag should override env: %v", cfg.PollTags)
+	}
+}
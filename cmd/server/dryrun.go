@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/masahide/7dtd-stats/pkg/poller"
+)
+
+// pollDryRun は -poll-dry-run の本体です。prov で 1 回だけ取得し、ページごとのレスポンスの形・抽出したプレイヤー・
+// 飛ばした要素とその理由を w へ書きます。配信も保存もしない。戻り値は終了コード（取得に失敗したら 1）。
+func pollDryRun(ctx context.Context, prov *poller.JSONProvider, w io.Writer) int {
+	r, err := prov.DebugFetch(ctx)
+	for i, pg := range r.Pages {
+		fmt.Fprintf(w, "page %d: GET %s (%d items)\n  shape: %s\n", i+1, pg.URL, pg.Items, pg.Shape)
+	}
+	fmt.Fprintf(w, "players: %d\n", len(r.Players))
+	for _, pl := range r.Players {
+		fmt.Fprintf(w, "  id=%q name=%q x=%g z=%g\n", pl.ID, pl.Name, pl.X, pl.Z)
+	}
+	fmt.Fprintf(w, "skipped: %d\n", len(r.Skipped))
+	for _, s := range r.Skipped {
+		item, _ := json.Marshal(s.Item)
+		fmt.Fprintf(w, "  page %d item %d: %s\n    %s\n", s.Page+1, s.Index, s.Reason, item)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
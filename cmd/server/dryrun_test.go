@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/masahide/7dtd-stats/pkg/poller"
+)
+
+func TestPollDryRunPrintsExtractedAndSkipped(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `[{"id":"P:1","name":"alice","x":1.5,"z":-2},{"id":"P:2","name":"bob"}]`)
+	}))
+	defer srv.Close()
+
+	var out strings.Builder
+	if code := pollDryRun(context.Background(), &poller.JSONProvider{URL: srv.URL}, &out); code != 0 {
+		t.Fatalf("exit code %d:\n%s", code, out.String())
+	}
+	for _, want := range []string{
+		"(2 items)",
+		`shape: [2 × {"id": string, "name": string, "x": number, "z": number}]`,
+		"players: 1\n  id=\"P:1\" name=\"alice\" x=1.5 z=-2\n",
+		"skipped: 1\n  page 1 item 1: missing x and z",
+		`{"id":"P:2","name":"bob"}`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, out.String())
+		}
+	}
+
+	// 取得できなければ終了コード 1
+	out.Reset()
+	srv.Close()
+	if code := pollDryRun(context.Background(), &poller.JSONProvider{URL: srv.URL}, &out); code != 1 || !strings.Contains(out.String(), "error: ") {
+		t.Fatalf("exit code %d:\n%s", code, out.String())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/masahide/7dtd-stats/internal/httpx"
+)
+
+// gzipSkipExt は既に圧縮済みの形式。再圧縮しても縮まないので素通しする。
+var gzipSkipExt = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true,
+	".gz": true, ".br": true, ".zst": true, ".zip": true,
+	".woff": true, ".woff2": true, ".mp4": true, ".webm": true,
+}
+
+var gzipWriterPool = sync.Pool{New: func() any {
+	w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return w
+}}
+
+// gzipHandler は Accept-Encoding: gzip のクライアントに対し、next の 200 応答を逐次 gzip 圧縮する。
+// 圧縮済み拡張子・Range リクエスト・既に Content-Encoding 付きの応答は対象外。
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gzipSkipExt[strings.ToLower(path.Ext(r.URL.Path))] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !httpx.AcceptsGzip(r) || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter は WriteHeader の時点で圧縮するかを決める（200 かつ未エンコードのときだけ）。
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head        bool
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && !w.head {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length") // 圧縮後の長さは分からないので chunked で送る
+		h.Del("Accept-Ranges")
+		w.gz = gzipWriterPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			// 圧縮後のバイト列で推測されないよう、元のデータで決めておく
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush は圧縮途中のデータも送り出す（http.Flusher）。
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	_ = w.gz.Close()
+	w.gz.Reset(nil)
+	gzipWriterPool.Put(w.gz)
+	w.gz = nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	dir := t.TempDir()
+	js := strings.Repeat("console.log('hello');\n", 500)
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte(js), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tile.png"), []byte("\x89PNG...."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := gzipHandler(http.FileServer(http.Dir(dir)))
+
+	do := func(path string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("compressed", func(t *testing.T) {
+		rec := do("/app.js", map[string]string{"Accept-Encoding": "br, gzip"})
+		if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("headers: %v", rec.Header())
+		}
+		if rec.Header().Get("Content-Length") != "" {
+			t.Fatalf("Content-Length must be dropped: %v", rec.Header())
+		}
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") {
+			t.Fatalf("content-type: %q", rec.Header().Get("Content-Type"))
+		}
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		b, _ := io.ReadAll(zr)
+		if string(b) != js {
+			t.Fatalf("body mismatch (%d bytes)", len(b))
+		}
+	})
+	t.Run("no accept-encoding", func(t *testing.T) {
+		rec := do("/app.js", nil)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != js {
+			t.Fatalf("should be identity: %v", rec.Header())
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("Vary missing")
+		}
+	})
+	t.Run("gzip q=0", func(t *testing.T) {
+		if rec := do("/app.js", map[string]string{"Accept-Encoding": "gzip;q=0"}); rec.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("q=0 must disable gzip")
+		}
+	})
+	t.Run("already compressed asset", func(t *testing.T) {
+		rec := do("/tile.png", map[string]string{"Accept-Encoding": "gzip"})
+		if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Vary") != "" {
+			t.Fatalf("png must pass through: %v", rec.Header())
+		}
+	})
+	t.Run("range", func(t *testing.T) {
+		rec := do("/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"})
+		if rec.Code != http.StatusPartialContent || rec.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("range must not be compressed: %d %v", rec.Code, rec.Header())
+		}
+	})
+	t.Run("not modified", func(t *testing.T) {
+		first := do("/app.js", nil)
+		rec := do("/app.js", map[string]string{"Accept-Encoding": "gzip", "If-Modified-Since": first.Header().Get("Last-Modified")})
+		if rec.Code != http.StatusNotModified || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+			t.Fatalf("304 must stay bodyless: %d %v", rec.Code, rec.Header())
+		}
+	})
+}
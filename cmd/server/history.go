@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+// historyHandler は TSStore を読み出す /api/history/* の実装です。
+type historyHandler struct {
+	store    *storage.TSStore
+	maxRange time.Duration  // from〜to の最大幅（0 以下で無制限）
+	loc      *time.Location // 日付だけの from/to と bucket の区切りに使う TZ（nil なら UTC。?tz= で上書き）
+}
+
+// trackPoint は /api/history/tracks の 1 要素です。
+type trackPoint struct {
+	T time.Time `json:"t"`
+	X float64   `json:"x"`
+	Z float64   `json:"z"`
+}
+
+// tracks: GET /api/history/tracks?player_id=...&from=RFC3339&to=RFC3339[&bucket=1m][&tz=Asia/Tokyo]
+// players.x / players.z を player_id で絞り込み、時刻で突き合わせた {t,x,z} を時刻順で返す。
+// bucket 指定時はバケットごとの平均値（バケットは tz の 0 時から区切る）。bucket なしは 1 時間ずつ読んで逐次書き出す（広い範囲でもメモリは 1 時間分）。
+func (h *historyHandler) tracks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pid := q.Get("player_id")
+	if pid == "" {
+		http.Error(w, "player_id is required", http.StatusBadRequest)
+		return
+	}
+	from, to, loc, status, err := h.parseRange(q.Get("from"), q.Get("to"), q.Get("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	var bucket time.Duration
+	if v := q.Get("bucket"); v != "" {
+		bucket, err = time.ParseDuration(v)
+		if err != nil || bucket <= 0 {
+			http.Error(w, "bucket must be a positive duration (e.g. 1m)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	match := tsfile.Tags{storage.TagPlayerID: pid}
+	if bucket <= 0 {
+		h.streamTracks(r.Context(), w, from, to, match)
+		return
+	}
+	xs, err := h.store.AggregateIn("players.x", from, to, match, bucket, loc)
+	if err != nil {
+		log.Printf("history: tracks players.x: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	zs, err := h.store.AggregateIn("players.z", from, to, match, bucket, loc)
+	if err != nil {
+		log.Printf("history: tracks players.z: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, joinTracks(xs, zs))
+}
+
+// streamTracks は [from,to] を 1 時間ずつ区切って x/z を組にし、時刻順の JSON 配列として書き出す。
+// 最初の区切りを読めなかったときは 500 を返す。書き出し始めた後に失敗した場合は配列を閉じずに終える
+// （クライアントは不完全な JSON として検知できる）。
+func (h *historyHandler) streamTracks(ctx context.Context, w http.ResponseWriter, from, to time.Time, match tsfile.Tags) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	started, n := false, 0
+	for ws := from; !ws.After(to); {
+		we := ws.Truncate(time.Hour).Add(time.Hour - time.Nanosecond)
+		if we.After(to) {
+			we = to
+		}
+		pts, err := h.trackWindow(ctx, ws, we, match)
+		if err != nil {
+			if ctx.Err() != nil {
+				return // クライアント切断
+			}
+			log.Printf("history: tracks: %v", err)
+			if !started {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			_ = bw.Flush()
+			return
+		}
+		if !started {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			bw.WriteByte('[')
+			started = true
+		}
+		for _, p := range pts {
+			if n > 0 {
+				bw.WriteByte(',')
+			}
+			n++
+			if err := enc.Encode(p); err != nil {
+				log.Printf("write json: %v", err)
+				return
+			}
+		}
+		ws = we.Add(time.Nanosecond)
+	}
+	bw.WriteString("]\n")
+	if err := bw.Flush(); err != nil {
+		log.Printf("write json: %v", err)
+	}
+}
+
+// trackWindow は [from,to]（1 時間以内）の x/z を、同じタグセット・同じ時刻で組にして時刻順に返す。
+func (h *historyHandler) trackWindow(ctx context.Context, from, to time.Time, match tsfile.Tags) ([]trackPoint, error) {
+	type key struct {
+		tags string
+		t    int64
+	}
+	zs := make(map[key]float64)
+	err := h.store.QueryStream(ctx, "players.z", from, to, match, func(p tsfile.Point) bool {
+		zs[key{p.Tags.Canonical(), p.T.UnixNano()}] = p.V
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []trackPoint
+	err = h.store.QueryStream(ctx, "players.x", from, to, match, func(p tsfile.Point) bool {
+		if z, ok := zs[key{p.Tags.Canonical(), p.T.UnixNano()}]; ok {
+			out = append(out, trackPoint{T: p.T, X: p.V, Z: z})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].T.Before(out[j].T) })
+	return out, nil
+}
+
+// eventRecord は /api/history/events の 1 要素です。
+type eventRecord struct {
+	T        time.Time `json:"t"`
+	Kind     string    `json:"kind"`
+	PlayerID string    `json:"player_id,omitempty"`
+	Name     string    `json:"name,omitempty"`
+}
+
+// eventsPage は /api/history/events のレスポンスです。Next が空なら続きは無い。
+type eventsPage struct {
+	Events []eventRecord `json:"events"`
+	Next   string        `json:"next,omitempty"`
+}
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+	eventsMaxSpan      = 30 * 24 * time.Hour // scanEvents が 1 回に読む区切りの上限
+)
+
+// events: GET /api/history/events?from=RFC3339&to=RFC3339[&kind=][&player_id=][&limit=][&after=][&tz=]
+// events.count を kind/player_id のタグで絞り込み（該当しないタグ集合は展開しない）、時刻順に返す。
+// 続きがある場合は next に不透明なカーソルを入れるので、after に渡して次ページを取得する。
+func (h *historyHandler) events(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to, _, status, err := h.parseRange(q.Get("from"), q.Get("to"), q.Get("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	limit := defaultEventsLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxEventsLimit)
+	}
+	var cur eventCursor
+	if v := q.Get("after"); v != "" {
+		if cur, err = parseEventCursor(v); err != nil {
+			http.Error(w, "invalid after cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	match := tsfile.Tags{}
+	if v := q.Get("kind"); v != "" {
+		match[storage.TagKind] = v
+	}
+	if v := q.Get("player_id"); v != "" {
+		match[storage.TagPlayerID] = v
+	}
+	pts, err := h.scanEvents(from, to, cur, match, limit)
+	if err != nil {
+		log.Printf("history: events: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, pageEvents(pts, cur, limit))
+}
+
+// scanEvents は [from,to] の events.count を cur の時刻から時刻順に読む。カーソルの前は読み直さず、
+// 1 時間から倍々に（最大 eventsMaxSpan まで）広げた区切りごとに読んで、ページ（cur の持ち越し分＋limit）を 1 件超えたら残りは読まない。
+// 区切りは時刻で分かれるので、同時刻のイベントは必ず同じ区切りに入る。
+func (h *historyHandler) scanEvents(from, to time.Time, cur eventCursor, match tsfile.Tags, limit int) ([]tsfile.Point, error) {
+	if cur.T.After(from) {
+		from = cur.T
+	}
+	var pts []tsfile.Point
+	for ws, span := from, time.Hour; !ws.After(to) && len(pts) <= cur.Skip+limit; span = min(span*2, eventsMaxSpan) {
+		we := ws.Add(span - time.Nanosecond)
+		if we.After(to) {
+			we = to
+		}
+		w, err := h.store.Query(storage.EventsSeries, ws, we, match)
+		if err != nil {
+			return nil, err
+		}
+		pts = append(pts, w...)
+		ws = we.Add(time.Nanosecond)
+	}
+	return pts, nil
+}
+
+// eventCursor は直前ページの最後の時刻と、その時刻で返済みの件数です。
+// 同時刻のイベントがページ境界を跨いでも取りこぼさないよう件数も持つ。
+type eventCursor struct {
+	T    time.Time
+	Skip int
+}
+
+func (c eventCursor) String() string {
+	raw := strconv.FormatInt(c.T.UnixNano(), 10) + ":" + strconv.Itoa(c.Skip)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseEventCursor(s string) (eventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return eventCursor{}, err
+	}
+	ts, skip, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return eventCursor{}, fmt.Errorf("malformed cursor")
+	}
+	ns, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return eventCursor{}, err
+	}
+	n, err := strconv.Atoi(skip)
+	if err != nil || n < 0 {
+		return eventCursor{}, fmt.Errorf("malformed cursor")
+	}
+	return eventCursor{T: time.Unix(0, ns).UTC(), Skip: n}, nil
+}
+
+// pageEvents は時刻順の pts から cur より後ろを最大 limit 件取り出す（pts は cur より前を含んでいてもよい）。
+func pageEvents(pts []tsfile.Point, cur eventCursor, limit int) eventsPage {
+	i := 0
+	if !cur.T.IsZero() {
+		for i < len(pts) && pts[i].T.Before(cur.T) {
+			i++
+		}
+		for skipped := 0; i < len(pts) && pts[i].T.Equal(cur.T) && skipped < cur.Skip; skipped++ {
+			i++
+		}
+	}
+	page := eventsPage{Events: make([]eventRecord, 0, min(limit, len(pts)-i))}
+	for ; i < len(pts) && len(page.Events) < limit; i++ {
+		p := pts[i]
+		page.Events = append(page.Events, eventRecord{
+			T:        p.T,
+			Kind:     p.Tags[storage.TagKind],
+			PlayerID: p.Tags[storage.TagPlayerID],
+			Name:     p.Tags[storage.TagName],
+		})
+	}
+	if i < len(pts) && len(page.Events) > 0 {
+		last := page.Events[len(page.Events)-1].T
+		next := eventCursor{T: last}
+		// 同時刻で返した件数（前ページからの持ち越し分も含む）
+		for j := i - 1; j >= 0 && pts[j].T.Equal(last); j-- {
+			next.Skip++
+		}
+		page.Next = next.String()
+	}
+	return page
+}
+
+// parseRange は from/to（RFC3339、または YYYY-MM-DD）を解釈し、範囲の妥当性と最大幅を検証する。
+// 日付だけの from はその日の 0 時、to はその日の終わり（翌日 0 時の直前）で、日の境界は tz（IANA 名。空なら h.loc）で決める
+// （例: tz=Asia/Tokyo で from=to=2025-08-26 は JST のその日 1 日分）。両方とも日付なら最大幅は日数×24h で比べるので、
+// 夏時間で 25 時間の日も 24h の上限で 1 日として読める。返す loc は使った TZ（bucket の区切り用）。
+// 失敗時は返すべき HTTP ステータスとエラーを返す。
+func (h *historyHandler) parseRange(fromStr, toStr, tz string) (from, to time.Time, loc *time.Location, status int, err error) {
+	if fromStr == "" || toStr == "" {
+		return from, to, nil, http.StatusBadRequest, fmt.Errorf("from and to are required (RFC3339)")
+	}
+	loc = h.loc
+	if tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return from, to, nil, http.StatusBadRequest, fmt.Errorf("invalid tz: %v", err)
+		}
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	from, fromDay, err := parseTimeOrDay(fromStr, loc, false)
+	if err != nil {
+		return from, to, nil, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err)
+	}
+	to, toDay, err := parseTimeOrDay(toStr, loc, true)
+	if err != nil {
+		return from, to, nil, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err)
+	}
+	if to.Before(from) {
+		return from, to, nil, http.StatusBadRequest, fmt.Errorf("to must not be before from")
+	}
+	span := to.Sub(from)
+	if fromDay && toDay {
+		f, _ := time.Parse(time.DateOnly, fromStr)
+		t, _ := time.Parse(time.DateOnly, toStr)
+		span = t.Sub(f) + 24*time.Hour
+	}
+	if h.maxRange > 0 && span > h.maxRange {
+		return from, to, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("range too large (max %s)", h.maxRange)
+	}
+	return from.UTC(), to.UTC(), loc, 0, nil
+}
+
+// parseTimeOrDay は RFC3339 か loc の日付（YYYY-MM-DD）を解釈する。日付なら end に応じてその日の始まりか終わりを返す。
+func parseTimeOrDay(s string, loc *time.Location, end bool) (t time.Time, day bool, err error) {
+	if d, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		from, to := storage.DayRange(d, loc)
+		if end {
+			return to, true, nil
+		}
+		return from, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	return t, false, err
+}
+
+// joinTracks は同じタグセット・同時刻の x/z を組にして時刻順に並べる（片方しか無い時刻は捨てる）。
+// poll_tags の変更などで 1 人のプレイヤーに複数のタグセットがあると、同じバケット時刻の点がタグセットごとに来るので、
+// 時刻だけで組にすると別のタグセットの z と取り違える（trackWindow と同じキー）。
+func joinTracks(xs, zs []tsfile.Point) []trackPoint {
+	type key struct {
+		tags string
+		t    int64
+	}
+	zBy := make(map[key]float64, len(zs))
+	for _, p := range zs {
+		zBy[key{p.Tags.Canonical(), p.T.UnixNano()}] = p.V
+	}
+	out := make([]trackPoint, 0, len(xs))
+	for _, p := range xs {
+		if z, ok := zBy[key{p.Tags.Canonical(), p.T.UnixNano()}]; ok {
+			out = append(out, trackPoint{T: p.T, X: p.V, Z: z})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].T.Before(out[j].T) })
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("write json: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+func newHistoryForTest(t *testing.T) (*historyHandler, *storage.TSStore) {
+	t.Helper()
+	s := storage.NewTSStore(t.TempDir(), tsfile.WithFlushEvery(1))
+	t.Cleanup(func() { _ = s.Close() })
+	return &historyHandler{store: s, maxRange: 24 * time.Hour}, s
+}
+
+func TestHistoryTracks(t *testing.T) {
+	h, s := newHistoryForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	for i := 2; i >= 0; i-- {
+		ts := base.Add(time.Duration(i) * time.Minute)
+		if err := s.AppendVec("players", ts, map[string]float64{"x": float64(i), "z": float64(-i)},
+			map[string]string{"player_id": "P:A"}); err != nil {
+			t.Fatalf("AppendVec: %v", err)
+		}
+		if err := s.AppendVec("players", ts, map[string]float64{"x": 99, "z": 99},
+			map[string]string{"player_id": "P:B"}); err != nil {
+			t.Fatalf("AppendVec: %v", err)
+		}
+	}
+
+	q := url.Values{
+		"player_id": {"P:A"},
+		"from":      {base.Format(time.RFC3339)},
+		"to":        {base.Add(time.Hour).Format(time.RFC3339)},
+	}
+	rec := httptest.NewRecorder()
+	h.tracks(rec, httptest.NewRequest(http.MethodGet, "/api/history/tracks?"+q.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	var got []trackPoint
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("want 3 points, got %+v", got)
+	}
+	for i, p := range got {
+		if !p.T.Equal(base.Add(time.Duration(i)*time.Minute)) || p.X != float64(i) || p.Z != float64(-i) {
+			t.Fatalf("point %d unexpected: %+v", i, p)
+		}
+	}
+}
+
+// 1 人のプレイヤーに複数のタグセット（poll_tags の変更・複数サーバーの集約）があっても、bucket の x/z はタグセットごとに組にする。
+func TestHistoryTracksBucketKeepsTagSetsApart(t *testing.T) {
+	h, s := newHistoryForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	for i, world := range []string{"W1", "W2"} {
+		v := float64(i+1) * 10 // W1: (10, -10), W2: (20, -20)
+		if err := s.AppendVec("players", base.Add(time.Duration(i)*time.Second), map[string]float64{"x": v, "z": -v},
+			map[string]string{storage.TagPlayerID: "P:A", "world": world}); err != nil {
+			t.Fatalf("AppendVec: %v", err)
+		}
+	}
+
+	q := url.Values{
+		"player_id": {"P:A"},
+		"from":      {base.Format(time.RFC3339)},
+		"to":        {base.Add(time.Hour).Format(time.RFC3339)},
+		"bucket":    {"1m"},
+	}
+	rec := httptest.NewRecorder()
+	h.tracks(rec, httptest.NewRequest(http.MethodGet, "/api/history/tracks?"+q.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: %d body=%s", rec.Code, rec.Body.String())
+	}
+	var got []trackPoint
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want one point per tag set, got %+v", got)
+	}
+	for _, p := range got {
+		if !p.T.Equal(base) || p.Z != -p.X {
+			t.Fatalf("x/z from different tag sets were paired: %+v", got)
+		}
+	}
+}
+
+func TestHistoryTracksBadParams(t *testing.T) {
+	h, _ := newHistoryForTest(t)
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{"missing player", url.Values{"from": {base.Format(time.RFC3339)}, "to": {base.Format(time.RFC3339)}}, http.StatusBadRequest},
+		{"bad from", url.Values{"player_id": {"P:A"}, "from": {"yesterday"}, "to": {base.Format(time.RFC3339)}}, http.StatusBadRequest},
+		{"reversed", url.Values{"player_id": {"P:A"}, "from": {base.Format(time.RFC3339)}, "to": {base.Add(-time.Hour).Format(time.RFC3339)}}, http.StatusBadRequest},
+		{"bad bucket", url.Values{"player_id": {"P:A"}, "from": {base.Format(time.RFC3339)}, "to": {base.Format(time.RFC3339)}, "bucket": {"-1s"}}, http.StatusBadRequest},
+		{"too large", url.Values{"player_id": {"P:A"}, "from": {base.Format(time.RFC3339)}, "to": {base.Add(48 * time.Hour).Format(time.RFC3339)}}, http.StatusRequestEntityTooLarge},
+		{"bad tz", url.Values{"player_id": {"P:A"}, "from": {"2025-08-26"}, "to": {"2025-08-26"}, "tz": {"Nowhere/City"}}, http.StatusBadRequest},
+		{"two days", url.Values{"player_id": {"P:A"}, "from": {"2025-08-26"}, "to": {"2025-08-27"}}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.tracks(rec, httptest.NewRequest(http.MethodGet, "/api/history/tracks?"+tt.query.Encode(), nil))
+			if rec.Code != tt.want {
+				t.Fatalf("status: want %d, got %d (%s)", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHistoryTracksDayInTimeZone(t *testing.T) {
+	h, s := newHistoryForTest(t)
+	h.loc = time.FixedZone("JST", 9*3600)
+
+	// JST 2025-08-26 の前後の境界（UTC 15:00）に点を置く
+	for _, ts := range []time.Time{
+		time.Date(2025, 8, 25, 14, 59, 0, 0, time.UTC), // JST 8/25 23:59
+		time.Date(2025, 8, 25, 15, 0, 0, 0, time.UTC),  // JST 8/26 0:00
+		time.Date(2025, 8, 26, 14, 59, 0, 0, time.UTC), // JST 8/26 23:59
+		time.Date(2025, 8, 26, 15, 0, 0, 0, time.UTC),  // JST 8/27 0:00
+	} {
+		if err := s.AppendVec("players", ts, map[string]float64{"x": 1, "z": 2}, map[string]string{"player_id": "P:A"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(q url.Values) []trackPoint {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.tracks(rec, httptest.NewRequest(http.MethodGet, "/api/history/tracks?"+q.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status: %d body=%s", rec.Code, rec.Body.String())
+		}
+		var got []trackPoint
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return got
+	}
+
+	got := get(url.Values{"player_id": {"P:A"}, "from": {"2025-08-26"}, "to": {"2025-08-26"}})
+	if len(got) != 2 || !got[0].T.Equal(time.Date(2025, 8, 25, 15, 0, 0, 0, time.UTC)) {
+		t.Fatalf("JST day = %+v, want the two points of 8/26 JST", got)
+	}
+	// ?tz= で上書き。日のバケットも tz の 0 時から
+	got = get(url.Values{"player_id": {"P:A"}, "from": {"2025-08-26"}, "to": {"2025-08-26"}, "tz": {"UTC"}, "bucket": {"24h"}})
+	if len(got) != 1 || !got[0].T.Equal(time.Date(2025, 8, 26, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("UTC daily bucket = %+v", got)
+	}
+}
+
+func TestHistoryEventsFilterAndPaging(t *testing.T) {
+	h, s := newHistoryForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	// 同時刻の kill を 3 件（ページ境界を跨がせる）+ connect/別プレイヤー
+	for i := 0; i < 3; i++ {
+		if err := s.AppendEvent(base.Add(time.Minute), "kill", map[string]string{"player_id": "P:A", "name": "alice"}); err != nil {
+			t.Fatalf("AppendEvent: %v", err)
+		}
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("AppendEvent: %v", err)
+		}
+	}
+	must(s.AppendEvent(base, "kill", map[string]string{"player_id": "P:A", "name": "alice"}))
+	must(s.AppendPlayerEvent(base.Add(2*time.Minute), storage.EventPlayerConnect, "P:A", "", "", nil))
+	must(s.AppendEvent(base.Add(3*time.Minute), "kill", map[string]string{"player_id": "P:B"}))
+
+	fetch := func(after string) eventsPage {
+		t.Helper()
+		q := url.Values{
+			"from":      {base.Format(time.RFC3339)},
+			"to":        {base.Add(time.Hour).Format(time.RFC3339)},
+			"kind":      {"kill"},
+			"player_id": {"P:A"},
+			"limit":     {"2"},
+		}
+		if after != "" {
+			q.Set("after", after)
+		}
+		rec := httptest.NewRecorder()
+		h.events(rec, httptest.NewRequest(http.MethodGet, "/api/history/events?"+q.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status: %d body=%s", rec.Code, rec.Body.String())
+		}
+		var page eventsPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return page
+	}
+
+	var got []eventRecord
+	page := fetch("")
+	got = append(got, page.Events...)
+	if page.Next == "" {
+		t.Fatalf("expected next cursor on first page: %+v", page)
+	}
+	page = fetch(page.Next)
+	got = append(got, page.Events...)
+	if page.Next != "" {
+		t.Fatalf("expected last page, got next=%q", page.Next)
+	}
+
+	if len(got) != 4 {
+		t.Fatalf("want 4 kill events for P:A, got %d: %+v", len(got), got)
+	}
+	if !got[0].T.Equal(base) {
+		t.Fatalf("events not in time order: %+v", got)
+	}
+	for _, e := range got {
+		if e.Kind != "kill" || e.PlayerID != "P:A" || e.Name != "alice" {
+			t.Fatalf("unexpected record: %+v", e)
+		}
+	}
+}
+
+func TestHistoryEventsResumesFromCursor(t *testing.T) {
+	root := t.TempDir()
+	s := storage.NewTSStore(root, tsfile.WithFlushEvery(1))
+	t.Cleanup(func() { _ = s.Close() })
+	h := &historyHandler{store: s, maxRange: 24 * time.Hour}
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	tags := map[string]string{storage.TagPlayerID: "P:A"}
+	for _, d := range []time.Duration{0, 5 * time.Hour, 5*time.Hour + time.Minute} {
+		if err := s.AppendEvent(base.Add(d), "kill", maps.Clone(tags)); err != nil {
+			t.Fatalf("AppendEvent: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fetch := func(after string) (int, eventsPage) {
+		t.Helper()
+		q := url.Values{
+			"from":  {base.Format(time.RFC3339)},
+			"to":    {base.Add(12 * time.Hour).Format(time.RFC3339)},
+			"limit": {"2"},
+		}
+		if after != "" {
+			q.Set("after", after)
+		}
+		rec := httptest.NewRecorder()
+		h.events(rec, httptest.NewRequest(http.MethodGet, "/api/history/events?"+q.Encode(), nil))
+		var page eventsPage
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+		}
+		return rec.Code, page
+	}
+	code, page := fetch("")
+	if code != http.StatusOK || len(page.Events) != 2 || page.Next == "" {
+		t.Fatalf("first page: %d %+v", code, page)
+	}
+
+	// カーソルより前の時間のファイルを壊す: 次のページはそこを読み直さないので影響しない
+	labels := tsfile.Tags{storage.TagKind: "kill", storage.TagPlayerID: "P:A"}
+	_, file := tsfile.PathForHour(root, storage.EventsSeries, labels, base)
+	if err := os.WriteFile(file, []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	code, page = fetch(page.Next)
+	if code != http.StatusOK || len(page.Events) != 1 || page.Next != "" ||
+		!page.Events[0].T.Equal(base.Add(5*time.Hour+time.Minute)) {
+		t.Fatalf("second page: %d %+v", code, page)
+	}
+	// 最初から読み直すと壊れたファイルに当たる（壊し方が効いていることの確認）
+	if code, _ := fetch(""); code != http.StatusInternalServerError {
+		t.Fatalf("first page after corruption: status %d, want 500", code)
+	}
+}
+
+func TestHistoryEventsBadCursor(t *testing.T) {
+	h, _ := newHistoryForTest(t)
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	q := url.Values{
+		"from":  {base.Format(time.RFC3339)},
+		"to":    {base.Add(time.Hour).Format(time.RFC3339)},
+		"after": {"!!"},
+	}
+	rec := httptest.NewRecorder()
+	h.events(rec, httptest.NewRequest(http.MethodGet, "/api/history/events?"+q.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status: want 400, got %d", rec.Code)
+	}
+}
+
+func TestHistoryTracksStreamsAcrossHours(t *testing.T) {
+	h, s := newHistoryForTest(t)
+	base := time.Date(2025, 8, 26, 10, 30, 0, 0, time.UTC)
+	// 10:30〜13:30 に 1 時間おき（4 時間ファイルに跨る）。11 時台は空
+	for _, d := range []time.Duration{0, 2 * time.Hour, 3 * time.Hour} {
+		if err := s.AppendVec("players", base.Add(d), map[string]float64{"x": d.Hours(), "z": -d.Hours()},
+			map[string]string{"player_id": "P:A"}); err != nil {
+			t.Fatalf("AppendVec: %v", err)
+		}
+	}
+
+	get := func(from, to time.Time) []trackPoint {
+		t.Helper()
+		q := url.Values{"player_id": {"P:A"}, "from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)}}
+		rec := httptest.NewRecorder()
+		h.tracks(rec, httptest.NewRequest(http.MethodGet, "/api/history/tracks?"+q.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status: %d body=%s", rec.Code, rec.Body.String())
+		}
+		var got []trackPoint
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		return got
+	}
+
+	got := get(base, base.Add(3*time.Hour))
+	if len(got) != 3 || got[0].X != 0 || got[1].X != 2 || got[2].X != 3 || got[2].Z != -3 {
+		t.Fatalf("unexpected points: %+v", got)
+	}
+	// 範囲の境界は両端を含む
+	if got := get(base.Add(2*time.Hour), base.Add(2*time.Hour)); len(got) != 1 || got[0].X != 2 {
+		t.Fatalf("single instant: %+v", got)
+	}
+	if got := get(base.Add(30*time.Minute), base.Add(90*time.Minute)); got == nil || len(got) != 0 {
+		t.Fatalf("empty range: want [], got %+v", got)
+	}
+}
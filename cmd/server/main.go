@@ -1,89 +1,78 @@
 package main
 
 import (
-    "context"
-    "flag"
-    "fmt"
-    "log"
-    "net/http"
-    "os"
-    "os/signal"
-    "path/filepath"
-    "syscall"
-    "time"
-
-    "github.com/masahide/7dtd-stats/pkg/mapproxy"
-    "github.com/masahide/7dtd-stats/pkg/sse"
-    "github.com/masahide/7dtd-stats/pkg/poller"
-    envconfig "github.com/kelseyhightower/envconfig"
-)
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
-// Config はサービス起動に必要な設定です。
-type Config struct {
-    Listen          string        // 例: ":8081"
-    UpstreamBaseURL string        // 例: "http://game:8080"
-    StaticDir       string        // 例: "./web"（空なら無効）
-    ShutdownTimeout time.Duration // 例: 5s（実値。env は秒で指定）
-    PollPlayersURL  string        // 例: "http://game:8080/api/players"
-    PollInterval    time.Duration // 例: 2s
-    ShutdownTimeoutSec int `envconfig:"SHUTDOWN_TIMEOUT_SEC" default:"5"`
-}
+	"github.com/prometheus/client_golang/prometheus"
 
-func loadConfig() Config {
-    // 1) 環境変数から読み込み
-    var cfg Config
-    _ = envconfig.Process("", &struct {
-        *Config
-        Listen             string        `envconfig:"LISTEN_ADDR"`
-        UpstreamBaseURL    string        `envconfig:"UPSTREAM_BASE_URL"`
-        StaticDir          string        `envconfig:"STATIC_DIR"`
-        PollPlayersURL     string        `envconfig:"POLL_PLAYERS_URL"`
-        PollInterval       time.Duration `envconfig:"POLL_INTERVAL" default:"2s"`
-        ShutdownTimeoutSec int           `envconfig:"SHUTDOWN_TIMEOUT_SEC" default:"5"`
-    }{Config: &cfg})
-
-    // 2) フラグ（envをデフォルトに）
-    flag.StringVar(&cfg.Listen, "listen", cfg.Listen, "listen address (e.g. :8081)")
-    flag.StringVar(&cfg.UpstreamBaseURL, "upstream", cfg.UpstreamBaseURL, "upstream base URL (e.g. http://host:8080)")
-    flag.StringVar(&cfg.StaticDir, "static-dir", cfg.StaticDir, "path to static contents (optional)")
-    flag.StringVar(&cfg.PollPlayersURL, "poll-players-url", cfg.PollPlayersURL, "players JSON endpoint (optional)")
-    pollInt := cfg.PollInterval.String()
-    flag.StringVar(&pollInt, "poll-interval", pollInt, "poll interval for players (e.g. 2s)")
-    shutdownSec := cfg.ShutdownTimeoutSec
-    flag.IntVar(&shutdownSec, "shutdown-timeout", shutdownSec, "graceful shutdown timeout seconds")
-    flag.Parse()
-
-    // 3) 派生値の確定
-    cfg.ShutdownTimeout = time.Duration(shutdownSec) * time.Second
-    if d, err := time.ParseDuration(pollInt); err == nil { cfg.PollInterval = d } else if cfg.PollInterval == 0 { cfg.PollInterval = 2 * time.Second }
-    cfg.ShutdownTimeoutSec = shutdownSec
-    return cfg
-}
+	"github.com/masahide/7dtd-stats/pkg/mapproxy"
+	"github.com/masahide/7dtd-stats/pkg/payload"
+	"github.com/masahide/7dtd-stats/pkg/poller"
+	"github.com/masahide/7dtd-stats/pkg/reqid"
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
 
 func main() {
-	cfg := loadConfig()
-	if cfg.UpstreamBaseURL == "" {
-		fmt.Fprintln(os.Stderr, "-upstream or UPSTREAM_BASE_URL is required")
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
 		os.Exit(2)
 	}
+	if cfg.PollDryRun {
+		os.Exit(pollDryRun(context.Background(), newJSONProvider(cfg), os.Stdout))
+	}
 
 	// SSE Hub（replay/ping 対応）。現時点では外部入力が無いので ping のみ送出。
-	hub := sse.NewHub(
+	overflow, _ := sse.ParseOverflowPolicy(cfg.SSEOverflow) // validate 済み
+	hubOpts := []sse.Option{
 		sse.WithReplay(256),
-		sse.WithPingInterval(15*time.Second),
+		sse.WithPingInterval(15 * time.Second),
 		sse.WithClientBuffer(64),
-	)
-    go hub.Run()
-    defer hub.Close()
+		sse.WithWriteTimeout(10 * time.Second),
+		sse.WithClientIdleTimeout(time.Minute), // ping 4 回分書けない接続は半開きとみなす
+		sse.WithPingAsEvent(cfg.SSEPingEvent),
+		sse.WithReplayMaxAge(cfg.SSEReplayMaxAge),
+		sse.WithMaxReplayOnConnect(cfg.SSEMaxReplay),
+		sse.WithMaxClientBuffer(cfg.SSEMaxClientBuf),
+		sse.WithBroadcastOverflowPolicy(overflow),
+		sse.WithSnapshotTopic(payload.TopicSnapshot), // リプレイでは最新のスナップショットだけを送る
+		sse.WithLogger(log.Default()),
+	}
+	if cfg.SSEGzip {
+		hubOpts = append(hubOpts, sse.WithSSECompression())
+	}
+	hub := sse.NewHub(hubOpts...)
+	go hub.Run()
+	defer hub.Close()
 
-    // "Tile Proxy/Cache" 相当（/map/* のみ許可）。他機能は未実装だが、土台のルータ構成を先に用意。
-    mapHandler, err := mapproxy.Handler(cfg.UpstreamBaseURL,
-		mapproxy.WithRequestTimeout(15*time.Second),
-		mapproxy.WithAllowedPrefixes("/map/"),
-	)
+	// SIGHUP で差し替える設定・コンポーネントの置き場
+	rl := newReloader(cfg)
+
+	// "Tile Proxy/Cache" 相当（既定で /map/* のみ許可）。SIGHUP で作り直せるよう proxySwitch 越しに公開。
+	proxyMetrics := mapproxy.NewMetrics()
+	proxy, err := newMapProxy(cfg, proxyMetrics)
 	if err != nil {
 		log.Fatalf("failed to init map proxy: %v", err)
 	}
+	mapHandler := newProxySwitch(proxy)
+	rl.proxy, rl.proxyMetrics = mapHandler, proxyMetrics
 
 	mux := http.NewServeMux()
 
@@ -91,23 +80,61 @@ func main() {
 	mux.Handle("/map/", mapHandler)
 
 	// Health/Ready endpoints
+	// /healthz はプロセス生存のみ。/readyz は上流と Poller の状態を見る（Poller は下で追加）。
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	readyChecks := []readyCheck{upstreamCheck(mapHandler.Healthy)}
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { readyzHandler(readyChecks...)(w, r) })
+	mux.HandleFunc("/status", statusHandler(mapHandler.Healthy, mapHandler.LatencyQuantiles, hub.TopicStats))
+
+	// ビルド情報
+	mux.HandleFunc("/version", versionHandler(func() string { return rl.Current().UpstreamBaseURL }))
 
 	// SSE: /sse/live
-    mux.Handle("/sse/live", http.HandlerFunc(hub.ServeHTTP))
-    // Future endpoints (未実装の土台): REST
-    mux.HandleFunc("/api/map/info", notImplemented)
-    mux.HandleFunc("/api/history/tracks", notImplemented)
-    mux.HandleFunc("/api/history/events", notImplemented)
+	mux.Handle("/sse/live", http.HandlerFunc(hub.ServeHTTP))
+	// 接続一覧（デバッグ用）。RemoteAddr などを含むので Basic 認証の掛かるときだけ公開する
+	if cfg.AdminUser != "" && hasPrefix(sseClientsPath, cfg.AuthPrefixes) {
+		mux.HandleFunc(sseClientsPath, sseClientsHandler(hub.ClientsDebug))
+	} else if cfg.AdminUser != "" {
+		log.Printf("warn: %s disabled: auth_prefixes does not cover it", sseClientsPath)
+	}
+	// Future endpoints (未実装の土台): REST
+	mux.HandleFunc("/api/map/info", notImplemented)
+	// 履歴 API（-data-dir 指定時のみ）
+	var store *storage.TSStore
+	if cfg.DataDir != "" {
+		minFree := uint64(cfg.StoreMinFreeMB) << 20
+		store = storage.NewTSStoreWithFactory(cfg.DataDir, storeWriterOpts(cfg.FlushInterval),
+			storage.WithRateLimit(cfg.StoreRateLimit, 0),
+			storage.WithMinFreeBytes(minFree, storage.EventsSeries, storage.SessionsSeries)) // イベントは最後まで残す
+		defer store.Close()
+		if minFree > 0 {
+			readyChecks = append(readyChecks, diskCheck(store.DiskStatus, minFree))
+		}
+		loc, _ := time.LoadLocation(cfg.RetentionTZ) // validate 済み
+		rl.retention = startRetention(store, cfg.RetentionDays, loc, cfg.RetentionDryRun, time.Hour)
+		defer rl.retention.Stop()
+		histLoc, _ := time.LoadLocation(cfg.HistoryTZ) // validate 済み
+		hist := &historyHandler{store: store, maxRange: cfg.HistoryMaxRange, loc: histLoc}
+		mux.HandleFunc("/api/history/tracks", hist.tracks)
+		mux.HandleFunc("/api/history/events", hist.events)
+		mux.HandleFunc("/sse/replay", hist.replay)
+	} else {
+		mux.HandleFunc("/api/history/tracks", notImplemented)
+		mux.HandleFunc("/api/history/events", notImplemented)
+		mux.HandleFunc("/sse/replay", notImplemented)
+	}
 
 	// Root/Static (オプショナル)。指定時のみ有効化。
 	if d := cfg.StaticDir; d != "" {
 		// セキュリティ: ディレクトリが存在するときのみ公開
 		if fi, err := os.Stat(d); err == nil && fi.IsDir() {
-			fs := http.FileServer(http.Dir(d))
 			// SvelteKit の一般的な構成を想定し、"/" 直下で配信
-			mux.Handle("/", fs)
+			// JS/CSS などは gzip で返す（画像などの圧縮済み形式は素通し）
+			if cfg.SPA {
+				mux.Handle("/", gzipHandler(spaHandler(d)))
+			} else {
+				mux.Handle("/", gzipHandler(http.FileServer(http.Dir(d))))
+			}
 		} else {
 			abs, _ := filepath.Abs(d)
 			log.Printf("warn: static-dir not found or not a dir: %s", abs)
@@ -121,62 +148,188 @@ func main() {
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			fmt.Fprintf(w, "7dtd-stats server\n\n")
 			fmt.Fprintf(w, "- /map/{z}/{x}/{y}.png  -> proxied to upstream\n")
-			fmt.Fprintf(w, "- /healthz, /readyz\n")
+			fmt.Fprintf(w, "- /healthz, /readyz, /status, /metrics (-metrics)\n")
+			fmt.Fprintf(w, "- /version  -> commit, build time, Go version, upstream host\n")
 			fmt.Fprintf(w, "- /sse/live (501), /api/map/info (501)\n")
-			fmt.Fprintf(w, "- /api/history/tracks (501), /api/history/events (501)\n")
+			fmt.Fprintf(w, "- /api/debug/sse/clients  -> SSE connections and their topics (only with -admin-user)\n")
+			fmt.Fprintf(w, "- /api/players/current  -> latest poller snapshot (501 without -poll-players-url)\n")
+			fmt.Fprintf(w, "- /api/history/tracks?player_id=&from=&to=[&bucket=] (501 without -data-dir)\n")
+			fmt.Fprintf(w, "- /api/history/events?from=&to=[&kind=&player_id=&limit=&after=] (501 without -data-dir)\n")
+			fmt.Fprintf(w, "- /sse/replay?from=&to=[&series=players,events&player_id=&speed=] (501 without -data-dir)\n")
 		})
 	}
 
-    srv := &http.Server{
-        Addr:              cfg.Listen,
-        Handler:           mux,
-        ReadHeaderTimeout: 5 * time.Second,
-        ReadTimeout:       10 * time.Second,
-        WriteTimeout:      30 * time.Second,
-        IdleTimeout:       60 * time.Second,
-    }
-
-    // 起動ログ
-    log.Printf("starting server on %s -> %s (paths: /map/)", cfg.Listen, cfg.UpstreamBaseURL)
-
-    // Poller 起動（任意）: プレイヤー位置をポーリングして SSE に配信
-    var pollCancel context.CancelFunc
-    if cfg.PollPlayersURL != "" {
-        ctxPoll, cancel := context.WithCancel(context.Background())
-        pollCancel = cancel
-        prov := &poller.JSONProvider{URL: cfg.PollPlayersURL, Timeout: 5 * time.Second}
-        pl := &poller.Poller{Prov: prov, Hub: hub, Interval: cfg.PollInterval}
-        go func() {
-            if err := pl.Run(ctxPoll); err != nil && err != context.Canceled {
-                log.Printf("poller error: %v", err)
-            }
-        }()
-        log.Printf("poller started: %s (interval=%s)", cfg.PollPlayersURL, cfg.PollInterval)
-    } else {
-        log.Printf("poller disabled: set -poll-players-url or POLL_PLAYERS_URL to enable")
-    }
+	// ミドルウェア: IP 制限 → リクエスト ID → Basic 認証 → mux
+	allowed, _ := parsePrefixes(cfg.AllowCIDRs)     // validate 済み
+	trusted, _ := parsePrefixes(cfg.TrustedProxies) // validate 済み
+	handler := allowlistHandler(allowed, trusted,
+		reqid.Middleware(cfg.RequestIDHeader,
+			basicAuth(cfg.AdminUser, cfg.AdminPass, cfg.AdminPassHash, cfg.AuthPrefixes, mux)))
+
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second, // /sse/live は書き込みごとに期限を張り直すので対象外
+		IdleTimeout:       60 * time.Second,
+	}
+	if cfg.TLSEnabled() {
+		minVer, _ := parseTLSVersion(cfg.TLSMinVersion) // validate 済み
+		srv.TLSConfig = &tls.Config{MinVersion: minVer}
+	}
+
+	// 起動ログ
+	scheme := "http"
+	if cfg.TLSEnabled() {
+		scheme = "https"
+	}
+	log.Printf("starting server (%s, commit %s) on %s -> %s (paths: %v)",
+		scheme, buildVersionInfo("").Commit, cfg.Listen, cfg.UpstreamBaseURL, cfg.MapAllowedPrefixes)
+
+	// Poller 起動（任意）: プレイヤー位置をポーリングして SSE に配信（-data-dir 指定時はストアにも保存）
+	var (
+		pollCancel      context.CancelFunc
+		pollDone        chan struct{} // Run が戻ったら閉じる（終了時に store や webhook を閉じる前に待つ）
+		pollerCollector prometheus.Collector
+	)
+	if cfg.PollPlayersURL != "" {
+		ctxPoll, cancel := context.WithCancel(context.Background())
+		pollCancel = cancel
+		prov := newJSONProvider(cfg)
+		var sinks []poller.OutputSink
+		if store != nil {
+			sinks = append(sinks, poller.NewStoreSink(store)) // 履歴 API 用に位置とイベントを保存
+		}
+		if cfg.WebhookURL != "" {
+			var kinds []storage.EventKind
+			for _, k := range cfg.WebhookKinds {
+				kinds = append(kinds, storage.EventKind(k))
+			}
+			hook := poller.NewWebhookSink(cfg.WebhookURL, poller.WithWebhookKinds(kinds...))
+			defer hook.Close()
+			sinks = append(sinks, hook)
+			log.Printf("webhook enabled: kinds=%v", cfg.WebhookKinds)
+		}
+		pl := poller.New(prov, hub, sinks...)
+		pl.Interval = cfg.PollInterval
+		pl.DisconnectGrace = cfg.PollDisconnectGrace
+		pl.MinInterval, pl.LargeMovement = cfg.PollMinInterval, cfg.PollLargeMovement
+		pl.DistanceMetric, _ = poller.ParseDistanceMetric(cfg.PollDistanceMetric) // validate 済み
+		pl.HeartbeatInterval = cfg.PollHeartbeat
+		pl.SnapshotInterval = cfg.PollSnapshot
+		pl.BaseTags = cfg.PollTags
+		if store != nil {
+			// 再起動前に居たプレイヤーの接続イベントを出し直さない
+			if players, at, err := storedPlayers(store, pollerSeedWindow, cfg.PollTags); err != nil {
+				log.Printf("poller: seed from store: %v", err)
+			} else if len(players) > 0 {
+				pl.Seed(players, at)
+				log.Printf("poller: seeded %d player(s) from store (last seen %s)", len(players), at.Format(time.RFC3339))
+			}
+		}
+		readyChecks = append(readyChecks, pollerCheck(pl.FailureStreak, readyMaxPollFailures))
+		rl.poller = pl
+		pollerCollector = pl.Collector()
+		mux.HandleFunc("/api/players/current", playersCurrentHandler(pl.Snapshot))
+		pollDone = make(chan struct{})
+		go func() {
+			defer close(pollDone)
+			if err := pl.Run(ctxPoll); err != nil && err != context.Canceled {
+				log.Printf("poller error: %v", err)
+			}
+		}()
+		log.Printf("poller started: %s (interval=%s)", cfg.PollPlayersURL, cfg.PollInterval)
+	} else {
+		mux.HandleFunc("/api/players/current", notImplemented)
+		log.Printf("poller disabled: set -poll-players-url or POLL_PLAYERS_URL to enable")
+	}
+
+	// Prometheus（-metrics 指定時のみ。Poller の作成後に登録する）
+	if cfg.Metrics {
+		var storeCollector prometheus.Collector
+		if store != nil {
+			storeCollector = store.Collector()
+		}
+		mh, err := metricsHandler(proxyMetrics, hub.Collector(), storeCollector, pollerCollector)
+		if err != nil {
+			log.Fatalf("failed to init metrics: %v", err)
+		}
+		mux.Handle("/metrics", mh)
+	}
 
 	// Graceful shutdown
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if cfg.TLSEnabled() {
+			err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
 	}()
 
-    stop := make(chan os.Signal, 1)
-    signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-    <-stop
-
-    ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
-    defer cancel()
-    if pollCancel != nil { pollCancel() }
-    if err := srv.Shutdown(ctx); err != nil {
-        log.Printf("graceful shutdown failed: %v", err)
-        _ = srv.Close()
-    }
-    log.Printf("shutdown complete")
+	// SIGHUP: 設定を読み直して差し替え可能なものだけ反映
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next, err := loadConfig(os.Args[1:])
+			if err != nil {
+				log.Printf("reload: invalid configuration, keeping current: %v", err)
+				continue
+			}
+			if err := rl.Apply(next); err != nil {
+				log.Printf("reload: %v", err)
+				continue
+			}
+			log.Printf("reload: done")
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	signal.Stop(hup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), rl.Current().ShutdownTimeout)
+	defer cancel()
+	if pollCancel != nil {
+		pollCancel()
+		// 書き込み途中の tick が終わるまで待ってから、defer で store・webhook を閉じる
+		select {
+		case <-pollDone:
+		case <-ctx.Done():
+			log.Printf("poller did not stop within shutdown timeout")
+		}
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("graceful shutdown failed: %v", err)
+		_ = srv.Close()
+	}
+	log.Printf("shutdown complete")
 }
 
 func notImplemented(w http.ResponseWriter, _ *http.Request) {
 	http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
 }
+
+// playersBufferSize は players.* の writer のバッファサイズ。プレイヤーごとにタグセット（writer）ができ、
+// 1 人あたりの書き込みは flush_interval の間に数十点程度なので、既定の 1MiB では大半が使われないまま残る。
+const playersBufferSize = 64 << 10
+
+// storeWriterOpts はシリーズごとの WriterOpt を返す RouterFactory。
+func storeWriterOpts(flushInterval time.Duration) storage.RouterFactory {
+	return func(series string) []tsfile.WriterOpt {
+		opts := []tsfile.WriterOpt{
+			tsfile.WithFlushInterval(flushInterval),
+			tsfile.WithTagSanitizer(tsfile.SanitizeTag), // プレイヤー名などに '/' や ';' が入っても点を落とさない
+		}
+		if strings.HasPrefix(series, "players.") {
+			opts = append(opts, tsfile.WithBufferSize(playersBufferSize))
+		}
+		return opts
+	}
+}
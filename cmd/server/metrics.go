@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsHandler は cs と Go ランタイム／プロセスのメトリクスをまとめた /metrics ハンドラを返す。
+// nil の Collector は無視する（無効化されたコンポーネント向け）。
+func metricsHandler(cs ...prometheus.Collector) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	cs = append(cs,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	for _, c := range cs {
+		if c == nil {
+			continue
+		}
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/masahide/7dtd-stats/pkg/mapproxy"
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+func TestMetricsHandlerExposesAllComponents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	pm := mapproxy.NewMetrics()
+	mh, err := mapproxy.Handler(upstream.URL, mapproxy.WithMetrics(pm))
+	if err != nil {
+		t.Fatalf("mapproxy.Handler: %v", err)
+	}
+	mh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+
+	hub := sse.NewHub()
+	store := storage.NewTSStore(t.TempDir())
+	t.Cleanup(func() { _ = store.Close() })
+
+	h, err := metricsHandler(pm, hub.Collector(), store.Collector(), nil)
+	if err != nil {
+		t.Fatalf("metricsHandler: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`mapproxy_requests_total{code="200"} 1`,
+		"sse_clients 0",
+		"tsstore_routers 0",
+		"go_goroutines",
+		"process_",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output lacks %q", want)
+		}
+	}
+}
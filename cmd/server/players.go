@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/poller"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+// currentPlayer は /api/players/current の 1 要素です（キー名は SSE の pos と揃える）。
+type currentPlayer struct {
+	PID      string    `json:"pid"`
+	Name     string    `json:"name"`
+	X        float64   `json:"x"`
+	Z        float64   `json:"z"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// currentPlayers は /api/players/current のレスポンスです。T はスナップショットの取得時刻（未取得なら省略）。
+type currentPlayers struct {
+	T       *time.Time      `json:"t,omitempty"`
+	Players []currentPlayer `json:"players"`
+}
+
+// playersCurrentHandler: GET /api/players/current
+// Poller が最後に取得したプレイヤー一覧を返す。UI はこれを初期状態にして SSE の差分を重ねる。
+func playersCurrentHandler(snapshot func() ([]poller.Player, time.Time)) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		players, at := snapshot()
+		resp := currentPlayers{Players: make([]currentPlayer, 0, len(players))}
+		if !at.IsZero() {
+			resp.T = &at
+		}
+		for _, p := range players {
+			seen := p.LastSeen
+			if seen.IsZero() {
+				seen = at
+			}
+			resp.Players = append(resp.Players, currentPlayer{PID: p.ID, Name: p.Name, X: p.X, Z: p.Z, LastSeen: seen})
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// pollerSeedWindow は起動時に Poller.Seed へ読み込む位置の範囲。これより前から位置の出ていない
+// （立ち止まったまま poll_heartbeat_interval も無い）プレイヤーは、再起動後に接続イベントが出直す。
+const pollerSeedWindow = 10 * time.Minute
+
+// storedPlayers は store の直近 within の players.x / players.z から、プレイヤーごとの最後の位置を組み立てる
+// （Poller.Seed 用。名前は保存していないので空）。baseTags（poll_tags）を含むタグセットだけを使い、
+// 別のサーバーから集約した位置は混ぜない。戻り値の時刻は使った点のうち最も新しいもの。
+func storedPlayers(store *storage.TSStore, within time.Duration, baseTags map[string]string) ([]poller.Player, time.Time, error) {
+	xs, err := store.LatestPositions("players.x", within)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	zs, err := store.LatestPositions("players.z", within)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	byID := make(map[string]poller.Player)
+	seenAt := make(map[string]time.Time)
+	var at time.Time
+	for k, x := range xs {
+		z, ok := zs[k]
+		if !ok || !z.T.Equal(x.T) || !x.Tags.Contains(tsfile.Tags(baseTags)) {
+			continue
+		}
+		id := x.Tags[storage.TagPlayerID]
+		if id == "" || x.T.Before(seenAt[id]) {
+			continue
+		}
+		byID[id] = poller.Player{ID: id, X: x.V, Z: z.V, LastSeen: x.T}
+		seenAt[id] = x.T
+		if x.T.After(at) {
+			at = x.T
+		}
+	}
+	out := make([]poller.Player, 0, len(byID))
+	for _, pl := range byID {
+		out = append(out, pl)
+	}
+	return out, at, nil
+}
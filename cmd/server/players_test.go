@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/poller"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+func TestPlayersCurrent(t *testing.T) {
+	at := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	snap := func() ([]poller.Player, time.Time) {
+		return []poller.Player{{ID: "P:A", Name: "alice", X: 1.5, Z: -2}}, at
+	}
+	rec := httptest.NewRecorder()
+	playersCurrentHandler(snap)(rec, httptest.NewRequest(http.MethodGet, "/api/players/current", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: %d", rec.Code)
+	}
+	var got currentPlayers
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.T == nil || !got.T.Equal(at) || len(got.Players) != 1 {
+		t.Fatalf("unexpected: %+v", got)
+	}
+	if p := got.Players[0]; p.PID != "P:A" || p.Name != "alice" || p.X != 1.5 || p.Z != -2 || !p.LastSeen.Equal(at) {
+		t.Fatalf("unexpected player: %+v", p)
+	}
+
+	// DisconnectGrace 中のプレイヤーは一覧で最後に見えた時刻を返す
+	seen := at.Add(-4 * time.Second)
+	rec = httptest.NewRecorder()
+	playersCurrentHandler(func() ([]poller.Player, time.Time) {
+		return []poller.Player{{ID: "P:A", LastSeen: seen}, {ID: "P:B", LastSeen: at}}, at
+	})(rec, httptest.NewRequest(http.MethodGet, "/api/players/current", nil))
+	got = currentPlayers{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got.Players) != 2 || !got.Players[0].LastSeen.Equal(seen) || !got.Players[1].LastSeen.Equal(at) {
+		t.Fatalf("grace last_seen: %+v", got.Players)
+	}
+
+	// 未取得時は空配列（null ではない）
+	rec = httptest.NewRecorder()
+	playersCurrentHandler(func() ([]poller.Player, time.Time) { return nil, time.Time{} })(
+		rec, httptest.NewRequest(http.MethodGet, "/api/players/current", nil))
+	if body := rec.Body.String(); body != "{\"players\":[]}\n" {
+		t.Fatalf("empty snapshot body: %q", body)
+	}
+}
+
+func TestStoredPlayersForSeed(t *testing.T) {
+	store := storage.NewTSStore(t.TempDir())
+	t.Cleanup(func() { _ = store.Close() })
+	now := time.Now().UTC().Truncate(time.Second)
+	write := func(ago time.Duration, x, z float64, tags map[string]string) {
+		t.Helper()
+		if err := store.AppendVec("players", now.Add(-ago), map[string]float64{"x": x, "z": z}, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	here := map[string]string{storage.TagPlayerID: "P:A", "world": "W"}
+	write(5*time.Minute, 1, 1, here)
+	write(time.Minute, 2, 3, here) // 最新
+	write(2*time.Minute, 7, 7, map[string]string{storage.TagPlayerID: "P:B", "world": "other"})
+	write(time.Hour, 8, 8, map[string]string{storage.TagPlayerID: "P:C", "world": "W"}) // 範囲外
+	if err := store.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	players, at, err := storedPlayers(store, 10*time.Minute, map[string]string{"world": "W"})
+	if err != nil {
+		t.Fatalf("storedPlayers: %v", err)
+	}
+	if len(players) != 1 || players[0].ID != "P:A" || players[0].X != 2 || players[0].Z != 3 || !at.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("players = %+v at %s", players, at)
+	}
+}
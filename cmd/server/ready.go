@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/sse"
+)
+
+// readyMaxPollFailures は Poller を不健全とみなす連続失敗回数です。
+const readyMaxPollFailures = 3
+
+// readyCheck は readiness の判定要素です。check は不健全なら理由を返す（健全なら ""）。
+type readyCheck struct {
+	name  string
+	check func() string
+}
+
+// readyzHandler は全 checks が健全なら 200、いずれかが不健全なら 503 と理由を JSON で返す。
+// /healthz（プロセス生存のみ）とは別物で、ロールアウトのゲートに使う想定。
+func readyzHandler(checks ...readyCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		unhealthy := map[string]string{}
+		for _, c := range checks {
+			if reason := c.check(); reason != "" {
+				unhealthy[c.name] = reason
+			}
+		}
+		if len(unhealthy) > 0 {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+				"status":    "unavailable",
+				"unhealthy": unhealthy,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+	}
+}
+
+// upstreamCheck は mapproxy の上流健全性を readiness に載せる。
+func upstreamCheck(healthy func() (bool, string)) readyCheck {
+	return readyCheck{name: "upstream", check: func() string {
+		ok, reason := healthy()
+		if ok {
+			return ""
+		}
+		if reason == "" {
+			reason = "upstream failing"
+		}
+		return reason
+	}}
+}
+
+// pollerCheck は Poller の連続失敗が maxFailures 以上なら不健全とする。
+func pollerCheck(streak func() (int, error), maxFailures int) readyCheck {
+	return readyCheck{name: "poller", check: func() string {
+		n, err := streak()
+		if n < maxFailures {
+			return ""
+		}
+		return fmt.Sprintf("%d consecutive failures: %v", n, err)
+	}}
+}
+
+// diskCheck はデータディレクトリの空き容量が minFree バイト未満なら不健全とする（書き込みが失敗し始める前に知らせる）。
+// 空き容量を測れない環境では判定しない。
+func diskCheck(status func() (uint64, error), minFree uint64) readyCheck {
+	return readyCheck{name: "storage", check: func() string {
+		free, err := status()
+		if err != nil || free >= minFree {
+			return ""
+		}
+		return fmt.Sprintf("low disk space: %d MiB free (< %d MiB)", free>>20, minFree>>20)
+	}}
+}
+
+// topicStatus は /status の sse 欄（トピックごと）です。
+type topicStatus struct {
+	Broadcasts    uint64    `json:"broadcasts"`
+	LastBroadcast time.Time `json:"last_broadcast"`
+	Delivered     uint64    `json:"delivered"`
+	Dropped       uint64    `json:"dropped"`
+}
+
+// statusHandler は上流の健全性と直近の上流レイテンシ（p50/p95/p99、ミリ秒）、SSE のトピックごとの配信状況を
+// JSON で返す（常に 200）。/readyz と違い判定はしないので、完全に落ちる前の劣化をアラート側で拾う用途に使う。
+func statusHandler(healthy func() (bool, string), latency func() (p50, p95, p99 time.Duration), topics func() map[string]sse.TopicStat) http.HandlerFunc {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return func(w http.ResponseWriter, _ *http.Request) {
+		ok, reason := healthy()
+		p50, p95, p99 := latency()
+		up := map[string]any{
+			"healthy":    ok,
+			"latency_ms": map[string]float64{"p50": ms(p50), "p95": ms(p95), "p99": ms(p99)},
+		}
+		if !ok {
+			up["reason"] = reason
+		}
+		ts := map[string]topicStatus{}
+		for name, st := range topics() {
+			ts[name] = topicStatus{Broadcasts: st.Broadcasts, LastBroadcast: st.LastBroadcast, Delivered: st.Delivered, Dropped: st.Dropped}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"upstream": up, "sse": ts})
+	}
+}
+
+// sseClientsPath は SSE の接続一覧（ClientsDebug）を返すデバッグ用のパスです。
+// admin_user を設定し、auth_prefixes がこのパスを覆う（既定の /api/ など）ときだけ公開する。
+const sseClientsPath = "/api/debug/sse/clients"
+
+// sseClient は /api/debug/sse/clients の 1 接続分です。
+type sseClient struct {
+	RemoteAddr string    `json:"remote_addr"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Topics     []string  `json:"topics"` // 空なら全トピック
+	Matcher    bool      `json:"matcher"`
+	Connected  time.Time `json:"connected"`
+	Delivered  uint64    `json:"delivered"`
+	Dropped    uint64    `json:"dropped"`
+	Buffered   int       `json:"buffered"`
+	BufferCap  int       `json:"buffer_cap"`
+}
+
+// sseClientsHandler は SSE の接続ごとの購読トピック・接続時刻・配信数を JSON で返す。
+// 「一部のプレイヤーしか見えない」などの報告で、その接続の topics や取りこぼしを確かめる用途。
+func sseClientsHandler(clients func() []sse.ClientInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		out := []sseClient{}
+		for _, c := range clients() {
+			topics := c.Topics
+			if topics == nil {
+				topics = []string{}
+			}
+			out = append(out, sseClient{
+				RemoteAddr: c.RemoteAddr, RequestID: c.RequestID, Topics: topics, Matcher: c.Matcher, Connected: c.Connected,
+				Delivered: c.Delivered, Dropped: c.Dropped, Buffered: c.Buffered, BufferCap: c.BufferCap,
+			})
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, map[string]any{"clients": out})
+	}
+}
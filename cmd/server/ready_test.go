@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/sse"
+)
+
+func TestReadyzReportsUnhealthyDependencies(t *testing.T) {
+	upOK, upReason := true, ""
+	streak, lastErr := 0, error(nil)
+	free := uint64(4 << 30)
+	h := readyzHandler(
+		upstreamCheck(func() (bool, string) { return upOK, upReason }),
+		pollerCheck(func() (int, error) { return streak, lastErr }, 3),
+		diskCheck(func() (uint64, error) { return free, nil }, 1<<30),
+	)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("healthy: want 200, got %d", rec.Code)
+	}
+
+	upOK, upReason = false, "upstream status 503 Service Unavailable"
+	streak, lastErr = 3, errors.New("connection refused")
+	free = 100 << 20
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unhealthy: want 503, got %d", rec.Code)
+	}
+	var body struct {
+		Status    string            `json:"status"`
+		Unhealthy map[string]string `json:"unhealthy"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body.Unhealthy["upstream"] != upReason || body.Unhealthy["poller"] == "" ||
+		body.Unhealthy["storage"] != "low disk space: 100 MiB free (< 1024 MiB)" {
+		t.Fatalf("unexpected body: %+v", body)
+	}
+}
+
+func TestStatusReportsUpstreamLatency(t *testing.T) {
+	h := statusHandler(
+		func() (bool, string) { return false, "upstream status 502 Bad Gateway" },
+		func() (p50, p95, p99 time.Duration) {
+			return 10 * time.Millisecond, 95 * time.Millisecond, 150 * time.Millisecond
+		},
+		func() map[string]sse.TopicStat {
+			return map[string]sse.TopicStat{"pos": {Broadcasts: 3, LastBroadcast: time.Unix(1700000000, 0), Delivered: 2, Dropped: 1}}
+		},
+	)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	var body struct {
+		Upstream struct {
+			Healthy   bool               `json:"healthy"`
+			Reason    string             `json:"reason"`
+			LatencyMS map[string]float64 `json:"latency_ms"`
+		} `json:"upstream"`
+		SSE map[string]topicStatus `json:"sse"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	up := body.Upstream
+	if up.Healthy || up.Reason == "" || up.LatencyMS["p50"] != 10 || up.LatencyMS["p95"] != 95 || up.LatencyMS["p99"] != 150 {
+		t.Fatalf("unexpected body: %s", rec.Body.String())
+	}
+	if pos := body.SSE["pos"]; pos.Broadcasts != 3 || pos.Dropped != 1 || pos.LastBroadcast.Unix() != 1700000000 {
+		t.Fatalf("unexpected sse: %+v", body.SSE)
+	}
+}
+
+func TestSSEClientsListsConnections(t *testing.T) {
+	at := time.Unix(1700000000, 0).UTC()
+	h := sseClientsHandler(func() []sse.ClientInfo {
+		return []sse.ClientInfo{
+			{RemoteAddr: "10.0.0.5:51234", RequestID: "abc", Topics: []string{"pos"}, Connected: at, Delivered: 40, Dropped: 2, Buffered: 1, BufferCap: 64},
+			{RemoteAddr: "10.0.0.6:40000", Connected: at, BufferCap: 64},
+		}
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, sseClientsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", rec.Code)
+	}
+	var body struct {
+		Clients []sseClient `json:"clients"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Clients) != 2 {
+		t.Fatalf("clients = %+v", body.Clients)
+	}
+	c := body.Clients[0]
+	if c.RemoteAddr != "10.0.0.5:51234" || c.RequestID != "abc" || len(c.Topics) != 1 || c.Topics[0] != "pos" ||
+		!c.Connected.Equal(at) || c.Delivered != 40 || c.Dropped != 2 {
+		t.Fatalf("unexpected client: %+v", c)
+	}
+	// 全トピックの接続は null ではなく空配列
+	if !strings.Contains(rec.Body.String(), `"topics":[]`) {
+		t.Fatalf("topics of an unfiltered client should be []: %s", rec.Body)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/mapproxy"
+	"github.com/masahide/7dtd-stats/pkg/poller"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+// newMapProxy は cfg から mapproxy.Proxy を組み立てる（起動時と SIGHUP 時で共通）。
+func newMapProxy(cfg Config, m *mapproxy.Metrics) (*mapproxy.Proxy, error) {
+	opts := []mapproxy.Option{
+		mapproxy.WithRequestTimeout(cfg.MapRequestTimeout),
+		mapproxy.WithAllowedPrefixes(cfg.MapAllowedPrefixes...),
+		mapproxy.WithMetrics(m),
+		mapproxy.WithFallbackTileDir(cfg.MapFallbackDir),
+		mapproxy.WithTileCacheControl(cfg.MapTileMaxAge),
+		mapproxy.WithFollowRedirects(cfg.MapMaxRedirects),
+		mapproxy.WithCORS(cfg.MapCORSOrigins...),
+	}
+	if len(cfg.MapQueryParams) > 0 {
+		opts = append(opts, mapproxy.WithAllowedQueryParams(cfg.MapQueryParams...))
+	}
+	if len(cfg.MapRespHeaders) > 0 {
+		opts = append(opts, mapproxy.WithResponseHeaders(cfg.MapRespHeaders))
+	}
+	if len(cfg.MapStripHeaders) > 0 {
+		opts = append(opts, mapproxy.WithStripResponseHeaders(cfg.MapStripHeaders...))
+	}
+	if cfg.MapStripSlash {
+		opts = append(opts, mapproxy.WithTrailingSlashPolicy(mapproxy.TrailingSlashStrip))
+	}
+	if cfg.MapCacheEntries > 0 {
+		opts = append(opts, mapproxy.WithCache(cfg.MapCacheEntries, cfg.MapCacheTTL))
+		if cfg.MapCacheStale {
+			opts = append(opts, mapproxy.WithServeStaleOnError())
+		}
+	}
+	if cfg.MapAccessLog {
+		opts = append(opts, mapproxy.WithAccessLog(log.Default()))
+	}
+	return mapproxy.New(cfg.UpstreamBaseURL, opts...)
+}
+
+// newJSONProvider は cfg から Poller のデータソースを組み立てる（起動時と SIGHUP 時で共通）。
+func newJSONProvider(cfg Config) *poller.JSONProvider {
+	return &poller.JSONProvider{
+		URL:      cfg.PollPlayersURL,
+		Timeout:  cfg.PollTimeout,
+		Username: cfg.PollUsername,
+		Password: cfg.PollPassword,
+
+		ArrayPath: cfg.PollArrayPath,
+		NextPath:  cfg.PollNextPath,
+	}
+}
+
+// proxySwitch は実行中に差し替え可能な mapproxy.Proxy です。
+// 処理中のリクエストは差し替え前の Proxy で最後まで処理される。
+type proxySwitch struct {
+	p atomic.Pointer[mapproxy.Proxy]
+}
+
+func newProxySwitch(p *mapproxy.Proxy) *proxySwitch {
+	s := &proxySwitch{}
+	s.p.Store(p)
+	return s
+}
+
+func (s *proxySwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.p.Load().ServeHTTP(w, r) }
+func (s *proxySwitch) Healthy() (bool, string)                          { return s.p.Load().Healthy() }
+func (s *proxySwitch) Store(p *mapproxy.Proxy)                          { s.p.Store(p) }
+
+// LatencyQuantiles は現在の Proxy の値を返す（作り直すと窓は空から始まる）。
+func (s *proxySwitch) LatencyQuantiles() (p50, p95, p99 time.Duration) {
+	return s.p.Load().LatencyQuantiles()
+}
+
+// retentionLoop は store.Retention を定期実行する。保持日数・TZ・dry-run は実行中に変更できる。
+type retentionLoop struct {
+	store  *storage.TSStore
+	days   atomic.Int64
+	loc    atomic.Pointer[time.Location]
+	dryRun atomic.Bool
+	done   chan struct{}
+}
+
+// startRetention は起動直後と every ごとに Retention を実行する（days<=0 の間は何もしない）。
+func startRetention(store *storage.TSStore, days int, loc *time.Location, dryRun bool, every time.Duration) *retentionLoop {
+	rl := &retentionLoop{store: store, done: make(chan struct{})}
+	rl.Set(days, loc, dryRun)
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			if d := rl.days.Load(); d > 0 {
+				rl.run(int(d), rl.loc.Load(), rl.dryRun.Load())
+			}
+			select {
+			case <-rl.done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return rl
+}
+
+// run は 1 回分のリテンションを実行し、削除した（dry-run なら削除するはずの）日ディレクトリ数をログに出す。
+func (rl *retentionLoop) run(days int, loc *time.Location, dryRun bool) {
+	if dryRun {
+		paths, err := rl.store.RetentionDryRun(days, loc)
+		for _, p := range paths {
+			log.Printf("retention (dry-run): would delete %s", p)
+		}
+		log.Printf("retention (dry-run): %d day directories older than %d days (%s) would be deleted", len(paths), days, loc)
+		if err != nil {
+			log.Printf("retention (dry-run) error: %v", err)
+		}
+		return
+	}
+	if err := rl.store.Retention(days, loc); err != nil {
+		log.Printf("retention error: %v", err)
+	}
+}
+
+// Set は次回実行から使う保持日数・TZ・dry-run を設定する。
+func (rl *retentionLoop) Set(days int, loc *time.Location, dryRun bool) {
+	rl.loc.Store(loc)
+	rl.dryRun.Store(dryRun)
+	rl.days.Store(int64(days))
+}
+
+func (rl *retentionLoop) Stop() { close(rl.done) }
+
+// reloadApply は SIGHUP で読み直した設定項目の反映先です。
+type reloadApply int
+
+const (
+	reloadRestart      reloadApply = iota // 再起動が必要（変更はログに出して旧値のまま保持する）
+	reloadKeep                            // 新しい値をそのまま保持する（参照されたときに効く・導出値・起動時だけの値）
+	reloadMapProxy                        // mapproxy を作り直して差し替える
+	reloadProvider                        // Poller のデータソースを差し替える
+	reloadPollInterval                    // Poller.SetInterval
+	reloadRetention                       // 次回のリテンション実行から
+)
+
+// reloadField は Config の 1 フィールドの扱いです。Config に項目を足したらここにも足すこと（テストで検出する）。
+type reloadField struct {
+	field  string // Config のフィールド名
+	apply  reloadApply
+	secret bool // ログに値を出さない（設定の有無だけ）
+}
+
+// reloadFields は Config の全フィールドの SIGHUP での扱い（Config の宣言順）。
+var reloadFields = []reloadField{
+	{field: "Listen"},
+	{field: "UpstreamBaseURL", apply: reloadMapProxy},
+	{field: "StaticDir"},
+	{field: "SPA"},
+	{field: "ShutdownTimeout", apply: reloadKeep},
+	{field: "ShutdownTimeoutSec", apply: reloadKeep},
+	{field: "HistoryMaxRange"},
+	{field: "HistoryTZ"},
+	{field: "Metrics"},
+	{field: "TLSCert"},
+	{field: "TLSKey"},
+	{field: "TLSMinVersion"},
+	{field: "RequestIDHeader"},
+	{field: "AllowCIDRs"},
+	{field: "TrustedProxies"},
+	{field: "AdminUser"},
+	{field: "AdminPass", secret: true},
+	{field: "AdminPassHash", secret: true},
+	{field: "AuthPrefixes"},
+	{field: "MapAccessLog", apply: reloadMapProxy},
+	{field: "MapAllowedPrefixes", apply: reloadMapProxy},
+	{field: "MapRequestTimeout", apply: reloadMapProxy},
+	{field: "MapCacheEntries", apply: reloadMapProxy},
+	{field: "MapCacheTTL", apply: reloadMapProxy},
+	{field: "MapCacheStale", apply: reloadMapProxy},
+	{field: "MapFallbackDir", apply: reloadMapProxy},
+	{field: "MapTileMaxAge", apply: reloadMapProxy},
+	{field: "MapStripSlash", apply: reloadMapProxy},
+	{field: "MapMaxRedirects", apply: reloadMapProxy},
+	{field: "MapCORSOrigins", apply: reloadMapProxy},
+	{field: "MapStripHeaders", apply: reloadMapProxy},
+	{field: "MapQueryParams", apply: reloadMapProxy},
+	{field: "MapRespHeaders", apply: reloadMapProxy},
+	{field: "SSEPingEvent"},
+	{field: "SSEGzip"},
+	{field: "SSEReplayMaxAge"},
+	{field: "SSEMaxReplay"},
+	{field: "SSEMaxClientBuf"},
+	{field: "SSEOverflow"},
+	{field: "PollPlayersURL", apply: reloadProvider},
+	{field: "PollInterval", apply: reloadPollInterval},
+	{field: "PollTimeout", apply: reloadProvider},
+	{field: "PollUsername", apply: reloadProvider},
+	{field: "PollPassword", apply: reloadProvider, secret: true},
+	{field: "PollArrayPath", apply: reloadProvider},
+	{field: "PollNextPath", apply: reloadProvider},
+	{field: "PollMinInterval"},
+	{field: "PollLargeMovement"},
+	{field: "PollDistanceMetric"},
+	{field: "PollHeartbeat"},
+	{field: "PollSnapshot"},
+	{field: "PollDisconnectGrace"},
+	{field: "WebhookURL", secret: true},
+	{field: "WebhookKinds"},
+	{field: "PollTags"},
+	{field: "PollDryRun", apply: reloadKeep},
+	{field: "DataDir"},
+	{field: "FlushInterval"},
+	{field: "StoreRateLimit"},
+	{field: "StoreMinFreeMB"},
+	{field: "RetentionDays", apply: reloadRetention},
+	{field: "RetentionTZ", apply: reloadRetention},
+	{field: "RetentionDryRun", apply: reloadRetention},
+}
+
+// key はログに出す設定キー（yaml 名。yaml に無い項目はフィールド名）を返す。
+func (f reloadField) key() string {
+	sf, _ := reflect.TypeFor[Config]().FieldByName(f.field)
+	if k := sf.Tag.Get("yaml"); k != "" && k != "-" {
+		return k
+	}
+	return f.field
+}
+
+// value は cfg のこのフィールドの値を返す。
+func (f reloadField) value(cfg *Config) reflect.Value {
+	return reflect.ValueOf(cfg).Elem().FieldByName(f.field)
+}
+
+// changed は apply に振り分けた項目のうち、old と next で値が違うものがあるかを返す。
+func changed(old, next *Config, apply reloadApply) bool {
+	for _, f := range reloadFields {
+		if f.apply == apply && !sameValue(f.value(old), f.value(next)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameValue は設定値として同じかを返す（nil と空のスライス・map は同じとみなす）。
+func sameValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Slice, reflect.Map:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// reloader は SIGHUP で読み直した Config のうち、安全に差し替えられるものを反映する。
+// 項目ごとの扱いは reloadFields で決まる（差し替え: mapproxy・Poller のデータソースと間隔・リテンション・シャットダウンタイムアウト）。
+type reloader struct {
+	cur atomic.Pointer[Config]
+
+	proxy        *proxySwitch
+	proxyMetrics *mapproxy.Metrics
+	poller       *poller.Poller // nil なら Poller 無効
+	retention    *retentionLoop // nil なら -data-dir 無効
+}
+
+func newReloader(cfg Config) *reloader {
+	r := &reloader{}
+	r.cur.Store(&cfg)
+	return r
+}
+
+// Current は現在有効な設定を返す。
+func (r *reloader) Current() Config { return *r.cur.Load() }
+
+// Apply は next を反映する。mapproxy の再構築に失敗した場合は何も変更しない。
+func (r *reloader) Apply(next Config) error {
+	old := r.Current()
+
+	if r.proxy != nil && changed(&old, &next, reloadMapProxy) {
+		p, err := newMapProxy(next, r.proxyMetrics)
+		if err != nil {
+			return err
+		}
+		r.proxy.Store(p)
+		log.Printf("reload: map proxy -> %s (prefixes=%v timeout=%s)",
+			next.UpstreamBaseURL, next.MapAllowedPrefixes, next.MapRequestTimeout)
+	}
+
+	switch {
+	case r.poller != nil && next.PollPlayersURL == "":
+		// 停止は未対応（ゼロから作り直すと SSE の差分状態が飛ぶため）
+		next.PollPlayersURL = old.PollPlayersURL
+		log.Printf("reload: poll_players_url cannot be cleared at runtime; keeping %s", old.PollPlayersURL)
+	case r.poller == nil && next.PollPlayersURL != "":
+		log.Printf("reload: poller was disabled at startup; restart to enable it")
+	case r.poller != nil:
+		if changed(&old, &next, reloadProvider) {
+			r.poller.SetProvider(newJSONProvider(next))
+			log.Printf("reload: poller provider -> %s (timeout=%s)", next.PollPlayersURL, next.PollTimeout)
+		}
+		if changed(&old, &next, reloadPollInterval) {
+			r.poller.SetInterval(next.PollInterval)
+			log.Printf("reload: poll interval -> %s", next.PollInterval)
+		}
+	}
+
+	if r.retention != nil && changed(&old, &next, reloadRetention) {
+		loc, _ := time.LoadLocation(next.RetentionTZ) // validate 済み
+		r.retention.Set(next.RetentionDays, loc, next.RetentionDryRun)
+		log.Printf("reload: retention -> %d days (%s dry_run=%t)", next.RetentionDays, next.RetentionTZ, next.RetentionDryRun)
+	}
+
+	// 再起動が必要な項目は旧値のまま保持する（次回の差分判定をずらさないため）
+	for _, f := range reloadFields {
+		if f.apply != reloadRestart {
+			continue
+		}
+		ov, nv := f.value(&old), f.value(&next)
+		if sameValue(ov, nv) {
+			continue
+		}
+		if f.secret {
+			log.Printf("reload: %s changed but requires restart; unchanged", f.key())
+		} else {
+			log.Printf("reload: %s changed (%v -> %v) but requires restart; unchanged", f.key(), ov, nv)
+		}
+		nv.Set(ov)
+	}
+	if r.poller == nil {
+		next.PollPlayersURL = old.PollPlayersURL
+	}
+
+	r.cur.Store(&next)
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/mapproxy"
+	"github.com/masahide/7dtd-stats/pkg/poller"
+)
+
+func namedUpstream(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, name)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestReloaderSwapsProxyAndKeepsRestartOnlyFields(t *testing.T) {
+	a, b := namedUpstream(t, "a"), namedUpstream(t, "b")
+
+	cfg := defaultConfig()
+	cfg.UpstreamBaseURL = a.URL
+	cfg.Listen = ":8081"
+	rl := newReloader(cfg)
+	m := mapproxy.NewMetrics()
+	p, err := newMapProxy(cfg, m)
+	if err != nil {
+		t.Fatalf("newMapProxy: %v", err)
+	}
+	rl.proxy, rl.proxyMetrics = newProxySwitch(p), m
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		rl.proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+	if _, body := get("/map/0/0/0.png"); body != "a" {
+		t.Fatalf("before reload: got %q", body)
+	}
+
+	next := cfg
+	next.UpstreamBaseURL = b.URL
+	next.MapAllowedPrefixes = []string{"/map/1/"}
+	next.Listen = ":9999"
+	next.ShutdownTimeout = time.Minute
+	if err := rl.Apply(next); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if _, body := get("/map/1/0/0.png"); body != "b" {
+		t.Fatalf("after reload: got %q", body)
+	}
+	if code, _ := get("/map/0/0/0.png"); code != http.StatusNotFound {
+		t.Fatalf("prefix not reloaded: status %d", code)
+	}
+	cur := rl.Current()
+	if cur.Listen != ":8081" {
+		t.Fatalf("listen must stay until restart: %q", cur.Listen)
+	}
+	if cur.ShutdownTimeout != time.Minute {
+		t.Fatalf("shutdown timeout should be hot-swapped: %s", cur.ShutdownTimeout)
+	}
+}
+
+func TestReloaderUpdatesPollerAndRetention(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UpstreamBaseURL = "http://game:8080"
+	cfg.PollPlayersURL = "http://game:8080/api/players"
+	rl := newReloader(cfg)
+	pl := &poller.Poller{Interval: cfg.PollInterval}
+	rl.poller = pl
+	rl.retention = &retentionLoop{}
+
+	next := cfg
+	next.PollInterval = 7 * time.Second
+	next.PollPlayersURL = "http://game2:8080/api/players"
+	next.RetentionDays = 14
+	next.RetentionTZ = "Asia/Tokyo"
+	if err := rl.Apply(next); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if pl.Interval != 7*time.Second {
+		t.Fatalf("interval not applied: %s", pl.Interval)
+	}
+	if jp, ok := pl.Prov.(*poller.JSONProvider); !ok || jp.URL != next.PollPlayersURL {
+		t.Fatalf("provider not swapped: %#v", pl.Prov)
+	}
+	if rl.retention.days.Load() != 14 || rl.retention.loc.Load().String() != "Asia/Tokyo" {
+		t.Fatalf("retention not applied: %d %v", rl.retention.days.Load(), rl.retention.loc.Load())
+	}
+}
+
+func TestReloadFieldsCoverConfig(t *testing.T) {
+	// Config の全フィールドが reloadFields のどれか 1 つに振り分けられている（足し忘れると差し替えも再起動の警告も出ない）
+	seen := make(map[string]bool)
+	for _, f := range reloadFields {
+		if seen[f.field] {
+			t.Errorf("reloadFields lists %s twice", f.field)
+		}
+		seen[f.field] = true
+		if _, ok := reflect.TypeFor[Config]().FieldByName(f.field); !ok {
+			t.Errorf("reloadFields lists unknown Config field %s", f.field)
+		}
+	}
+	typ := reflect.TypeFor[Config]()
+	for i := range typ.NumField() {
+		if name := typ.Field(i).Name; !seen[name] {
+			t.Errorf("Config.%s is neither hot-swappable nor restart-only in reloadFields", name)
+		}
+	}
+}
+
+func TestReloaderKeepsEveryRestartOnlyField(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UpstreamBaseURL = "http://game:8080"
+	rl := newReloader(cfg)
+
+	// 再起動が必要な項目を全てゼロ値以外へ変えても、現在の設定は元のまま
+	next := cfg
+	nv := reflect.ValueOf(&next).Elem()
+	for _, f := range reloadFields {
+		if f.apply != reloadRestart {
+			continue
+		}
+		v := nv.FieldByName(f.field)
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(v.String() + "x")
+		case reflect.Bool:
+			v.SetBool(!v.Bool())
+		case reflect.Int, reflect.Int64:
+			v.SetInt(v.Int() + 1)
+		case reflect.Float64:
+			v.SetFloat(v.Float() + 1)
+		case reflect.Slice:
+			v.Set(reflect.Append(v, reflect.ValueOf("x")))
+		case reflect.Map:
+			v.Set(reflect.ValueOf(map[string]string{"k": "v"}))
+		default:
+			t.Fatalf("%s: unhandled kind %s", f.field, v.Kind())
+		}
+	}
+	if err := rl.Apply(next); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if cur := rl.Current(); !reflect.DeepEqual(cur, cfg) {
+		t.Fatalf("restart-only fields changed:\n got %+v\nwant %+v", cur, cfg)
+	}
+}
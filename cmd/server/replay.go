@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/payload"
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+const (
+	maxReplaySpeed     = 1000
+	replayPingInterval = 15 * time.Second
+	replayWriteTimeout = 10 * time.Second
+)
+
+// replayItem は再生する 1 件（元の時刻と SSE イベント）です。
+type replayItem struct {
+	t    time.Time
+	name string
+	data []byte
+}
+
+// replay: GET /sse/replay?from=RFC3339&to=RFC3339[&series=players,events][&player_id=][&speed=2][&tz=]
+// TSStore の履歴を時刻順に読み、元の時刻間隔を speed で割った間隔で SSE の pos / events として流す。
+// ライブの Hub とは独立（ID なし・リプレイなし）。to まで流し終えたら event: end を送って閉じ、クライアント切断でも止まる。
+func (h *historyHandler) replay(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to, _, status, err := h.parseRange(q.Get("from"), q.Get("to"), q.Get("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	speed := 1.0
+	if v := q.Get("speed"); v != "" {
+		speed, err = strconv.ParseFloat(v, 64)
+		if err != nil || speed <= 0 || speed > maxReplaySpeed {
+			http.Error(w, "speed must be a number in (0, 1000]", http.StatusBadRequest)
+			return
+		}
+	}
+	players, events := true, true
+	if v := q.Get("series"); v != "" {
+		players, events = false, false
+		for _, s := range splitCSV(v) {
+			switch s {
+			case "players":
+				players = true
+			case "events":
+				events = true
+			default:
+				http.Error(w, "series must be players and/or events", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	items, err := h.replayItems(from, to, q.Get("player_id"), players, events)
+	if err != nil {
+		log.Printf("history: replay: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	st, err := sse.NewStream(w, replayWriteTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := playItems(r.Context(), st, items, from, speed); err != nil {
+		return
+	}
+	_ = st.Send("end", []byte(`{}`))
+}
+
+// replayItems は [from,to] の位置（players.x/z を同じタグセット・同じ時刻で組にしたもの）とイベントを時刻順に返す。
+func (h *historyHandler) replayItems(from, to time.Time, pid string, players, events bool) ([]replayItem, error) {
+	match := tsfile.Tags{}
+	if pid != "" {
+		match[storage.TagPlayerID] = pid
+	}
+	var items []replayItem
+	if players {
+		xs, err := h.store.Query("players.x", from, to, match)
+		if err != nil {
+			return nil, err
+		}
+		zs, err := h.store.Query("players.z", from, to, match)
+		if err != nil {
+			return nil, err
+		}
+		// player_id だけでなくタグセット全体で組にする（poll_tags の異なる同じプレイヤーの z と取り違えない）
+		type key struct {
+			tags string
+			t    int64
+		}
+		zBy := make(map[key]float64, len(zs))
+		for _, p := range zs {
+			zBy[key{p.Tags.Canonical(), p.T.UnixNano()}] = p.V
+		}
+		for _, p := range xs {
+			id := p.Tags[storage.TagPlayerID]
+			z, ok := zBy[key{p.Tags.Canonical(), p.T.UnixNano()}]
+			if !ok {
+				continue
+			}
+			b, _ := json.Marshal(payload.NewPosEvent(id, p.V, z, p.T, "", nil))
+			items = append(items, replayItem{t: p.T, name: payload.TopicPos, data: b})
+		}
+	}
+	if events {
+		pts, err := h.store.Query(storage.EventsSeries, from, to, match)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pts {
+			b, _ := json.Marshal(payload.NewPlayerEvent(p.Tags[storage.TagKind], p.Tags[storage.TagPlayerID], p.T, p.Tags[storage.TagName], nil))
+			items = append(items, replayItem{t: p.T, name: payload.TopicEvents, data: b})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].t.Before(items[j].t) })
+	return items, nil
+}
+
+// playItems は items を from からの経過時間 / speed の時刻に合わせて送る。間が空くときは :ping を挟む。
+func playItems(ctx context.Context, st *sse.Stream, items []replayItem, from time.Time, speed float64) error {
+	start := time.Now()
+	ping := time.NewTicker(replayPingInterval)
+	defer ping.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for _, it := range items {
+		due := start.Add(time.Duration(float64(it.t.Sub(from)) / speed))
+		if wait := time.Until(due); wait > 0 {
+			timer.Reset(wait)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-ping.C:
+					if err := st.Ping(); err != nil {
+						return err
+					}
+				case <-timer.C:
+					break wait
+				}
+			}
+		}
+		if err := st.Send(it.name, it.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
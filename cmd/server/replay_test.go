@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/payload"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+func TestReplayStreamsHistoryInOrderAtSpeed(t *testing.T) {
+	h, s := newHistoryForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	for i, id := range []string{"P:A", "P:B"} {
+		ts := base.Add(time.Duration(i) * time.Minute)
+		if err := s.AppendVec("players", ts, map[string]float64{"x": float64(i), "z": 5},
+			map[string]string{storage.TagPlayerID: id}); err != nil {
+			t.Fatalf("AppendVec: %v", err)
+		}
+	}
+	if err := s.AppendPlayerEvent(base.Add(30*time.Second), storage.EventPlayerConnect, "P:B", "bob", "", nil); err != nil {
+		t.Fatalf("AppendPlayerEvent: %v", err)
+	}
+
+	q := url.Values{
+		"from":  {base.Format(time.RFC3339)},
+		"to":    {base.Add(time.Hour).Format(time.RFC3339)},
+		"speed": {"600"}, // 1 分 → 100ms
+	}
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	h.replay(rec, httptest.NewRequest(http.MethodGet, "/sse/replay?"+q.Encode(), nil))
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("replay finished in %s, want it paced to >= 100ms", elapsed)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var names []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			names = append(names, name)
+		}
+	}
+	if got := strings.Join(names, ","); got != "pos,events,pos,end" {
+		t.Fatalf("events = %s, want pos,events,pos,end\n%s", got, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `data: {"schema":1,"kind":"player_connect","pid":"P:B","t":"2025-08-26T10:00:30Z","name":"bob"}`) {
+		t.Fatalf("unexpected events payload:\n%s", rec.Body.String())
+	}
+
+	// series / player_id で絞り込む
+	q.Set("series", "players")
+	q.Set("player_id", "P:B")
+	rec = httptest.NewRecorder()
+	h.replay(rec, httptest.NewRequest(http.MethodGet, "/sse/replay?"+q.Encode(), nil))
+	if body := rec.Body.String(); strings.Count(body, "event: pos") != 1 || strings.Contains(body, "event: events") {
+		t.Fatalf("filtered replay:\n%s", body)
+	}
+}
+
+func TestReplayPairsPositionsWithinTagSet(t *testing.T) {
+	h, s := newHistoryForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	// 同じプレイヤー・同じ時刻で world だけ違う位置（x と z の組を取り違えると x=1,z=-2 などが出る）
+	for i, world := range []string{"W1", "W2"} {
+		v := float64(i + 1)
+		if err := s.AppendVec("players", base, map[string]float64{"x": v, "z": -v},
+			map[string]string{storage.TagPlayerID: "P:A", "world": world}); err != nil {
+			t.Fatalf("AppendVec: %v", err)
+		}
+	}
+
+	items, err := h.replayItems(base, base.Add(time.Hour), "P:A", true, false)
+	if err != nil {
+		t.Fatalf("replayItems: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("want 2 positions, got %d", len(items))
+	}
+	for _, it := range items {
+		var pos payload.PosEvent
+		if err := json.Unmarshal(it.data, &pos); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if pos.Z != -pos.X {
+			t.Fatalf("x/z from different tag sets were paired: %s", it.data)
+		}
+	}
+}
+
+func TestReplayBadParams(t *testing.T) {
+	h, _ := newHistoryForTest(t)
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	for _, extra := range []string{"&speed=0", "&speed=abc", "&series=bogus"} {
+		target := "/sse/replay?from=" + base.Format(time.RFC3339) + "&to=" + base.Add(time.Hour).Format(time.RFC3339) + extra
+		rec := httptest.NewRecorder()
+		h.replay(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", extra, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// spaExcludedPrefixes は SPA フォールバックの対象外にするパス（API 利用者には素直に 404 を返す）。
+var spaExcludedPrefixes = []string{"/api/", "/map/", "/sse/"}
+
+// spaHandler は dir を静的配信し、存在しないパスへの GET/HEAD には index.html を 200 で返す。
+// クライアント側ルーティング（例: /map/player/123 のリロード）を SPA に任せるため。
+func spaHandler(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	index := filepath.Join(dir, "index.html")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !staticExists(dir, r.URL.Path) {
+			for _, p := range spaExcludedPrefixes {
+				if strings.HasPrefix(r.URL.Path, p) {
+					http.NotFound(w, r)
+					return
+				}
+			}
+			http.ServeFile(w, r, index)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// staticExists は URL パスに対応するファイル/ディレクトリが dir 配下にあるかを返す。
+func staticExists(dir, urlPath string) bool {
+	name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+urlPath)))
+	_, err := os.Stat(name)
+	return err == nil
+}
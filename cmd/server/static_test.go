@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSPAHandlerFallback(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>app</html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "assets", "app.js"), []byte("console.log(1)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := spaHandler(dir)
+
+	tests := []struct {
+		method, path string
+		wantCode     int
+		wantBody     string
+	}{
+		{http.MethodGet, "/assets/app.js", http.StatusOK, "console.log"},
+		{http.MethodGet, "/map/0/0/0.png", http.StatusNotFound, ""},
+		{http.MethodGet, "/players/123", http.StatusOK, "<html>app</html>"},
+		{http.MethodGet, "/", http.StatusOK, "<html>app</html>"},
+		{http.MethodGet, "/api/unknown", http.StatusNotFound, ""},
+		{http.MethodGet, "/sse/other", http.StatusNotFound, ""},
+		{http.MethodPost, "/players/123", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %s: status want %d, got %d", tt.method, tt.path, tt.wantCode, rec.Code)
+			continue
+		}
+		if tt.wantBody != "" && !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s %s: body %q lacks %q", tt.method, tt.path, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
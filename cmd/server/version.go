@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+)
+
+// ビルド情報。-ldflags で埋め込む:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/server
+var (
+	commit    = ""
+	buildTime = ""
+)
+
+// versionInfo は /version のレスポンスです。
+type versionInfo struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Upstream  string `json:"upstream"` // ホスト部のみ（認証情報やパスは含めない）
+}
+
+// buildVersionInfo は ldflags の値を優先し、無ければ Go が埋め込む VCS 情報で補う。
+func buildVersionInfo(upstream string) versionInfo {
+	v := versionInfo{Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version(), Upstream: upstreamHost(upstream)}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = s.Value
+				}
+			case "vcs.time":
+				if v.BuildTime == "" {
+					v.BuildTime = s.Value
+				}
+			}
+		}
+	}
+	if v.Commit == "" {
+		v.Commit = "unknown"
+	}
+	return v
+}
+
+// upstreamHost は上流 URL から host[:port] だけを取り出す。
+func upstreamHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// versionHandler: GET /version。upstream は SIGHUP 後の値を返せるよう関数で受け取る。
+func versionHandler(upstream func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, buildVersionInfo(upstream()))
+	}
+}
@@ -0,0 +1,36 @@
+// Package httpx は cmd/server と pkg 配下のハンドラで共有する HTTP の小さな補助関数です。
+package httpx
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AcceptsGzip は r の Accept-Encoding に gzip（q=0 以外）が含まれるかを返します。
+// q は数値として比べるので "q=0.0" や "Q=0" も拒否として扱い、q 以外のパラメータは無視します。
+// 同じ名前が複数あれば最初のものを使います。
+func AcceptsGzip(r *http.Request) bool {
+	for part := range strings.SplitSeq(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		return qValue(params) > 0
+	}
+	return false
+}
+
+// qValue は ";" 区切りのパラメータから q の値を返します（無い・読めなければ 1）。
+func qValue(params string) float64 {
+	for p := range strings.SplitSeq(params, ";") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+			continue
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f
+		}
+	}
+	return 1
+}
@@ -0,0 +1,37 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"br, gzip;q=0.5", true},
+		{"deflate", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"gzip;q=0.000", false},
+		{"gzip;Q=0", false},
+		{"gzip;q = 0", false},
+		{"gzip;level=1;q=0", false},
+		{"gzip;q=0.001", true},
+		{"gzip;q=bogus", true},
+		{"gzipx", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := AcceptsGzip(r); got != tt.want {
+			t.Errorf("AcceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package mapproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masahide/7dtd-stats/internal/httpx"
+)
+
+// cacheMaxBody は 1 エントリに保存する本文の上限です。これを超える応答はキャッシュせずに素通しします。
+const cacheMaxBody = 4 << 20
+
+// tileCache は上流の 200 応答をメモリに保持する LRU キャッシュです（WithCache で有効化）。
+// キーは「ネゴシエーション済みエンコーディング + RequestURI」で、gzip 版と非圧縮版を別エントリとして持ちます。
+type tileCache struct {
+	mu        sync.Mutex
+	max       int
+	ttl       time.Duration
+	keepStale bool       // 期限切れのエントリを LRU で追い出されるまで残す（WithServeStaleOnError）
+	ll        *list.List // 先頭が最近使ったもの
+	items     map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newTileCache(max int, ttl time.Duration) *tileCache {
+	return &tileCache{max: max, ttl: ttl, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *tileCache) get(key string, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.ttl > 0 && now.After(e.expires) {
+		if !c.keepStale {
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+// stale は期限切れでも残っているエントリを返します（上流が失敗したときの代わり。LRU の順序は変えない）。
+func (c *tileCache) stale(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *tileCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.max {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.items, old.Value.(*cacheEntry).key)
+	}
+}
+
+// serve はキャッシュ済みの応答を w に書き出します。
+// 条件付きリクエスト（If-None-Match / If-Modified-Since）が保存時の検証子と一致すれば本文なしの 304、
+// HEAD では本文を省略します（判定は http.ServeContent に任せる）。
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	for k, vs := range e.header {
+		if k == "Vary" {
+			// WithCORS が先に付けた Vary: Origin を消さない
+			for _, v := range vs {
+				for f := range strings.SplitSeq(v, ",") {
+					addVary(h, strings.TrimSpace(f))
+				}
+			}
+			continue
+		}
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Del("Content-Length")
+	modtime, _ := http.ParseTime(e.header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(e.body))
+}
+
+// serveStale は上流の失敗時に e を返します。X-Map-Degraded: stale を付け、上流が戻ったら取り直せるようブラウザには保存させません。
+func (e *cacheEntry) serveStale(w http.ResponseWriter, r *http.Request) {
+	s := *e
+	s.header = e.header.Clone()
+	s.header.Set("Cache-Control", "no-store")
+	s.header.Del("Expires")
+	s.header.Set(DegradedHeader, "stale")
+	s.serve(w, r)
+}
+
+// staleResponse は上流の 5xx の代わりにキャッシュを返すため、ModifyResponse から ErrorHandler へ渡すエラーです。
+type staleResponse struct {
+	entry  *cacheEntry
+	status string
+}
+
+func (e *staleResponse) Error() string {
+	return "upstream status " + e.status + " (serving stale cache)"
+}
+
+// staleEntry は WithServeStaleOnError のとき、r のキャッシュキーに残っているエントリを返します。
+func (p *Proxy) staleEntry(r *http.Request) (*cacheEntry, bool) {
+	if !p.cfg.serveStale || p.cache == nil {
+		return nil, false
+	}
+	key, ok := r.Context().Value(cacheKeyCtx{}).(string)
+	if !ok {
+		return nil, false
+	}
+	return p.cache.stale(key)
+}
+
+// アクセスログの cache= とメトリクスの cache ラベルに出す、リクエスト 1 件のキャッシュの扱いです。
+const (
+	cacheMemHit      = "mem_hit"     // メモリキャッシュから返した（条件付きリクエストへの 304 を含む）
+	cacheMiss        = "miss"        // キャッシュに無く上流から取得して保存した（上流エラーも含む）
+	cacheRevalidated = "revalidated" // 上流へ条件付きリクエストを転送し 304 が返った
+	cacheBypass      = "bypass"      // キャッシュ無効・対象外のメソッド・保存できない応答（no-store や 200 以外）
+	cacheFallback    = "fallback"    // 上流エラーのためフォールバックタイルを返した
+	cacheStale       = "stale"       // 上流エラー・5xx のため期限切れを含むキャッシュを返した（WithServeStaleOnError）
+)
+
+// cacheStatusCtx はリクエストの context に *cacheStatus を載せるためのキーです。
+type cacheStatusCtx struct{}
+
+// cacheStatus はキャッシュ層が決めた扱いをアクセスログまで運ぶ入れ物です（1 リクエストの処理中だけ使う）。
+type cacheStatus struct{ v string }
+
+// setCacheStatus は r の context にある cacheStatus を v にします（無ければ何もしない）。
+// 上流への複製リクエスト（resp.Request）でも context を引き継いでいるので同じ入れ物に届きます。
+func setCacheStatus(r *http.Request, v string) {
+	if cs, ok := r.Context().Value(cacheStatusCtx{}).(*cacheStatus); ok {
+		cs.v = v
+	}
+}
+
+// cacheKeyCtx は上流リクエストの context にキャッシュキーを載せるためのキーです。
+type cacheKeyCtx struct{}
+
+// negotiatedEncoding はクライアントが受け取れるエンコーディングを "gzip" か "identity" に絞り込みます。
+// 上流への Accept-Encoding もこの値に揃えるので、キャッシュした本文の形式はキーと必ず一致します。
+func negotiatedEncoding(r *http.Request) string {
+	if httpx.AcceptsGzip(r) {
+		return "gzip"
+	}
+	return "identity"
+}
+
+// cacheRequest はキャッシュ対象のリクエストなら、キーを載せ Accept-Encoding を正規化した複製を返します。
+func cacheRequest(r *http.Request) (*http.Request, string) {
+	enc := negotiatedEncoding(r)
+	key := enc + " " + r.URL.RequestURI()
+	r2 := r.WithContext(context.WithValue(r.Context(), cacheKeyCtx{}, key))
+	r2.Header = r.Header.Clone()
+	if enc == "gzip" {
+		r2.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		r2.Header.Del("Accept-Encoding")
+	}
+	return r2, key
+}
+
+// store は上流応答がキャッシュ可能なら本文を読み切って保存し、resp.Body を読み直せる形に差し替えます。
+// 保存したかどうかを返します。
+func (c *tileCache) store(resp *http.Response, now time.Time) (bool, error) {
+	key, ok := resp.Request.Context().Value(cacheKeyCtx{}).(string)
+	if !ok || resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Set-Cookie") != "" || noStore(resp.Header.Get("Cache-Control")) ||
+		resp.ContentLength > cacheMaxBody {
+		return false, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, cacheMaxBody+1))
+	if err != nil {
+		return false, err
+	}
+	if len(b) > cacheMaxBody {
+		// 大きすぎる: 読んだ分を先頭に戻して素通し
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return false, nil
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+		// 上流が検証子を返さない場合は本文から作る（初回の応答にも載せ、以降の 304 判定に使う）
+		sum := sha256.Sum256(b)
+		resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	}
+	c.put(&cacheEntry{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    b,
+		expires: now.Add(c.ttl),
+	})
+	return true, nil
+}
+
+func noStore(cc string) bool {
+	for _, d := range strings.Split(cc, ",") {
+		switch strings.ToLower(strings.TrimSpace(d)) {
+		case "no-store", "private", "no-cache":
+			return true
+		}
+	}
+	return false
+}
+
+// addVary は Vary に v が無ければ追加します。
+func addVary(h http.Header, v string) {
+	for _, cur := range h.Values("Vary") {
+		for _, f := range strings.Split(cur, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, v) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", v)
+}
@@ -0,0 +1,159 @@
+package mapproxy
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DegradedHeader は上流の代わりにフォールバックタイルを返したときに付けるヘッダです。
+const DegradedHeader = "X-Map-Degraded"
+
+// fallbackZoomedMax は拡大したフォールバックタイルを覚えておく件数の上限です。
+// 上流の停止中は同じタイルが何度も要求されるので、毎回のデコードと拡大を避ける。
+const fallbackZoomedMax = 1024
+
+// fallbackTiles は WithFallbackTileDir で読み込んだ低ズームのタイル一式（z/x/y.png）です。
+type fallbackTiles struct {
+	tiles map[[3]int][]byte
+	maxZ  int
+
+	mu     sync.Mutex
+	zoomed map[[3]int][]byte // 要求された (z,x,y) → 親タイルから拡大した PNG（最大 fallbackZoomedMax 件）
+}
+
+// loadFallbackTiles は dir/{z}/{x}/{y}.png をすべてメモリに読み込みます。
+// 低ズームの少数のタイルを想定しているため、起動時に一度だけ読みます。
+func loadFallbackTiles(dir string) (*fallbackTiles, error) {
+	ft := &fallbackTiles{tiles: make(map[[3]int][]byte), maxZ: -1, zoomed: make(map[[3]int][]byte)}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		z, x, y, ok := parseTilePath(filepath.ToSlash(rel))
+		if !ok {
+			return nil // タイル以外は無視
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		ft.tiles[[3]int{z, x, y}] = b
+		ft.maxZ = max(ft.maxZ, z)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mapproxy: load fallback tiles: %w", err)
+	}
+	return ft, nil
+}
+
+// parseTilePath は ".../{z}/{x}/{y}.png" の末尾 3 要素を取り出します。
+func parseTilePath(p string) (z, x, y int, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(parts) < 3 {
+		return 0, 0, 0, false
+	}
+	parts = parts[len(parts)-3:]
+	ys, found := strings.CutSuffix(parts[2], ".png")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err error
+	if z, err = strconv.Atoi(parts[0]); err != nil || z < 0 {
+		return 0, 0, 0, false
+	}
+	if x, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, 0, false
+	}
+	if y, err = strconv.Atoi(ys); err != nil {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// tile は urlPath のタイルに最も近いズームのフォールバックを返します。
+// 同じズームが無ければ親タイルの該当部分を切り出して拡大します（粗いが位置は合う）。
+// 拡大した結果は (z,x,y) ごとに覚えておき、次からはそのまま返します（上限を超えたら任意の 1 件を捨てる）。
+func (ft *fallbackTiles) tile(urlPath string) ([]byte, bool) {
+	z, x, y, ok := parseTilePath(path.Clean(urlPath))
+	if !ok {
+		return nil, false
+	}
+	key := [3]int{z, x, y}
+	ft.mu.Lock()
+	b, ok := ft.zoomed[key]
+	ft.mu.Unlock()
+	if ok {
+		return b, true
+	}
+	for zz := min(z, ft.maxZ); zz >= 0; zz-- {
+		d := z - zz
+		b, ok := ft.tiles[[3]int{zz, x >> d, y >> d}]
+		if !ok {
+			continue
+		}
+		if d == 0 {
+			return b, true
+		}
+		if out, err := zoomIn(b, d, x, y); err == nil {
+			ft.remember(key, out)
+			return out, true
+		}
+	}
+	return nil, false
+}
+
+// remember は拡大したタイルを覚えます。
+func (ft *fallbackTiles) remember(key [3]int, b []byte) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if len(ft.zoomed) >= fallbackZoomedMax {
+		for k := range ft.zoomed {
+			delete(ft.zoomed, k)
+			break
+		}
+	}
+	ft.zoomed[key] = b
+}
+
+// zoomIn は親タイル src（d 段階上のズーム）から (x, y) に当たる部分を切り出し、元の大きさに拡大します。
+// 7DTD のタイルは TMS と同じく y が北向きに増えるため、画像上の行は反転して数えます。
+func zoomIn(src []byte, d, x, y int) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	sw, sh := w>>d, h>>d
+	if sw == 0 || sh == 0 {
+		return nil, fmt.Errorf("mapproxy: fallback tile too small to zoom %d levels", d)
+	}
+	mask := 1<<d - 1
+	ox := b.Min.X + (x&mask)*sw
+	oy := b.Min.Y + (mask-(y&mask))*sh
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			out.Set(i, j, img.At(ox+i*sw/w, oy+j*sh/h))
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package mapproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyRing は直近 N 件の上流レイテンシを保持するリングバッファです。
+type latencyRing struct {
+	mu   sync.Mutex
+	buf  []time.Duration
+	next int  // 次に書く位置
+	full bool // 一周したか
+}
+
+func newLatencyRing(n int) *latencyRing {
+	return &latencyRing{buf: make([]time.Duration, n)}
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = d
+	r.next++
+	if r.next == len(r.buf) {
+		r.next, r.full = 0, true
+	}
+}
+
+// quantiles は保持している値の p50 / p95 / p99（nearest-rank）を返します。
+func (r *latencyRing) quantiles() (p50, p95, p99 time.Duration) {
+	r.mu.Lock()
+	n := r.next
+	if r.full {
+		n = len(r.buf)
+	}
+	s := slices.Clone(r.buf[:n])
+	r.mu.Unlock()
+	if len(s) == 0 {
+		return 0, 0, 0
+	}
+	slices.Sort(s)
+	at := func(q float64) time.Duration {
+		i := int(math.Ceil(q*float64(len(s)))) - 1
+		return s[max(i, 0)]
+	}
+	return at(0.50), at(0.95), at(0.99)
+}
+
+// timedTransport は上流への RoundTrip（応答ヘッダ受信まで）の所要時間を ring に記録します。
+// クライアント都合の中断は上流の遅さではないので記録しません。
+type timedTransport struct {
+	base http.RoundTripper
+	ring *latencyRing
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err == nil || !errors.Is(err, context.Canceled) {
+		t.ring.add(time.Since(start))
+	}
+	return resp, err
+}
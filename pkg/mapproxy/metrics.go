@@ -0,0 +1,78 @@
+package mapproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics はプロキシのリクエスト統計です。NewMetrics で生成し、WithMetrics で Handler に渡す。
+// prometheus.Collector を実装しているので、そのまま Registry に登録できる。
+type Metrics struct {
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	upstreamErrors prometheus.Counter
+	byCache        *prometheus.HistogramVec
+}
+
+// NewMetrics は mapproxy_* メトリクスを生成する。
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapproxy_requests_total",
+			Help: "Total number of proxied map requests, by status code.",
+		}, []string{"code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mapproxy_request_duration_seconds",
+			Help:    "Latency of proxied map requests, by status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code"}),
+		upstreamErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mapproxy_upstream_errors_total",
+			Help: "Total number of upstream errors answered with 502.",
+		}),
+		byCache: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mapproxy_cache_request_duration_seconds",
+			Help:    "Latency of map requests, by cache disposition (mem_hit, miss, revalidated, bypass, fallback, stale).",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"cache"}),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+	m.upstreamErrors.Describe(ch)
+	m.byCache.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+	m.upstreamErrors.Collect(ch)
+	m.byCache.Collect(ch)
+}
+
+// instrument は h に件数・レイテンシ計測を被せる（m が nil ならそのまま返す）。
+func (m *Metrics) instrument(h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+	return promhttp.InstrumentHandlerDuration(m.duration,
+		promhttp.InstrumentHandlerCounter(m.requests, h))
+}
+
+func (m *Metrics) upstreamError() {
+	if m != nil {
+		m.upstreamErrors.Inc()
+	}
+}
+
+// observeCache はキャッシュの扱いごとのレイテンシを記録する（m が nil なら何もしない）。
+func (m *Metrics) observeCache(disposition string, d time.Duration) {
+	if m != nil {
+		m.byCache.WithLabelValues(disposition).Observe(d.Seconds())
+	}
+}
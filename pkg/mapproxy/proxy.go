@@ -4,12 +4,18 @@ import (
 	"context"
 	"errors"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/reqid"
 )
 
 // Handler は `/map/` 以下のパスを、同一パス・同一クエリのまま
@@ -17,7 +23,31 @@ import (
 // 例: upstream = "http://10.0.0.1:8080" のとき、
 //
 //	/map/0/0/0.png?t=123 -> http://10.0.0.1:8080/map/0/0/0.png?t=123
+//
+// 上流の健全性などを参照したい場合は New で *Proxy を受け取ってください。
 func Handler(upstream string, opts ...Option) (http.Handler, error) {
+	p, err := New(upstream, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Proxy は Handler の実体です。上流の健全性（連続失敗数）を追跡します。
+type Proxy struct {
+	cfg     config
+	handler http.Handler
+	cache   *tileCache     // WithCache 指定時のみ
+	backup  *fallbackTiles // WithFallbackTileDir 指定時のみ
+	latency *latencyRing   // 直近の上流レイテンシ（LatencyQuantiles）
+
+	// 健全性（パッシブ）: 上流エラー/5xx が連続した回数と最後の理由
+	failures atomic.Int64
+	lastErr  atomic.Pointer[string]
+}
+
+// New は Proxy を生成します。引数は Handler と同じです。
+func New(upstream string, opts ...Option) (*Proxy, error) {
 	u, err := url.Parse(upstream)
 	if err != nil {
 		return nil, err
@@ -34,25 +64,31 @@ func Handler(upstream string, opts ...Option) (http.Handler, error) {
 		expectContinueTimeout: 1 * time.Second,
 		requestTimeout:        15 * time.Second,
 		allowPrefixes:         []string{"/map/"},
+		unhealthyAfter:        3,
+		latencyWindow:         256,
 	}
 	for _, f := range opts {
 		f(&cfg)
 	}
 
 	// Transport with sensible timeouts.
-	tr := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   cfg.dialTimeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          cfg.idleConn,
-		MaxIdleConnsPerHost:   cfg.idleConnPerHost,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   cfg.tlsTimeout,
-		ResponseHeaderTimeout: cfg.respHeaderTimeout,
-		ExpectContinueTimeout: cfg.expectContinueTimeout,
+	// WithTransport が指定されていればそちらを使う（タイムアウト系のオプションは効かない）。
+	tr := cfg.transport
+	if tr == nil {
+		tr = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   cfg.dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          cfg.idleConn,
+			MaxIdleConnsPerHost:   cfg.idleConnPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   cfg.tlsTimeout,
+			ResponseHeaderTimeout: cfg.respHeaderTimeout,
+			ExpectContinueTimeout: cfg.expectContinueTimeout,
+		}
 	}
 
 	director := func(req *http.Request) {
@@ -60,10 +96,13 @@ func Handler(upstream string, opts ...Option) (http.Handler, error) {
 		req.URL.Scheme = u.Scheme
 		req.URL.Host = u.Host
 		// パスはそのまま（/map/...）を転送
-		// RawPath もあれば維持
+		// RawPath もあれば維持（%2F などのエンコードはクライアントが送った形のまま上流へ渡る）
 		if req.URL.RawPath == "" {
 			req.URL.RawPath = req.URL.EscapedPath()
 		}
+		if cfg.trailingSlash == TrailingSlashStrip {
+			stripTrailingSlash(req.URL)
+		}
 		// Host ヘッダも上流へ合わせる（多くのサーバーで必須）
 		req.Host = u.Host
 		// X-Forwarded-*
@@ -77,32 +116,295 @@ func Handler(upstream string, opts ...Option) (http.Handler, error) {
 		req.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
 	}
 
+	p := &Proxy{cfg: cfg, latency: newLatencyRing(cfg.latencyWindow)}
+	if cfg.cacheEntries > 0 {
+		p.cache = newTileCache(cfg.cacheEntries, cfg.cacheTTL)
+		p.cache.keepStale = cfg.serveStale
+	}
+	if cfg.fallbackDir != "" {
+		if p.backup, err = loadFallbackTiles(cfg.fallbackDir); err != nil {
+			return nil, err
+		}
+	}
 	rp := &httputil.ReverseProxy{
 		Director:  director,
-		Transport: tr,
+		Transport: timedTransport{base: redirectTransport{base: tr, max: cfg.maxRedirects}, ring: p.latency},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, e error) {
+			var stale *staleResponse
+			if errors.As(e, &stale) {
+				// 上流の 5xx（ModifyResponse で失敗として記録済み）の代わりにキャッシュを返す
+				setCacheStatus(r, cacheStale)
+				stale.entry.serveStale(w, r)
+				return
+			}
 			// ログだけ出して簡潔に 502
-			log.Printf("mapproxy: upstream error for %s: %v", r.URL.String(), e)
+			log.Printf("mapproxy: upstream error for %s: %v%s", r.URL.String(), e, reqid.LogSuffix(r.Context()))
+			cfg.metrics.upstreamError()
+			// クライアント都合の中断は上流の不調とみなさない
+			if !errors.Is(e, context.Canceled) {
+				p.markFailure(e.Error())
+				if ent, ok := p.staleEntry(r); ok {
+					setCacheStatus(r, cacheStale)
+					ent.serveStale(w, r)
+					return
+				}
+				if p.backup != nil {
+					if b, ok := p.backup.tile(r.URL.Path); ok {
+						setCacheStatus(r, cacheFallback)
+						w.Header().Set("Content-Type", "image/png")
+						w.Header().Set("Cache-Control", "no-store")
+						w.Header().Set(DegradedHeader, "fallback")
+						_, _ = w.Write(b)
+						return
+					}
+				}
+			}
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 		},
 		ModifyResponse: func(resp *http.Response) error {
 			// 画像はそのまま通す。追加のヘッダ調整が必要ならここで行う。
+			if len(cfg.corsOrigins) > 0 {
+				// CORS はプロキシ側で付ける（上流の値と二重にならないように）
+				for _, k := range corsResponseHeaders {
+					resp.Header.Del(k)
+				}
+			}
+			for _, k := range cfg.stripHeaders {
+				resp.Header.Del(k)
+			}
+			for k, v := range cfg.respHeaders {
+				resp.Header.Set(k, v)
+			}
+			if resp.StatusCode >= 500 {
+				p.markFailure("upstream status " + resp.Status)
+				if ent, ok := p.staleEntry(resp.Request); ok {
+					_ = resp.Body.Close()
+					return &staleResponse{entry: ent, status: resp.Status}
+				}
+			} else {
+				p.failures.Store(0)
+			}
+			if cfg.tileMaxAge > 0 {
+				setTileCacheControl(resp, cfg.tileMaxAge)
+			}
+			if resp.Request.Method == http.MethodHead {
+				// HEAD の応答に本文は無い（Content-Length は GET の値なので残す）。キャッシュにも入れない
+				_ = resp.Body.Close()
+				resp.Body = http.NoBody
+				if p.cache != nil {
+					addVary(resp.Header, "Accept-Encoding")
+					setCacheStatus(resp.Request, cacheBypass)
+				}
+				return nil
+			}
+			if p.cache != nil {
+				// 同じ URL でも Accept-Encoding で本文が変わり得るため、下流のキャッシュにも伝える
+				addVary(resp.Header, "Accept-Encoding")
+				stored, err := p.cache.store(resp, time.Now())
+				switch {
+				case resp.StatusCode == http.StatusNotModified:
+					setCacheStatus(resp.Request, cacheRevalidated)
+				case !stored:
+					setCacheStatus(resp.Request, cacheBypass)
+				}
+				return err
+			}
 			return nil
 		},
 	}
 
 	// ルーティング制御: 指定プレフィックスのみ許可
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	p.handler = cfg.metrics.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		cs := &cacheStatus{v: cacheBypass}
+		r = r.WithContext(context.WithValue(r.Context(), cacheStatusCtx{}, cs))
+		var sw *statusWriter
+		if cfg.accessLog != nil {
+			sw = &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			w = sw
+		}
+		defer func() {
+			d := time.Since(start)
+			cfg.metrics.observeCache(cs.v, d)
+			if sw != nil {
+				cfg.accessLog.Printf("mapproxy: %s %s %d %dB %s cache=%s%s",
+					r.Method, r.URL.RequestURI(), sw.status, sw.bytes, d.Round(time.Millisecond), cs.v, reqid.LogSuffix(r.Context()))
+			}
+		}()
 		if !hasAnyPrefix(r.URL.Path, cfg.allowPrefixes) {
 			http.NotFound(w, r)
 			return
 		}
+		if len(cfg.corsOrigins) > 0 {
+			setCORSHeaders(w.Header(), r, cfg.corsOrigins)
+		}
+		if r.Method == http.MethodOptions {
+			// プリフライトなどは上流へ送らずに答える
+			w.Header().Set("Allow", allowedMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if cfg.allowQuery != nil && r.URL.RawQuery != "" {
+			// 上流へ転送するクエリ（director は r.URL をそのまま使う）とキャッシュキーの両方から除く
+			u := *r.URL
+			u.RawQuery = filterQuery(u.RawQuery, cfg.allowQuery)
+			r = r.Clone(r.Context())
+			r.URL = &u
+		}
+		if p.cache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			var key string
+			r, key = cacheRequest(r)
+			if e, ok := p.cache.get(key, time.Now()); ok {
+				cs.v = cacheMemHit
+				e.serve(w, r)
+				return
+			}
+			cs.v = cacheMiss // 保存できない応答だったら ModifyResponse で bypass に戻す
+		}
 		// 上流への全体タイムアウト
 		ctx, cancel := context.WithTimeout(r.Context(), cfg.requestTimeout)
 		defer cancel()
 		r = r.WithContext(ctx)
 		rp.ServeHTTP(w, r)
-	}), nil
+	}))
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) { p.handler.ServeHTTP(w, r) }
+
+// Healthy は上流が健全かどうかを返します。
+// 上流エラー（接続失敗・タイムアウト）または 5xx が WithUnhealthyThreshold 回連続すると false、
+// 以降 1 回でも 5xx 未満の応答があれば true に戻ります。
+// 戻り値の文字列は不健全時の最後の理由です。
+func (p *Proxy) Healthy() (bool, string) {
+	if p.failures.Load() < int64(p.cfg.unhealthyAfter) {
+		return true, ""
+	}
+	reason := ""
+	if s := p.lastErr.Load(); s != nil {
+		reason = *s
+	}
+	return false, reason
+}
+
+// LatencyQuantiles は直近 WithLatencyWindow 件の上流レイテンシ（リクエスト送信から応答ヘッダ受信まで）の
+// p50 / p95 / p99 を返します。まだ 1 件も無ければすべて 0 です。キャッシュやフォールバックで返した応答は含みません。
+func (p *Proxy) LatencyQuantiles() (p50, p95, p99 time.Duration) {
+	return p.latency.quantiles()
+}
+
+func (p *Proxy) markFailure(reason string) {
+	p.lastErr.Store(&reason)
+	p.failures.Add(1)
+}
+
+// statusWriter はアクセスログ用にステータスと送信バイト数を記録する。
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap は http.ResponseController が Flush などを元の Writer へ届けるためのもの。
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// stripTrailingSlash は u のパス末尾の（エンコードされていない）"/" を取り除きます。ルート "/" はそのまま。
+func stripTrailingSlash(u *url.URL) {
+	raw := u.EscapedPath()
+	trimmed := strings.TrimRight(raw, "/")
+	if trimmed == raw {
+		return
+	}
+	if trimmed == "" {
+		trimmed = "/"
+	}
+	p, err := url.PathUnescape(trimmed)
+	if err != nil {
+		return
+	}
+	u.Path, u.RawPath = p, trimmed
+}
+
+// filterQuery は生のクエリ文字列から、キーが allowed に無いパラメータを取り除きます。
+// 残すパラメータの順序とエンコードはクライアントが送ったままです。
+func filterQuery(raw string, allowed []string) string {
+	var kept []string
+	for part := range strings.SplitSeq(raw, "&") {
+		if part == "" {
+			continue
+		}
+		k, _, _ := strings.Cut(part, "=")
+		if key, err := url.QueryUnescape(k); err == nil && slices.Contains(allowed, key) {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// allowedMethods は OPTIONS への応答（Allow / Access-Control-Allow-Methods）に載せるメソッドです。
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// corsResponseHeaders は WithCORS 指定時に上流の応答から取り除く CORS ヘッダです。
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Max-Age",
+}
+
+// setCORSHeaders は r の Origin が origins に含まれていれば（"*" は全許可）CORS ヘッダを h に付けます。
+// プリフライト（OPTIONS + Access-Control-Request-Method）には許可するメソッドとヘッダも返します。
+func setCORSHeaders(h http.Header, r *http.Request, origins []string) {
+	addVary(h, "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	allow := ""
+	for _, o := range origins {
+		if o == "*" {
+			allow = "*"
+			break
+		}
+		if strings.EqualFold(o, origin) {
+			allow = origin
+			break
+		}
+	}
+	if allow == "" {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", allow)
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.Set("Access-Control-Allow-Methods", allowedMethods)
+		if rh := r.Header.Get("Access-Control-Request-Headers"); rh != "" {
+			h.Set("Access-Control-Allow-Headers", rh)
+		}
+		h.Set("Access-Control-Max-Age", "600")
+	}
+}
+
+// setTileCacheControl は WithTileCacheControl の既定 Cache-Control を必要なら付けます。
+func setTileCacheControl(resp *http.Response, maxAge time.Duration) {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") ||
+		resp.Header.Get("Cache-Control") != "" || resp.Header.Get("Expires") != "" {
+		return
+	}
+	resp.Header.Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(maxAge/time.Second), 10))
 }
 
 func hasAnyPrefix(p string, prefixes []string) bool {
@@ -124,6 +426,22 @@ type config struct {
 	expectContinueTimeout time.Duration
 	requestTimeout        time.Duration
 	allowPrefixes         []string
+	metrics               *Metrics
+	unhealthyAfter        int
+	accessLog             *log.Logger
+	cacheEntries          int
+	cacheTTL              time.Duration
+	fallbackDir           string
+	tileMaxAge            time.Duration
+	trailingSlash         TrailingSlashPolicy
+	latencyWindow         int
+	maxRedirects          int
+	corsOrigins           []string
+	transport             http.RoundTripper
+	stripHeaders          []string
+	respHeaders           map[string]string
+	allowQuery            []string // nil なら全て転送
+	serveStale            bool
 }
 
 type Option func(*config)
@@ -140,6 +458,118 @@ func WithResponseHeaderTimeout(d time.Duration) Option {
 func WithExpectContinueTimeout(d time.Duration) Option {
 	return func(c *config) { c.expectContinueTimeout = d }
 }
+func WithMetrics(m *Metrics) Option { return func(c *config) { c.metrics = m } }
+
+// WithAccessLog は 1 リクエスト 1 行のアクセスログを l に出します（nil で無効、既定は無効）。
+// リクエスト ID（pkg/reqid）が context にあれば req_id として載せます。
+func WithAccessLog(l *log.Logger) Option { return func(c *config) { c.accessLog = l } }
+
+// WithCache は上流の 200 応答をメモリに最大 maxEntries 件、ttl の間キャッシュします（既定は無効、ttl<=0 は無期限）。
+// キャッシュはクライアントの Accept-Encoding（gzip か否か）ごとに分けて持ち、応答には Vary: Accept-Encoding を付けます。
+// Cache-Control: no-store/no-cache/private や Set-Cookie 付きの応答は保存しません。
+// キャッシュヒット時は保存時の ETag / Last-Modified で条件付きリクエストを判定し、一致すれば 304 を返します
+// （上流がどちらも返さない場合は本文から ETag を作ります）。
+func WithCache(maxEntries int, ttl time.Duration) Option {
+	return func(c *config) { c.cacheEntries, c.cacheTTL = maxEntries, ttl }
+}
+
+// WithServeStaleOnError は、上流が 5xx を返した・接続できなかったときに、同じキーのキャッシュ（WithCache）が残っていれば
+// 期限切れでもそれを 200 で返します（既定は無効。WithCache が無ければ何もしない）。
+// 応答には X-Map-Degraded: stale と Cache-Control: no-store を付けます。キャッシュに無ければ従来どおり上流の 5xx か 502
+// （WithFallbackTileDir があればフォールバックタイル）を返します。期限切れのエントリは LRU で追い出されるまで残ります。
+func WithServeStaleOnError() Option { return func(c *config) { c.serveStale = true } }
+
+// WithFallbackTileDir は上流に接続できないときに返す低ズームのタイル一式（dir/{z}/{x}/{y}.png）を指定します。
+// New の時点で読み込み、該当ズームが無ければ最も近い親タイルを切り出して拡大し、200 と
+// X-Map-Degraded: fallback を付けて返します。上流が応答する限りフォールバックは使いません。
+func WithFallbackTileDir(dir string) Option { return func(c *config) { c.fallbackDir = dir } }
+
+// WithTileCacheControl は上流の成功応答（2xx の image/*）にキャッシュ系ヘッダ（Cache-Control / Expires）が無いとき、
+// Cache-Control: public, max-age=<maxAge 秒> を付けてブラウザにタイルを保持させます（0 以下で無効、既定は無効）。
+// 上流が自分で付けたヘッダは上書きしません。WithCache のサーバー側キャッシュとは独立に働きます。
+func WithTileCacheControl(maxAge time.Duration) Option {
+	return func(c *config) { c.tileMaxAge = maxAge }
+}
+
+// TrailingSlashPolicy は上流へ転送するパスの末尾スラッシュの扱いです（WithTrailingSlashPolicy）。
+type TrailingSlashPolicy int
+
+const (
+	// TrailingSlashPreserve はクライアントのパスをそのまま転送します（既定）。
+	TrailingSlashPreserve TrailingSlashPolicy = iota
+	// TrailingSlashStrip は末尾の "/" を取り除いて転送します（"/map/info/" → "/map/info"）。
+	// エンコードされた "%2F" は取り除きません。
+	TrailingSlashStrip
+)
+
+// WithTrailingSlashPolicy は上流へ転送するパスの末尾スラッシュの扱いを設定します。
+// 許可プレフィックスの判定はクライアントのパスのまま行います。
+func WithTrailingSlashPolicy(p TrailingSlashPolicy) Option {
+	return func(c *config) { c.trailingSlash = p }
+}
+
+// WithFollowRedirects は上流のリダイレクト（301/302/303/307/308）をサーバー側で最大 max 回たどり、
+// 最終的な応答を返します（0 以下で無効、既定は無効＝Location をそのままクライアントへ返す）。
+// CDN の裏にある上流が絶対 URL へリダイレクトしても、ブラウザがプロキシを迂回しないようにするためのものです。
+// たどるのは GET / HEAD のみで、同じリクエストの context（タイムアウト）の中で行います。
+// ホストが変わる場合は Authorization / Cookie を送りません。max 回を超えたら最後のリダイレクト応答をそのまま返します。
+func WithFollowRedirects(max int) Option { return func(c *config) { c.maxRedirects = max } }
+
+// WithCORS はタイルを別オリジンのページから読めるように、Origin が origins のいずれか（"*" で全許可）なら
+// Access-Control-Allow-Origin を付けます（既定は無効）。上流の CORS ヘッダは使わずに取り除きます。
+// OPTIONS は WithCORS の有無にかかわらず上流へ送らずに 204 で答え、プリフライトには許可するメソッドとヘッダを返します。
+func WithCORS(origins ...string) Option {
+	return func(c *config) { c.corsOrigins = append([]string{}, origins...) }
+}
+
+// WithAllowedQueryParams は上流へ転送するクエリパラメータを keys に限ります（既定は全て転送）。
+// それ以外のパラメータは転送前に取り除き、残すものはクライアントが送った順序のまま渡します。キャッシュキーも取り除いた後の URL です。
+// 任意のパラメータを付けたキャッシュ破りで上流に負荷をかけられないようにするためのものです（例: WithAllowedQueryParams("t", "v")）。
+// keys を空で指定するとクエリを全て取り除きます。
+func WithAllowedQueryParams(keys ...string) Option {
+	return func(c *config) { c.allowQuery = append([]string{}, keys...) }
+}
+
+// WithStripResponseHeaders は上流の応答から names のヘッダを取り除いてからクライアントへ返します
+// （names が空なら Set-Cookie、既定は無効）。タイルは状態を持たないので、上流の設定ミスで付いたセッション Cookie が
+// ブラウザにプロキシのオリジンの Cookie として保存されないようにするためのものです。
+// キャッシュの保存判定より前に取り除くので、Set-Cookie だけが理由で保存されなかった応答も WithCache で保存されます。
+func WithStripResponseHeaders(names ...string) Option {
+	if len(names) == 0 {
+		names = []string{"Set-Cookie"}
+	}
+	return func(c *config) { c.stripHeaders = append([]string{}, names...) }
+}
+
+// WithResponseHeaders は上流の応答に headers の各ヘッダを設定してからクライアントへ返します（既定は無効）。
+// 上流が同じ名前のヘッダを返していても headers の値で置き換えます（名前の大文字小文字は区別しない）。
+// CDN やブラウザ向けのヘッダ（Timing-Allow-Origin、独自の X-Tile-Source など）を付けるためのもので、
+// 上流の応答ごと保存するため WithCache のヒットにも付きます。WithStripResponseHeaders より後に適用します。
+// Access-Control-Allow-Origin などの CORS ヘッダは WithCORS が付けるので、ここでは指定しないでください。
+func WithResponseHeaders(headers map[string]string) Option {
+	return func(c *config) { c.respHeaders = maps.Clone(headers) }
+}
+
+// WithTransport は上流への通信に rt を使います（nil なら既定の *http.Transport）。
+// 指定すると内部で組み立てる *http.Transport は作らないため、WithDialTimeout などのタイムアウト系オプションは
+// 効きません（rt 側で設定してください）。WithRequestTimeout・WithFollowRedirects・レイテンシ計測は rt の外側で働きます。
+// テストでのモックや、HTTP/3・独自の TLS 設定などを使うためのものです。
+func WithTransport(rt http.RoundTripper) Option { return func(c *config) { c.transport = rt } }
+
+// WithLatencyWindow は LatencyQuantiles の計算に使う直近の上流リクエスト数を設定します（既定 256、1 未満は 1）。
+func WithLatencyWindow(n int) Option {
+	return func(c *config) { c.latencyWindow = max(n, 1) }
+}
+
+// WithUnhealthyThreshold は Healthy が false になる連続失敗回数を設定します（既定 3、1 未満は 1）。
+func WithUnhealthyThreshold(n int) Option {
+	return func(c *config) {
+		if n < 1 {
+			n = 1
+		}
+		c.unhealthyAfter = n
+	}
+}
 func WithMaxIdleConns(total, perHost int) Option {
 	return func(c *config) { c.idleConn, c.idleConnPerHost = total, perHost }
 }
@@ -1,11 +1,29 @@
 package mapproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/masahide/7dtd-stats/pkg/reqid"
 )
 
 func TestHandler_ProxiesSamePathAndQuery(t *testing.T) {
@@ -52,3 +70,900 @@ func TestHandler_ProxiesSamePathAndQuery(t *testing.T) {
 		t.Fatalf("body not proxied correctly: %v", b)
 	}
 }
+
+func TestProxy_HealthyTracksConsecutiveFailures(t *testing.T) {
+	var fail atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "boom", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithUnhealthyThreshold(2))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	get := func() {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+	}
+
+	if ok, _ := p.Healthy(); !ok {
+		t.Fatalf("new proxy should be healthy")
+	}
+	fail.Store(true)
+	get()
+	if ok, _ := p.Healthy(); !ok {
+		t.Fatalf("one failure should not flip health")
+	}
+	get()
+	if ok, reason := p.Healthy(); ok || reason == "" {
+		t.Fatalf("want unhealthy with reason after 2 failures, got ok=%v reason=%q", ok, reason)
+	}
+	fail.Store(false)
+	get()
+	if ok, _ := p.Healthy(); !ok {
+		t.Fatalf("success should restore health")
+	}
+
+	// 接続できない上流もエラーとして数える
+	upstream.Close()
+	get()
+	get()
+	if ok, _ := p.Healthy(); ok {
+		t.Fatalf("unreachable upstream should be unhealthy")
+	}
+}
+
+func TestProxy_AccessLogIncludesRequestID(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tile"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	var buf bytes.Buffer
+	p, err := New(upstream.URL, WithAccessLog(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	h := reqid.Middleware("", p)
+	req := httptest.NewRequest(http.MethodGet, "/map/1/2/3.png?t=9", nil)
+	req.Header.Set(reqid.DefaultHeader, "trace-42")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	for _, want := range []string{"GET /map/1/2/3.png?t=9 200 4B", "req_id=trace-42"} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("access log %q lacks %q", line, want)
+		}
+	}
+}
+
+func TestProxy_CacheKeyedByAcceptEncoding(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			_, _ = zw.Write([]byte(`{"ok":true}`))
+			_ = zw.Close()
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/map/info.json", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// gzip 版でキャッシュを温める
+	if rec := get("gzip, deflate"); rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("first response not gzipped: %v", rec.Header())
+	}
+	// gzip 非対応クライアントにキャッシュ済みの gzip 本文を返してはいけない
+	rec := get("")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("non-gzip client got Content-Encoding %q", ce)
+	}
+	if got := rec.Body.String(); got != `{"ok":true}` {
+		t.Fatalf("body = %q", got)
+	}
+	if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("Vary = %q", rec.Header().Get("Vary"))
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("upstream hits = %d, want 2", n)
+	}
+
+	// 以降はそれぞれのエンコーディングでキャッシュヒット
+	if rec := get("gzip;q=0"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != `{"ok":true}` {
+		t.Fatalf("identity cache hit mismatch: %v %q", rec.Header(), rec.Body.String())
+	}
+	rec = get("gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip cache hit mismatch: %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("cached gzip body: %v", err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != `{"ok":true}` {
+		t.Fatalf("cached gzip body = %q", b)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("upstream hits = %d, want 2 (cache hits)", n)
+	}
+}
+
+func TestProxy_AccessLogCacheDisposition(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.URL.Path == "/map/private.png" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("tile"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	var buf bytes.Buffer
+	m := NewMetrics()
+	p, err := New(upstream.URL, WithCache(16, time.Minute), WithAccessLog(log.New(&buf, "", 0)), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, path, inm string) string {
+		buf.Reset()
+		req := httptest.NewRequest(method, path, nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		p.ServeHTTP(httptest.NewRecorder(), req)
+		return buf.String()
+	}
+
+	cases := []struct {
+		method, path, inm string
+		want              string
+	}{
+		{http.MethodGet, "/map/a.png", `"v1"`, "304 0B"},            // 上流の 304
+		{http.MethodGet, "/map/a.png", "", "cache=miss"},            // 取得して保存
+		{http.MethodGet, "/map/a.png", "", "cache=mem_hit"},         // メモリから
+		{http.MethodGet, "/map/a.png", `"v1"`, "cache=mem_hit"},     // 保存済みの検証子で 304
+		{http.MethodGet, "/map/private.png", "", "cache=bypass"},    // no-store は保存しない
+		{http.MethodPost, "/map/a.png", "", "cache=bypass"},         // 対象外のメソッド
+		{http.MethodGet, "/map/b.png", `"v1"`, "cache=revalidated"}, // 未保存のタイルを上流で再検証
+	}
+	for i, c := range cases {
+		if line := do(c.method, c.path, c.inm); !strings.Contains(line, c.want) {
+			t.Fatalf("case %d: access log %q lacks %q", i, line, c.want)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "mapproxy_cache_request_duration_seconds" {
+			continue
+		}
+		for _, mt := range mf.GetMetric() {
+			counts[mt.GetLabel()[0].GetValue()] = mt.GetHistogram().GetSampleCount()
+		}
+	}
+	want := map[string]uint64{"revalidated": 2, "miss": 1, "mem_hit": 2, "bypass": 2}
+	for k, v := range want {
+		if counts[k] != v {
+			t.Fatalf("cache=%s count = %d, want %d (all %v)", k, counts[k], v, counts)
+		}
+	}
+}
+
+func TestProxy_OptionsAnsweredLocally(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+		_, _ = w.Write([]byte("tile"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	preflight := func(p *Proxy, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/map/0/0/0.png", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "x-request-id")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// CORS 未設定: 204 と Allow だけ返し、CORS ヘッダは付けない
+	plain, err := New(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := preflight(plain, "https://viewer.example")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("OPTIONS = %d %v", rec.Code, rec.Header())
+	}
+	if v := rec.Header().Get("Access-Control-Allow-Origin"); v != "" {
+		t.Fatalf("Access-Control-Allow-Origin = %q without WithCORS", v)
+	}
+
+	p, err := New(upstream.URL, WithCORS("https://viewer.example"), WithCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = preflight(p, "https://viewer.example")
+	h := rec.Header()
+	if rec.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://viewer.example" ||
+		h.Get("Access-Control-Allow-Methods") != "GET, HEAD, OPTIONS" || h.Get("Access-Control-Allow-Headers") != "x-request-id" {
+		t.Fatalf("preflight = %d %v", rec.Code, h)
+	}
+	if rec := preflight(p, "https://evil.example"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed origin got %v", rec.Header())
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("upstream hits = %d, want 0 for OPTIONS", n)
+	}
+
+	// 実際の GET にもプロキシの値だけが載る（上流の値は捨てる）。キャッシュヒットでも同じ
+	for i := range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil)
+		req.Header.Set("Origin", "https://viewer.example")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if got := rec.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://viewer.example" {
+			t.Fatalf("GET #%d Access-Control-Allow-Origin = %q", i, got)
+		}
+		if vary := strings.Join(rec.Header().Values("Vary"), ","); !strings.Contains(vary, "Origin") || !strings.Contains(vary, "Accept-Encoding") {
+			t.Fatalf("GET #%d Vary = %q", i, vary)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream hits = %d, want 1", n)
+	}
+}
+
+func TestProxy_HeadIsProxiedWithoutBodyOrCaching(t *testing.T) {
+	var methods []string
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", "4")
+		_, _ = w.Write([]byte("tile")) // HEAD では net/http が捨てる
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	do := func(method string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+"/map/1/1/1.png", nil)
+		req.Header.Set("Accept-Encoding", "identity") // GET と HEAD で同じキャッシュキーにする
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	resp, body := do(http.MethodHead)
+	if resp.StatusCode != http.StatusOK || body != "" || resp.ContentLength != 4 {
+		t.Fatalf("HEAD = %d len=%d body=%q", resp.StatusCode, resp.ContentLength, body)
+	}
+	// HEAD はキャッシュを温めないので GET は上流へ行き、その後の HEAD はキャッシュから本文なしで返る
+	if _, body := do(http.MethodGet); body != "tile" {
+		t.Fatalf("GET body = %q", body)
+	}
+	resp, body = do(http.MethodHead)
+	if resp.StatusCode != http.StatusOK || body != "" || resp.ContentLength != 4 {
+		t.Fatalf("cached HEAD = %d len=%d body=%q", resp.StatusCode, resp.ContentLength, body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{http.MethodHead, http.MethodGet}; !slices.Equal(methods, want) {
+		t.Fatalf("upstream methods = %v, want %v", methods, want)
+	}
+}
+
+func TestProxy_FallbackTileWhenUpstreamUnreachable(t *testing.T) {
+	// 2x2 の親タイル 0/0/-1.png（画素ごとに色が違う）
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	colors := [2][2]color.RGBA{
+		{{255, 0, 0, 255}, {0, 255, 0, 255}},
+		{{0, 0, 255, 255}, {255, 255, 0, 255}},
+	}
+	for y := range 2 {
+		for x := range 2 {
+			src.Set(x, y, colors[y][x])
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "0", "0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "0", "0", "-1.png"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 接続できない上流
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	p, err := New(down.URL, WithFallbackTileDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/map/0/0/-1.png?t=1")
+	if rec.Code != http.StatusOK || rec.Header().Get(DegradedHeader) == "" {
+		t.Fatalf("exact zoom: code=%d header=%v", rec.Code, rec.Header())
+	}
+	if !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+		t.Fatal("exact zoom: body differs from fallback file")
+	}
+
+	// z=1 の (1,-1) は親の右上（TMS なので y の奇数側が上）
+	rec = get("/map/1/1/-1.png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("zoomed: code=%d", rec.Code)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("zoomed: decode: %v", err)
+	}
+	if got := color.RGBAModel.Convert(img.At(0, 0)).(color.RGBA); got != colors[0][1] {
+		t.Fatalf("zoomed pixel = %v, want %v", got, colors[0][1])
+	}
+
+	// フォールバックに無い範囲は従来どおり 502
+	if rec := get("/map/0/5/5.png"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("missing tile: code=%d", rec.Code)
+	}
+}
+
+func TestFallbackTilesMemoizesZoomedTiles(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	ft := &fallbackTiles{tiles: map[[3]int][]byte{{0, 0, 0}: buf.Bytes()}, maxZ: 0, zoomed: make(map[[3]int][]byte)}
+
+	first, ok := ft.tile("/map/1/1/1.png")
+	if !ok {
+		t.Fatal("zoomed tile not found")
+	}
+	// 親タイルを壊しても、拡大済みの (1,1,1) は覚えている結果を返す（デコードし直さない）
+	ft.tiles[[3]int{0, 0, 0}] = []byte("not a png")
+	again, ok := ft.tile("/map/1/1/1.png")
+	if !ok || &again[0] != &first[0] {
+		t.Fatal("zoomed tile was not memoized")
+	}
+	if _, ok := ft.tile("/map/1/0/1.png"); ok {
+		t.Fatal("other tiles must still be zoomed from the parent")
+	}
+
+	// 覚える件数は上限まで（z=0 の親タイルを横に並べ、それぞれの z=3 の子 64 枚を要求する）
+	parents := fallbackZoomedMax/64 + 1
+	for px := range parents {
+		ft.tiles[[3]int{0, px, 0}] = buf.Bytes()
+	}
+	for i := range parents * 64 {
+		if _, ok := ft.tile(fmt.Sprintf("/map/3/%d/%d.png", i%(parents*8), i/(parents*8))); !ok {
+			t.Fatalf("tile %d not found", i)
+		}
+	}
+	if n := len(ft.zoomed); n > fallbackZoomedMax {
+		t.Fatalf("memoized %d tiles, want at most %d", n, fallbackZoomedMax)
+	}
+}
+
+func TestProxy_FallbackNotUsedWhenUpstreamUp(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("live"))
+	}))
+	t.Cleanup(upstream.Close)
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "0", "0"), 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "0", "0", "0.png"), []byte("fallback"), 0o644)
+
+	p, err := New(upstream.URL, WithFallbackTileDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+	if rec.Body.String() != "live" || rec.Header().Get(DegradedHeader) != "" {
+		t.Fatalf("got %q %v, want live tile", rec.Body.String(), rec.Header())
+	}
+}
+
+func TestProxy_CacheAnswersConditionalRequestWith304(t *testing.T) {
+	var hits atomic.Int64
+	lastMod := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/map/0/0/1.png" {
+			w.Header().Set("Last-Modified", lastMod.Format(http.TimeFormat))
+		}
+		_, _ = w.Write([]byte{0x89, 'P', 'N', 'G'})
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(path string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 上流が検証子を返さなければ ETag を付けてキャッシュする
+	first := do("/map/0/0/0.png", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("warm: code=%d etag=%q", first.Code, etag)
+	}
+	rec := do("/map/0/0/0.png", map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("If-None-Match: code=%d body=%d bytes", rec.Code, rec.Body.Len())
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Fatalf("304 ETag = %q, want %q", got, etag)
+	}
+	if rec := do("/map/0/0/0.png", map[string]string{"If-None-Match": `"other"`}); rec.Code != http.StatusOK || rec.Body.Len() != 4 {
+		t.Fatalf("stale ETag: code=%d body=%d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// 上流の Last-Modified は If-Modified-Since で判定する
+	do("/map/0/0/1.png", nil)
+	rec = do("/map/0/0/1.png", map[string]string{"If-Modified-Since": lastMod.Format(http.TimeFormat)})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("If-Modified-Since: code=%d body=%d bytes", rec.Code, rec.Body.Len())
+	}
+
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("upstream hits = %d, want 2", n)
+	}
+}
+
+func TestProxy_ServeStaleOnError(t *testing.T) {
+	var failing atomic.Bool
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		_, _ = w.Write([]byte{0x89, 'P', 'N', 'G'})
+	}))
+	t.Cleanup(upstream.Close)
+
+	stale, err := New(upstream.URL, WithCache(16, time.Millisecond), WithServeStaleOnError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := New(upstream.URL, WithCache(16, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(p *Proxy, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	for _, p := range []*Proxy{stale, plain} {
+		if rec := get(p, "/map/0/0/0.png"); rec.Code != http.StatusOK {
+			t.Fatalf("warm: %d", rec.Code)
+		}
+	}
+	failing.Store(true)
+	time.Sleep(5 * time.Millisecond) // TTL 切れ
+
+	before := hits.Load()
+	rec := get(stale, "/map/0/0/0.png")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 4 {
+		t.Fatalf("stale: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get(DegradedHeader) != "stale" || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("stale headers: %v", rec.Header())
+	}
+	if hits.Load() != before+1 {
+		t.Fatalf("expired entry should be revalidated upstream first")
+	}
+	// キャッシュに無いタイル・オプション無しは上流の 5xx のまま
+	if rec := get(stale, "/map/0/0/9.png"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("uncached tile: %d, want 500", rec.Code)
+	}
+	if rec := get(plain, "/map/0/0/0.png"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("without WithServeStaleOnError: %d, want 500", rec.Code)
+	}
+
+	// 上流に接続できないときも返す
+	upstream.Close()
+	if rec := get(stale, "/map/0/0/0.png"); rec.Code != http.StatusOK || rec.Header().Get(DegradedHeader) != "stale" {
+		t.Fatalf("unreachable upstream: code=%d headers=%v", rec.Code, rec.Header())
+	}
+}
+
+func TestProxy_TileCacheControl(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/map/own.png":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Content-Type", "image/png")
+		case "/map/info":
+			w.Header().Set("Content-Type", "application/json")
+		case "/map/missing.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+		}
+		_, _ = w.Write([]byte("x"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithTileCacheControl(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"/map/0/0/0.png":   "public, max-age=600",
+		"/map/own.png":     "no-cache", // 上流のヘッダは上書きしない
+		"/map/info":        "",         // 画像以外
+		"/map/missing.png": "",         // 失敗応答
+	} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := rec.Header().Get("Cache-Control"); got != want {
+			t.Errorf("%s: Cache-Control = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestProxy_PathEscapingAndTrailingSlash(t *testing.T) {
+	var got atomic.Pointer[string]
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri := r.RequestURI
+		got.Store(&uri)
+	}))
+	t.Cleanup(upstream.Close)
+
+	forwarded := func(p *Proxy, target string) string {
+		t.Helper()
+		got.Store(nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, rec.Code)
+		}
+		return *got.Load()
+	}
+
+	preserve, err := New(upstream.URL, WithAllowedPrefixes("/map/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strip, err := New(upstream.URL, WithAllowedPrefixes("/map/"), WithTrailingSlashPolicy(TrailingSlashStrip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		p        *Proxy
+		in, want string
+	}{
+		// 既定: 末尾スラッシュもエンコードもそのまま
+		{preserve, "/map/info/", "/map/info/"},
+		{preserve, "/map/a%2Fb.png?x=1", "/map/a%2Fb.png?x=1"},
+		{preserve, "/map/a%20b/", "/map/a%20b/"},
+		// プレフィックス判定はデコード後のパス（/map/info）で行い、転送はエンコードのまま
+		{preserve, "/map%2Finfo", "/map%2Finfo"},
+		// Strip: 末尾の "/" だけ落とし、%2F やクエリは残す
+		{strip, "/map/info/", "/map/info"},
+		{strip, "/map/info//?v=2", "/map/info?v=2"},
+		{strip, "/map/a%2F", "/map/a%2F"},
+		{strip, "/map/a%20b/", "/map/a%20b"},
+		{strip, "/map/0/0/0.png", "/map/0/0/0.png"},
+	} {
+		if got := forwarded(tc.p, tc.in); got != tc.want {
+			t.Errorf("%s forwarded as %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLatencyRingQuantiles(t *testing.T) {
+	r := newLatencyRing(100)
+	if p50, p95, p99 := r.quantiles(); p50 != 0 || p95 != 0 || p99 != 0 {
+		t.Fatalf("empty ring: %v %v %v", p50, p95, p99)
+	}
+	// 古い値は窓から押し出される
+	for i := 0; i < 50; i++ {
+		r.add(time.Hour)
+	}
+	for i := 1; i <= 100; i++ {
+		r.add(time.Duration(i) * time.Millisecond)
+	}
+	p50, p95, p99 := r.quantiles()
+	if p50 != 50*time.Millisecond || p95 != 95*time.Millisecond || p99 != 99*time.Millisecond {
+		t.Fatalf("quantiles = %v %v %v, want 50ms 95ms 99ms", p50, p95, p99)
+	}
+}
+
+func TestProxy_LatencyQuantilesTrackUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithLatencyWindow(8), WithCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		// 2 回目以降はキャッシュヒットなので上流レイテンシには数えない
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+	}
+	p50, _, p99 := p.LatencyQuantiles()
+	if p50 < 20*time.Millisecond || p99 != p50 {
+		t.Fatalf("p50=%v p99=%v, want a single sample >= 20ms", p50, p99)
+	}
+}
+
+func TestProxy_FollowRedirects(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Authorization leaked to another host")
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("origin:" + r.URL.RequestURI()))
+	}))
+	t.Cleanup(origin.Close)
+	var hops atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops.Add(1)
+		if r.URL.Path == "/map/loop.png" {
+			http.Redirect(w, r, "/map/loop.png", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, origin.URL+"/tiles"+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+	t.Cleanup(upstream.Close)
+
+	do := func(p *Proxy, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Basic eDp5")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 既定では Location を素通しする
+	plain, err := New(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := do(plain, "/map/0/0/0.png?t=1")
+	if rec.Code != http.StatusMovedPermanently || !strings.HasPrefix(rec.Header().Get("Location"), origin.URL) {
+		t.Fatalf("default: code=%d location=%q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	follow, err := New(upstream.URL, WithFollowRedirects(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = do(follow, "/map/0/0/0.png?t=1")
+	if rec.Code != http.StatusOK || rec.Body.String() != "origin:/tiles/map/0/0/0.png?t=1" {
+		t.Fatalf("follow: code=%d body=%q", rec.Code, rec.Body.String())
+	}
+
+	// 上限を超えたら最後のリダイレクトを返す（1 回目 + 2 hop）
+	hops.Store(0)
+	rec = do(follow, "/map/loop.png")
+	if rec.Code != http.StatusFound || hops.Load() != 3 {
+		t.Fatalf("loop: code=%d upstream hits=%d, want 302 after 3 hits", rec.Code, hops.Load())
+	}
+}
+
+// roundTripFunc は関数を http.RoundTripper として使うためのものです。
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestProxy_WithTransportReplacesUpstreamTransport(t *testing.T) {
+	var gotURL string
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		gotURL = r.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"image/png"}},
+			Body:       io.NopCloser(strings.NewReader("tile")),
+			Request:    r,
+		}, nil
+	})
+	// 上流ホストは存在しないが、rt が応答するのでネットワークには出ない。タイムアウト指定より rt が優先される
+	p, err := New("http://upstream.invalid", WithTransport(rt), WithDialTimeout(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/map/1/2/3.png?t=9", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "tile" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if gotURL != "http://upstream.invalid/map/1/2/3.png?t=9" {
+		t.Fatalf("upstream URL = %q", gotURL)
+	}
+}
+
+func TestProxy_StripResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.Header().Set("X-Upstream-Node", "n1")
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("tile"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithStripResponseHeaders())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "tile" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if v := rec.Header().Values("Set-Cookie"); len(v) != 0 {
+		t.Fatalf("Set-Cookie should be stripped by default, got %q", v)
+	}
+	if rec.Header().Get("X-Upstream-Node") != "n1" {
+		t.Fatal("other headers should pass through")
+	}
+
+	p, err = New(upstream.URL, WithStripResponseHeaders("x-upstream-node"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+	if rec.Header().Get("X-Upstream-Node") != "" || rec.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("only the named header should be stripped: %v", rec.Header())
+	}
+}
+
+func TestProxy_ResponseHeaders(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Timing-Allow-Origin", "https://upstream.example")
+		w.Header().Set("X-Upstream-Node", "n1")
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("tile"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithCache(10, time.Minute), WithResponseHeaders(map[string]string{
+		"timing-allow-origin": "*",
+		"X-Tile-Source":       "node1",
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for i := range 2 { // 2 回目はキャッシュのヒット
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/map/0/0/0.png", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "tile" {
+			t.Fatalf("#%d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+		if v := rec.Header().Values("Timing-Allow-Origin"); len(v) != 1 || v[0] != "*" {
+			t.Fatalf("#%d: Timing-Allow-Origin = %q, want upstream value replaced", i, v)
+		}
+		if rec.Header().Get("X-Tile-Source") != "node1" || rec.Header().Get("X-Upstream-Node") != "n1" {
+			t.Fatalf("#%d: headers = %v", i, rec.Header())
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream hits = %d, want 1", n)
+	}
+}
+
+func TestProxy_AllowedQueryParams(t *testing.T) {
+	var hits atomic.Int32
+	var gotQuery atomic.Pointer[string]
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		q := r.URL.RawQuery
+		gotQuery.Store(&q)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("tile"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	p, err := New(upstream.URL, WithAllowedQueryParams("t", "v"), WithCache(10, time.Minute))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	get := func(uri string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", uri, rec.Code)
+		}
+	}
+
+	get("/map/0/0/0.png?bust=1&v=2&x%3D=y&t=1756728782772&cb")
+	if q := *gotQuery.Load(); q != "v=2&t=1756728782772" {
+		t.Fatalf("upstream query = %q, want only allowed params in client order", q)
+	}
+	// 取り除いたパラメータだけが違うリクエストは同じキャッシュエントリに当たる
+	get("/map/0/0/0.png?v=2&t=1756728782772&bust=2")
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream hits = %d, want 1 (cache-busting params ignored)", n)
+	}
+
+	// 未指定なら全て転送する
+	p, err = New(upstream.URL)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	get("/map/0/0/0.png?bust=1&t=5")
+	if q := *gotQuery.Load(); q != "bust=1&t=5" {
+		t.Fatalf("upstream query without allowlist = %q", q)
+	}
+}
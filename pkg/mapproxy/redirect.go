@@ -0,0 +1,53 @@
+package mapproxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// redirectTransport は WithFollowRedirects の実体です。max 回まで上流のリダイレクトをたどります。
+type redirectTransport struct {
+	base http.RoundTripper
+	max  int
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	for hops := 0; err == nil && hops < t.max; hops++ {
+		next := redirectRequest(req, resp)
+		if next == nil {
+			break
+		}
+		// 捨てる応答の本文は読み切って接続を再利用できるようにする
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		_ = resp.Body.Close()
+		req = next
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// redirectRequest は resp がたどれるリダイレクトなら次のリクエストを返します（たどらないなら nil）。
+func redirectRequest(req *http.Request, resp *http.Response) *http.Request {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	next := req.Clone(req.Context())
+	next.URL = loc
+	next.Host = "" // 上流の Host ヘッダは新しい URL に合わせる
+	if loc.Host != req.URL.Host {
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	return next
+}
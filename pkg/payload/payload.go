@@ -0,0 +1,81 @@
+// Package payload は SSE（/sse/live・/sse/replay）と Webhook で送る JSON の形を定義します。
+// フロントエンドや別の集計プロセスなど、受け取る側もこの型をそのまま使えます。
+//
+// どの payload も先頭に "schema"（SchemaVersion）を持ちます。フィールドの追加は互換とみなして据え置き、
+// 既存フィールドの削除・改名・意味の変更をするときに SchemaVersion を上げます。
+// 受け取る側は知らない schema を見たら非互換として扱ってください。
+package payload
+
+import "time"
+
+// SchemaVersion は現在の payload の版です。
+const SchemaVersion = 1
+
+// SSE のトピック（event: 名）です。
+const (
+	TopicPos      = "pos"      // PosEvent
+	TopicEvents   = "events"   // PlayerEvent
+	TopicSnapshot = "snapshot" // Snapshot
+)
+
+// PosEvent はプレイヤーの位置です（topic: pos）。
+//
+//	{"schema":1,"pid":"P:steam:...","x":123.45,"z":-67.8,"t":"2025-09-02T12:34:56.789Z","name":"alice","tags":{"world":"Navezgane"}}
+type PosEvent struct {
+	Schema int               `json:"schema"`
+	PID    string            `json:"pid"`
+	X      float64           `json:"x"`
+	Z      float64           `json:"z"`
+	T      time.Time         `json:"t"`
+	Name   string            `json:"name,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"` // Poller.BaseTags など（無ければ省略）
+}
+
+// NewPosEvent は現在の SchemaVersion の PosEvent を返します（T は UTC にそろえる）。
+func NewPosEvent(pid string, x, z float64, t time.Time, name string, tags map[string]string) PosEvent {
+	return PosEvent{Schema: SchemaVersion, PID: pid, X: x, Z: z, T: t.UTC(), Name: name, Tags: tags}
+}
+
+// Snapshot は接続中の全プレイヤーの位置です（topic: snapshot）。Poller.SnapshotInterval ごとに送ります。
+// 接続直後のクライアントが差分（pos）を待たずに全体を描けるようにするためのもので、Players の各要素は PosEvent と同じ形です。
+//
+//	{"schema":1,"t":"2025-09-02T12:34:56.789Z","players":[{"schema":1,"pid":"P:steam:...","x":123.45,"z":-67.8,"t":"2025-09-02T12:34:56.789Z"}]}
+type Snapshot struct {
+	Schema  int        `json:"schema"`
+	T       time.Time  `json:"t"`
+	Players []PosEvent `json:"players"` // 誰も居なければ空配列
+}
+
+// NewSnapshot は現在の SchemaVersion の Snapshot を返します（T は UTC にそろえ、players が nil なら空にする）。
+func NewSnapshot(t time.Time, players []PosEvent) Snapshot {
+	if players == nil {
+		players = []PosEvent{}
+	}
+	return Snapshot{Schema: SchemaVersion, T: t.UTC(), Players: players}
+}
+
+// PlayerEvent はプレイヤーの接続・切断などのイベントです（topic: events、Webhook の本文も同じ形）。
+// Kind は storage.EventKind の値（"player_connect" / "player_disconnect"）です。
+//
+//	{"schema":1,"kind":"player_disconnect","pid":"P:steam:...","t":"2025-09-02T12:34:56.789Z","name":"alice","duration_seconds":1800}
+type PlayerEvent struct {
+	Schema          int               `json:"schema"`
+	Kind            string            `json:"kind"`
+	PID             string            `json:"pid,omitempty"`
+	T               time.Time         `json:"t"`
+	Name            string            `json:"name,omitempty"`
+	DurationSeconds *float64          `json:"duration_seconds,omitempty"` // 切断時のセッション長（分かる場合のみ）
+	Tags            map[string]string `json:"tags,omitempty"`
+}
+
+// NewPlayerEvent は現在の SchemaVersion の PlayerEvent を返します（T は UTC にそろえる）。
+func NewPlayerEvent(kind, pid string, t time.Time, name string, tags map[string]string) PlayerEvent {
+	return PlayerEvent{Schema: SchemaVersion, Kind: kind, PID: pid, T: t.UTC(), Name: name, Tags: tags}
+}
+
+// WithDuration は DurationSeconds に d を入れた e を返します。
+func (e PlayerEvent) WithDuration(d time.Duration) PlayerEvent {
+	s := d.Seconds()
+	e.DurationSeconds = &s
+	return e
+}
@@ -0,0 +1,39 @@
+package payload
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// 受け取る側との約束なので、JSON の形が変わったら SchemaVersion を上げるかどうかを判断すること。
+func TestWireFormat(t *testing.T) {
+	ts := time.Date(2025, 9, 2, 21, 34, 56, 789e6, time.FixedZone("JST", 9*3600))
+	cases := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"pos", NewPosEvent("P:1", 123.45, -67.8, ts, "alice", map[string]string{"world": "Navezgane"}),
+			`{"schema":1,"pid":"P:1","x":123.45,"z":-67.8,"t":"2025-09-02T12:34:56.789Z","name":"alice","tags":{"world":"Navezgane"}}`},
+		{"pos without name", NewPosEvent("P:1", 1, 2, ts, "", nil),
+			`{"schema":1,"pid":"P:1","x":1,"z":2,"t":"2025-09-02T12:34:56.789Z"}`},
+		{"connect", NewPlayerEvent("player_connect", "P:1", ts, "alice", nil),
+			`{"schema":1,"kind":"player_connect","pid":"P:1","t":"2025-09-02T12:34:56.789Z","name":"alice"}`},
+		{"disconnect", NewPlayerEvent("player_disconnect", "P:1", ts, "alice", nil).WithDuration(30 * time.Minute),
+			`{"schema":1,"kind":"player_disconnect","pid":"P:1","t":"2025-09-02T12:34:56.789Z","name":"alice","duration_seconds":1800}`},
+		{"snapshot", NewSnapshot(ts, []PosEvent{NewPosEvent("P:1", 1, 2, ts, "alice", nil)}),
+			`{"schema":1,"t":"2025-09-02T12:34:56.789Z","players":[{"schema":1,"pid":"P:1","x":1,"z":2,"t":"2025-09-02T12:34:56.789Z","name":"alice"}]}`},
+		{"empty snapshot", NewSnapshot(ts, nil),
+			`{"schema":1,"t":"2025-09-02T12:34:56.789Z","players":[]}`},
+	}
+	for _, c := range cases {
+		b, err := json.Marshal(c.v)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if string(b) != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, b, c.want)
+		}
+	}
+}
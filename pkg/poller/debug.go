@@ -0,0 +1,88 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// DebugReport は JSONProvider.DebugFetch の結果です。
+type DebugReport struct {
+	Pages   []DebugPage   // 取得したページ（順番どおり）
+	Players []Player      // FetchPlayers が返すのと同じプレイヤー
+	Skipped []SkippedItem // ID や座標が取れずに飛ばした要素
+}
+
+// DebugPage は 1 ページ分の取得結果です。
+type DebugPage struct {
+	URL   string // 認証情報を伏せた URL
+	Shape string // レスポンスの形の要約（例: {"result": {"players": [3 × {"id": string, "pos": {...}}]}}）
+	Items int    // プレイヤー配列の要素数
+}
+
+// SkippedItem は DebugFetch が飛ばした配列の要素です。
+type SkippedItem struct {
+	Page   int    // Pages の添字
+	Index  int    // ページ内のプレイヤー配列の添字
+	Reason string // 飛ばした理由（例: "missing id (tried id, player_id, ...)"）
+	Item   any    // 要素そのもの（JSON をデコードした値）
+}
+
+// DebugFetch は FetchPlayers と同じ取得・抽出を行い、途中経過を DebugReport にまとめて返します。
+// ArrayPath・NextPath や候補キーが新しいサーバの API に合っているかを、配信も保存もせずに確かめるためのもので、
+// レスポンスの形と、どの要素がどの理由（ID が無い・座標が無い）で飛ばされたかが分かります。
+// エラーの場合も、それまでに取得できたページの分は返します。
+func (p *JSONProvider) DebugFetch(ctx context.Context) (*DebugReport, error) {
+	r := &DebugReport{Players: []Player{}}
+	err := p.fetchAll(ctx, func(u *url.URL, root any, arr []any) {
+		r.Pages = append(r.Pages, DebugPage{URL: u.Redacted(), Shape: describeShape(root, 0), Items: len(arr)})
+		for i, it := range arr {
+			pl, skip := parsePlayer(it)
+			if skip != "" {
+				r.Skipped = append(r.Skipped, SkippedItem{Page: len(r.Pages) - 1, Index: i, Reason: skip, Item: it})
+				continue
+			}
+			r.Players = append(r.Players, pl)
+		}
+	})
+	return r, err
+}
+
+// maxShapeDepth より深い入れ子は {...} / [...] に省略する。
+const maxShapeDepth = 4
+
+// describeShape は JSON をデコードした値の形（キーと型、配列は長さと先頭要素の形）を 1 行で返す。
+func describeShape(v any, depth int) string {
+	switch t := v.(type) {
+	case map[string]any:
+		if depth >= maxShapeDepth {
+			return "{...}"
+		}
+		keys := slices.Sorted(maps.Keys(t))
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = fmt.Sprintf("%q: %s", k, describeShape(t[k], depth+1))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case []any:
+		if len(t) == 0 {
+			return "[]"
+		}
+		if depth >= maxShapeDepth {
+			return fmt.Sprintf("[%d × ...]", len(t))
+		}
+		return fmt.Sprintf("[%d × %s]", len(t), describeShape(t[0], depth+1))
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,73 @@
+package poller
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	descPollDuration = prometheus.NewDesc(
+		"poller_last_poll_duration_seconds",
+		"Duration of the most recent poll (fetch and output).",
+		nil, nil,
+	)
+	descLastSuccess = prometheus.NewDesc(
+		"poller_last_success_timestamp_seconds",
+		"Unix time of the most recent successful fetch (0 if none yet).",
+		nil, nil,
+	)
+	descOnline = prometheus.NewDesc(
+		"poller_players_online",
+		"Number of players currently considered online.",
+		nil, nil,
+	)
+	descPolls = prometheus.NewDesc(
+		"poller_polls_total",
+		"Total number of polls, including failed ones.",
+		nil, nil,
+	)
+	descFailures = prometheus.NewDesc(
+		"poller_poll_failures_total",
+		"Total number of failed fetches.",
+		nil, nil,
+	)
+	descFailureStreak = prometheus.NewDesc(
+		"poller_consecutive_failures",
+		"Number of consecutive failed fetches (reset on success).",
+		nil, nil,
+	)
+	descEmitted = prometheus.NewDesc(
+		"poller_events_emitted_total",
+		"Total number of outputs emitted by the poller, by kind.",
+		[]string{"kind"}, nil,
+	)
+)
+
+// Collector は Poller の Stats を公開する prometheus.Collector を返す。
+func (p *Poller) Collector() prometheus.Collector { return &pollerCollector{p: p} }
+
+type pollerCollector struct{ p *Poller }
+
+func (c *pollerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descPollDuration
+	ch <- descLastSuccess
+	ch <- descOnline
+	ch <- descPolls
+	ch <- descFailures
+	ch <- descFailureStreak
+	ch <- descEmitted
+}
+
+func (c *pollerCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.p.Stats()
+	var last float64
+	if !st.LastSuccess.IsZero() {
+		last = float64(st.LastSuccess.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(descPollDuration, prometheus.GaugeValue, st.LastPollDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(descLastSuccess, prometheus.GaugeValue, last)
+	ch <- prometheus.MustNewConstMetric(descOnline, prometheus.GaugeValue, float64(st.Online))
+	ch <- prometheus.MustNewConstMetric(descPolls, prometheus.CounterValue, float64(st.Polls))
+	ch <- prometheus.MustNewConstMetric(descFailures, prometheus.CounterValue, float64(st.Failures))
+	ch <- prometheus.MustNewConstMetric(descFailureStreak, prometheus.GaugeValue, float64(st.FailureStreak))
+	ch <- prometheus.MustNewConstMetric(descEmitted, prometheus.CounterValue, float64(st.Connects), "connect")
+	ch <- prometheus.MustNewConstMetric(descEmitted, prometheus.CounterValue, float64(st.Disconnects), "disconnect")
+	ch <- prometheus.MustNewConstMetric(descEmitted, prometheus.CounterValue, float64(st.Positions), "position")
+}
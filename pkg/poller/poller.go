@@ -1,234 +1,802 @@
 package poller
 
 import (
-    "context"
-    "encoding/json"
-    "errors"
-    "fmt"
-    "io"
-    "net/http"
-    "strings"
-    "sync"
-    "time"
-
-    "github.com/masahide/7dtd-stats/pkg/sse"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
 )
 
 // Player は最小限のプレイヤー情報です。
 type Player struct {
-    ID   string
-    Name string
-    X    float64
-    Z    float64
+	ID   string
+	Name string
+	X    float64
+	Z    float64
+	// Tags は出力（ストアのタグ・SSE / Webhook の tags）に付ける追加のタグです（nil 可）。
+	// Poller が BaseTags を重ねます（同じキーは Provider の値が優先）。
+	Tags map[string]string
+	// LastSeen は一覧で最後に見えた時刻です。Poller が設定します（Provider の値は使いません）。
+	// DisconnectGrace 中のプレイヤーは消える前の時刻のままです。
+	LastSeen time.Time
 }
 
 // Provider はプレイヤー一覧を返すデータソースです。
 type Provider interface {
-    FetchPlayers(ctx context.Context) ([]Player, error)
+	FetchPlayers(ctx context.Context) ([]Player, error)
 }
 
 // JSONProvider は任意の JSON エンドポイントからプレイヤー情報を抽出します。
 // 期待構造：
-//  - ルートが配列、またはオブジェクト内の players/data/items フィールドが配列
-//  - 各要素はオブジェクトで、以下の候補キーから ID, Name, X, Z を抽出
-//    ID:   id, player_id, steamid, steamId, entityId
-//    Name: name, playerName, nick
-//    X:    x, xpos, x_pos
-//    Z:    z, zpos, z_pos
+//   - ルートが配列、またはオブジェクト内の players/data/items/list フィールドが配列
+//     （ArrayPath を設定するとそのドット区切りのパスにある配列を使う。例: "result.players"）
+//   - 各要素はオブジェクトで、以下の候補キーから ID, Name, X, Z を抽出
+//     （ドット区切りは入れ子のオブジェクトを辿る。各階層で大文字小文字は区別しない）
+//     ID:   id, player_id, steamid, steamId, entityId, player.id
+//     Name: name, playerName, nick, player.name
+//     X:    x, xpos, x_pos, pos.x, position.x, player.pos.x
+//     Z:    z, zpos, z_pos, pos.z, position.z, player.pos.z
+//
+// NextPath を設定すると、レスポンスのそのパスにある文字列を次ページの URL（相対なら現在のページ基準）として辿り、
+// 全ページのプレイヤーを 1 回の結果にまとめます。値が無い・空・既に取得した URL なら終わり。
+// 認証情報を別のホストへ送らないよう、次ページは URL と同じスキーム・ホストに限ります。
+// MaxPages（0 なら 10）を超えるページがある場合は、一部だけの一覧で切断イベントを出さないようエラーにします。
+// Timeout は全ページの取得にかかる時間の上限です。
+//
+// Username を設定すると Basic 認証を付けます。Header の値はそのまま各リクエストに設定します
+// （例: {"Authorization": "Bearer ..."}。Basic 認証と併用した場合は Username が優先）。
 type JSONProvider struct {
-    URL     string
-    Client  *http.Client
-    Timeout time.Duration
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+
+	ArrayPath string
+	NextPath  string
+	MaxPages  int
+
+	Username string
+	Password string
+	Header   map[string]string
 }
 
+// defaultMaxPages は JSONProvider.MaxPages が 0 のときのページ数の上限です。
+const defaultMaxPages = 10
+
 func (p *JSONProvider) FetchPlayers(ctx context.Context) ([]Player, error) {
-    if p.URL == "" {
-        return nil, errors.New("poller: JSONProvider.URL is empty")
-    }
-    client := p.Client
-    if client == nil {
-        client = http.DefaultClient
-    }
-    req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
-    if err != nil {
-        return nil, err
-    }
-    if p.Timeout > 0 {
-        ctx2, cancel := context.WithTimeout(req.Context(), p.Timeout)
-        defer cancel()
-        req = req.WithContext(ctx2)
-    }
-    resp, err := client.Do(req)
-    if err != nil {
-        return nil, err
-    }
-    defer resp.Body.Close()
-    if resp.StatusCode != http.StatusOK {
-        b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
-        return nil, fmt.Errorf("poller: GET %s: %s: %s", p.URL, resp.Status, string(b))
-    }
-    dec := json.NewDecoder(resp.Body)
-    var root any
-    if err := dec.Decode(&root); err != nil {
-        return nil, err
-    }
-    arr, ok := pickArray(root)
-    if !ok {
-        return nil, errors.New("poller: unsupported JSON shape (array or object with players/data/items[] expected)")
-    }
-    out := make([]Player, 0, len(arr))
-    for _, it := range arr {
-        m, ok := it.(map[string]any)
-        if !ok {
-            continue
-        }
-        id := pickString(m, "id", "player_id", "steamid", "steamId", "entityId")
-        if id == "" {
-            continue
-        }
-        name := pickString(m, "name", "playerName", "nick")
-        x, xok := pickFloat(m, "x", "xpos", "x_pos")
-        z, zok := pickFloat(m, "z", "zpos", "z_pos")
-        if !xok || !zok {
-            continue
-        }
-        out = append(out, Player{ID: id, Name: name, X: x, Z: z})
-    }
-    return out, nil
+	out := []Player{}
+	err := p.fetchAll(ctx, func(_ *url.URL, _ any, arr []any) {
+		out = append(out, parsePlayers(arr)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// fetchAll は全ページを取得し、ページごとにレスポンスとプレイヤーの配列を fn へ渡す。
+func (p *JSONProvider) fetchAll(ctx context.Context, fn func(u *url.URL, root any, arr []any)) error {
+	if p.URL == "" {
+		return errors.New("poller: JSONProvider.URL is empty")
+	}
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	maxPages := p.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	first, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for u := first; u != nil; {
+		if len(seen) == maxPages {
+			return fmt.Errorf("poller: GET %s: more than %d pages", first.Redacted(), maxPages)
+		}
+		seen[u.String()] = true
+		root, err := p.fetchPage(ctx, u)
+		if err != nil {
+			return err
+		}
+		arr, err := p.pickArray(root)
+		if err != nil {
+			return err
+		}
+		fn(u, root, arr)
+		next, err := p.nextPage(root, u, first)
+		if err != nil {
+			return err
+		}
+		if next != nil && seen[next.String()] {
+			break
+		}
+		u = next
+	}
+	return nil
+}
+
+// fetchPage は u を GET して JSON をデコードする。
+func (p *JSONProvider) fetchPage(ctx context.Context, u *url.URL) (any, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p.Header {
+		req.Header.Set(k, v)
+	}
+	if p.Username != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("poller: GET %s: %s: %s", req.URL.Redacted(), resp.Status, string(b))
+	}
+	dec := json.NewDecoder(resp.Body)
+	var root any
+	if err := dec.Decode(&root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// pickArray は ArrayPath（空なら既定の候補）からプレイヤーの配列を取り出す。
+func (p *JSONProvider) pickArray(root any) ([]any, error) {
+	if p.ArrayPath == "" {
+		arr, ok := pickArray(root)
+		if !ok {
+			return nil, errors.New("poller: unsupported JSON shape (array or object with players/data/items[] expected)")
+		}
+		return arr, nil
+	}
+	m, ok := root.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("poller: array path %q: response is not an object", p.ArrayPath)
+	}
+	v, _ := lookup(m, p.ArrayPath)
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("poller: array path %q: no array found", p.ArrayPath)
+	}
+	return arr, nil
+}
+
+// nextPage は NextPath が指す次ページの URL を返す（無ければ nil）。
+func (p *JSONProvider) nextPage(root any, cur, first *url.URL) (*url.URL, error) {
+	if p.NextPath == "" {
+		return nil, nil
+	}
+	m, ok := root.(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	v, _ := lookup(m, p.NextPath)
+	link, _ := v.(string)
+	if link == "" {
+		return nil, nil
+	}
+	next, err := cur.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("poller: next page %q: %w", link, err)
+	}
+	if next.Scheme != first.Scheme || next.Host != first.Host {
+		return nil, fmt.Errorf("poller: next page %s is not on %s://%s", next.Redacted(), first.Scheme, first.Host)
+	}
+	return next, nil
+}
+
+// 各要素から ID, Name, X, Z を取り出す候補キー（先頭から順に探す）。
+var (
+	idKeys   = []string{"id", "player_id", "steamid", "steamId", "entityId", "player.id"}
+	nameKeys = []string{"name", "playerName", "nick", "player.name"}
+	xKeys    = []string{"x", "xpos", "x_pos", "pos.x", "position.x", "player.pos.x"}
+	zKeys    = []string{"z", "zpos", "z_pos", "pos.z", "position.z", "player.pos.z"}
+)
+
+// parsePlayers は配列の各要素から Player を取り出す。ID か座標の無い要素は飛ばす。
+func parsePlayers(arr []any) []Player {
+	out := make([]Player, 0, len(arr))
+	for _, it := range arr {
+		if pl, skip := parsePlayer(it); skip == "" {
+			out = append(out, pl)
+		}
+	}
+	return out
+}
+
+// parsePlayer は 1 要素から Player を取り出す。取り出せなければ飛ばす理由を返す。
+func parsePlayer(it any) (Player, string) {
+	m, ok := it.(map[string]any)
+	if !ok {
+		return Player{}, "not an object"
+	}
+	id := pickString(m, idKeys...)
+	if id == "" {
+		return Player{}, "missing id (tried " + strings.Join(idKeys, ", ") + ")"
+	}
+	name := pickString(m, nameKeys...)
+	x, xok := pickFloat(m, xKeys...)
+	z, zok := pickFloat(m, zKeys...)
+	switch {
+	case !xok && !zok:
+		return Player{}, "missing x and z (tried " + strings.Join(xKeys, ", ") + " / " + strings.Join(zKeys, ", ") + ")"
+	case !xok:
+		return Player{}, "missing x (tried " + strings.Join(xKeys, ", ") + ")"
+	case !zok:
+		return Player{}, "missing z (tried " + strings.Join(zKeys, ", ") + ")"
+	}
+	return Player{ID: id, Name: name, X: x, Z: z}, ""
 }
 
 func pickArray(v any) ([]any, bool) {
-    switch t := v.(type) {
-    case []any:
-        return t, true
-    case map[string]any:
-        for _, k := range []string{"players", "data", "items", "list"} {
-            if a, ok := t[k].([]any); ok {
-                return a, true
-            }
-        }
-    }
-    return nil, false
+	switch t := v.(type) {
+	case []any:
+		return t, true
+	case map[string]any:
+		for _, k := range []string{"players", "data", "items", "list"} {
+			if a, ok := t[k].([]any); ok {
+				return a, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// lookup は key で m を辿る。key は "player.pos.x" のようなドット区切りで入れ子のオブジェクトを降りられる。
+// 各階層で完全一致を優先し、無ければ大文字小文字を無視して探す。
+func lookup(m map[string]any, key string) (any, bool) {
+	var cur any = m
+	for part := range strings.SplitSeq(key, ".") {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		v, ok := obj[part]
+		if !ok {
+			for k2, v2 := range obj {
+				if strings.EqualFold(part, k2) {
+					v, ok = v2, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+		cur = v
+	}
+	return cur, true
 }
 
 func pickString(m map[string]any, keys ...string) string {
-    for _, k := range keys {
-        if v, ok := m[k]; ok {
-            switch s := v.(type) {
-            case string:
-                return s
-            }
-        }
-        for k2, v := range m {
-            if strings.EqualFold(k, k2) {
-                if s, ok := v.(string); ok { return s }
-            }
-        }
-    }
-    return ""
+	for _, k := range keys {
+		if v, ok := lookup(m, k); ok {
+			if s, ok := v.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
 }
 
 func pickFloat(m map[string]any, keys ...string) (float64, bool) {
-    for _, k := range keys {
-        if v, ok := m[k]; ok {
-            switch n := v.(type) {
-            case float64:
-                return n, true
-            case json.Number:
-                f, err := n.Float64(); if err == nil { return f, true }
-            case int:
-                return float64(n), true
-            case int64:
-                return float64(n), true
-            }
-        }
-        for k2, v := range m {
-            if strings.EqualFold(k, k2) {
-                switch n := v.(type) {
-                case float64: return n, true
-                case json.Number: f, err := n.Float64(); if err == nil { return f, true }
-                case int:     return float64(n), true
-                case int64:   return float64(n), true
-                }
-            }
-        }
-    }
-    return 0, false
-}
-
-// Poller は Provider を一定間隔で呼び出し、差分を SSE へ配信します。
+	for _, k := range keys {
+		v, ok := lookup(m, k)
+		if !ok {
+			continue
+		}
+		switch n := v.(type) {
+		case float64:
+			return n, true
+		case json.Number:
+			f, err := n.Float64()
+			if err == nil {
+				return f, true
+			}
+		case int:
+			return float64(n), true
+		case int64:
+			return float64(n), true
+		}
+	}
+	return 0, false
+}
+
+// Poller は Provider を一定間隔で呼び出し、差分を Sinks（SSE・ストアなど）へ出力します。
 type Poller struct {
-    Prov         Provider
-    Hub          *sse.Hub
-    Interval     time.Duration // 例: 2s
-    Jitter       time.Duration // 0で無効（未使用: 予約）
-    MovementEPS  float64       // 例: 0.01
+	Prov        Provider
+	Hub         *sse.Hub      // 互換用: 設定すると HubSink{Hub} を Sinks の先頭に加えたのと同じ
+	Sinks       []OutputSink  // 出力先（Hub と合わせて 1 つ以上必要）
+	Logger      *log.Logger   // Sink のエラー出力先（nil なら log.Default()）
+	Interval    time.Duration // 例: 2s
+	Jitter      time.Duration // 0で無効（未使用: 予約）
+	MovementEPS float64       // 例: 0.01
+	// MinInterval は、同じプレイヤーの位置を出力する最短間隔です（0 なら毎 tick）。
+	// 細かく揺れ続けるプレイヤーで位置の書き込みが膨らむのを抑えます。プレイヤーごとに数えます。
+	MinInterval time.Duration
+	// LargeMovement を超える移動（DistanceMetric で測った前回 tick 比の距離）は MinInterval を待たずに出力します（0 なら無効）。
+	LargeMovement float64
+	// DistanceMetric は MovementEPS と LargeMovement の判定に使う距離の測り方です（ゼロ値は AxisMax）。
+	DistanceMetric DistanceMetric
+	// HeartbeatInterval ごとに、動いていない接続中のプレイヤーの位置も出力します（0 なら無効）。
+	// 前回の位置出力から HeartbeatInterval 経ったプレイヤーだけが対象なので、動いているプレイヤーには追加の出力は出ません。
+	// 長時間立ち止まっているプレイヤーを UI がタイムアウトで消さないためのものです。
+	HeartbeatInterval time.Duration
+	// SnapshotInterval ごとに、接続中の全プレイヤーの位置をまとめたスナップショットを SnapshotSink を実装した Sink へ出力します（0 なら無効）。
+	// HubSink は topic: snapshot で配信し、Hub を sse.WithSnapshotTopic(payload.TopicSnapshot) で作っておくと、
+	// 接続直後のクライアントはリプレイで最新の全体を受け取れます。Run 開始後の最初の取得で 1 回出し、以降は前回から SnapshotInterval 経った tick で出します。
+	SnapshotInterval time.Duration
+	// DisconnectGrace は、一覧から消えたプレイヤーを接続中とみなし続ける連続 tick 数です（0 なら即切断）。
+	// 重いサーバーで 1 回だけ一覧から漏れたときに、切断→接続の偽イベントが出るのを防ぎます。
+	DisconnectGrace int
+	// PlayerFilter は取得したプレイヤーのうち残すものを選びます（nil なら全員）。
+	// 落としたプレイヤーは一覧に居ないものとして扱う（接続・切断の判定も含む）。
+	// 例: AI ボット（負のエンティティ ID）や、座標が (0,0) の番兵値になっているオフライン直後の項目を除く。
+	PlayerFilter func(Player) bool
+	// BaseTags は全プレイヤーの位置・イベントに付けるタグです（nil なら付けない）。
+	// 複数サーバーを 1 つのストアへ集約するときに world / src などで出所を区別するためのもの。
+	// player_id など Sink が付けるタグは上書きできません。Run の開始後に変更しないこと。
+	BaseTags map[string]string
+	// Now は現在時刻の取得元です（nil なら time.Now）。テストで時刻を進めて MinInterval などを決定的に検証するためのもの。
+	Now func() time.Time
+
+	mu       sync.Mutex // prev と、Run 開始後の Prov/Interval を保護
+	prev     map[string]Player
+	prevAt   time.Time            // prev を取得した時刻（最後に成功した取得）
+	seeded   bool                 // prev が Seed で読み込んだもので、まだ 1 回も取得していない
+	absent   map[string]int       // DisconnectGrace 中のプレイヤーの連続不在回数（tick からのみ触る）
+	sessions map[string]session   // 接続時刻が分かっているプレイヤーのセッション（tick からのみ触る）
+	lastPos  map[string]time.Time // プレイヤーごとの最後に位置を出力した時刻（tick からのみ触る）
+	lastEmit map[string]Player    // プレイヤーごとの最後に出力した位置（MovementEPS の基準。tick からのみ触る）
+	lastSnap time.Time            // 最後にスナップショットを出力した時刻（tick からのみ触る）
+	reset    chan struct{}        // SetInterval からのタイマ張り直し通知
+
+	// 連続失敗の記録（readiness 判定用）
+	failMu     sync.Mutex
+	failStreak int
+	lastErr    error
+
+	// 監視用のカウンタ（Stats / Collector）
+	lastDuration atomic.Int64 // 直近の取得 1 回にかかった時間（ns）
+	lastSuccess  atomic.Int64 // 直近で取得に成功した時刻（UnixNano、0 なら未成功）
+	online       atomic.Int64
+	polls        atomic.Uint64
+	failures     atomic.Uint64
+	connects     atomic.Uint64
+	disconnects  atomic.Uint64
+	positions    atomic.Uint64
+}
+
+// Stats は Poller の稼働状況のスナップショットです（ポーリングが止まった・データソースが空を返し続けるのを監視する用）。
+type Stats struct {
+	LastPollDuration time.Duration // 直近の取得 1 回（取得と出力）にかかった時間
+	LastSuccess      time.Time     // 直近で取得に成功した時刻（未成功なら zero）
+	Online           int           // 現在接続中とみなしているプレイヤー数（DisconnectGrace 中を含む）
+	Polls            uint64        // 取得した回数（失敗を含む）
+	Failures         uint64        // 取得に失敗した回数
+	FailureStreak    int           // 連続して失敗している回数（成功で 0）
+	Connects         uint64        // 出力した player_connect の件数
+	Disconnects      uint64        // 出力した player_disconnect の件数
+	Positions        uint64        // 出力した位置（pos）の件数（接続時・移動・ハートビート）
+}
+
+// Stats は現在のカウンタを返します。
+func (p *Poller) Stats() Stats {
+	streak, _ := p.FailureStreak()
+	st := Stats{
+		LastPollDuration: time.Duration(p.lastDuration.Load()),
+		Online:           int(p.online.Load()),
+		Polls:            p.polls.Load(),
+		Failures:         p.failures.Load(),
+		FailureStreak:    streak,
+		Connects:         p.connects.Load(),
+		Disconnects:      p.disconnects.Load(),
+		Positions:        p.positions.Load(),
+	}
+	if ns := p.lastSuccess.Load(); ns != 0 {
+		st.LastSuccess = time.Unix(0, ns)
+	}
+	return st
+}
 
-    mu   sync.Mutex
-    prev map[string]Player
+// New は hub へ配信する HubSink と、追加の sinks を出力先にした Poller を返します。
+func New(prov Provider, hub *sse.Hub, sinks ...OutputSink) *Poller {
+	return &Poller{Prov: prov, Sinks: append([]OutputSink{NewHubSink(hub)}, sinks...)}
+}
+
+// FailureStreak は直近で連続して失敗した取得回数と、最後のエラーを返す（成功で 0/nil に戻る）。
+func (p *Poller) FailureStreak() (int, error) {
+	p.failMu.Lock()
+	defer p.failMu.Unlock()
+	return p.failStreak, p.lastErr
+}
+
+// record は1回の取得結果を連続失敗数に反映する。
+func (p *Poller) record(err error) {
+	p.polls.Add(1)
+	if err != nil {
+		p.failures.Add(1)
+	}
+	p.failMu.Lock()
+	defer p.failMu.Unlock()
+	if err == nil {
+		p.failStreak, p.lastErr = 0, nil
+		return
+	}
+	p.failStreak++
+	p.lastErr = err
+}
+
+// Snapshot は最後に取得できたプレイヤー一覧（ID 順）と、その取得時刻を返します。
+// DisconnectGrace 中のプレイヤーも含み、各プレイヤーの LastSeen は最後に一覧で見えた時刻です。
+// まだ一度も取得できていなければ空と zero time です。戻り値は内部状態のコピーです。
+func (p *Poller) Snapshot() ([]Player, time.Time) {
+	p.mu.Lock()
+	out := make([]Player, 0, len(p.prev))
+	for _, pl := range p.prev {
+		out = append(out, pl)
+	}
+	at := p.prevAt
+	p.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, at
+}
+
+// Seed は Run の前に、前回の実行で最後に見えていたプレイヤー（ストアの直近の位置など）を前回状態として読み込みます。
+// at はその状態の時刻で、最初の取得までは Snapshot がこの一覧と at を返します（LastSeen が zero のプレイヤーは at を使う）。
+// 最初の取得でも一覧に居るプレイヤーには player_connect を出し直さず、居ないプレイヤーは player_disconnect を出さずに忘れます
+// （停止中に抜けたのか、読み込んだ時点で既に抜けていたのか区別できないため）。
+// 再起動のたびに全員分の接続イベントが出るのを防ぐためのものです。Run の開始後に呼ばないこと。
+func (p *Poller) Seed(players []Player, at time.Time) {
+	prev := make(map[string]Player, len(players))
+	for _, pl := range players {
+		if pl.LastSeen.IsZero() {
+			pl.LastSeen = at
+		}
+		prev[pl.ID] = pl
+	}
+	p.mu.Lock()
+	p.prev, p.prevAt, p.seeded = prev, at.UTC(), true
+	p.mu.Unlock()
+	p.online.Store(int64(len(prev)))
+}
+
+// SetInterval は実行中でもポーリング間隔を変更します（次の周期から反映。0 以下は無視）。
+func (p *Poller) SetInterval(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.Interval = d
+	reset := p.resetChan()
+	p.mu.Unlock()
+	select {
+	case reset <- struct{}{}:
+	default: // 既に通知済み
+	}
+}
+
+// SetProvider は実行中でもデータソースを差し替えます（次の取得から反映。nil は無視）。
+func (p *Poller) SetProvider(prov Provider) {
+	if prov == nil {
+		return
+	}
+	p.mu.Lock()
+	p.Prov = prov
+	p.mu.Unlock()
+}
+
+// resetChan は p.mu を保持した状態で呼ぶこと。
+func (p *Poller) resetChan() chan struct{} {
+	if p.reset == nil {
+		p.reset = make(chan struct{}, 1)
+	}
+	return p.reset
 }
 
 // Run はコンテキストがキャンセルされるまでループします。
 func (p *Poller) Run(ctx context.Context) error {
-    if p.Prov == nil || p.Hub == nil {
-        return errors.New("poller: missing Provider or Hub")
-    }
-    if p.Interval <= 0 { p.Interval = 2 * time.Second }
-    if p.MovementEPS <= 0 { p.MovementEPS = 0.001 }
-    p.mu.Lock(); if p.prev == nil { p.prev = make(map[string]Player) }; p.mu.Unlock()
-
-    _ = p.tick(ctx)
-    t := time.NewTicker(p.Interval)
-    defer t.Stop()
-    for {
-        select {
-        case <-ctx.Done():
-            return ctx.Err()
-        case <-t.C:
-            _ = p.tick(ctx)
-        }
-    }
+	p.mu.Lock()
+	if p.Prov == nil || (p.Hub == nil && len(p.Sinks) == 0) {
+		p.mu.Unlock()
+		return errors.New("poller: missing Provider or output (Hub/Sinks)")
+	}
+	if p.Interval <= 0 {
+		p.Interval = 2 * time.Second
+	}
+	if p.MovementEPS <= 0 {
+		p.MovementEPS = 0.001
+	}
+	if p.prev == nil {
+		p.prev = make(map[string]Player)
+	}
+	interval, reset := p.Interval, p.resetChan()
+	p.mu.Unlock()
+
+	if err := p.tick(ctx); ctx.Err() == nil {
+		p.record(err)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-reset:
+			p.mu.Lock()
+			interval = p.Interval
+			p.mu.Unlock()
+			t.Reset(interval)
+		case <-t.C:
+			if err := p.tick(ctx); ctx.Err() == nil {
+				p.record(err)
+			}
+		}
+	}
 }
 
 func (p *Poller) tick(ctx context.Context) error {
-    players, err := p.Prov.FetchPlayers(ctx)
-    if err != nil {
-        return err
-    }
-    now := time.Now().UTC()
-    curr := make(map[string]Player, len(players))
-    for _, pl := range players { curr[pl.ID] = pl }
-
-    p.mu.Lock()
-    prev := p.prev
-    p.prev = curr
-    p.mu.Unlock()
-
-    for id, pl := range curr {
-        if old, ok := prev[id]; ok {
-            if moved(old, pl, p.MovementEPS) {
-                payload := fmt.Sprintf(`{"pid":%q,"x":%g,"z":%g,"t":%q,"name":%q}`, pl.ID, pl.X, pl.Z, now.Format(time.RFC3339Nano), pl.Name)
-                p.Hub.Broadcast("pos", []byte(payload))
-            }
-        } else {
-            payload := fmt.Sprintf(`{"kind":"player_connect","pid":%q,"t":%q,"name":%q}`, pl.ID, now.Format(time.RFC3339Nano), pl.Name)
-            p.Hub.Broadcast("events", []byte(payload))
-            payload2 := fmt.Sprintf(`{"pid":%q,"x":%g,"z":%g,"t":%q,"name":%q}`, pl.ID, pl.X, pl.Z, now.Format(time.RFC3339Nano), pl.Name)
-            p.Hub.Broadcast("pos", []byte(payload2))
-        }
-    }
-    for id, old := range prev {
-        if _, ok := curr[id]; !ok {
-            payload := fmt.Sprintf(`{"kind":"player_disconnect","pid":%q,"t":%q,"name":%q}`, old.ID, now.Format(time.RFC3339Nano), old.Name)
-            p.Hub.Broadcast("events", []byte(payload))
-        }
-    }
-    return nil
-}
-
-func moved(a, b Player, eps float64) bool {
-    dx := a.X - b.X; if dx < 0 { dx = -dx }
-    dz := a.Z - b.Z; if dz < 0 { dz = -dz }
-    return dx > eps || dz > eps
+	start := time.Now()
+	defer func() { p.lastDuration.Store(int64(time.Since(start))) }()
+	p.mu.Lock()
+	prov := p.Prov
+	p.mu.Unlock()
+	players, err := prov.FetchPlayers(ctx)
+	if err != nil {
+		return err
+	}
+	now := p.now().UTC()
+	p.lastSuccess.Store(now.UnixNano())
+	curr := make(map[string]Player, len(players))
+	for _, pl := range players {
+		if p.PlayerFilter != nil && !p.PlayerFilter(pl) {
+			continue
+		}
+		pl.Tags = p.mergeBaseTags(pl.Tags)
+		pl.LastSeen = now
+		curr[pl.ID] = pl
+	}
+
+	p.mu.Lock()
+	prev, seeded := p.prev, p.seeded
+	p.mu.Unlock()
+
+	// 消えたプレイヤーは DisconnectGrace 回までは最後の位置のまま接続中として持ち越す
+	if p.absent == nil {
+		p.absent = make(map[string]int)
+		p.sessions = make(map[string]session)
+		p.lastPos = make(map[string]time.Time)
+		p.lastEmit = make(map[string]Player)
+	}
+	// 起動直後の 1 回目に居たプレイヤーは接続時刻が分からないので、セッションを記録しない
+	first := p.prevAt.IsZero() || seeded
+	state := make(map[string]Player, len(curr))
+	var gone []Player
+	for id, old := range prev {
+		if _, ok := curr[id]; ok {
+			continue
+		}
+		if seeded {
+			continue // Seed で読み込んだだけのプレイヤーは黙って忘れる
+		}
+		if n := p.absent[id] + 1; n <= p.DisconnectGrace {
+			p.absent[id] = n
+			state[id] = old
+			continue
+		}
+		delete(p.absent, id)
+		gone = append(gone, old)
+	}
+	for id, pl := range curr {
+		delete(p.absent, id)
+		state[id] = pl
+	}
+
+	p.mu.Lock()
+	p.prev, p.prevAt, p.seeded = state, now, false
+	p.mu.Unlock()
+	p.online.Store(int64(len(state)))
+
+	sinks := p.sinks()
+	for id, pl := range curr {
+		if old, ok := prev[id]; ok {
+			if ss, ok := p.sessions[id]; ok {
+				ss.lastSeen = now
+				p.sessions[id] = ss
+			}
+			if p.shouldEmitPosition(old, pl, now) || p.heartbeatDue(id, now) {
+				p.lastPos[id], p.lastEmit[id] = now, pl
+				p.emitPosition(sinks, now, pl)
+			}
+		} else {
+			if !first {
+				p.sessions[id] = session{start: now, lastSeen: now}
+			}
+			p.emitEvent(sinks, PlayerEvent{Kind: storage.EventPlayerConnect, Player: pl, T: now})
+			p.lastPos[id], p.lastEmit[id] = now, pl
+			p.emitPosition(sinks, now, pl)
+		}
+	}
+	for _, old := range gone {
+		delete(p.lastPos, old.ID)
+		delete(p.lastEmit, old.ID)
+		ev := PlayerEvent{Kind: storage.EventPlayerDisconnect, Player: old, T: now}
+		if ss, ok := p.sessions[old.ID]; ok {
+			ev.Duration, ev.HasDuration = ss.lastSeen.Sub(ss.start), true
+			delete(p.sessions, old.ID)
+		}
+		p.emitEvent(sinks, ev)
+	}
+	if p.SnapshotInterval > 0 && (p.lastSnap.IsZero() || now.Sub(p.lastSnap) >= p.SnapshotInterval) {
+		p.lastSnap = now
+		p.emitSnapshot(sinks, now, state)
+	}
+	return nil
+}
+
+// shouldEmitPosition は前回 tick の old から pl へ動いたとき位置を出力するかを返す。
+// 最後に出力した位置から MovementEPS を超えて動き、かつそのプレイヤーの前回出力から MinInterval 以上経っていれば出す。
+// 前回 tick の位置ではなく最後に出力した位置と比べるので、MinInterval 中に動いて止まったプレイヤーも、間隔が過ぎれば止まった位置を出す。
+// 前回 tick から LargeMovement を超える移動は間隔に関係なく出す。
+func (p *Poller) shouldEmitPosition(old, pl Player, now time.Time) bool {
+	base, ok := p.lastEmit[pl.ID]
+	if !ok {
+		base = old // Seed で読み込んだだけでまだ出力していない
+	}
+	if p.DistanceMetric.Distance(base, pl) <= p.MovementEPS {
+		return false
+	}
+	if p.MinInterval <= 0 || now.Sub(p.lastPos[pl.ID]) >= p.MinInterval {
+		return true
+	}
+	return p.LargeMovement > 0 && p.DistanceMetric.Distance(old, pl) > p.LargeMovement
+}
+
+// heartbeatDue はプレイヤー id の前回の位置出力から HeartbeatInterval 以上経っているかを返す。
+func (p *Poller) heartbeatDue(id string, now time.Time) bool {
+	return p.HeartbeatInterval > 0 && now.Sub(p.lastPos[id]) >= p.HeartbeatInterval
+}
+
+// session は 1 プレイヤーの接続中セッション（接続を検出した時刻と、最後に一覧で見えた時刻）。
+type session struct {
+	start, lastSeen time.Time
+}
+
+// mergeBaseTags は BaseTags に tags を重ねたタグを返します（BaseTags が無ければ tags のまま）。
+func (p *Poller) mergeBaseTags(tags map[string]string) map[string]string {
+	if len(p.BaseTags) == 0 {
+		return tags
+	}
+	out := make(map[string]string, len(p.BaseTags)+len(tags))
+	maps.Copy(out, p.BaseTags)
+	maps.Copy(out, tags)
+	return out
+}
+
+func (p *Poller) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+// sinks は Hub（互換用）を含めた出力先の一覧を返す。
+func (p *Poller) sinks() []OutputSink {
+	if p.Hub == nil {
+		return p.Sinks
+	}
+	return append([]OutputSink{NewHubSink(p.Hub)}, p.Sinks...)
+}
+
+func (p *Poller) emitPosition(sinks []OutputSink, t time.Time, pl Player) {
+	p.positions.Add(1)
+	for _, s := range sinks {
+		if err := s.Position(t, pl); err != nil {
+			p.logf("poller: sink %T position %s: %v", s, pl.ID, err)
+		}
+	}
 }
 
+func (p *Poller) emitEvent(sinks []OutputSink, ev PlayerEvent) {
+	switch ev.Kind {
+	case storage.EventPlayerConnect:
+		p.connects.Add(1)
+	case storage.EventPlayerDisconnect:
+		p.disconnects.Add(1)
+	}
+	for _, s := range sinks {
+		if err := s.Event(ev); err != nil {
+			p.logf("poller: sink %T event %s %s: %v", s, ev.Kind, ev.Player.ID, err)
+		}
+	}
+}
+
+// emitSnapshot は state（DisconnectGrace 中を含む接続中のプレイヤー）を ID 順にして SnapshotSink へ渡す。
+func (p *Poller) emitSnapshot(sinks []OutputSink, t time.Time, state map[string]Player) {
+	players := make([]Player, 0, len(state))
+	for _, id := range slices.Sorted(maps.Keys(state)) {
+		players = append(players, state[id])
+	}
+	for _, s := range sinks {
+		ss, ok := s.(SnapshotSink)
+		if !ok {
+			continue
+		}
+		if err := ss.Snapshot(t, players); err != nil {
+			p.logf("poller: sink %T snapshot: %v", s, err)
+		}
+	}
+}
+
+func (p *Poller) logf(format string, args ...any) {
+	l := p.Logger
+	if l == nil {
+		l = log.Default()
+	}
+	l.Printf(format, args...)
+}
+
+// DistanceMetric は前回 tick からの移動量の測り方です。
+type DistanceMetric int
+
+const (
+	// AxisMax は X と Z の差の大きい方を距離とします（既定）。斜めの移動は同じ直線距離でも
+	// 軸に沿った移動より小さく数えられるので、斜めの細かい揺れは出力されにくくなります。
+	AxisMax DistanceMetric = iota
+	// Euclidean は XZ 平面上の直線距離を距離とします。移動の向きによらず閾値が一定になります。
+	Euclidean
+)
+
+// ParseDistanceMetric は "axis" / "euclidean" を DistanceMetric に変換します（"" は AxisMax）。
+func ParseDistanceMetric(s string) (DistanceMetric, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "axis":
+		return AxisMax, nil
+	case "euclidean":
+		return Euclidean, nil
+	}
+	return AxisMax, fmt.Errorf("poller: unknown distance metric %q (want axis or euclidean)", s)
+}
+
+// String は ParseDistanceMetric が受け付ける名前を返します。
+func (m DistanceMetric) String() string {
+	if m == Euclidean {
+		return "euclidean"
+	}
+	return "axis"
+}
+
+// Distance は a から b への移動量を m で測って返します。
+func (m DistanceMetric) Distance(a, b Player) float64 {
+	dx, dz := math.Abs(a.X-b.X), math.Abs(a.Z-b.Z)
+	if m == Euclidean {
+		return math.Hypot(dx, dz)
+	}
+	return max(dx, dz)
+}
@@ -0,0 +1,790 @@
+package poller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/masahide/7dtd-stats/pkg/payload"
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+type fakeProvider struct {
+	errs []error // 呼び出しごとに返すエラー（尽きたら nil）
+}
+
+func (f *fakeProvider) FetchPlayers(context.Context) ([]Player, error) {
+	if len(f.errs) == 0 {
+		return nil, nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return nil, err
+}
+
+func TestFailureStreak(t *testing.T) {
+	boom := errors.New("boom")
+	p := &Poller{Prov: &fakeProvider{errs: []error{boom, boom, nil, boom}}}
+	ctx := context.Background()
+
+	want := []int{1, 2, 0, 1}
+	for i, w := range want {
+		p.record(p.tick(ctx))
+		n, err := p.FailureStreak()
+		if n != w {
+			t.Fatalf("tick %d: streak want %d, got %d", i, w, n)
+		}
+		if (n > 0) != (err != nil) {
+			t.Fatalf("tick %d: lastErr %v inconsistent with streak %d", i, err, n)
+		}
+	}
+}
+
+type countingProvider struct{ calls chan struct{} }
+
+func (c *countingProvider) FetchPlayers(context.Context) ([]Player, error) {
+	c.calls <- struct{}{}
+	return nil, nil
+}
+
+func TestSetIntervalWhileRunning(t *testing.T) {
+	prov := &countingProvider{calls: make(chan struct{}, 16)}
+	p := &Poller{Prov: prov, Hub: sse.NewHub(), Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = p.Run(ctx) }()
+
+	<-prov.calls // 起動直後の1回
+	p.SetInterval(10 * time.Millisecond)
+	select {
+	case <-prov.calls:
+	case <-time.After(2 * time.Second):
+		t.Fatal("interval change was not applied to the running loop")
+	}
+
+	next := &countingProvider{calls: make(chan struct{}, 16)}
+	p.SetProvider(next)
+	select {
+	case <-next.calls:
+	case <-time.After(2 * time.Second):
+		t.Fatal("provider swap was not applied")
+	}
+}
+
+func TestSnapshotCopiesLatestPlayers(t *testing.T) {
+	hub := sse.NewHub()
+	go hub.Run()
+	t.Cleanup(hub.Close)
+
+	prov := NewStaticProvider(Player{ID: "b", Name: "bob", X: 1, Z: 2}, Player{ID: "a", Name: "alice", X: 3, Z: 4})
+	p := &Poller{Prov: prov, Hub: hub}
+	if got, at := p.Snapshot(); len(got) != 0 || !at.IsZero() {
+		t.Fatalf("before first tick: %v %v", got, at)
+	}
+	if err := p.tick(context.Background()); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	got, at := p.Snapshot()
+	if len(got) != 2 || got[0].ID != "a" || got[1].Name != "bob" || at.IsZero() {
+		t.Fatalf("unexpected snapshot: %+v at %v", got, at)
+	}
+	got[0].X = 999
+	if again, _ := p.Snapshot(); again[0].X != 3 {
+		t.Fatalf("snapshot must be a copy")
+	}
+}
+
+func TestJSONProviderNestedFields(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"players":[
+			{"player":{"id":"P:1","name":"alice","pos":{"x":1.5,"z":-2}}},
+			{"ID":"P:2","Player":{"Pos":{"X":3,"Z":4}}},
+			{"id":"P:3","x":5,"z":6},
+			{"id":"P:4","pos":{"x":7}}
+		]}`)
+	}))
+	defer srv.Close()
+
+	got, err := (&JSONProvider{URL: srv.URL}).FetchPlayers(context.Background())
+	if err != nil {
+		t.Fatalf("FetchPlayers: %v", err)
+	}
+	want := []Player{
+		{ID: "P:1", Name: "alice", X: 1.5, Z: -2},
+		{ID: "P:2", X: 3, Z: 4}, // 各階層で大文字小文字を無視
+		{ID: "P:3", X: 5, Z: 6},
+		// P:4 は z が無いので除外
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestJSONProviderArrayPathAndNextPage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprint(w, `{"result":{"players":[{"id":"P:1","x":1,"z":2}]},"page":1,"total":2,"links":{"next":"?page=2"}}`)
+		case "2":
+			// 最初のページへ戻るリンクは終わりとして扱う
+			fmt.Fprint(w, `{"result":{"players":[{"id":"P:2","x":3,"z":4}]},"page":2,"total":2,"links":{"next":"/"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	prov := &JSONProvider{URL: srv.URL + "/", ArrayPath: "result.players", NextPath: "links.next"}
+	got, err := prov.FetchPlayers(context.Background())
+	if err != nil {
+		t.Fatalf("FetchPlayers: %v", err)
+	}
+	want := []Player{{ID: "P:1", X: 1, Z: 2}, {ID: "P:2", X: 3, Z: 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// 上限を超えるページは一部だけ返さずエラー
+	prov.MaxPages = 1
+	if _, err := prov.FetchPlayers(context.Background()); err == nil || !strings.Contains(err.Error(), "more than 1 pages") {
+		t.Fatalf("want page limit error, got %v", err)
+	}
+
+	// NextPath 無しなら最初のページだけ。既定の候補では入れ子の配列は見つからない
+	prov = &JSONProvider{URL: srv.URL + "/", ArrayPath: "result.players"}
+	if got, err := prov.FetchPlayers(context.Background()); err != nil || len(got) != 1 {
+		t.Fatalf("single page = %+v, %v", got, err)
+	}
+	prov.ArrayPath = ""
+	if _, err := prov.FetchPlayers(context.Background()); err == nil {
+		t.Fatalf("want unsupported shape error without ArrayPath")
+	}
+	prov.ArrayPath = "result.total"
+	if _, err := prov.FetchPlayers(context.Background()); err == nil || !strings.Contains(err.Error(), "result.total") {
+		t.Fatalf("want array path error, got %v", err)
+	}
+}
+
+func TestJSONProviderRejectsNextPageOnOtherHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"players":[{"id":"P:1","x":1,"z":2}],"next":"http://evil.example/steal"}`)
+	}))
+	defer srv.Close()
+
+	prov := &JSONProvider{URL: srv.URL, NextPath: "next", Header: map[string]string{"Authorization": "Bearer t"}}
+	if _, err := prov.FetchPlayers(context.Background()); err == nil || !strings.Contains(err.Error(), "evil.example") {
+		t.Fatalf("want cross-host next page error, got %v", err)
+	}
+}
+
+func TestJSONProviderDebugFetchReportsSkippedItems(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"players":[{"id":"P:1","name":"alice","pos":{"x":1,"z":2}},{"name":"bob","x":3,"z":4},{"id":"P:3","x":5},"oops"]}`)
+	}))
+	defer srv.Close()
+
+	prov := &JSONProvider{URL: srv.URL}
+	r, err := prov.DebugFetch(context.Background())
+	if err != nil {
+		t.Fatalf("DebugFetch: %v", err)
+	}
+	if want := []Player{{ID: "P:1", Name: "alice", X: 1, Z: 2}}; !reflect.DeepEqual(r.Players, want) {
+		t.Fatalf("players = %+v, want %+v", r.Players, want)
+	}
+	if len(r.Pages) != 1 || r.Pages[0].Items != 4 || !strings.HasPrefix(r.Pages[0].Shape, `{"players": [4 × {"id": string, "name": string, "pos": {"x": number, "z": number}}]`) {
+		t.Fatalf("pages = %+v", r.Pages)
+	}
+	var reasons []string
+	for _, s := range r.Skipped {
+		reasons = append(reasons, fmt.Sprintf("%d:%s", s.Index, s.Reason))
+	}
+	if len(reasons) != 3 || !strings.HasPrefix(reasons[0], "1:missing id (tried id,") ||
+		!strings.HasPrefix(reasons[1], "2:missing z (tried z,") || reasons[2] != "3:not an object" {
+		t.Fatalf("skipped = %q", reasons)
+	}
+	// 抽出結果は FetchPlayers と同じ
+	if got, _ := prov.FetchPlayers(context.Background()); !reflect.DeepEqual(got, r.Players) {
+		t.Fatalf("FetchPlayers = %+v, DebugFetch = %+v", got, r.Players)
+	}
+}
+
+func TestLookupDottedPath(t *testing.T) {
+	m := map[string]any{"a": map[string]any{"B": map[string]any{"c": 1.0}}, "s": "x"}
+	if v, ok := lookup(m, "a.b.c"); !ok || v != 1.0 {
+		t.Fatalf("lookup a.b.c = %v, %v", v, ok)
+	}
+	for _, k := range []string{"a.b.d", "s.x", "a.b.c.d", "missing"} {
+		if _, ok := lookup(m, k); ok {
+			t.Fatalf("lookup %q should fail", k)
+		}
+	}
+}
+
+type recordingSink struct {
+	positions []Player
+	events    []PlayerEvent
+}
+
+func (r *recordingSink) Position(_ time.Time, pl Player) error {
+	r.positions = append(r.positions, pl)
+	return nil
+}
+
+func (r *recordingSink) Event(ev PlayerEvent) error {
+	r.events = append(r.events, ev)
+	return nil
+}
+
+type failingSink struct{}
+
+func (failingSink) Position(time.Time, Player) error { return errors.New("down") }
+func (failingSink) Event(PlayerEvent) error          { return errors.New("down") }
+
+func TestTickFansOutToSinks(t *testing.T) {
+	store := storage.NewTSStore(t.TempDir())
+	rec := &recordingSink{}
+	prov := NewStaticProvider(Player{ID: "P:1", Name: "alice", X: 1, Z: 2})
+	p := &Poller{Prov: prov, Sinks: []OutputSink{failingSink{}, rec, NewStoreSink(store)}, Logger: log.New(io.Discard, "", 0)}
+	ctx := context.Background()
+
+	if err := p.tick(ctx); err != nil { // connect + 初期位置
+		t.Fatalf("tick: %v", err)
+	}
+	prov.Set(Player{ID: "P:1", Name: "alice", X: 5, Z: 2})
+	if err := p.tick(ctx); err != nil { // 移動
+		t.Fatalf("tick: %v", err)
+	}
+	prov.Set()
+	if err := p.tick(ctx); err != nil { // disconnect
+		t.Fatalf("tick: %v", err)
+	}
+
+	if len(rec.positions) != 2 || rec.positions[1].X != 5 {
+		t.Fatalf("positions = %+v", rec.positions)
+	}
+	if len(rec.events) != 2 || rec.events[0].Kind != storage.EventPlayerConnect || rec.events[1].Kind != storage.EventPlayerDisconnect {
+		t.Fatalf("events = %+v", rec.events)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	from, to := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	xs, err := store.Query("players.x", from, to, tsfile.Tags{storage.TagPlayerID: "P:1"})
+	if err != nil || len(xs) != 2 {
+		t.Fatalf("players.x = %v, %v; want 2 points", xs, err)
+	}
+	evs, err := store.Query(storage.EventsSeries, from, to, nil)
+	if err != nil || len(evs) != 2 {
+		t.Fatalf("events = %v, %v; want 2 points", evs, err)
+	}
+}
+
+func TestDisconnectGraceSuppressesFlaps(t *testing.T) {
+	rec := &recordingSink{}
+	alice := Player{ID: "P:1", Name: "alice", X: 1, Z: 1}
+	prov := NewStaticProvider()
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, DisconnectGrace: 1}
+	ctx := context.Background()
+
+	steps := []struct {
+		players []Player
+		want    []storage.EventKind // この tick までに出ているイベント
+	}{
+		{[]Player{alice}, []storage.EventKind{storage.EventPlayerConnect}},
+		{nil, []storage.EventKind{storage.EventPlayerConnect}},             // 1 tick の不在は猶予内
+		{[]Player{alice}, []storage.EventKind{storage.EventPlayerConnect}}, // 復帰しても connect は出ない
+		{nil, []storage.EventKind{storage.EventPlayerConnect}},
+		{nil, []storage.EventKind{storage.EventPlayerConnect, storage.EventPlayerDisconnect}}, // 猶予切れ
+		{[]Player{alice}, []storage.EventKind{storage.EventPlayerConnect, storage.EventPlayerDisconnect, storage.EventPlayerConnect}},
+	}
+	for i, st := range steps {
+		prov.Set(st.players...)
+		if err := p.tick(ctx); err != nil {
+			t.Fatalf("tick %d: %v", i, err)
+		}
+		var got []storage.EventKind
+		for _, ev := range rec.events {
+			got = append(got, ev.Kind)
+		}
+		if !reflect.DeepEqual(got, st.want) {
+			t.Fatalf("tick %d: events %v, want %v", i, got, st.want)
+		}
+		if i == 1 {
+			if snap, _ := p.Snapshot(); len(snap) != 1 {
+				t.Fatalf("player in grace should stay in Snapshot, got %+v", snap)
+			}
+		}
+	}
+}
+
+func TestDisconnectGraceKeepsLastSeen(t *testing.T) {
+	prov := NewStaticProvider(Player{ID: "P:1"}, Player{ID: "P:2"})
+	t0 := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	p := &Poller{Prov: prov, Sinks: []OutputSink{&recordingSink{}}, DisconnectGrace: 1,
+		Now: func() time.Time { return now }}
+	ctx := context.Background()
+	if err := p.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now = t0.Add(2 * time.Second)
+	prov.Set(Player{ID: "P:2"}) // P:1 は猶予中
+	if err := p.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	snap, at := p.Snapshot()
+	if len(snap) != 2 || !at.Equal(now) {
+		t.Fatalf("Snapshot = %+v at %s", snap, at)
+	}
+	if !snap[0].LastSeen.Equal(t0) || !snap[1].LastSeen.Equal(now) {
+		t.Fatalf("LastSeen = %s, %s; want %s, %s", snap[0].LastSeen, snap[1].LastSeen, t0, now)
+	}
+}
+
+func TestSeedAvoidsConnectStorm(t *testing.T) {
+	rec := &recordingSink{}
+	alice := Player{ID: "P:1", Name: "alice", X: 1, Z: 1}
+	carol := Player{ID: "P:3", Name: "carol", X: 9, Z: 9}
+	prov := NewStaticProvider(alice, carol)
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}}
+	at := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	p.Seed([]Player{{ID: "P:1", X: 1, Z: 1}, {ID: "P:2", X: 5, Z: 5}}, at)
+
+	// 最初の取得までは Seed した一覧を返す
+	if snap, got := p.Snapshot(); len(snap) != 2 || !got.Equal(at) {
+		t.Fatalf("seeded Snapshot = %+v at %s", snap, got)
+	}
+	ctx := context.Background()
+	if err := p.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// alice は接続し直さず、居なくなった P:2 は切断を出さずに忘れ、新顔の carol だけ接続
+	if len(rec.events) != 1 || rec.events[0].Kind != storage.EventPlayerConnect || rec.events[0].Player.ID != "P:3" {
+		t.Fatalf("events after seeded tick = %+v", rec.events)
+	}
+	if snap, _ := p.Snapshot(); len(snap) != 2 || snap[0].Name != "alice" {
+		t.Fatalf("Snapshot after tick = %+v", snap)
+	}
+
+	// Seed 後に居続けた alice の切断は通常どおり（接続時刻は分からないのでセッション長なし）
+	prov.Set(carol)
+	if err := p.tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.events) != 2 || rec.events[1].Kind != storage.EventPlayerDisconnect || rec.events[1].Player.ID != "P:1" || rec.events[1].HasDuration {
+		t.Fatalf("events = %+v", rec.events)
+	}
+}
+
+func TestSessionDurationOnDisconnect(t *testing.T) {
+	store := storage.NewTSStore(t.TempDir())
+	rec := &recordingSink{}
+	prov := NewStaticProvider(Player{ID: "P:old", Name: "bob"})
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec, NewStoreSink(store)}, Now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	// 1 回目: 起動時から居た bob は接続時刻が分からない
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	prov.Set(Player{ID: "P:old", Name: "bob"}, Player{ID: "P:new", Name: "alice"})
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	now = now.Add(20 * time.Second)
+	if err := p.tick(ctx); err != nil { // alice を再確認（lastSeen 更新）
+		t.Fatalf("tick: %v", err)
+	}
+	prov.Set()
+	now = now.Add(5 * time.Second)
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+
+	durs := map[string]PlayerEvent{}
+	for _, ev := range rec.events {
+		if ev.Kind == storage.EventPlayerDisconnect {
+			durs[ev.Player.ID] = ev
+		}
+	}
+	if ev := durs["P:old"]; ev.HasDuration {
+		t.Fatalf("P:old: duration must be unknown after restart, got %v", ev.Duration)
+	}
+	// 最後に一覧で見えた時刻までなので、切断を検出した tick の 5s は含まない
+	if ev := durs["P:new"]; !ev.HasDuration || ev.Duration != 20*time.Second {
+		t.Fatalf("P:new: want duration 20s, got %+v", ev)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	pts, err := store.Query(storage.SessionsSeries, now.Add(-time.Minute), now.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(pts) != 1 || pts[0].Tags[storage.TagPlayerID] != "P:new" || pts[0].V != 20 {
+		t.Fatalf("sessions = %+v, want one point for P:new", pts)
+	}
+}
+
+func TestJSONProviderSendsCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, pw, ok := r.BasicAuth()
+		if !ok || u != "stats" || pw != "s3cret" || r.Header.Get("X-Api-Key") != "k" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[{"id":"P:1","x":1,"z":2}]`)
+	}))
+	defer srv.Close()
+
+	prov := &JSONProvider{URL: srv.URL, Username: "stats", Password: "s3cret", Header: map[string]string{"X-Api-Key": "k"}}
+	got, err := prov.FetchPlayers(context.Background())
+	if err != nil || len(got) != 1 {
+		t.Fatalf("FetchPlayers = %v, %v", got, err)
+	}
+
+	prov.Password = "wrong"
+	_, err = prov.FetchPlayers(context.Background())
+	if err == nil || strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("want 401 error without credentials, got %v", err)
+	}
+}
+
+func TestPlayerFilterTreatsDroppedAsAbsent(t *testing.T) {
+	rec := &recordingSink{}
+	prov := NewStaticProvider(
+		Player{ID: "P:1", X: 10, Z: 20},
+		Player{ID: "-171", X: 5, Z: 5}, // ボット
+	)
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, PlayerFilter: func(pl Player) bool {
+		return !strings.HasPrefix(pl.ID, "-") && (pl.X != 0 || pl.Z != 0)
+	}}
+	ctx := context.Background()
+
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	if snap, _ := p.Snapshot(); len(snap) != 1 || snap[0].ID != "P:1" {
+		t.Fatalf("snapshot = %+v, want only P:1", snap)
+	}
+	// 座標が番兵値になったら居ないものとして切断扱い
+	prov.Set(Player{ID: "P:1"}, Player{ID: "-171", X: 6, Z: 6})
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	var kinds []storage.EventKind
+	for _, ev := range rec.events {
+		if ev.Player.ID != "P:1" {
+			t.Fatalf("filtered player produced event %+v", ev)
+		}
+		kinds = append(kinds, ev.Kind)
+	}
+	if !reflect.DeepEqual(kinds, []storage.EventKind{storage.EventPlayerConnect, storage.EventPlayerDisconnect}) {
+		t.Fatalf("events = %v", kinds)
+	}
+}
+
+func TestMinIntervalThrottlesPerPlayer(t *testing.T) {
+	rec := &recordingSink{}
+	prov := NewStaticProvider()
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, MovementEPS: 0.01, MinInterval: time.Hour, LargeMovement: 100}
+	ctx := context.Background()
+
+	ticks := [][]Player{
+		{{ID: "a", X: 0}, {ID: "b", X: 0}},   // 接続時の位置は出す
+		{{ID: "a", X: 1}, {ID: "b", X: 0}},   // a は小さく動いたが MinInterval 内
+		{{ID: "a", X: 2}, {ID: "b", X: 500}}, // b は大きく動いたので出す
+	}
+	for i, players := range ticks {
+		prov.Set(players...)
+		if err := p.tick(ctx); err != nil {
+			t.Fatalf("tick %d: %v", i, err)
+		}
+	}
+	var got []string
+	for _, pl := range rec.positions {
+		got = append(got, fmt.Sprintf("%s@%g", pl.ID, pl.X))
+	}
+	sort.Strings(got)
+	want := []string{"a@0", "b@0", "b@500"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("positions = %v, want %v", got, want)
+	}
+}
+
+func TestMinIntervalEmitsPositionAfterStop(t *testing.T) {
+	// MinInterval 内に動いて止まったプレイヤーも、間隔が過ぎたら止まった位置を出す
+	rec := &recordingSink{}
+	prov := NewStaticProvider()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, MovementEPS: 0.01, MinInterval: 10 * time.Second,
+		Now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	for i, x := range []float64{0, 1, 2, 2} { // 接続、移動、移動、停止（いずれも MinInterval 内）
+		prov.Set(Player{ID: "a", X: x})
+		if err := p.tick(ctx); err != nil {
+			t.Fatalf("tick %d: %v", i, err)
+		}
+		now = now.Add(time.Second)
+	}
+	now = now.Add(10 * time.Second)
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	var got []float64
+	for _, pl := range rec.positions {
+		got = append(got, pl.X)
+	}
+	if want := []float64{0, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("positions = %v, want %v", got, want)
+	}
+}
+
+func TestDistanceMetricDiagonalMove(t *testing.T) {
+	// 斜めに (0.8, 0.8) 動く: 各軸では eps=1 を超えないが、直線距離（約 1.13）は超える
+	for _, tt := range []struct {
+		metric DistanceMetric
+		want   int
+	}{
+		{AxisMax, 1},
+		{Euclidean, 2},
+	} {
+		t.Run(tt.metric.String(), func(t *testing.T) {
+			rec := &recordingSink{}
+			prov := NewStaticProvider(Player{ID: "a"})
+			p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, MovementEPS: 1, DistanceMetric: tt.metric}
+			ctx := context.Background()
+			if err := p.tick(ctx); err != nil {
+				t.Fatalf("tick: %v", err)
+			}
+			prov.Set(Player{ID: "a", X: 0.8, Z: 0.8})
+			if err := p.tick(ctx); err != nil {
+				t.Fatalf("tick: %v", err)
+			}
+			if n := len(rec.positions); n != tt.want {
+				t.Fatalf("positions = %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistanceMetricLargeMovement(t *testing.T) {
+	// LargeMovement も同じ測り方で判定する: (80, 80) は各軸 100 以下だが直線距離は 100 を超える
+	rec := &recordingSink{}
+	prov := NewStaticProvider(Player{ID: "a"})
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, MovementEPS: 0.01, MinInterval: time.Hour,
+		LargeMovement: 100, DistanceMetric: Euclidean}
+	ctx := context.Background()
+	for _, pl := range []Player{{ID: "a"}, {ID: "a", X: 80, Z: 80}} {
+		prov.Set(pl)
+		if err := p.tick(ctx); err != nil {
+			t.Fatalf("tick: %v", err)
+		}
+	}
+	if n := len(rec.positions); n != 2 {
+		t.Fatalf("positions = %d, want 2", n)
+	}
+}
+
+func TestParseDistanceMetric(t *testing.T) {
+	for in, want := range map[string]DistanceMetric{"": AxisMax, "axis": AxisMax, " Euclidean ": Euclidean} {
+		got, err := ParseDistanceMetric(in)
+		if err != nil || got != want {
+			t.Fatalf("ParseDistanceMetric(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseDistanceMetric("manhattan"); err == nil {
+		t.Fatal("unknown metric should fail")
+	}
+}
+
+func TestHeartbeatEmitsStationaryPlayers(t *testing.T) {
+	rec := &recordingSink{}
+	prov := NewStaticProvider(Player{ID: "a", X: 1, Z: 1})
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	p := &Poller{Prov: prov, Sinks: []OutputSink{rec}, MovementEPS: 0.01, HeartbeatInterval: 30 * time.Second,
+		Now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	if err := p.tick(ctx); err != nil { // 接続時の位置
+		t.Fatalf("tick: %v", err)
+	}
+	if err := p.tick(ctx); err != nil { // 動いておらず間隔内なので出さない
+		t.Fatalf("tick: %v", err)
+	}
+	if n := len(rec.positions); n != 1 {
+		t.Fatalf("positions after 2 ticks = %d, want 1", n)
+	}
+	now = now.Add(30 * time.Second)
+	if err := p.tick(ctx); err != nil { // 立ち止まったままでもハートビートで出す
+		t.Fatalf("tick: %v", err)
+	}
+	if err := p.tick(ctx); err != nil { // 直後は出さない
+		t.Fatalf("tick: %v", err)
+	}
+	if n := len(rec.positions); n != 2 {
+		t.Fatalf("positions = %d, want 2 (one heartbeat)", n)
+	}
+}
+
+func TestStatsCountsPollsAndOutputs(t *testing.T) {
+	boom := errors.New("boom")
+	var fail bool
+	prov := NewStaticProvider(Player{ID: "P:1", X: 1}, Player{ID: "P:2"})
+	p := &Poller{Prov: FuncProvider(func(ctx context.Context) ([]Player, error) {
+		if fail {
+			return nil, boom
+		}
+		return prov.FetchPlayers(ctx)
+	}), Sinks: []OutputSink{&recordingSink{}}}
+	ctx := context.Background()
+
+	p.record(p.tick(ctx)) // connect x2 + 初期位置 x2
+	prov.Set(Player{ID: "P:1", X: 5})
+	p.record(p.tick(ctx)) // P:1 移動、P:2 切断
+	fail = true
+	p.record(p.tick(ctx))
+
+	st := p.Stats()
+	if st.Polls != 3 || st.Failures != 1 || st.FailureStreak != 1 || st.Online != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if st.Connects != 2 || st.Disconnects != 1 || st.Positions != 3 || st.LastSuccess.IsZero() {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(p.Collector()); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				name += "/" + lp.GetValue()
+			}
+			got[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	if got["poller_players_online"] != 1 || got["poller_events_emitted_total/position"] != 3 || got["poller_consecutive_failures"] != 1 {
+		t.Fatalf("unexpected metrics: %v", got)
+	}
+}
+
+func TestBaseTagsReachEveryOutput(t *testing.T) {
+	payloads := make(chan string, 8)
+	hub := sse.NewHub(sse.WithEventDecoder(func(b []byte) any { payloads <- string(b); return nil }))
+	go hub.Run()
+	defer hub.Close()
+	store := storage.NewTSStore(t.TempDir())
+	prov := NewStaticProvider(Player{ID: "P:1", Name: "alice", X: 1, Tags: map[string]string{"src": "override"}})
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	p := &Poller{Prov: prov, Hub: hub, Sinks: []OutputSink{NewStoreSink(store)},
+		BaseTags: map[string]string{"world": "Navezgane", "src": "node1"},
+		Now:      func() time.Time { return now }}
+	ctx := context.Background()
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+
+	// SSE: events（connect）と pos の両方に tags が載る
+	for range 2 {
+		select {
+		case b := <-payloads:
+			if !strings.Contains(b, `"tags":{"src":"override","world":"Navezgane"}`) {
+				t.Fatalf("payload without tags: %s", b)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no payload broadcast")
+		}
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	match := tsfile.Tags{storage.TagPlayerID: "P:1", storage.TagWorld: "Navezgane", "src": "override"}
+	from, to := now.Add(-time.Minute), now.Add(time.Minute)
+	if xs, err := store.Query("players.x", from, to, match); err != nil || len(xs) != 1 {
+		t.Fatalf("players.x = %v, %v; want 1 tagged point", xs, err)
+	}
+	if evs, err := store.Query(storage.EventsSeries, from, to, match); err != nil || len(evs) != 1 || evs[0].Tags[storage.TagName] != "alice" {
+		t.Fatalf("events = %v, %v; want 1 tagged point", evs, err)
+	}
+}
+
+func TestSnapshotIntervalReplaysLatestSnapshot(t *testing.T) {
+	hub := sse.NewHub(sse.WithPingInterval(0), sse.WithSnapshotTopic(payload.TopicSnapshot))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	prov := NewStaticProvider(Player{ID: "b", X: 1, Z: 1})
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	p := &Poller{Prov: prov, Hub: hub, SnapshotInterval: 30 * time.Second, Now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	if err := p.tick(ctx); err != nil { // 最初の取得でスナップショット（b のみ）
+		t.Fatalf("tick: %v", err)
+	}
+	prov.Set(Player{ID: "b", X: 1, Z: 1}, Player{ID: "a", X: 2, Z: 3})
+	now = now.Add(10 * time.Second)
+	if err := p.tick(ctx); err != nil { // 間隔内なので出さない
+		t.Fatalf("tick: %v", err)
+	}
+	now = now.Add(20 * time.Second)
+	if err := p.tick(ctx); err != nil {
+		t.Fatalf("tick: %v", err)
+	}
+	if got := hub.TopicStats()[payload.TopicSnapshot].Broadcasts; got != 2 {
+		t.Fatalf("snapshots = %d, want 2", got)
+	}
+	for hub.Stats().Broadcasts < 6 { // connect・pos が 2 人分とスナップショット 2 件
+		time.Sleep(time.Millisecond)
+	}
+
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+	resp, err := http.Get(srv.URL + "?last_event_id=0&topics=snapshot")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	var data string
+	for data == "" {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if d, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+			data = d
+		}
+	}
+	var snap payload.Snapshot
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		t.Fatalf("unmarshal %q: %v", data, err)
+	}
+	if !snap.T.Equal(now) || len(snap.Players) != 2 || snap.Players[0].PID != "a" || snap.Players[1].PID != "b" {
+		t.Fatalf("replayed snapshot = %+v, want the latest with a, b", snap)
+	}
+}
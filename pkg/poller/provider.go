@@ -0,0 +1,39 @@
+package poller
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// FuncProvider は関数をそのまま Provider として使うためのアダプタです（テストや HTTP 以外のデータソース向け）。
+type FuncProvider func(ctx context.Context) ([]Player, error)
+
+func (f FuncProvider) FetchPlayers(ctx context.Context) ([]Player, error) { return f(ctx) }
+
+// StaticProvider は Set で与えた一覧をそのまま返すメモリ上の Provider です。
+// テストで接続・移動・切断の順序を決め打ちで再現するためのもので、Set と FetchPlayers は並行に呼べます。
+type StaticProvider struct {
+	mu      sync.Mutex
+	players []Player
+}
+
+// NewStaticProvider は players を返す StaticProvider を返します。
+func NewStaticProvider(players ...Player) *StaticProvider {
+	s := &StaticProvider{}
+	s.Set(players...)
+	return s
+}
+
+// Set は次回以降の FetchPlayers が返す一覧を差し替えます（引数なしで空）。
+func (s *StaticProvider) Set(players ...Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.players = slices.Clone(players)
+}
+
+func (s *StaticProvider) FetchPlayers(context.Context) ([]Player, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.players), nil
+}
@@ -0,0 +1,118 @@
+package poller
+
+import (
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/payload"
+	"github.com/masahide/7dtd-stats/pkg/sse"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+// PlayerEvent は Poller が検出したプレイヤーのイベント（接続・切断）です。
+type PlayerEvent struct {
+	Kind   storage.EventKind
+	Player Player
+	T      time.Time // UTC
+
+	// 切断イベントのセッション長（接続を検出してから最後に一覧で見えたまで）。
+	// 接続時刻が分からない（Poller 起動時に既に接続していた）場合は HasDuration が false。
+	Duration    time.Duration
+	HasDuration bool
+}
+
+// OutputSink は Poller の出力先です。tick ごとに、移動したプレイヤーの Position と
+// 検出したイベントの Event が呼ばれます（ポーリングのループ内で同期的に呼ぶので、遅い出力先は自前でキューを持つこと）。
+// エラーはログに出すだけで、ほかの Sink への出力や Poller の失敗数には影響しません。
+type OutputSink interface {
+	Position(t time.Time, pl Player) error
+	Event(ev PlayerEvent) error
+}
+
+// SnapshotSink は、Poller.SnapshotInterval ごとのスナップショット（接続中の全プレイヤー、ID 順）も受け取る OutputSink です。
+// 実装していない Sink にはスナップショットを渡しません。
+type SnapshotSink interface {
+	OutputSink
+	Snapshot(t time.Time, players []Player) error
+}
+
+// HubSink は SSE Hub へ配信する Sink です（topic: pos / events / snapshot）。
+// payload は pkg/payload の PosEvent / PlayerEvent / Snapshot で、Player.Tags があれば "tags" に載せます。
+type HubSink struct {
+	Hub *sse.Hub
+}
+
+// NewHubSink は hub へ配信する Sink を返します。
+func NewHubSink(hub *sse.Hub) *HubSink { return &HubSink{Hub: hub} }
+
+func (s *HubSink) Position(t time.Time, pl Player) error {
+	b, err := json.Marshal(payload.NewPosEvent(pl.ID, pl.X, pl.Z, t, pl.Name, pl.Tags))
+	if err != nil {
+		return err
+	}
+	s.Hub.Broadcast(payload.TopicPos, b)
+	return nil
+}
+
+func (s *HubSink) Event(ev PlayerEvent) error {
+	b, err := json.Marshal(wireEvent(ev))
+	if err != nil {
+		return err
+	}
+	s.Hub.Broadcast(payload.TopicEvents, b)
+	return nil
+}
+
+// Snapshot は players を payload.Snapshot にして topic: snapshot で配信します（各プレイヤーの "t" はスナップショットの時刻）。
+func (s *HubSink) Snapshot(t time.Time, players []Player) error {
+	pos := make([]payload.PosEvent, 0, len(players))
+	for _, pl := range players {
+		pos = append(pos, payload.NewPosEvent(pl.ID, pl.X, pl.Z, t, pl.Name, pl.Tags))
+	}
+	b, err := json.Marshal(payload.NewSnapshot(t, pos))
+	if err != nil {
+		return err
+	}
+	s.Hub.Broadcast(payload.TopicSnapshot, b)
+	return nil
+}
+
+// wireEvent は ev を SSE と Webhook で送る payload.PlayerEvent にします。
+func wireEvent(ev PlayerEvent) payload.PlayerEvent {
+	e := payload.NewPlayerEvent(string(ev.Kind), ev.Player.ID, ev.T, ev.Player.Name, ev.Player.Tags)
+	if ev.HasDuration {
+		e = e.WithDuration(ev.Duration)
+	}
+	return e
+}
+
+// StoreSink は TSStore へ書き込む Sink です。
+// 位置は players.x / players.z（タグ player_id）、イベントは events.count（タグ kind/player_id/name）へ書きます。
+// セッション長の分かる切断は、秒数を値として sessions シリーズ（タグ player_id/name）にも書きます。
+// Player.Tags（Poller.BaseTags）はいずれのタグにも足します。
+type StoreSink struct {
+	Store *storage.TSStore
+}
+
+// NewStoreSink は store へ書き込む Sink を返します。
+func NewStoreSink(store *storage.TSStore) *StoreSink { return &StoreSink{Store: store} }
+
+func (s *StoreSink) Position(t time.Time, pl Player) error {
+	tags := make(map[string]string, len(pl.Tags)+1)
+	maps.Copy(tags, pl.Tags)
+	tags[storage.TagPlayerID] = pl.ID
+	return s.Store.AppendVec("players", t, map[string]float64{"x": pl.X, "z": pl.Z}, tags)
+}
+
+// Event は AppendPlayerEvent で書き、セッション長があれば AppendSession でも書きます（pl.Tags は追加のタグ）。
+func (s *StoreSink) Event(ev PlayerEvent) error {
+	pl := ev.Player
+	if err := s.Store.AppendPlayerEvent(ev.T, ev.Kind, pl.ID, pl.Name, "", pl.Tags); err != nil {
+		return err
+	}
+	if !ev.HasDuration {
+		return nil
+	}
+	return s.Store.AppendSession(ev.T, pl.ID, pl.Name, ev.Duration, pl.Tags)
+}
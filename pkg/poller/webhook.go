@@ -0,0 +1,195 @@
+package poller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+// ErrWebhookQueueFull は WebhookSink のキューがいっぱいで、イベントを捨てたことを表します。
+var ErrWebhookQueueFull = errors.New("poller: webhook queue full; event dropped")
+
+// WebhookSink はプレイヤーイベント（SSE の events トピックと同じもの）を、設定した URL へ JSON で POST する Sink です。
+// 送信は専用の goroutine で行い、キューが溢れたら捨てるので、遅い送信先でもポーリングを止めません。
+// 失敗した送信は間隔を倍にしながら再試行し、上限に達したらログに出して捨てます。位置（Position）は送りません。
+//
+// 送信する JSON は SSE の events と同じ payload.PlayerEvent です:
+// {"schema":1,"kind":"player_connect","pid":"...","t":"RFC3339Nano","name":"..."}（セッション長の分かる切断には "duration_seconds" も付く）
+type WebhookSink struct {
+	url     string
+	client  *http.Client
+	kinds   []storage.EventKind // 空なら全種別
+	retries int
+	backoff time.Duration
+	logger  *log.Logger
+
+	queue  chan PlayerEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// WebhookOpt は WebhookSink のオプションです。
+type WebhookOpt func(*WebhookSink)
+
+// WithWebhookKinds は送信するイベント種別を限定します（既定は全種別）。
+func WithWebhookKinds(kinds ...storage.EventKind) WebhookOpt {
+	return func(s *WebhookSink) { s.kinds = kinds }
+}
+
+// WithWebhookQueue は送信待ちキューの長さです（既定 64、0 以下は無視）。
+func WithWebhookQueue(n int) WebhookOpt {
+	return func(s *WebhookSink) {
+		if n > 0 {
+			s.queue = make(chan PlayerEvent, n)
+		}
+	}
+}
+
+// WithWebhookRetry は 1 イベントあたりの再試行回数と、最初の再試行までの待ち時間です（既定 3 回・1s、以降倍々）。
+func WithWebhookRetry(retries int, backoff time.Duration) WebhookOpt {
+	return func(s *WebhookSink) {
+		if retries >= 0 {
+			s.retries = retries
+		}
+		if backoff > 0 {
+			s.backoff = backoff
+		}
+	}
+}
+
+// WithWebhookClient は送信に使う http.Client です（既定は Timeout 10s）。
+func WithWebhookClient(c *http.Client) WebhookOpt {
+	return func(s *WebhookSink) {
+		if c != nil {
+			s.client = c
+		}
+	}
+}
+
+// WithWebhookLogger は送信失敗の出力先です（既定 log.Default()）。
+func WithWebhookLogger(l *log.Logger) WebhookOpt {
+	return func(s *WebhookSink) {
+		if l != nil {
+			s.logger = l
+		}
+	}
+}
+
+// NewWebhookSink は url へ送信する WebhookSink を作り、送信 goroutine を開始します。使い終わったら Close すること。
+func NewWebhookSink(url string, opts ...WebhookOpt) *WebhookSink {
+	s := &WebhookSink{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: 3,
+		backoff: time.Second,
+		logger:  log.Default(),
+		queue:   make(chan PlayerEvent, 64),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+// Position は何もしません（位置は送らない）。
+func (s *WebhookSink) Position(time.Time, Player) error { return nil }
+
+// Event は対象の種別ならキューに積みます（ブロックしない）。キューが満杯なら ErrWebhookQueueFull。
+func (s *WebhookSink) Event(ev PlayerEvent) error {
+	if len(s.kinds) > 0 && !slices.Contains(s.kinds, ev.Kind) {
+		return nil
+	}
+	if s.ctx.Err() != nil {
+		return nil // Close 済み
+	}
+	select {
+	case s.queue <- ev:
+		return nil
+	default:
+		return ErrWebhookQueueFull
+	}
+}
+
+// Close は送信 goroutine を止めます。送信中・再試行待ちのイベントと、キューに残ったイベントは捨てます。
+func (s *WebhookSink) Close() {
+	s.once.Do(func() {
+		s.cancel()
+		s.wg.Wait()
+		if n := len(s.queue); n > 0 {
+			s.logger.Printf("poller: webhook closed with %d queued event(s) dropped", n)
+		}
+	})
+}
+
+func (s *WebhookSink) loop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case ev := <-s.queue:
+			s.deliver(ev)
+		}
+	}
+}
+
+// deliver は ev を送信し、失敗したら backoff を倍にしながら retries 回まで再試行する。
+func (s *WebhookSink) deliver(ev PlayerEvent) {
+	body, err := json.Marshal(wireEvent(ev))
+	if err != nil {
+		s.logger.Printf("poller: webhook marshal: %v", err)
+		return
+	}
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= s.retries {
+			s.logger.Printf("poller: webhook %s %s dropped after %d attempt(s): %v", ev.Kind, ev.Player.ID, attempt+1, err)
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post は 1 回送信する。retry は再試行する価値があるか（通信エラー・429・5xx）。
+func (s *WebhookSink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return s.ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("POST %s: %s", s.url, resp.Status)
+}
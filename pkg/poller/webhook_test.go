@@ -0,0 +1,89 @@
+package poller
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/payload"
+	"github.com/masahide/7dtd-stats/pkg/storage"
+)
+
+func TestWebhookSinkFiltersAndRetries(t *testing.T) {
+	var calls atomic.Int32
+	got := make(chan payload.PlayerEvent, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable) // 2 回失敗してから成功
+			return
+		}
+		var body payload.PlayerEvent
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		got <- body
+	}))
+	defer srv.Close()
+
+	s := NewWebhookSink(srv.URL,
+		WithWebhookKinds(storage.EventPlayerConnect),
+		WithWebhookRetry(3, time.Millisecond),
+		WithWebhookLogger(log.New(io.Discard, "", 0)),
+	)
+	defer s.Close()
+
+	now := time.Now().UTC()
+	if err := s.Event(PlayerEvent{Kind: storage.EventPlayerDisconnect, Player: Player{ID: "P:0"}, T: now}); err != nil {
+		t.Fatalf("Event: %v", err)
+	}
+	if err := s.Event(PlayerEvent{Kind: storage.EventPlayerConnect, Player: Player{ID: "P:1", Name: "alice"}, T: now}); err != nil {
+		t.Fatalf("Event: %v", err)
+	}
+	select {
+	case body := <-got:
+		if body.Schema != payload.SchemaVersion || body.Kind != "player_connect" || body.PID != "P:1" || body.Name != "alice" {
+			t.Fatalf("unexpected body %v", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("calls = %d, want 3 (filtered kind must not be sent)", n)
+	}
+}
+
+func TestWebhookSinkNeverBlocks(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	s := NewWebhookSink(srv.URL, WithWebhookQueue(1), WithWebhookRetry(0, 0), WithWebhookLogger(log.New(io.Discard, "", 0)))
+	defer s.Close()
+
+	ev := PlayerEvent{Kind: storage.EventPlayerConnect, Player: Player{ID: "P:1"}, T: time.Now()}
+	start := time.Now()
+	var full int
+	for i := 0; i < 10; i++ {
+		if err := s.Event(ev); errors.Is(err, ErrWebhookQueueFull) {
+			full++
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Event blocked on a slow endpoint")
+	}
+	if full == 0 {
+		t.Fatal("expected events to be dropped when the queue is full")
+	}
+}
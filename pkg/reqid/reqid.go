@@ -0,0 +1,74 @@
+// Package reqid はリクエスト ID の生成・伝播を扱います。
+// サーバ全体のミドルウェアで ID を決め、context 経由で mapproxy や sse のログに載せる。
+package reqid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultHeader は既定のヘッダ名です。
+const DefaultHeader = "X-Request-ID"
+
+// maxLen を超える、または表示可能 ASCII 以外を含む受信 ID は信用せず振り直す。
+const maxLen = 128
+
+type ctxKey struct{}
+
+// NewContext は id を持つ context を返します。
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext は ctx のリクエスト ID を返します（無ければ ""）。
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// LogSuffix はログの末尾に付ける " req_id=<ID>" を返します（ctx に ID が無ければ ""）。
+// mapproxy や sse のログ行を同じ形でリクエスト ID と突き合わせるためのものです。
+func LogSuffix(ctx context.Context) string {
+	if id := FromContext(ctx); id != "" {
+		return " req_id=" + id
+	}
+	return ""
+}
+
+// New はランダムな ID（16 バイトの hex）を生成します。
+func New() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Middleware は header（空なら DefaultHeader）の値をリクエスト ID として採用し、
+// 無ければ生成して context・リクエストヘッダ（上流への転送用）・レスポンスヘッダに載せます。
+func Middleware(header string, next http.Handler) http.Handler {
+	if header == "" {
+		header = DefaultHeader
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !valid(id) {
+			id = New()
+			r.Header.Set(header, id)
+		}
+		w.Header().Set(header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+func valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
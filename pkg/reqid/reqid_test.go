@@ -0,0 +1,55 @@
+package reqid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var gotCtx, gotHdr string
+	h := Middleware("X-Trace", http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		gotCtx = FromContext(r.Context())
+		gotHdr = r.Header.Get("X-Trace")
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"generated", "", false},
+		{"honored", "abc-123", true},
+		{"too long", strings.Repeat("a", 200), false},
+		{"control chars", "bad\nid", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Trace", tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get("X-Trace")
+			if id == "" || id != gotCtx || id != gotHdr {
+				t.Fatalf("id mismatch: resp=%q ctx=%q req=%q", id, gotCtx, gotHdr)
+			}
+			if (id == tt.incoming) != tt.keep {
+				t.Fatalf("incoming %q kept=%v, want %v", tt.incoming, id == tt.incoming, tt.keep)
+			}
+		})
+	}
+}
+
+func TestLogSuffix(t *testing.T) {
+	if got := LogSuffix(context.Background()); got != "" {
+		t.Fatalf("without ID: %q", got)
+	}
+	if got := LogSuffix(NewContext(context.Background(), "abc")); got != " req_id=abc" {
+		t.Fatalf("with ID: %q", got)
+	}
+}
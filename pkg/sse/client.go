@@ -0,0 +1,198 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetryDelay は Client の再接続までの既定の待ち時間です（サーバが retry: を送ればそちらを使う）。
+const DefaultRetryDelay = 3 * time.Second
+
+// Client は別ノードの /sse/live などを購読する SSE クライアントです（ノード間の連携・再取り込み向け）。
+// 切断されると最後に受け取った ID を Last-Event-ID に載せて自動で再接続します。ゼロ値で使えます。
+type Client struct {
+	// HTTPClient は接続に使うクライアントです（nil なら http.DefaultClient）。
+	// ストリームは長時間続くので http.Client.Timeout は付けないこと。
+	HTTPClient *http.Client
+	// Header は各リクエストに付けるヘッダです（認証など）。
+	Header http.Header
+	// RetryDelay は再接続までの待ち時間です（0 なら DefaultRetryDelay）。
+	RetryDelay time.Duration
+	// Logger は再接続のログ出力先です（nil なら出さない）。
+	Logger *log.Logger
+}
+
+// Subscribe は rawURL に接続し、受け取ったイベントを返すチャネルに流します。
+// topics を指定すると ?topics= に載せ、lastEventID が正ならそれより新しいイベントから受け取ります（Last-Event-ID）。
+// 最初の接続に失敗した場合はエラーを返します。以降の切断・接続失敗では待ってから再接続し、
+// ctx が終わるか、サーバが 204 No Content を返すとチャネルを閉じます。
+func (c *Client) Subscribe(ctx context.Context, rawURL string, topics []string, lastEventID int64) (<-chan Event, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(topics) > 0 {
+		q := u.Query()
+		q.Set("topics", strings.Join(topics, ","))
+		u.RawQuery = q.Encode()
+	}
+	s := &subscription{c: c, url: u.String(), lastID: lastEventID, retry: c.RetryDelay}
+	if s.retry <= 0 {
+		s.retry = DefaultRetryDelay
+	}
+	body, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event)
+	go s.run(ctx, body, ch)
+	return ch, nil
+}
+
+// errNoContent はサーバが 204 で購読の停止を指示したことを表します（再接続しない）。
+var errNoContent = errors.New("sse: server responded 204 No Content")
+
+// subscription は 1 回の Subscribe の状態です（run のゴルーチンだけが触る）。
+type subscription struct {
+	c      *Client
+	url    string
+	lastID int64
+	retry  time.Duration
+}
+
+func (s *subscription) run(ctx context.Context, body io.ReadCloser, ch chan<- Event) {
+	defer close(ch)
+	for {
+		err := s.read(ctx, body, ch)
+		body.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		s.logf("sse client: %s: stream ended (%v); reconnecting in %s (last_event_id=%d)", s.url, err, s.retry, s.lastID)
+		for {
+			t := time.NewTimer(s.retry)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			body, err = s.connect(ctx)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errNoContent) || ctx.Err() != nil {
+				return
+			}
+			s.logf("sse client: %s: reconnect: %v", s.url, err)
+		}
+	}
+}
+
+func (s *subscription) connect(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range s.c.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if s.lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(s.lastID, 10))
+	}
+	hc := s.c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		resp.Body.Close()
+		return nil, errNoContent
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("sse: unexpected status %s", resp.Status)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		resp.Body.Close()
+		return nil, fmt.Errorf("sse: unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	return resp.Body, nil
+}
+
+// read は body を SSE として解析し、空行で区切られたイベントを ch に送ります。
+// data: が複数行なら改行で連結し、コメント行（: で始まる）と data: の無いブロックは捨てます。
+// id: は以降のイベントにも引き継ぎ（再接続時の Last-Event-ID）、retry: は再接続の待ち時間を更新します。
+func (s *subscription) read(ctx context.Context, body io.Reader, ch chan<- Event) error {
+	br := bufio.NewReader(body)
+	var (
+		name string
+		data bytes.Buffer
+		seen bool // data: を 1 行以上受け取った
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			// 空行で終わっていない最後のブロックは破棄する（途中で切れたイベント）
+			return err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			if seen {
+				ev := Event{ID: s.lastID, Name: name, Data: bytes.Clone(bytes.TrimSuffix(data.Bytes(), []byte("\n")))}
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			name, seen = "", false
+			data.Reset()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			name = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			seen = true
+		case "id":
+			// 数値でない ID は Hub の形式ではないので無視する
+			if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+				s.lastID = id
+			}
+		case "retry":
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+				s.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+func (s *subscription) logf(format string, args ...any) {
+	if s.c.Logger != nil {
+		s.c.Logger.Printf(format, args...)
+	}
+}
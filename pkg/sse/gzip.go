@@ -0,0 +1,36 @@
+package sse
+
+import (
+	"compress/gzip"
+	"net/http"
+)
+
+// gzipStream は SSE のストリームを gzip で包む ResponseWriter です（WithSSECompression）。
+// Flush で gzip の同期フラッシュと下位の Flush を行うので、イベント単位で即座に届きます。
+type gzipStream struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	flusher http.Flusher
+}
+
+// newGzipStream は応答ヘッダを gzip 用に整えて w を包みます（ヘッダ送信前に呼ぶこと）。
+func newGzipStream(w http.ResponseWriter, f http.Flusher) *gzipStream {
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	return &gzipStream{ResponseWriter: w, gz: gzip.NewWriter(w), flusher: f}
+}
+
+func (g *gzipStream) Write(b []byte) (int, error) { return g.gz.Write(b) }
+
+func (g *gzipStream) Flush() {
+	_ = g.gz.Flush()
+	g.flusher.Flush()
+}
+
+// Close は gzip のフッターを書きます（切断済みならエラーは無視してよい）。
+func (g *gzipStream) Close() error { return g.gz.Close() }
+
+// Unwrap は http.ResponseController が書き込み期限を元の Writer へ届けるためのもの。
+func (g *gzipStream) Unwrap() http.ResponseWriter { return g.ResponseWriter }
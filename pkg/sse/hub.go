@@ -2,13 +2,20 @@ package sse
 
 import (
 	"bufio"
+	"cmp"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/masahide/7dtd-stats/internal/httpx"
+	"github.com/masahide/7dtd-stats/pkg/reqid"
 )
 
 // Event は1件のSSEイベントです。
@@ -17,14 +24,35 @@ type Event struct {
 	ID   int64  // 連番ID（文字列化して id: に出力）
 	Name string // event: 名（空文字可）
 	Data []byte // data: 本文（改行含む可）
+	// Time は Hub.Broadcast がイベントを受け付けた時刻です（WithReplayMaxAge の判定に使う。ストリームには出力しない）。
+	Time time.Time
+
+	decoded any // WithEventDecoder で Run が 1 回だけ復号した値
 }
 
+// Decoded は WithEventDecoder で復号済みの Data を返します（デコーダ未設定なら nil）。
+// WithEventMatcher の条件から使い、クライアントごとに Data を解析し直さないためのものです。
+func (e Event) Decoded() any { return e.decoded }
+
 // オプション
 type options struct {
 	replaySize   int
 	pingInterval time.Duration
 	clientBuf    int
 	writeTimeout time.Duration
+	logger       *log.Logger
+	decode       func([]byte) any
+	matcher      func(*http.Request) func(Event) bool
+	idleTimeout  time.Duration
+	pingEvent    string
+	compress     bool
+	broadcastBuf int
+	maxTopics    int
+	replayMaxAge time.Duration
+	maxReplay    int
+	maxClientBuf int
+	snapshot     string
+	overflow     OverflowPolicy
 }
 
 // Option は Hub のオプション設定です。
@@ -40,6 +68,31 @@ func WithReplay(n int) Option {
 	}
 }
 
+// WithReplayMaxAge は、リプレイで送るイベントを Broadcast から d 以内のものに限ります（0 で無制限、既定は無制限）。
+// リングの件数（WithReplay）に加えて時刻でも絞るので、静かな時間帯が長いときに、長く切断していたクライアントへ
+// 何時間も前の位置を再送しなくなります。Last-Event-ID より後でも d より古いイベントは送りません。
+func WithReplayMaxAge(d time.Duration) Option { return func(o *options) { o.replayMaxAge = d } }
+
+// WithMaxReplayOnConnect は 1 接続がリプレイで受け取るイベント数の上限を設定します（0 で無制限、既定は無制限）。
+// 超える場合は新しい方から n 件だけを送ります（topics・WithEventMatcher で絞った後の件数）。リング（WithReplay）の大きさとは独立で、
+// last_event_id=0 の接続が満杯のリングを一気に受け取り、遅いクライアントや接続のゴルーチンを詰まらせるのを防ぎます。
+// 全履歴が必要なクライアントはディスクの履歴（cmd/server の /sse/replay）を使ってください。
+func WithMaxReplayOnConnect(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			n = 0
+		}
+		o.maxReplay = n
+	}
+}
+
+// WithSnapshotTopic は、name のイベントを全体の状態のスナップショットとして扱います（空文字で無効、既定は無効）。
+// Hub は最新のスナップショットをリングとは別に 1 件保持し、リプレイではリング上の古いスナップショットを送らず、
+// 最新の 1 件だけを ID 順の位置に入れて送ります。リングから押し出されていても、WithMaxReplayOnConnect で古い側が欠ける場合でも
+// 送るので（上限にはスナップショットも数える）、接続直後のクライアントはまず全体を受け取り、続く差分で追従できます。
+// Last-Event-ID より古い・WithReplayMaxAge より古い・topics や WithEventMatcher で除かれるスナップショットは送りません。
+func WithSnapshotTopic(name string) Option { return func(o *options) { o.snapshot = name } }
+
 // WithPingInterval は :ping コメント送信間隔を設定します。
 func WithPingInterval(d time.Duration) Option { return func(o *options) { o.pingInterval = d } }
 
@@ -53,9 +106,115 @@ func WithClientBuffer(n int) Option {
 	}
 }
 
+// WithMaxClientBuffer は、接続ごとに ?buffer=n で指定できる送信バッファサイズの上限を設定します（既定 1024、1 未満は 1）。
+// 取りこぼしを避けたい記録用のクライアントは大きく、対話的なクライアントは既定（WithClientBuffer）のまま、と 1 つの Hub で
+// 使い分けるためのものです。n は 1〜上限に丸め、数値でなければ WithClientBuffer の値を使います。
+func WithMaxClientBuffer(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.maxClientBuf = n
+	}
+}
+
 // WithWriteTimeout は各書き込みのタイムアウトを設定します（0 で無効）。
 func WithWriteTimeout(d time.Duration) Option { return func(o *options) { o.writeTimeout = d } }
 
+// WithLogger は接続/切断のログ出力先を設定します（nil で無効、既定は無効）。
+// リクエスト ID（pkg/reqid）が context にあれば req_id として載せます。
+func WithLogger(l *log.Logger) Option { return func(o *options) { o.logger = l } }
+
+// WithEventDecoder は、ブロードキャストされた各イベントの Data を Run で 1 回だけ復号する関数を設定します。
+// 結果は Event.Decoded で参照でき、接続数に関係なく復号はイベントごとに 1 回です（リプレイにも保持）。
+func WithEventDecoder(fn func([]byte) any) Option { return func(o *options) { o.decode = fn } }
+
+// WithEventMatcher は、接続ごとの絞り込み条件をリクエスト（クエリなど）から作る関数を設定します。
+// 返した条件が false のイベントはその接続に送りません（nil を返せば絞り込みなし）。topics と併用した場合は両方を満たすものだけ送ります。
+// 条件は Run（リプレイ時は接続のゴルーチン）から呼ばれるため、重い処理は避け、Data の解析には Event.Decoded を使ってください。
+func WithEventMatcher(fn func(r *http.Request) func(Event) bool) Option {
+	return func(o *options) { o.matcher = fn }
+}
+
+// WithSSECompression は、クライアントが Accept-Encoding: gzip を送ってきた接続のストリーム全体を gzip で圧縮します（既定は無効）。
+// イベント・ping ごとに gzip を Flush するので遅延は増えません。小さなイベントが大量に流れる低速回線向けです。
+func WithSSECompression() Option { return func(o *options) { o.compress = true } }
+
+// WithPingAsEvent は ping をコメント（:ping）ではなく event: name のイベントとして送ります（空文字で既定のコメントに戻す）。
+// コメント行を無視するクライアントライブラリでも生存確認できるようにするためのものです。
+// data: は送信時刻 {"t":"RFC3339Nano"} で、id: は付けません（Last-Event-ID には影響しない）。topics の絞り込みは受けません。
+func WithPingAsEvent(name string) Option { return func(o *options) { o.pingEvent = name } }
+
+// WithClientIdleTimeout は、イベントも ping も d の間 1 件も書き込めていない接続を Hub から外して切断します（0 で無効、既定は無効）。
+// 書き込みが詰まったまま OS が検知しない半開きの接続（バックグラウンドで凍結したタブなど）の枠を解放するためのものです。
+// 切断時は書き込み期限を過去に設定して詰まった書き込みを中断させます。ping が無いと静かな接続も切れるので、
+// WithPingInterval は d より短くしてください。
+func WithClientIdleTimeout(d time.Duration) Option { return func(o *options) { o.idleTimeout = d } }
+
+// WithBroadcastBuffer は Broadcast から Run へ渡すキューの容量を設定します（既定 128、1 未満は 1）。
+// キューが満杯のあいだ Broadcast はブロックします（Stats の BroadcastQueue / BroadcastBlocked で飽和具合を見る）。
+func WithBroadcastBuffer(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.broadcastBuf = n
+	}
+}
+
+// OverflowPolicy は Broadcast から Run へのキュー（WithBroadcastBuffer）が満杯のときの振る舞いです。
+type OverflowPolicy int
+
+const (
+	// Block はキューが空くまで Broadcast を待たせます（既定）。イベントは欠けませんが、ファンアウトが詰まると送り手（Poller の tick など）も止まります。
+	Block OverflowPolicy = iota
+	// DropNewest は渡されたイベントを捨てて Broadcast をすぐ返します。キューに入っている古いイベントは配信されます。
+	DropNewest
+	// DropOldest はキューの先頭（最も古い未処理のイベント）を捨てて、渡されたイベントを入れます。
+	// 位置のように新しい値が古い値を置き換えるイベントでは、最新の状態を優先して届けられます。
+	DropOldest
+)
+
+// ParseOverflowPolicy は "block" / "drop_newest" / "drop_oldest" を OverflowPolicy に変換します（"" は Block）。
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "block":
+		return Block, nil
+	case "drop_newest":
+		return DropNewest, nil
+	case "drop_oldest":
+		return DropOldest, nil
+	}
+	return Block, fmt.Errorf("sse: unknown overflow policy %q (want block, drop_newest or drop_oldest)", s)
+}
+
+// String は ParseOverflowPolicy が受け付ける名前を返します。
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop_newest"
+	case DropOldest:
+		return "drop_oldest"
+	}
+	return "block"
+}
+
+// WithBroadcastOverflowPolicy は Broadcast のキューが満杯のときの振る舞いを設定します（既定は Block）。
+// DropNewest / DropOldest で捨てたイベントは採番済みなので、リプレイの ID に欠番ができ、Last-Event-ID で再接続したクライアントにも届きません。
+// 捨てた件数は Stats の BroadcastDroppedNewest / BroadcastDroppedOldest で見られます（Block で待った回数は BroadcastBlocked）。
+func WithBroadcastOverflowPolicy(p OverflowPolicy) Option { return func(o *options) { o.overflow = p } }
+
+// WithMaxTopics は 1 接続の topics に指定できるトピック数の上限を設定します（既定 32、1 未満は 1）。
+// 空・重複を除いたうえで先頭から n 件だけを使い、残りは無視します。
+func WithMaxTopics(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.maxTopics = n
+	}
+}
+
 // Hub はSSEの接続・ブロードキャスト・リプレイを管理します。
 type Hub struct {
 	// 設定
@@ -69,14 +228,30 @@ type Hub struct {
 	ring   []Event // len <= opt.replaySize
 	start  int     // リングの先頭インデックス
 	length int     // 現在の件数
+	snap   Event   // 最新のスナップショット（WithSnapshotTopic。ID 0 なら無し）
 
 	// 接続管理
 	register   chan *client
 	unregister chan *client
 	broadcast  chan Event
+	debugReq   chan chan []ClientInfo // ClientsDebug から Run への問い合わせ
+
+	// 統計（Collector 用）
+	clients    atomic.Int64
+	broadcasts atomic.Uint64
+	dropped    atomic.Uint64
+	blocked    atomic.Uint64 // キュー満杯で Broadcast が待たされた回数
+	dropNewest atomic.Uint64 // キュー満杯で DropNewest が捨てたイベント数
+	dropOldest atomic.Uint64 // キュー満杯で DropOldest が捨てたイベント数
+
+	// トピック（イベント名）ごとの統計（TopicStats 用）
+	topicMu sync.Mutex
+	topics  map[string]*TopicStat
 
 	// ライフサイクル
-	done chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	running   atomic.Bool // Run が呼ばれた（2 回目は panic）
 }
 
 // client は1つの接続を表します。
@@ -86,6 +261,54 @@ type client struct {
 	r       *http.Request
 	ch      chan Event
 	filter  func(Event) bool
+	lastOK  atomic.Int64 // 最後に書き込みに成功した時刻（UnixNano、WithClientIdleTimeout 用）
+
+	// ClientsDebug 用（delivered / dropped は Run からのみ触る）
+	topics             []string
+	matcher            bool
+	connected          time.Time
+	delivered, dropped uint64
+}
+
+// ClientInfo は接続中の 1 クライアントの状態です（ClientsDebug 用）。
+type ClientInfo struct {
+	RemoteAddr string    // リクエストの RemoteAddr
+	RequestID  string    // pkg/reqid のリクエスト ID（無ければ空）
+	Topics     []string  // topics で購読したトピック（空なら全トピック）
+	Matcher    bool      // WithEventMatcher の条件が付いている（topics 以外でも絞られている）
+	Connected  time.Time // 接続した時刻
+	Delivered  uint64    // ライブ配信で送信バッファへ渡した件数（リプレイは含まない）
+	Dropped    uint64    // 送信バッファ溢れで落とした件数
+	Buffered   int       // 送信バッファに溜まっている件数
+	BufferCap  int       // 送信バッファの容量（?buffer= / WithClientBuffer）
+}
+
+// touch は書き込み成功を記録します。
+func (c *client) touch() { c.lastOK.Store(time.Now().UnixNano()) }
+
+// idleSince は最後の書き込み成功からの経過時間です。
+func (c *client) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastOK.Load()))
+}
+
+// abort は詰まっている書き込みを中断させます（書き込み期限を過去にする）。
+func (c *client) abort() {
+	_ = http.NewResponseController(c.w).SetWriteDeadline(time.Unix(1, 0))
+}
+
+// info は c の ClientInfo を返します（Run から呼ぶ）。
+func (c *client) info() ClientInfo {
+	return ClientInfo{
+		RemoteAddr: c.r.RemoteAddr,
+		RequestID:  reqid.FromContext(c.r.Context()),
+		Topics:     slices.Clone(c.topics),
+		Matcher:    c.matcher,
+		Connected:  c.connected,
+		Delivered:  c.delivered,
+		Dropped:    c.dropped,
+		Buffered:   len(c.ch),
+		BufferCap:  cap(c.ch),
+	}
 }
 
 // NewHub を生成します。
@@ -95,6 +318,9 @@ func NewHub(opts ...Option) *Hub {
 		pingInterval: 15 * time.Second,
 		clientBuf:    32,
 		writeTimeout: 0,
+		broadcastBuf: 128,
+		maxTopics:    32,
+		maxClientBuf: 1024,
 	}
 	for _, f := range opts {
 		f(&o)
@@ -103,8 +329,10 @@ func NewHub(opts ...Option) *Hub {
 		opt:        o,
 		register:   make(chan *client),
 		unregister: make(chan *client),
-		broadcast:  make(chan Event, 128),
+		broadcast:  make(chan Event, o.broadcastBuf),
+		debugReq:   make(chan chan []ClientInfo),
 		done:       make(chan struct{}),
+		topics:     make(map[string]*TopicStat),
 	}
 	if o.replaySize > 0 {
 		h.ring = make([]Event, o.replaySize)
@@ -113,9 +341,20 @@ func NewHub(opts ...Option) *Hub {
 }
 
 // Run は Hub のメインループを開始します。別ゴルーチンで実行してください。
+// 1 つの Hub で Run を呼べるのは 1 回だけです（2 回目は panic）。Close 後に配信を再開するには Clone で新しい Hub を作ります。
 func (h *Hub) Run() {
+	if !h.running.CompareAndSwap(false, true) {
+		panic("sse: Hub.Run called more than once")
+	}
 	// 接続集合（Runスレッド専有）
 	conns := make(map[*client]struct{})
+	// 無通信の接続の掃除（無効時は nil チャネルで select から外す）
+	var idleC <-chan time.Time
+	if h.opt.idleTimeout > 0 {
+		t := time.NewTicker(max(h.opt.idleTimeout/2, time.Millisecond))
+		defer t.Stop()
+		idleC = t.C
+	}
 	for {
 		select {
 		case <-h.done:
@@ -123,58 +362,261 @@ func (h *Hub) Run() {
 			for c := range conns {
 				close(c.ch)
 			}
+			h.clients.Store(0)
 			return
 		case c := <-h.register:
 			conns[c] = struct{}{}
+			h.clients.Store(int64(len(conns)))
 		case c := <-h.unregister:
 			if _, ok := conns[c]; ok {
 				delete(conns, c)
 				close(c.ch)
+				h.clients.Store(int64(len(conns)))
+			}
+		case reply := <-h.debugReq:
+			infos := make([]ClientInfo, 0, len(conns))
+			for c := range conns {
+				infos = append(infos, c.info())
+			}
+			reply <- infos
+		case now := <-idleC:
+			for c := range conns {
+				if c.idleSince(now) < h.opt.idleTimeout {
+					continue
+				}
+				delete(conns, c)
+				close(c.ch)
+				c.abort()
+				if l := h.opt.logger; l != nil {
+					l.Printf("sse: idle timeout %s%s", c.r.RemoteAddr, reqid.LogSuffix(c.r.Context()))
+				}
 			}
+			h.clients.Store(int64(len(conns)))
 		case ev := <-h.broadcast:
+			if h.opt.decode != nil {
+				ev.decoded = h.opt.decode(ev.Data) // 全クライアントで共有
+			}
 			// リングに記録
+			h.broadcasts.Add(1)
 			h.pushReplay(ev)
 			// 各クライアントに送信（バッファフルなら落とす）
+			var delivered, dropped uint64
 			for c := range conns {
 				if c.filter != nil && !c.filter(ev) {
 					continue
 				}
 				select {
 				case c.ch <- ev:
+					delivered++
+					c.delivered++
 				default:
 					// バッファ溢れはドロップ（混雑耐性）
+					dropped++
+					c.dropped++
 				}
 			}
+			h.dropped.Add(dropped)
+			h.recordFanOut(ev.Name, delivered, dropped)
 		}
 	}
 }
 
-// Close は全接続を閉じ、Run ループを停止します。
-func (h *Hub) Close() { close(h.done) }
+// Close は全接続を閉じ、Run ループを停止します。2 回目以降は何もしません。
+// 閉じた Hub は再利用できません（接続の受け付けも Broadcast の配信も止まったまま）。
+func (h *Hub) Close() { h.closeOnce.Do(func() { close(h.done) }) }
+
+// Clone は h の設定（opts で上書き可）とリプレイ用リング・次の ID を引き継いだ新しい Hub を返します。
+// 閉じた Hub は done が閉じたままで、Run の接続集合も各クライアントのチャネルも閉じ終えているため再開できません。
+// 設定の変更などで Hub を作り直すときは、送り手を止めて h.Close() してから Clone し、新しい Hub で Run してください。
+// 切断されたクライアントは Last-Event-ID 付きで再接続すれば、新しい Hub のリプレイから欠番なく受け取れます。
+// Close 時に Run が未処理だったイベント（Broadcast のキューに残ったもの）もリプレイに入れます。
+// 統計（Stats / TopicStats）は引き継ぎません。Close 前に Clone した場合、その後 h に送ったイベントは含まれません。
+// h の WithReplayMaxAge より古くなったイベントは引き継ぎません。WithSnapshotTopic の最新のスナップショットも引き継ぎます。
+func (h *Hub) Clone(opts ...Option) *Hub {
+	o := h.opt
+	for _, f := range opts {
+		f(&o)
+	}
+	n := &Hub{
+		opt:        o,
+		nextID:     atomic.LoadInt64(&h.nextID),
+		register:   make(chan *client),
+		unregister: make(chan *client),
+		broadcast:  make(chan Event, o.broadcastBuf),
+		debugReq:   make(chan chan []ClientInfo),
+		done:       make(chan struct{}),
+		topics:     make(map[string]*TopicStat),
+	}
+	if o.replaySize > 0 {
+		n.ring = make([]Event, o.replaySize)
+	}
+	for _, ev := range h.collectSince(0) {
+		n.pushReplay(ev)
+	}
+	if snap, ok := h.snapshotSince(0); ok && snap.Name == o.snapshot {
+		n.snap = snap
+	}
+	select {
+	case <-h.done:
+	default:
+		return n
+	}
+	// Close 済みならキューに残ったイベントは誰も配信しないので引き取る
+drain:
+	for {
+		select {
+		case ev := <-h.broadcast:
+			if o.decode != nil {
+				ev.decoded = o.decode(ev.Data)
+			}
+			n.pushReplay(ev)
+		default:
+			break drain
+		}
+	}
+	return n
+}
 
 // Broadcast はイベントを全クライアントに送信します。ID は内部で付与されます。
+// Run へのキュー（WithBroadcastBuffer）が満杯のときは WithBroadcastOverflowPolicy に従います。既定の Block では空くまでブロックします。
+// ID は採番済みなので、ここで捨てるとリプレイに欠番ができるためです（遅いクライアントの分はクライアントごとのバッファで落とす）。
+// Close 後は待たずに返します（配信されない）。
 func (h *Hub) Broadcast(name string, data []byte) Event {
 	id := atomic.AddInt64(&h.nextID, 1)
-	ev := Event{ID: id, Name: name, Data: append([]byte(nil), data...)}
+	now := time.Now()
+	ev := Event{ID: id, Name: name, Data: append([]byte(nil), data...), Time: now}
+	h.recordBroadcast(name, now)
 	select {
 	case h.broadcast <- ev:
+		return ev
 	default:
-		// 混雑時にブロッキングしない（通常は十分なバッファを推奨）
-		h.broadcast <- ev
+	}
+	switch h.opt.overflow {
+	case DropNewest:
+		h.dropNewest.Add(1)
+		return ev
+	case DropOldest:
+		for {
+			select {
+			case <-h.broadcast:
+				h.dropOldest.Add(1)
+			default: // その間に Run が取り出した
+			}
+			select {
+			case h.broadcast <- ev:
+				return ev
+			default: // ほかの送り手に先を越された
+			}
+		}
+	}
+	h.blocked.Add(1)
+	select {
+	case h.broadcast <- ev:
+	case <-h.done:
 	}
 	return ev
 }
 
+// ClientsDebug は接続中のクライアントごとの状態（購読したトピック・接続時刻・配信数など）を接続の古い順に返します。
+// 「一部のプレイヤーしか見えない」といった報告で、その接続がどんな topics / 条件で登録されているかを調べるためのものです。
+// 接続集合は Run のゴルーチンが持っているので、Run に問い合わせて集めます。Run の開始前と Close 後は nil を返します。
+// RemoteAddr やリクエスト ID を含むので、HTTP で公開するときは認証を掛けてください。
+func (h *Hub) ClientsDebug() []ClientInfo {
+	if !h.running.Load() {
+		return nil
+	}
+	reply := make(chan []ClientInfo, 1)
+	select {
+	case h.debugReq <- reply:
+	case <-h.done:
+		return nil
+	}
+	infos := <-reply
+	slices.SortFunc(infos, func(a, b ClientInfo) int {
+		return cmp.Or(a.Connected.Compare(b.Connected), cmp.Compare(a.RemoteAddr, b.RemoteAddr))
+	})
+	return infos
+}
+
+// Stats は Hub 全体の統計のスナップショットです。
+type Stats struct {
+	Clients                int    // 接続中のクライアント数
+	BroadcastQueue         int    // Run が未処理のイベント数（Broadcast のキューの現在長）
+	BroadcastCap           int    // Broadcast のキューの容量（WithBroadcastBuffer）
+	BroadcastBlocked       uint64 // キューが満杯で Broadcast が待たされた回数（Block）
+	BroadcastDroppedNewest uint64 // キューが満杯で捨てた渡されたイベントの数（DropNewest）
+	BroadcastDroppedOldest uint64 // キューが満杯で捨てたキュー先頭のイベントの数（DropOldest）
+	Broadcasts             uint64 // Run が処理したイベント数
+	Dropped                uint64 // クライアントのバッファ溢れで落とした延べ件数
+}
+
+// Stats は現在の統計を返します。BroadcastQueue が BroadcastCap に近いまま、または BroadcastBlocked
+// （DropNewest / DropOldest なら BroadcastDroppedNewest / BroadcastDroppedOldest）が増え続けるなら、Run（ファンアウト）が送り手に追いついていません。
+func (h *Hub) Stats() Stats {
+	return Stats{
+		Clients:                int(h.clients.Load()),
+		BroadcastQueue:         len(h.broadcast),
+		BroadcastCap:           cap(h.broadcast),
+		BroadcastBlocked:       h.blocked.Load(),
+		BroadcastDroppedNewest: h.dropNewest.Load(),
+		BroadcastDroppedOldest: h.dropOldest.Load(),
+		Broadcasts:             h.broadcasts.Load(),
+		Dropped:                h.dropped.Load(),
+	}
+}
+
+// TopicStat はトピック（イベント名）ごとの配信統計です。
+type TopicStat struct {
+	Broadcasts    uint64    // Broadcast された件数
+	LastBroadcast time.Time // 最後に Broadcast された時刻
+	Delivered     uint64    // クライアントのバッファへ渡した延べ件数
+	Dropped       uint64    // バッファ溢れで落とした延べ件数
+}
+
+// TopicStats はトピックごとの統計のコピーを返します（名前なしのイベントは "" に集計）。
+// LastBroadcast が古ければ送り手（Poller など）が止まっている、Broadcasts は増えているのに
+// Delivered が増えなければ配信側の問題、と切り分けられます。
+func (h *Hub) TopicStats() map[string]TopicStat {
+	h.topicMu.Lock()
+	defer h.topicMu.Unlock()
+	out := make(map[string]TopicStat, len(h.topics))
+	for name, st := range h.topics {
+		out[name] = *st
+	}
+	return out
+}
+
+// topicLocked は name の統計を返します（無ければ作る）。topicMu を保持して呼ぶこと。
+func (h *Hub) topicLocked(name string) *TopicStat {
+	st, ok := h.topics[name]
+	if !ok {
+		st = &TopicStat{}
+		h.topics[name] = st
+	}
+	return st
+}
+
+func (h *Hub) recordBroadcast(name string, t time.Time) {
+	h.topicMu.Lock()
+	defer h.topicMu.Unlock()
+	st := h.topicLocked(name)
+	st.Broadcasts++
+	st.LastBroadcast = t
+}
+
+func (h *Hub) recordFanOut(name string, delivered, dropped uint64) {
+	h.topicMu.Lock()
+	defer h.topicMu.Unlock()
+	st := h.topicLocked(name)
+	st.Delivered += delivered
+	st.Dropped += dropped
+}
+
 // ServeHTTP は /sse/live ハンドラ実装です。
 // クエリ: topics=pos,events （省略時は制限なし）
 // ヘッダ or クエリ: Last-Event-ID / last_event_id（数値）
 func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// SSE ヘッダ
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
-
+	setStreamHeaders(w)
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
@@ -183,13 +625,10 @@ func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// フィルタ（topics）
 	var filter func(Event) bool
-	topics := parseCSV(r.URL.Query().Get("topics"))
+	topics := parseTopics(r.URL.Query().Get("topics"), h.opt.maxTopics)
 	if len(topics) > 0 {
 		allowed := make(map[string]struct{}, len(topics))
 		for _, t := range topics {
-			if t == "" {
-				continue
-			}
 			allowed[t] = struct{}{}
 		}
 		filter = func(ev Event) bool {
@@ -200,14 +639,29 @@ func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return ok
 		}
 	}
+	var matched bool
+	if h.opt.matcher != nil {
+		if m := h.opt.matcher(r); m != nil {
+			matched = true
+			if topicFilter := filter; topicFilter != nil {
+				filter = func(ev Event) bool { return topicFilter(ev) && m(ev) }
+			} else {
+				filter = m
+			}
+		}
+	}
 
 	c := &client{
-		w:       w,
-		flusher: flusher,
-		r:       r,
-		ch:      make(chan Event, h.opt.clientBuf),
-		filter:  filter,
+		w:         w,
+		flusher:   flusher,
+		r:         r,
+		ch:        make(chan Event, clientBufferSize(r, h.opt.clientBuf, h.opt.maxClientBuf)),
+		filter:    filter,
+		topics:    topics,
+		matcher:   matched,
+		connected: time.Now(),
 	}
+	c.touch()
 
 	// 接続登録
 	select {
@@ -216,61 +670,131 @@ func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	case h.register <- c:
 	}
+	if h.opt.compress && httpx.AcceptsGzip(r) {
+		gw := newGzipStream(w, flusher)
+		defer gw.Close()
+		w, flusher = gw, gw
+	}
+	if l := h.opt.logger; l != nil {
+		start := time.Now()
+		l.Printf("sse: connect %s topics=%q%s", r.RemoteAddr, r.URL.Query().Get("topics"), reqid.LogSuffix(r.Context()))
+		defer func() {
+			l.Printf("sse: disconnect %s after %s%s", r.RemoteAddr, time.Since(start).Round(time.Second), reqid.LogSuffix(r.Context()))
+		}()
+	}
 
 	// リプレイ送信
-	if lastID, ok := readLastEventID(r); ok {
-		replay := h.collectSince(lastID)
-		for _, ev := range replay {
+	// 以降の書き込みは毎回 setWriteDeadline で期限を張り直すため、
+	// http.Server.WriteTimeout が長時間ストリームを切ることはない。
+	// まだ採番していない ID（再起動前の ID など）より先は無いので、リングを見ずにリプレイなしとする
+	if lastID, ok := readLastEventID(r); ok && lastID < atomic.LoadInt64(&h.nextID) {
+		for _, ev := range h.replayFor(lastID, filter) {
 			if !writeEvent(w, flusher, h.opt.writeTimeout, ev) {
-				h.unregister <- c
+				h.leave(c)
 				return
 			}
+			c.touch()
 		}
 	}
 
 	// 初期フラッシュ（ヘッダ送信）
+	if !setWriteDeadline(w, h.opt.writeTimeout) {
+		h.leave(c)
+		return
+	}
 	flusher.Flush()
+	c.touch()
 
-	// ピングタイマ
-	var ping *time.Ticker
+	// ピングタイマ（無効時は nil チャネルで select から外す）
+	var pingC <-chan time.Time
 	if h.opt.pingInterval > 0 {
-		ping = time.NewTicker(h.opt.pingInterval)
+		ping := time.NewTicker(h.opt.pingInterval)
 		defer ping.Stop()
+		pingC = ping.C
 	}
 
 	// クライアントループ
 	for {
 		select {
 		case <-r.Context().Done():
-			h.unregister <- c
+			h.leave(c)
 			return
 		case <-h.done:
-			h.unregister <- c
+			h.leave(c)
 			return
 		case ev, ok := <-c.ch:
 			if !ok {
 				return
 			}
 			if !writeEvent(w, flusher, h.opt.writeTimeout, ev) {
-				h.unregister <- c
+				h.leave(c)
 				return
 			}
-		case <-ping.C:
-			if !writePing(w, flusher, h.opt.writeTimeout) {
-				h.unregister <- c
+			c.touch()
+		case <-pingC:
+			if !h.ping(w, flusher) {
+				h.leave(c)
 				return
 			}
+			c.touch()
 		}
 	}
 }
 
-// 内部: リングに push（排他）
+// leave は c の登録を外します。Close 後は Run が終わっていて unregister を受け取らないので待たない
+// （接続集合と c.ch は Run が閉じ終えている）。
+func (h *Hub) leave(c *client) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// ping は WithPingAsEvent に応じてイベントかコメントの ping を書きます。
+func (h *Hub) ping(w http.ResponseWriter, flusher http.Flusher) bool {
+	if h.opt.pingEvent == "" {
+		return writePing(w, flusher, h.opt.writeTimeout)
+	}
+	data := `{"t":"` + time.Now().UTC().Format(time.RFC3339Nano) + `"}`
+	return writeEvent(w, flusher, h.opt.writeTimeout, Event{Name: h.opt.pingEvent, Data: []byte(data)})
+}
+
+// replayFor は lastID より新しいリプレイを、filter・WithSnapshotTopic・WithMaxReplayOnConnect を適用して返します。
+func (h *Hub) replayFor(lastID int64, filter func(Event) bool) []Event {
+	replay := h.collectSince(lastID)
+	snap, hasSnap := h.snapshotSince(lastID)
+	if h.opt.snapshot != "" {
+		// 古いスナップショットは最新の 1 件で置き換える
+		replay = slices.DeleteFunc(replay, func(ev Event) bool { return ev.Name == h.opt.snapshot })
+	}
+	if filter != nil {
+		replay = slices.DeleteFunc(replay, func(ev Event) bool { return !filter(ev) })
+		hasSnap = hasSnap && filter(snap)
+	}
+	n := h.opt.maxReplay
+	if hasSnap && n > 0 {
+		n-- // スナップショットの枠を空けておく
+	}
+	if h.opt.maxReplay > 0 && len(replay) > n {
+		replay = replay[len(replay)-n:]
+	}
+	if hasSnap {
+		i, _ := slices.BinarySearchFunc(replay, snap.ID, func(ev Event, id int64) int { return cmp.Compare(ev.ID, id) })
+		replay = slices.Insert(replay, i, snap)
+	}
+	return replay
+}
+
+// 内部: リングに push（排他）。WithSnapshotTopic のイベントは最新のスナップショットとしても保持する
 func (h *Hub) pushReplay(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.opt.snapshot != "" && ev.Name == h.opt.snapshot {
+		h.snap = ev
+	}
 	if cap(h.ring) == 0 {
 		return
 	}
-	h.mu.Lock()
-	defer h.mu.Unlock()
 	if h.length < cap(h.ring) {
 		h.ring[h.length] = ev
 		h.length++
@@ -281,56 +805,115 @@ func (h *Hub) pushReplay(ev Event) {
 	h.start = (h.start + 1) % cap(h.ring)
 }
 
-// 内部: lastID より新しいイベントを取得（排他）
+// 内部: lastID より新しいイベントを取得（排他）。WithReplayMaxAge より古いイベントは除く
 func (h *Hub) collectSince(lastID int64) []Event {
-	if h.length == 0 || cap(h.ring) == 0 {
-		return nil
+	var cutoff time.Time
+	if h.opt.replayMaxAge > 0 {
+		cutoff = time.Now().Add(-h.opt.replayMaxAge)
 	}
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	if h.length == 0 || cap(h.ring) == 0 {
+		return nil
+	}
 	n := h.length
 	res := make([]Event, 0, n)
 	for i := 0; i < n; i++ {
 		idx := (h.start + i) % cap(h.ring)
 		ev := h.ring[idx]
-		if ev.ID > lastID {
+		if ev.ID > lastID && !ev.Time.Before(cutoff) {
 			res = append(res, ev)
 		}
 	}
 	return res
 }
 
+// 内部: 最新のスナップショットが lastID より新しく WithReplayMaxAge 以内なら返す（排他）
+func (h *Hub) snapshotSince(lastID int64) (Event, bool) {
+	h.mu.RLock()
+	snap := h.snap
+	h.mu.RUnlock()
+	if snap.ID <= lastID {
+		return Event{}, false
+	}
+	if d := h.opt.replayMaxAge; d > 0 && snap.Time.Before(time.Now().Add(-d)) {
+		return Event{}, false
+	}
+	return snap, true
+}
+
 // ユーティリティ
-func parseCSV(s string) []string {
+
+// setStreamHeaders は SSE の応答ヘッダを設定します。
+func setStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+}
+
+// parseTopics はカンマ区切りの topics を空・重複を除いて返します（先頭から最大 max 件）。
+func parseTopics(s string, max int) []string {
 	if s == "" {
 		return nil
 	}
-	parts := strings.Split(s, ",")
-	out := make([]string, 0, len(parts))
-	for _, p := range parts {
+	var out []string
+	for p := range strings.SplitSeq(s, ",") {
 		p = strings.TrimSpace(p)
-		if p != "" {
-			out = append(out, p)
+		if p == "" || slices.Contains(out, p) {
+			continue
+		}
+		if len(out) >= max {
+			break
 		}
+		out = append(out, p)
 	}
 	return out
 }
 
+// readLastEventID は Last-Event-ID ヘッダ（無ければ last_event_id クエリ）を読みます。
+// 数値でない・負の値は指定なしとして扱います。
 func readLastEventID(r *http.Request) (int64, bool) {
-	if v := r.Header.Get("Last-Event-ID"); v != "" {
-		if id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
-			return id, true
+	for _, v := range []string{r.Header.Get("Last-Event-ID"), r.URL.Query().Get("last_event_id")} {
+		if v == "" {
+			continue
 		}
-	}
-	if v := r.URL.Query().Get("last_event_id"); v != "" {
-		if id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+		if id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil && id >= 0 {
 			return id, true
 		}
 	}
 	return 0, false
 }
 
+// clientBufferSize は ?buffer= から接続の送信バッファサイズを決めます（1〜limit に丸め、無い・数値でなければ def）。
+func clientBufferSize(r *http.Request, def, limit int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("buffer")))
+	if err != nil {
+		return def
+	}
+	return min(max(n, 1), limit)
+}
+
+// setWriteDeadline は書き込み期限を now+timeout に張り直す（timeout<=0 なら期限なし）。
+// http.Server.WriteTimeout は接続単位の期限なので、ストリーム中はここで上書きする。
+// ResponseController 非対応の ResponseWriter（テスト用など）では何もしない。
+func setWriteDeadline(w http.ResponseWriter, timeout time.Duration) bool {
+	var dl time.Time
+	if timeout > 0 {
+		dl = time.Now().Add(timeout)
+	}
+	err := http.NewResponseController(w).SetWriteDeadline(dl)
+	return err == nil || errors.Is(err, http.ErrNotSupported)
+}
+
+// newlines は Data の改行（\r\n / \r）を \n に揃えます。SSE では \r も行の終わりなので、
+// 残すとクライアントによっては data: 行の末尾に \r が入ったり行が途中で切れたりします。
+var newlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
 func writeEvent(w http.ResponseWriter, flusher http.Flusher, timeout time.Duration, ev Event) bool {
+	if !setWriteDeadline(w, timeout) {
+		return false
+	}
 	bw := bufio.NewWriter(w)
 	if ev.Name != "" {
 		if _, err := bw.WriteString("event: "); err != nil {
@@ -354,9 +937,9 @@ func writeEvent(w http.ResponseWriter, flusher http.Flusher, timeout time.Durati
 			return false
 		}
 	}
-	// data:（複数行対応）
+	// data:（複数行対応。改行は \r\n / \r / \n のどれでも行の区切りとし、data: 行に \r を残さない）
 	if len(ev.Data) > 0 {
-		for _, line := range strings.Split(string(ev.Data), "\n") {
+		for _, line := range strings.Split(newlines.Replace(string(ev.Data)), "\n") {
 			if _, err := bw.WriteString("data: "); err != nil {
 				return false
 			}
@@ -383,6 +966,9 @@ func writeEvent(w http.ResponseWriter, flusher http.Flusher, timeout time.Durati
 }
 
 func writePing(w http.ResponseWriter, flusher http.Flusher, timeout time.Duration) bool {
+	if !setWriteDeadline(w, timeout) {
+		return false
+	}
 	bw := bufio.NewWriter(w)
 	if _, err := bw.WriteString(":ping\n\n"); err != nil {
 		return false
@@ -0,0 +1,850 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/reqid"
+)
+
+// readEvent は SSE ストリームから空行までを1件として読む（:ping などのコメントは飛ばす）。
+func readEvent(t *testing.T, br *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v (so far %q)", err, lines)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if len(lines) > 0 {
+				return lines
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+}
+
+// http.Server.WriteTimeout を超えて接続を保持してもストリームが切れないこと。
+// 本番の 30s を短縮した 200ms で検証する。
+func TestServeHTTPOutlivesServerWriteTimeout(t *testing.T) {
+	const serverWriteTimeout = 200 * time.Millisecond
+
+	hub := NewHub(WithPingInterval(0), WithWriteTimeout(time.Second))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+
+	srv := httptest.NewUnstartedServer(hub)
+	srv.Config.WriteTimeout = serverWriteTimeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content-type: %q", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * serverWriteTimeout)
+		hub.Broadcast("pos", []byte(`{"x":1}`))
+		got := readEvent(t, br)
+		if got[0] != "event: pos" || got[len(got)-1] != `data: {"x":1}` {
+			t.Fatalf("event %d unexpected: %q", i, got)
+		}
+	}
+}
+
+func TestServeHTTPLogsRequestID(t *testing.T) {
+	var buf syncBuffer
+	hub := NewHub(WithPingInterval(0), WithLogger(log.New(&buf, "", 0)))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+
+	srv := httptest.NewServer(reqid.Middleware("", hub))
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"?topics=pos", nil)
+	req.Header.Set(reqid.DefaultHeader, "trace-7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(buf.String(), "disconnect") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	out := buf.String()
+	for _, want := range []string{`sse: connect`, `topics="pos"`, "req_id=trace-7", "sse: disconnect"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("log %q lacks %q", out, want)
+		}
+	}
+}
+
+// syncBuffer は並行に書かれるログ用の bytes.Buffer です。
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestEventDecoderRunsOncePerEvent(t *testing.T) {
+	var decodes atomic.Int32
+	hub := NewHub(WithPingInterval(0),
+		WithEventDecoder(func(b []byte) any {
+			decodes.Add(1)
+			var v struct{ Pid string }
+			_ = json.Unmarshal(b, &v)
+			return v.Pid
+		}),
+		WithEventMatcher(func(r *http.Request) func(Event) bool {
+			pid := r.URL.Query().Get("pid")
+			if pid == "" {
+				return nil
+			}
+			return func(ev Event) bool { return ev.Decoded() == pid }
+		}),
+	)
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	const clients = 5
+	readers := make([]*bufio.Reader, clients)
+	for i := range readers {
+		resp, err := http.Get(srv.URL + "?pid=P:1")
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		readers[i] = bufio.NewReader(resp.Body)
+	}
+
+	hub.Broadcast("pos", []byte(`{"pid":"P:2"}`))
+	hub.Broadcast("pos", []byte(`{"pid":"P:1"}`))
+	for i, br := range readers {
+		got := readEvent(t, br)
+		if got[len(got)-1] != `data: {"pid":"P:1"}` {
+			t.Fatalf("client %d got %q, want only P:1", i, got)
+		}
+	}
+	if n := decodes.Load(); n != 2 {
+		t.Fatalf("decoder ran %d times for 2 events and %d clients, want 2", n, clients)
+	}
+}
+
+func TestTopicStatsTrackBroadcastAndFanOut(t *testing.T) {
+	hub := NewHub(WithPingInterval(0))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "?topics=pos")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	br := bufio.NewReader(resp.Body)
+
+	before := time.Now()
+	hub.Broadcast("events", []byte(`{}`))
+	hub.Broadcast("pos", []byte(`{"n":1}`))
+	hub.Broadcast("pos", []byte(`{"n":2}`))
+	readEvent(t, br)
+	readEvent(t, br)
+
+	st := hub.TopicStats()
+	pos, ev := st["pos"], st["events"]
+	if pos.Broadcasts != 2 || pos.Delivered != 2 || pos.Dropped != 0 || pos.LastBroadcast.Before(before) {
+		t.Fatalf("pos stats = %+v", pos)
+	}
+	// events は購読者がいないので配信 0
+	if ev.Broadcasts != 1 || ev.Delivered != 0 || ev.LastBroadcast.After(pos.LastBroadcast) {
+		t.Fatalf("events stats = %+v", ev)
+	}
+}
+
+// stalledWriter は最初の書き込み以降、書き込み期限が過去に設定されるまでブロックする ResponseWriter です
+// （OS が検知しない半開きの接続を模す）。
+type stalledWriter struct {
+	header   http.Header
+	mu       sync.Mutex
+	writes   int
+	unblock  chan struct{}
+	unblockO sync.Once
+}
+
+func (w *stalledWriter) Header() http.Header { return w.header }
+func (w *stalledWriter) WriteHeader(int)     {}
+func (w *stalledWriter) Flush()              {}
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	w.writes++
+	n := w.writes
+	w.mu.Unlock()
+	if n == 1 {
+		return len(b), nil
+	}
+	<-w.unblock
+	return 0, errors.New("write deadline exceeded")
+}
+func (w *stalledWriter) SetWriteDeadline(t time.Time) error {
+	if !t.IsZero() && t.Before(time.Now()) {
+		w.unblockO.Do(func() { close(w.unblock) })
+	}
+	return nil
+}
+
+func TestClientIdleTimeoutDropsStalledClient(t *testing.T) {
+	hub := NewHub(WithPingInterval(10*time.Millisecond), WithClientIdleTimeout(100*time.Millisecond))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+
+	w := &stalledWriter{header: http.Header{}, unblock: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		hub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sse/live", nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled client was not disconnected by the idle timeout")
+	}
+	if n := hub.clients.Load(); n != 0 {
+		t.Fatalf("clients = %d after idle timeout, want 0", n)
+	}
+}
+
+func TestClientIdleTimeoutKeepsPingedClient(t *testing.T) {
+	hub := NewHub(WithPingInterval(10*time.Millisecond), WithClientIdleTimeout(100*time.Millisecond))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	go func() { _, _ = io.Copy(io.Discard, resp.Body) }()
+	time.Sleep(300 * time.Millisecond)
+	if n := hub.clients.Load(); n != 1 {
+		t.Fatalf("clients = %d, want the pinged client to stay connected", n)
+	}
+}
+
+func TestPingAsEvent(t *testing.T) {
+	hub := NewHub(WithPingInterval(10*time.Millisecond), WithPingAsEvent("heartbeat"))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "?topics=pos") // ping は topics に関係なく届く
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	got := readEvent(t, bufio.NewReader(resp.Body))
+	if len(got) != 2 || got[0] != "event: heartbeat" || !strings.HasPrefix(got[1], `data: {"t":"`) {
+		t.Fatalf("got %q, want a heartbeat event without id", got)
+	}
+}
+
+func TestDataLineEndingsAreNormalized(t *testing.T) {
+	hub := NewHub(WithPingInterval(0))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	br := bufio.NewReader(resp.Body)
+
+	hub.Broadcast("events", []byte("a\r\nb\rc\nd\r\n"))
+	got := readEvent(t, br)
+	want := []string{"event: events", "id: 1", "data: a", "data: b", "data: c", "data: d", "data: "}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for _, line := range got {
+		if strings.Contains(line, "\r") {
+			t.Fatalf("stray carriage return in %q", line)
+		}
+	}
+}
+
+func TestSSECompressionGzipsStream(t *testing.T) {
+	hub := NewHub(WithPingInterval(0), WithSSECompression())
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	// 自前で Accept-Encoding を付け、Transport の自動展開を止める
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", ce)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	br := bufio.NewReader(zr)
+
+	// イベントごとに flush されるので、ストリームを閉じなくても 1 件ずつ読める
+	hub.Broadcast("pos", []byte(`{"pid":"P:1"}`))
+	if got := readEvent(t, br); got[0] != "event: pos" || got[2] != `data: {"pid":"P:1"}` {
+		t.Fatalf("first event = %q", got)
+	}
+	hub.Broadcast("pos", []byte("line1\nline2"))
+	if got := readEvent(t, br); len(got) != 4 || got[3] != "data: line2" {
+		t.Fatalf("second event = %q", got)
+	}
+
+	// gzip を受け付けないクライアントには素のまま
+	plain, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { plain.Body.Close() })
+	if ce := plain.Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("Content-Encoding without Accept-Encoding = %q", ce)
+	}
+}
+
+func TestClientSubscribeParsesAndReconnects(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		lastIDs []string
+		topics  []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := len(lastIDs)
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		topics = append(topics, r.URL.Query().Get("topics"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		if n == 0 {
+			// 複数行 data・コメント・retry: を含めて送り、そのまま切断する
+			io.WriteString(w, "retry: 10\n:ping\n\nevent: pos\nid: 7\ndata: {\"a\":1,\r\ndata:  \"b\":2}\n\nid: 8\n\nevent: events\ndata: x\n\n")
+			return
+		}
+		io.WriteString(w, "event: pos\nid: 9\ndata: {}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{RetryDelay: time.Minute}
+	ch, err := c.Subscribe(ctx, srv.URL+"/sse/live", []string{"pos", "events"}, 5)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	want := []Event{
+		{ID: 7, Name: "pos", Data: []byte("{\"a\":1,\n \"b\":2}")},
+		{ID: 8, Name: "events", Data: []byte("x")},
+		{ID: 9, Name: "pos", Data: []byte("{}")},
+	}
+	for i, w := range want {
+		select {
+		case ev := <-ch:
+			if ev.ID != w.ID || ev.Name != w.Name || string(ev.Data) != string(w.Data) {
+				t.Fatalf("event %d: want %+v, got %+v (data %q)", i, w, ev, ev.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for event %d", i)
+		}
+	}
+	mu.Lock()
+	if len(lastIDs) != 2 || lastIDs[0] != "5" || lastIDs[1] != "8" || topics[1] != "pos,events" {
+		t.Fatalf("unexpected requests: last ids %q, topics %q", lastIDs, topics)
+	}
+	mu.Unlock()
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected event after cancel")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestBroadcastBufferBlocksWhenFullAndReportsSaturation(t *testing.T) {
+	h := NewHub(WithBroadcastBuffer(2))
+	h.Broadcast("pos", []byte("1"))
+	h.Broadcast("pos", []byte("2"))
+	if st := h.Stats(); st.BroadcastQueue != 2 || st.BroadcastCap != 2 || st.BroadcastBlocked != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.Broadcast("pos", []byte("3")) // キュー満杯なので Run が取り出すまで待つ
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Stats().BroadcastBlocked == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Broadcast did not block on a full queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Broadcast returned while the queue was full")
+	default:
+	}
+
+	go h.Run()
+	defer h.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcast still blocked after Run started")
+	}
+
+	// Close 後は満杯でも待たない
+	h2 := NewHub(WithBroadcastBuffer(1))
+	h2.Broadcast("pos", nil)
+	h2.Close()
+	returned := make(chan struct{})
+	go func() {
+		h2.Broadcast("pos", nil)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcast blocked after Close")
+	}
+}
+
+func TestBroadcastOverflowPolicyDropsWithoutBlocking(t *testing.T) {
+	for _, tt := range []struct {
+		policy  OverflowPolicy
+		wantIDs []int64
+	}{
+		{DropNewest, []int64{1, 2}},
+		{DropOldest, []int64{2, 3}},
+	} {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			h := NewHub(WithBroadcastBuffer(2), WithBroadcastOverflowPolicy(tt.policy))
+			for i := range 3 { // Run 前なので 3 件目で満杯（待たずに返る）
+				h.Broadcast("pos", []byte(strconv.Itoa(i)))
+			}
+			st := h.Stats()
+			if st.BroadcastBlocked != 0 || st.BroadcastDroppedNewest+st.BroadcastDroppedOldest != 1 {
+				t.Fatalf("unexpected stats: %+v", st)
+			}
+			if (tt.policy == DropNewest) != (st.BroadcastDroppedNewest == 1) {
+				t.Fatalf("drop counted under the wrong policy: %+v", st)
+			}
+			go h.Run()
+			defer h.Close()
+			for h.Stats().Broadcasts < 2 {
+				time.Sleep(time.Millisecond)
+			}
+			var ids []int64
+			for _, ev := range h.collectSince(0) {
+				ids = append(ids, ev.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Fatalf("replay ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+	if _, err := ParseOverflowPolicy("drop_all"); err == nil {
+		t.Fatal("ParseOverflowPolicy accepted an unknown policy")
+	}
+}
+
+func TestClientsDebugReportsTopicsAndCounts(t *testing.T) {
+	hub := NewHub(WithPingInterval(0), WithClientBuffer(1))
+	if infos := hub.ClientsDebug(); infos != nil {
+		t.Fatalf("before Run = %+v, want nil", infos)
+	}
+	go hub.Run()
+	srv := httptest.NewServer(reqid.Middleware(reqid.DefaultHeader, hub))
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"?topics=pos,,pos", nil)
+	req.Header.Set(reqid.DefaultHeader, "dbg-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	// 読まないのでバッファ（1 件）はすぐ埋まる
+	for hub.Stats().Clients == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	hub.Broadcast("events", nil) // topics で除外
+	for range 3 {
+		hub.Broadcast("pos", nil)
+	}
+	for hub.Stats().Broadcasts < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	infos := hub.ClientsDebug()
+	if len(infos) != 1 {
+		t.Fatalf("ClientsDebug = %+v, want 1 client", infos)
+	}
+	ci := infos[0]
+	if !slices.Equal(ci.Topics, []string{"pos"}) || ci.RequestID != "dbg-1" || ci.Matcher || ci.RemoteAddr == "" || ci.Connected.IsZero() {
+		t.Fatalf("unexpected info: %+v", ci)
+	}
+	// 書き込み中の 1 件とバッファの 1 件は渡せ、残りは溢れる（ストリームのゴルーチンがどこまで取り出したかで分かれる）
+	if ci.Delivered+ci.Dropped != 3 || ci.Delivered == 0 || ci.BufferCap != 1 {
+		t.Fatalf("unexpected counts: %+v", ci)
+	}
+
+	resp.Body.Close()
+	for hub.Stats().Clients != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if infos := hub.ClientsDebug(); len(infos) != 0 {
+		t.Fatalf("after disconnect = %+v, want none", infos)
+	}
+	hub.Close()
+	if infos := hub.ClientsDebug(); infos != nil {
+		t.Fatalf("after Close = %+v, want nil", infos)
+	}
+}
+
+func TestReplayMaxAgeSkipsOldEvents(t *testing.T) {
+	h := NewHub(WithReplay(8), WithReplayMaxAge(time.Minute))
+	now := time.Now()
+	h.pushReplay(Event{ID: 1, Name: "pos", Time: now.Add(-2 * time.Hour)}) // 静かな時間帯の前の古い位置
+	h.pushReplay(Event{ID: 2, Name: "pos", Time: now.Add(-30 * time.Second)})
+	h.pushReplay(Event{ID: 3, Name: "pos", Time: now})
+
+	ids := func(evs []Event) []int64 {
+		var out []int64
+		for _, ev := range evs {
+			out = append(out, ev.ID)
+		}
+		return out
+	}
+	if got := ids(h.collectSince(0)); !slices.Equal(got, []int64{2, 3}) {
+		t.Fatalf("collectSince(0) = %v, want [2 3]", got)
+	}
+	if got := ids(h.collectSince(2)); !slices.Equal(got, []int64{3}) {
+		t.Fatalf("collectSince(2) = %v, want [3]", got)
+	}
+	// 既定（無制限）なら古いイベントも返す
+	if got := ids(h.Clone(WithReplayMaxAge(0)).collectSince(0)); !slices.Equal(got, []int64{2, 3}) {
+		t.Fatalf("clone keeps only what the source would replay: %v", got)
+	}
+
+	ev := h.Broadcast("pos", nil)
+	if ev.Time.IsZero() || ev.Time.Before(now) {
+		t.Fatalf("Broadcast should stamp Time: %v", ev.Time)
+	}
+}
+
+func TestParseTopicsDedupesAndClamps(t *testing.T) {
+	cases := []struct {
+		in   string
+		max  int
+		want []string
+	}{
+		{"", 32, nil},
+		{" , ,", 32, nil},
+		{"pos, events,pos,,events", 32, []string{"pos", "events"}},
+		{"a,b,a,c,d", 3, []string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		if got := parseTopics(c.in, c.max); !slices.Equal(got, c.want) {
+			t.Errorf("parseTopics(%q, %d) = %q, want %q", c.in, c.max, got, c.want)
+		}
+	}
+}
+
+func TestLastEventIDEdgeCases(t *testing.T) {
+	hub := NewHub(WithPingInterval(0))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+	for i := 1; i <= 3; i++ {
+		hub.Broadcast("pos", []byte(strconv.Itoa(i)))
+	}
+	for hub.Stats().Broadcasts < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// firstID は接続後に 1 件 Broadcast したとき、最初に届くイベントの ID を返す。
+	firstID := func(query string) string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + query)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		for hub.Stats().Clients == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		ev := hub.Broadcast("pos", []byte("live"))
+		defer func() {
+			for hub.Stats().Clients != 0 { // 次の接続の前に切断を反映させる
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		defer resp.Body.Close()
+		got := readEvent(t, bufio.NewReader(resp.Body))
+		if got[1] == "id: "+strconv.FormatInt(ev.ID, 10) {
+			return "live"
+		}
+		return got[1]
+	}
+
+	if got := firstID("?last_event_id=1"); got != "id: 2" {
+		t.Fatalf("last_event_id=1: first event %q, want id: 2", got)
+	}
+	if got := firstID("?last_event_id=999"); got != "live" {
+		t.Fatalf("last_event_id ahead of the hub: first event %q, want the live event (no replay)", got)
+	}
+	if got := firstID("?last_event_id=-5"); got != "live" {
+		t.Fatalf("negative last_event_id: first event %q, want the live event (no replay)", got)
+	}
+}
+
+func TestMaxReplayOnConnectSendsNewestEvents(t *testing.T) {
+	hub := NewHub(WithPingInterval(0), WithReplay(8), WithMaxReplayOnConnect(3))
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+	// リングは満杯（ID 3..10）。pos は奇数 ID
+	for i := 1; i <= 10; i++ {
+		name := "pos"
+		if i%2 == 0 {
+			name = "events"
+		}
+		hub.Broadcast(name, []byte(strconv.Itoa(i)))
+	}
+	for hub.Stats().Broadcasts < 10 {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, err := http.Get(srv.URL + "?last_event_id=0&topics=pos")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	for hub.Stats().Clients == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	live := hub.Broadcast("pos", []byte("live"))
+
+	// topics で絞った 3, 5, 7, 9 のうち新しい 3 件、続いてライブ
+	br := bufio.NewReader(resp.Body)
+	want := []string{"id: 5", "id: 7", "id: 9", "id: " + strconv.FormatInt(live.ID, 10)}
+	for _, w := range want {
+		if got := readEvent(t, br); got[1] != w {
+			t.Fatalf("got %q, want %s", got, w)
+		}
+	}
+}
+
+// Close 時に接続中だったハンドラは、Run が終わった後でも unregister で止まらずに返ること（Close → Clone の作り直しでゴルーチンが漏れない）。
+func TestCloseReleasesConnectedHandlers(t *testing.T) {
+	hub := NewHub(WithPingInterval(0))
+	go hub.Run()
+	returned := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(returned)
+		hub.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	for hub.Stats().Clients == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// 読まれていないイベントを残しておき、ハンドラが c.ch ではなく done の側で抜けやすくする
+	hub.Broadcast("pos", []byte("1"))
+	for hub.Stats().Broadcasts == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	hub.Close()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still blocked after Close")
+	}
+}
+
+func TestCloneCarriesReplayAfterClose(t *testing.T) {
+	h := NewHub(WithReplay(4))
+	exited := make(chan struct{})
+	go func() {
+		h.Run()
+		close(exited)
+	}()
+	for i := 1; i <= 3; i++ {
+		h.Broadcast("pos", []byte(strconv.Itoa(i)))
+	}
+	for h.Stats().Broadcasts < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	h.Close()
+	h.Close() // 2 回目は何もしない
+	<-exited
+	h.Broadcast("pos", []byte("4")) // Run が止まっているのでキューに残る
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("second Run did not panic")
+			}
+		}()
+		h.Run()
+	}()
+
+	c := h.Clone(WithReplay(3))
+	ids := func() []int64 {
+		var out []int64
+		for _, ev := range c.collectSince(0) {
+			out = append(out, ev.ID)
+		}
+		return out
+	}
+	if got := ids(); !slices.Equal(got, []int64{2, 3, 4}) {
+		t.Fatalf("cloned replay IDs = %v, want [2 3 4]", got)
+	}
+	go c.Run()
+	t.Cleanup(c.Close)
+	if ev := c.Broadcast("pos", []byte("5")); ev.ID != 5 {
+		t.Fatalf("next ID after Clone = %d, want 5", ev.ID)
+	}
+}
+
+func TestClientBufferSizeFromQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		want  int
+	}{
+		{"", 32},
+		{"?buffer=abc", 32},
+		{"?buffer=", 32},
+		{"?buffer=0", 1},
+		{"?buffer=-3", 1},
+		{"?buffer=500", 500},
+		{"?buffer=99999", 4096},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/sse/live"+c.query, nil)
+		if got := clientBufferSize(r, 32, 4096); got != c.want {
+			t.Errorf("clientBufferSize(%q) = %d, want %d", c.query, got, c.want)
+		}
+	}
+}
+
+func TestSnapshotTopicReplaysOnlyLatestSnapshot(t *testing.T) {
+	hub := NewHub(WithPingInterval(0), WithReplay(4), WithMaxReplayOnConnect(3), WithSnapshotTopic("snapshot"))
+	hub.Broadcast("snapshot", []byte("s1")) // 1
+	snap := hub.Broadcast("snapshot", []byte("s2"))
+	for i := range 5 { // 3..7。リング（4 件）から s2 は押し出される
+		hub.Broadcast("pos", []byte(strconv.Itoa(i)))
+	}
+	hub.Close()
+	// Clone でも最新のスナップショットを引き継ぐ
+	n := hub.Clone()
+	go n.Run()
+	t.Cleanup(n.Close)
+	srv := httptest.NewServer(n)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "?last_event_id=0")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	for n.Stats().Clients == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	live := n.Broadcast("pos", []byte("live"))
+
+	// 上限 3 件のうち 1 枠をスナップショットに使い、残りは新しい方から 2 件
+	br := bufio.NewReader(resp.Body)
+	want := []string{"id: " + strconv.FormatInt(snap.ID, 10), "id: 6", "id: 7", "id: " + strconv.FormatInt(live.ID, 10)}
+	for _, w := range want {
+		if got := readEvent(t, br); got[1] != w {
+			t.Fatalf("got %q, want %s", got, w)
+		}
+	}
+
+	// スナップショットより新しい Last-Event-ID なら送らない
+	resp2, err := http.Get(srv.URL + "?last_event_id=6")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp2.Body.Close()
+	if got := readEvent(t, bufio.NewReader(resp2.Body)); got[1] != "id: 7" {
+		t.Fatalf("got %q, want id: 7", got)
+	}
+}
@@ -0,0 +1,68 @@
+package sse
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	descClients = prometheus.NewDesc(
+		"sse_clients",
+		"Number of currently connected SSE clients.",
+		nil, nil,
+	)
+	descBroadcasts = prometheus.NewDesc(
+		"sse_events_broadcast_total",
+		"Total number of events broadcast by the hub.",
+		nil, nil,
+	)
+	descQueue = prometheus.NewDesc(
+		"sse_broadcast_queue_length",
+		"Number of broadcast events waiting to be fanned out.",
+		nil, nil,
+	)
+	descQueueCap = prometheus.NewDesc(
+		"sse_broadcast_queue_capacity",
+		"Capacity of the broadcast queue.",
+		nil, nil,
+	)
+	descBlocked = prometheus.NewDesc(
+		"sse_broadcast_blocked_total",
+		"Total number of Broadcast calls that had to wait because the queue was full.",
+		nil, nil,
+	)
+	descOverflowDropped = prometheus.NewDesc(
+		"sse_broadcast_overflow_dropped_total",
+		"Total number of events discarded by the overflow policy because the broadcast queue was full.",
+		[]string{"policy"}, nil,
+	)
+	descDropped = prometheus.NewDesc(
+		"sse_events_dropped_total",
+		"Total number of per-client deliveries dropped because the client buffer was full.",
+		nil, nil,
+	)
+)
+
+// Collector は Hub の接続数・配信数・キューの飽和具合を公開する prometheus.Collector を返す。
+func (h *Hub) Collector() prometheus.Collector { return &hubCollector{h: h} }
+
+type hubCollector struct{ h *Hub }
+
+func (c *hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descClients
+	ch <- descBroadcasts
+	ch <- descDropped
+	ch <- descQueue
+	ch <- descQueueCap
+	ch <- descBlocked
+	ch <- descOverflowDropped
+}
+
+func (c *hubCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.h.Stats()
+	ch <- prometheus.MustNewConstMetric(descClients, prometheus.GaugeValue, float64(st.Clients))
+	ch <- prometheus.MustNewConstMetric(descBroadcasts, prometheus.CounterValue, float64(st.Broadcasts))
+	ch <- prometheus.MustNewConstMetric(descDropped, prometheus.CounterValue, float64(st.Dropped))
+	ch <- prometheus.MustNewConstMetric(descQueue, prometheus.GaugeValue, float64(st.BroadcastQueue))
+	ch <- prometheus.MustNewConstMetric(descQueueCap, prometheus.GaugeValue, float64(st.BroadcastCap))
+	ch <- prometheus.MustNewConstMetric(descBlocked, prometheus.CounterValue, float64(st.BroadcastBlocked))
+	ch <- prometheus.MustNewConstMetric(descOverflowDropped, prometheus.CounterValue, float64(st.BroadcastDroppedNewest), DropNewest.String())
+	ch <- prometheus.MustNewConstMetric(descOverflowDropped, prometheus.CounterValue, float64(st.BroadcastDroppedOldest), DropOldest.String())
+}
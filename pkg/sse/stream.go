@@ -0,0 +1,55 @@
+package sse
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrStreamClosed は書き込みに失敗した（クライアントが切断した・期限切れ）Stream への送信で返ります。
+var ErrStreamClosed = errors.New("sse: stream closed")
+
+// Stream は Hub を介さずに 1 つの接続へ SSE を書くためのライタです（履歴の再生など）。
+// フレーミングと書き込み期限の扱いは Hub と同じです。ID は付けません（Last-Event-ID による追送は無し）。
+type Stream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	timeout time.Duration
+	closed  bool
+}
+
+// NewStream は SSE の応答ヘッダを書き出して Stream を返します。
+// writeTimeout は各書き込みの期限です（0 で無効、WithWriteTimeout と同じ）。
+// w がストリーミングに対応していなければエラーを返します（応答は書きません）。
+func NewStream(w http.ResponseWriter, writeTimeout time.Duration) (*Stream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("sse: streaming unsupported")
+	}
+	setStreamHeaders(w)
+	s := &Stream{w: w, flusher: flusher, timeout: writeTimeout}
+	if !setWriteDeadline(w, writeTimeout) {
+		return nil, ErrStreamClosed
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return s, nil
+}
+
+// Send は event: name の 1 件を書き出します。一度失敗した Stream には以降も ErrStreamClosed を返します。
+func (s *Stream) Send(name string, data []byte) error {
+	if s.closed || !writeEvent(s.w, s.flusher, s.timeout, Event{Name: name, Data: data}) {
+		s.closed = true
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// Ping は :ping コメントを書き出します（keep-alive）。
+func (s *Stream) Ping() error {
+	if s.closed || !writePing(s.w, s.flusher, s.timeout) {
+		s.closed = true
+		return ErrStreamClosed
+	}
+	return nil
+}
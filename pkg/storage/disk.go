@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrLowDisk は WithMinFreeBytes の下限を空き容量が下回っている間の書き込みで返すエラーです（errors.Is で判定する）。
+// 点は書かれていない。
+var ErrLowDisk = errors.New("storage: low disk space")
+
+// diskCheckInterval は Append が空き容量を測り直す間隔です（毎点 statfs しないため）。
+const diskCheckInterval = 5 * time.Second
+
+// WithMinFreeBytes は、データルートのファイルシステムの空き容量が minFree バイトを下回っている間、
+// critical 以外のシリーズへの Append（AppendVec・AppendMulti などを含む）を書かずに ErrLowDisk で拒否します（0 で無効、既定は無効）。
+// ディスクが埋まって全シリーズの書き込みが 1 点ずつ失敗し始める前に、位置などの量の多いシリーズを止めて
+// イベントなどの重要なシリーズ（critical）の分を残すためのものです。空き容量は最大 5 秒ごとに測り直します。
+// 空き容量を測れない環境（DiskStatus がエラー）では拒否しません。
+func WithMinFreeBytes(minFree uint64, critical ...string) Option {
+	return func(s *TSStore) {
+		if minFree == 0 {
+			s.disk = nil
+			return
+		}
+		g := &diskGuard{minFree: minFree, critical: make(map[string]bool, len(critical))}
+		for _, c := range critical {
+			g.critical[c] = true
+		}
+		s.disk = g
+	}
+}
+
+// diskGuard は WithMinFreeBytes の判定と、最後に測った空き容量のキャッシュです。
+type diskGuard struct {
+	minFree  uint64
+	critical map[string]bool
+
+	mu      sync.Mutex
+	checked time.Time
+	free    uint64
+	err     error
+}
+
+// DiskStatus はデータルートのファイルシステムの空き容量（一般ユーザーが使えるバイト数）を返します。
+// シャード構成では最も少ない root の値です。root がまだ無ければ、存在する親ディレクトリのファイルシステムを測ります。
+// 対応していない OS では errors.ErrUnsupported を返します。
+func (s *TSStore) DiskStatus() (freeBytes uint64, err error) {
+	for i, root := range s.roots {
+		free, err := freeBytesNear(root)
+		if err != nil {
+			return 0, fmt.Errorf("storage: disk status %s: %w", root, err)
+		}
+		if i == 0 || free < freeBytes {
+			freeBytes = free
+		}
+	}
+	return freeBytes, nil
+}
+
+// MinFreeBytes は WithMinFreeBytes の下限を返します（無効なら 0）。
+func (s *TSStore) MinFreeBytes() uint64 {
+	if s.disk == nil {
+		return 0
+	}
+	return s.disk.minFree
+}
+
+// checkDisk は WithMinFreeBytes の下限を下回っていて series が critical でなければ ErrLowDisk を返します。
+func (s *TSStore) checkDisk(series string) error {
+	g := s.disk
+	if g == nil || g.critical[series] {
+		return nil
+	}
+	g.mu.Lock()
+	if now := time.Now(); now.Sub(g.checked) >= diskCheckInterval {
+		g.free, g.err = s.diskStatus()
+		g.checked = now
+	}
+	free, err := g.free, g.err
+	g.mu.Unlock()
+	if err != nil || free >= g.minFree {
+		return nil
+	}
+	return fmt.Errorf("%w: %d bytes free (< %d): %s", ErrLowDisk, free, g.minFree, series)
+}
+
+// diskStatus はテストで差し替えられる DiskStatus です。
+func (s *TSStore) diskStatus() (uint64, error) {
+	if s.statDisk != nil {
+		return s.statDisk()
+	}
+	return s.DiskStatus()
+}
+
+// freeBytesNear は path（無ければ存在する最も近い親）のファイルシステムの空き容量を返します。
+func freeBytesNear(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return freeBytes(path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0, os.ErrNotExist
+		}
+		path = parent
+	}
+}
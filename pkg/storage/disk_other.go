@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package storage
+
+import "errors"
+
+// freeBytes はこの OS では空き容量を測れないので errors.ErrUnsupported を返します。
+func freeBytes(string) (uint64, error) { return 0, errors.ErrUnsupported }
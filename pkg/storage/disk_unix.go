@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+// freeBytes は path のファイルシステムの、特権の無いプロセスが使える空き容量を返します。
+func freeBytes(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"maps"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+// EventsSeries はイベント（V=1 のカウント）を書くシリーズ名です。
+const EventsSeries = "events.count"
+
+// SessionsSeries は終了したセッションの長さ（秒）を書くシリーズ名です。T は切断を検出した時刻。
+const SessionsSeries = "sessions"
+
+// イベントのタグキー。書き手（Poller など）と読み手（履歴 API）で共有する。
+const (
+	TagKind     = "kind"
+	TagPlayerID = "player_id"
+	TagName     = "name"
+	TagWorld    = "world"
+)
+
+// EventKind はイベントの種類（kind タグの値）です。
+type EventKind string
+
+const (
+	EventPlayerConnect    EventKind = "player_connect"
+	EventPlayerDisconnect EventKind = "player_disconnect"
+	EventPlayerDeath      EventKind = "player_death"
+)
+
+func (k EventKind) String() string { return string(k) }
+
+// PlayerEventKinds は定義済みのプレイヤーイベント種別の一覧です（設定値の検証用）。
+func PlayerEventKinds() []EventKind {
+	return []EventKind{EventPlayerConnect, EventPlayerDisconnect, EventPlayerDeath}
+}
+
+// AppendPlayerEvent: プレイヤーのイベントを kind/player_id/name/world のタグで書く
+// （name・world が空ならそのタグは付けない）。extra（nil 可）は追加のタグで、同じキーは kind などの方が優先。
+func (s *TSStore) AppendPlayerEvent(t time.Time, kind EventKind, playerID, name, world string, extra map[string]string) error {
+	tags := playerTags(extra, playerID, name)
+	tags[TagKind] = string(kind)
+	if world != "" {
+		tags[TagWorld] = world
+	}
+	return s.Append(EventsSeries, tsfile.Point{T: t, V: 1, Tags: tags})
+}
+
+// AppendSession: 終了したセッションの長さを秒で sessions シリーズへ書く（タグは player_id と、空でなければ name）。
+// extra（nil 可）は追加のタグで、同じキーは player_id・name の方が優先。
+func (s *TSStore) AppendSession(t time.Time, playerID, name string, d time.Duration, extra map[string]string) error {
+	return s.Append(SessionsSeries, tsfile.Point{T: t, V: d.Seconds(), Tags: playerTags(extra, playerID, name)})
+}
+
+// playerTags は extra の写しに player_id と、空でなければ name を重ねたタグを返す（extra は変更しない）。
+func playerTags(extra map[string]string, playerID, name string) tsfile.Tags {
+	tags := make(tsfile.Tags, len(extra)+4)
+	maps.Copy(tags, extra)
+	tags[TagPlayerID] = playerID
+	if name != "" {
+		tags[TagName] = name
+	}
+	return tags
+}
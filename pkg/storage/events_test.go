@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+func TestAppendPlayerEventTags(t *testing.T) {
+	s, _ := newStoreForTest(t)
+	now := time.Now().UTC()
+
+	if err := s.AppendPlayerEvent(now, EventPlayerDeath, "P:1", "alice", "Navezgane", nil); err != nil {
+		t.Fatalf("AppendPlayerEvent error: %v", err)
+	}
+	if err := s.AppendPlayerEvent(now.Add(time.Second), EventPlayerConnect, "P:2", "", "", nil); err != nil {
+		t.Fatalf("AppendPlayerEvent error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	pts, err := s.Query(EventsSeries, now.Add(-time.Minute), now.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	want := []tsfile.Tags{
+		{TagKind: "player_death", TagPlayerID: "P:1", TagName: "alice", TagWorld: "Navezgane"},
+		{TagKind: "player_connect", TagPlayerID: "P:2"}, // 空の name/world は付けない
+	}
+	if len(pts) != len(want) {
+		t.Fatalf("got %d points, want %d", len(pts), len(want))
+	}
+	for i, p := range pts {
+		if p.V != 1 || p.Tags.Canonical() != want[i].Canonical() {
+			t.Fatalf("point %d = %+v, want V=1 tags=%v", i, p, want[i])
+		}
+	}
+}
+
+func TestAppendPlayerEventAndSessionExtraTags(t *testing.T) {
+	s, _ := newStoreForTest(t)
+	now := time.Now().UTC()
+	extra := map[string]string{"src": "a", TagPlayerID: "ignored"}
+
+	if err := s.AppendPlayerEvent(now, EventPlayerDisconnect, "P:1", "alice", "", extra); err != nil {
+		t.Fatalf("AppendPlayerEvent error: %v", err)
+	}
+	if err := s.AppendSession(now, "P:1", "alice", 90*time.Second, extra); err != nil {
+		t.Fatalf("AppendSession error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if extra[TagPlayerID] != "ignored" || len(extra) != 2 {
+		t.Fatalf("extra was modified: %v", extra)
+	}
+
+	for _, tt := range []struct {
+		series string
+		v      float64
+		want   tsfile.Tags
+	}{
+		{EventsSeries, 1, tsfile.Tags{"src": "a", TagKind: "player_disconnect", TagPlayerID: "P:1", TagName: "alice"}},
+		{SessionsSeries, 90, tsfile.Tags{"src": "a", TagPlayerID: "P:1", TagName: "alice"}},
+	} {
+		pts, err := s.Query(tt.series, now.Add(-time.Minute), now.Add(time.Minute), nil)
+		if err != nil {
+			t.Fatalf("Query %s error: %v", tt.series, err)
+		}
+		if len(pts) != 1 || pts[0].V != tt.v || pts[0].Tags.Canonical() != tt.want.Canonical() {
+			t.Fatalf("%s = %+v, want V=%v tags=%v", tt.series, pts, tt.v, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+var (
+	descPointsWritten = prometheus.NewDesc(
+		"tsstore_points_written_total",
+		"Total number of points appended, per series.",
+		[]string{"series"}, nil,
+	)
+	descBytesWritten = prometheus.NewDesc(
+		"tsstore_bytes_written_total",
+		"Total number of compressed bytes written to disk, per series.",
+		[]string{"series"}, nil,
+	)
+	descFlushes = prometheus.NewDesc(
+		"tsstore_flushes_total",
+		"Total number of writer flushes, per series.",
+		[]string{"series"}, nil,
+	)
+	descWriters = prometheus.NewDesc(
+		"tsstore_writers",
+		"Number of open tag-set writers, per series.",
+		[]string{"series"}, nil,
+	)
+	descBufferedBytes = prometheus.NewDesc(
+		"tsstore_buffered_bytes",
+		"Uncompressed bytes buffered but not yet flushed, per series.",
+		[]string{"series"}, nil,
+	)
+	descThrottled = prometheus.NewDesc(
+		"tsstore_throttled_points_total",
+		"Total number of points rejected by the write rate limit, per series.",
+		[]string{"series"}, nil,
+	)
+	descDiskFree = prometheus.NewDesc(
+		"tsstore_disk_free_bytes",
+		"Free bytes available on the data root filesystem (the smallest across shards).",
+		nil, nil,
+	)
+	descRouters = prometheus.NewDesc(
+		"tsstore_routers",
+		"Number of series routers currently open.",
+		nil, nil,
+	)
+)
+
+// Collector は TSStore の書き込み統計を公開する prometheus.Collector を返す。
+// 値は Collect 時に各 Router の累積カウンタから読み出す（Reopen 後は 0 から数え直し）。
+func (s *TSStore) Collector() prometheus.Collector { return &storeCollector{s: s} }
+
+type storeCollector struct{ s *TSStore }
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descPointsWritten
+	ch <- descBytesWritten
+	ch <- descWriters
+	ch <- descBufferedBytes
+	ch <- descFlushes
+	ch <- descThrottled
+	ch <- descDiskFree
+	ch <- descRouters
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	n := 0
+	// シャード構成では同じシリーズの Router が複数あるので合算する
+	sums := map[string]tsfile.Counters{}
+	writers := map[string]int{}
+	buffered := map[string]int{}
+	c.s.routers.Range(func(k, v any) bool {
+		series := k.(routerKey).series
+		r := v.(*tsfile.Router)
+		st := r.Counters()
+		writers[series] += r.WriterCount()
+		buffered[series] += r.BufferedBytes()
+		sum := sums[series]
+		sum.Points += st.Points
+		sum.Bytes += st.Bytes
+		sum.Flushes += st.Flushes
+		sums[series] = sum
+		n++
+		return true
+	})
+	for series, st := range sums {
+		ch <- prometheus.MustNewConstMetric(descPointsWritten, prometheus.CounterValue, float64(st.Points), series)
+		ch <- prometheus.MustNewConstMetric(descBytesWritten, prometheus.CounterValue, float64(st.Bytes), series)
+		ch <- prometheus.MustNewConstMetric(descFlushes, prometheus.CounterValue, float64(st.Flushes), series)
+		ch <- prometheus.MustNewConstMetric(descWriters, prometheus.GaugeValue, float64(writers[series]), series)
+		ch <- prometheus.MustNewConstMetric(descBufferedBytes, prometheus.GaugeValue, float64(buffered[series]), series)
+	}
+	for series, n := range c.s.Throttled() {
+		ch <- prometheus.MustNewConstMetric(descThrottled, prometheus.CounterValue, float64(n), series)
+	}
+	if free, err := c.s.DiskStatus(); err == nil { // 測れない OS では出さない
+		ch <- prometheus.MustNewConstMetric(descDiskFree, prometheus.GaugeValue, float64(free))
+	}
+	ch <- prometheus.MustNewConstMetric(descRouters, prometheus.GaugeValue, float64(n))
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+func TestCollectorReportsWrites(t *testing.T) {
+	s, _ := newStoreForTest(t)
+
+	now := time.Now().UTC()
+	tags := map[string]string{"player_id": "P:test:metrics"}
+	for i := 0; i < 3; i++ {
+		if err := s.Append("players.x", tsfile.Point{T: now, V: float64(i), Tags: tags}); err != nil {
+			t.Fatalf("Append error: %v", err)
+		}
+	}
+	if err := s.AppendEvent(now, "player_connect", map[string]string{"player_id": "P:test:metrics"}); err != nil {
+		t.Fatalf("AppendEvent error: %v", err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(s.Collector()); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	got := map[string]map[string]float64{} // metric -> series -> value
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			series := ""
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "series" {
+					series = lp.GetValue()
+				}
+			}
+			if got[mf.GetName()] == nil {
+				got[mf.GetName()] = map[string]float64{}
+			}
+			got[mf.GetName()][series] = metricValue(m)
+		}
+	}
+
+	if v := got["tsstore_points_written_total"]["players.x"]; v != 3 {
+		t.Fatalf("points players.x: want 3, got %v", v)
+	}
+	if v := got["tsstore_points_written_total"]["events.count"]; v != 1 {
+		t.Fatalf("points events.count: want 1, got %v", v)
+	}
+	if v := got["tsstore_bytes_written_total"]["players.x"]; v <= 0 {
+		t.Fatalf("bytes players.x: want >0 (FlushEvery=1), got %v", v)
+	}
+	if v := got["tsstore_flushes_total"]["players.x"]; v < 3 {
+		t.Fatalf("flushes players.x: want >=3, got %v", v)
+	}
+	if v := got["tsstore_writers"]["players.x"]; v != 1 {
+		t.Fatalf("writers players.x: want 1, got %v", v)
+	}
+	if v := got["tsstore_buffered_bytes"]["players.x"]; v != 0 {
+		t.Fatalf("buffered players.x: want 0 after FlushEvery=1, got %v", v)
+	}
+	if v := got["tsstore_routers"][""]; v != 2 {
+		t.Fatalf("routers: want 2, got %v", v)
+	}
+}
+
+func metricValue(m *dto.Metric) float64 {
+	if c := m.GetCounter(); c != nil {
+		return c.GetValue()
+	}
+	if g := m.GetGauge(); g != nil {
+		return g.GetValue()
+	}
+	return 0
+}
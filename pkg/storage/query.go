@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+// Query: series の [from,to] から match のタグを含む点を時刻順（昇順）で返す。
+// タグの絞り込みは tsfile.ScanRangeMatch（labels.json で判定）で行うため、
+// 一致しないタグセットのファイルは展開しない。シリーズが存在しなければ空を返す。
+// シャード構成では全 root を読んでまとめる。
+func (s *TSStore) Query(series string, from, to time.Time, match tsfile.Tags) ([]tsfile.Point, error) {
+	var out []tsfile.Point
+	err := s.QueryStream(context.Background(), series, from, to, match, func(p tsfile.Point) bool {
+		out = append(out, p)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].T.Before(out[j].T) })
+	return out, nil
+}
+
+// QueryStream: Query の逐次版。結果を溜めずに 1 点ずつ fn へ渡す（fn が false を返すと打ち切り、nil を返す）。
+// 順序はタグセット（root）ごとの時刻順で、全体としては時刻順にならない。大きな範囲を一定のメモリで読むためのもので、
+// 全体の順序が要るなら範囲を時間ごとに区切って呼び、区切りの中で並べ替える。
+// ctx が終わると打ち切って ctx.Err() を返す。シリーズが存在しなければ何も渡さずに nil を返す。
+func (s *TSStore) QueryStream(ctx context.Context, series string, from, to time.Time, match tsfile.Tags, fn func(tsfile.Point) bool) error {
+	stopped := false
+	for _, root := range s.roots {
+		err := tsfile.ScanRangeMatch(root, series, from, to, match, func(p tsfile.Point) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			if !fn(p) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// LatestPositions: series の直近 within（現在時刻まで）で、タグセットごとに最も新しい点を返す（キーは Tags.Canonical()）。
+// 新しい時間から 1 時間ずつ遡って読み、新しい時間で見つかったタグセットは古い時間の点で上書きしない。
+// 再起動直後に Poller の前回状態を復元する（接続イベントを出し直さない）ためのもの。players.x と players.z のように
+// 軸が別シリーズなら、それぞれ呼んで player_id と時刻で組にする。シリーズが存在しなければ空を返す。
+func (s *TSStore) LatestPositions(series string, within time.Duration) (map[string]tsfile.Point, error) {
+	out := make(map[string]tsfile.Point)
+	if within <= 0 {
+		return out, nil
+	}
+	to := time.Now().UTC()
+	from := to.Add(-within)
+	for end := to; ; {
+		start := end.Truncate(time.Hour)
+		if start.Before(from) {
+			start = from
+		}
+		found := make(map[string]tsfile.Point)
+		err := s.QueryStream(context.Background(), series, start, end, nil, func(p tsfile.Point) bool {
+			k := p.Tags.Canonical()
+			if _, done := out[k]; done {
+				return true
+			}
+			if cur, ok := found[k]; !ok || !p.T.Before(cur.T) {
+				found[k] = p
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(out, found)
+		if !start.After(from) {
+			return out, nil
+		}
+		end = start.Add(-time.Nanosecond) // ScanRange は両端を含むので 1 つ前の時間とは重ねない
+	}
+}
+
+// QueryBefore: series の match を含む点のうち before より前（before ちょうどは含まない）のものを、新しい順に最大 limit 件返す。
+// next は次のページを読むときに before へ渡す値で、それより古い点が無ければ zero。イベント一覧の「もっと古いものを読む」用で、
+// tsfile.ScanReverse で新しい方から読むため、古いページほど読む量は増えるが直近のページは範囲の長さによらず安い。
+// limit 件目と同時刻の点は limit を超えても全て含める（次のページは next より前から始まるので、同時刻の点を取りこぼさない）。
+// シリーズが存在しなければ空を返す。シャード構成では root ごとに読んでまとめる。
+func (s *TSStore) QueryBefore(series string, match tsfile.Tags, before time.Time, limit int) (pts []tsfile.Point, next time.Time, err error) {
+	if limit <= 0 {
+		return nil, time.Time{}, errors.New("storage: limit must be positive")
+	}
+	var all []tsfile.Point
+	for _, root := range s.roots {
+		var got []tsfile.Point
+		err := tsfile.ScanReverse(root, series, before, match, func(p tsfile.Point) bool {
+			// limit 件に達したら、最後と同時刻の点と、それより古い点を 1 つ（次のページの有無の確認用）まで読む
+			more := len(got) >= limit && p.T.Before(got[len(got)-1].T)
+			got = append(got, p)
+			return !more
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, time.Time{}, err
+		}
+		all = append(all, got...)
+	}
+	slices.SortStableFunc(all, func(a, b tsfile.Point) int { return b.T.Compare(a.T) })
+	if len(all) <= limit {
+		return all, time.Time{}, nil
+	}
+	last := all[limit-1].T
+	n := limit
+	for n < len(all) && all[n].T.Equal(last) {
+		n++
+	}
+	if n < len(all) {
+		next = last
+	}
+	return all[:n], next, nil
+}
+
+// IntPoint は QueryInts が返す整数値の点です。
+type IntPoint struct {
+	T    time.Time
+	V    int64
+	Tags tsfile.Tags
+}
+
+// QueryInts: Query の結果を int64 の値で返す（イベント件数など整数のシリーズ用。位置などの float は Query を使う）。
+// 値は float64 で保存されているので、絶対値が tsfile.MaxExactInt 以下の整数なら書いた値がそのまま返る。
+// 整数でない点があればエラーにする（別の用途のシリーズを読み違えていないかを検出するため）。
+func (s *TSStore) QueryInts(series string, from, to time.Time, match tsfile.Tags) ([]IntPoint, error) {
+	pts, err := s.Query(series, from, to, match)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]IntPoint, 0, len(pts))
+	for _, p := range pts {
+		v, ok := p.Int()
+		if !ok {
+			return nil, fmt.Errorf("storage: %s: value %v at %s is not an integer", series, p.V, p.T.Format(time.RFC3339Nano))
+		}
+		out = append(out, IntPoint{T: p.T, V: v, Tags: p.Tags})
+	}
+	return out, nil
+}
+
+// DayRange: day を含む loc の暦日の範囲を UTC で返す（from はその日の 0 時、to は翌日 0 時の 1ns 前。Query は両端を含むため）。
+// 夏時間の切り替わる日は 23 / 25 時間になり、隣り合う日の範囲は重ならず隙間も無い。loc が nil なら UTC。
+// 例: DayRange(time.Now(), jst) は JST の「今日」。
+func DayRange(day time.Time, loc *time.Location) (from, to time.Time) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	y, m, d := day.In(loc).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	end := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	return start.UTC(), end.Add(-time.Nanosecond).UTC()
+}
+
+// QueryDay: day を含む loc の暦日（DayRange）の点を Query と同じく時刻順で返す。
+// ファイルは UTC の時間単位なので、日の境界がどのタイムゾーンでも読み漏らし・重複は無い。
+func (s *TSStore) QueryDay(series string, day time.Time, loc *time.Location, match tsfile.Tags) ([]tsfile.Point, error) {
+	from, to := DayRange(day, loc)
+	return s.Query(series, from, to, match)
+}
+
+// Aggregate: Query の結果を bucket 幅（UTC で切り捨て）ごとに平均した点を時刻順で返す。
+// タグセットごとに別バケットとして集計し、T はバケット先頭時刻、Tags は元のタグを引き継ぐ。
+// 複数値の点（AppendMulti）は Values も名前ごとに平均する。
+func (s *TSStore) Aggregate(series string, from, to time.Time, match tsfile.Tags, bucket time.Duration) ([]tsfile.Point, error) {
+	return s.aggregate(series, from, to, match, bucket, func(t time.Time) time.Time { return t.Truncate(bucket) })
+}
+
+// AggregateIn: Aggregate のバケットを loc の 0 時から区切る版（loc が nil なら UTC）。
+// バケットは日をまたがず、各日の最後のバケットは短くなることがある（夏時間で 23 / 25 時間の日を含む）。
+// bucket が 24h 以上なら loc の暦日ごとの集計になる。T はバケット先頭時刻（UTC）。
+func (s *TSStore) AggregateIn(series string, from, to time.Time, match tsfile.Tags, bucket time.Duration, loc *time.Location) ([]tsfile.Point, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return s.aggregate(series, from, to, match, bucket, func(t time.Time) time.Time {
+		y, m, d := t.In(loc).Date()
+		start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		if bucket < 24*time.Hour { // 25 時間の日でも 24h 以上は暦日 1 つにまとめる
+			start = start.Add(t.Sub(start).Truncate(bucket))
+		}
+		return start.UTC()
+	})
+}
+
+func (s *TSStore) aggregate(series string, from, to time.Time, match tsfile.Tags, bucket time.Duration, trunc func(time.Time) time.Time) ([]tsfile.Point, error) {
+	if bucket <= 0 {
+		return nil, errors.New("storage: bucket must be positive")
+	}
+	pts, err := s.Query(series, from, to, match)
+	if err != nil {
+		return nil, err
+	}
+	type key struct {
+		tagHash string
+		t       time.Time
+	}
+	type acc struct {
+		sum  float64
+		n    int
+		tags tsfile.Tags
+		vsum map[string]float64 // 複数値の点の名前ごとの合計と点数
+		vn   map[string]int
+	}
+	order := make([]key, 0)
+	buckets := make(map[key]*acc)
+	for _, p := range pts {
+		k := key{tagHash: p.Tags.Hash(), t: trunc(p.T)}
+		a, ok := buckets[k]
+		if !ok {
+			a = &acc{tags: p.Tags}
+			buckets[k] = a
+			order = append(order, k)
+		}
+		a.sum += p.V
+		a.n++
+		for name, v := range p.Values {
+			if a.vsum == nil {
+				a.vsum, a.vn = make(map[string]float64), make(map[string]int)
+			}
+			a.vsum[name] += v
+			a.vn[name]++
+		}
+	}
+	out := make([]tsfile.Point, 0, len(order))
+	for _, k := range order {
+		a := buckets[k]
+		p := tsfile.Point{T: k.t, V: a.sum / float64(a.n), Tags: a.tags}
+		if a.vsum != nil {
+			p.Values = make(map[string]float64, len(a.vsum))
+			for name, sum := range a.vsum {
+				p.Values[name] = sum / float64(a.vn[name])
+			}
+		}
+		out = append(out, p)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].T.Before(out[j].T) })
+	return out, nil
+}
@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata" // 夏時間のテストに America/New_York を使う
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+func TestQueryFiltersAndSorts(t *testing.T) {
+	s, _ := newStoreForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	a := map[string]string{"player_id": "P:A"}
+	b := map[string]string{"player_id": "P:B"}
+	// 時刻を逆順に書き込む
+	for i := 3; i >= 0; i-- {
+		if err := s.Append("players.x", tsfile.Point{T: base.Add(time.Duration(i) * time.Minute), V: float64(i), Tags: a}); err != nil {
+			t.Fatalf("Append A: %v", err)
+		}
+		if err := s.Append("players.x", tsfile.Point{T: base.Add(time.Duration(i) * time.Minute), V: float64(100 + i), Tags: b}); err != nil {
+			t.Fatalf("Append B: %v", err)
+		}
+	}
+	// Close せず（書き込み中のまま）読めること
+	if err := s.FlushAll(); err != nil {
+		t.Fatalf("FlushAll: %v", err)
+	}
+
+	pts, err := s.Query("players.x", base, base.Add(time.Hour), tsfile.Tags{"player_id": "P:A"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(pts) != 4 {
+		t.Fatalf("want 4 points for P:A, got %d: %+v", len(pts), pts)
+	}
+	for i, p := range pts {
+		if p.Tags["player_id"] != "P:A" || p.V != float64(i) {
+			t.Fatalf("point %d unexpected: %+v", i, p)
+		}
+	}
+
+	// 存在しないシリーズは空
+	none, err := s.Query("players.missing", base, base.Add(time.Hour), nil)
+	if err != nil || len(none) != 0 {
+		t.Fatalf("missing series: want empty/nil, got %v / %v", none, err)
+	}
+}
+
+func TestQueryBeforePaginatesAcrossHourBoundary(t *testing.T) {
+	s, _ := newStoreForTest(t)
+
+	// 10:57 〜 11:03 に 1 分おき。11:01 は 2 件（ページ境界で同時刻が分かれないこと）
+	base := time.Date(2025, 8, 26, 10, 57, 0, 0, time.UTC)
+	for i := range 7 {
+		if err := s.AppendEvent(base.Add(time.Duration(i)*time.Minute), "kill", map[string]string{"n": strconv.Itoa(i)}); err != nil {
+			t.Fatalf("AppendEvent: %v", err)
+		}
+	}
+	if err := s.AppendEvent(base.Add(4*time.Minute), "kill", map[string]string{"n": "4b"}); err != nil {
+		t.Fatalf("AppendEvent: %v", err)
+	}
+	if err := s.AppendEvent(base.Add(2*time.Minute), "death", nil); err != nil {
+		t.Fatalf("AppendEvent: %v", err)
+	}
+	if err := s.FlushAll(); err != nil {
+		t.Fatalf("FlushAll: %v", err)
+	}
+
+	var pages [][]string
+	before := base.Add(6 * time.Minute) // 11:03 は含まない
+	for range 5 {
+		pts, next, err := s.QueryBefore(EventsSeries, tsfile.Tags{TagKind: "kill"}, before, 2)
+		if err != nil {
+			t.Fatalf("QueryBefore: %v", err)
+		}
+		var page []string
+		for i, p := range pts {
+			if i > 0 && p.T.After(pts[i-1].T) {
+				t.Fatalf("not descending: %+v", pts)
+			}
+			page = append(page, p.Tags["n"])
+		}
+		slices.Sort(page) // 同時刻の点の順序は決まらない
+		pages = append(pages, page)
+		if next.IsZero() {
+			break
+		}
+		before = next
+	}
+	want := [][]string{{"4", "4b", "5"}, {"2", "3"}, {"0", "1"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Fatalf("pages = %v, want %v", pages, want)
+	}
+
+	if _, _, err := s.QueryBefore(EventsSeries, nil, before, 0); err == nil {
+		t.Fatal("limit 0 should fail")
+	}
+	none, next, err := s.QueryBefore("events.missing", nil, before, 10)
+	if err != nil || len(none) != 0 || !next.IsZero() {
+		t.Fatalf("missing series: %v %v %v", none, next, err)
+	}
+}
+
+func TestAggregateBucketsMean(t *testing.T) {
+	s, _ := newStoreForTest(t)
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	tags := map[string]string{"player_id": "P:A"}
+	for i := 0; i < 4; i++ {
+		// 0,1 分 → バケット 10:00、2,3 分 → バケット 10:02
+		if err := s.Append("players.x", tsfile.Point{T: base.Add(time.Duration(i) * time.Minute), V: float64(i), Tags: tags}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	pts, err := s.Aggregate("players.x", base, base.Add(time.Hour), tsfile.Tags{"player_id": "P:A"}, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("Aggregate: %v", err)
+	}
+	if len(pts) != 2 {
+		t.Fatalf("want 2 buckets, got %d: %+v", len(pts), pts)
+	}
+	if !pts[0].T.Equal(base) || pts[0].V != 0.5 {
+		t.Fatalf("bucket 0 unexpected: %+v", pts[0])
+	}
+	if !pts[1].T.Equal(base.Add(2*time.Minute)) || pts[1].V != 2.5 {
+		t.Fatalf("bucket 1 unexpected: %+v", pts[1])
+	}
+	if _, err := s.Aggregate("players.x", base, base.Add(time.Hour), nil, 0); err == nil {
+		t.Fatalf("zero bucket should be rejected")
+	}
+}
+
+func TestQueryStreamStopsEarlyAndHonorsContext(t *testing.T) {
+	s, _ := newStoreForTest(t)
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		if err := s.Append("players.x", tsfile.Point{T: base.Add(time.Duration(i) * time.Minute), V: float64(i), Tags: tsfile.Tags{"player_id": "P:A"}}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := s.FlushAll(); err != nil {
+		t.Fatalf("FlushAll: %v", err)
+	}
+
+	n := 0
+	err := s.QueryStream(context.Background(), "players.x", base, base.Add(time.Hour), nil, func(tsfile.Point) bool {
+		n++
+		return n < 2
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("early stop: n=%d err=%v", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n = 0
+	err = s.QueryStream(ctx, "players.x", base, base.Add(time.Hour), nil, func(tsfile.Point) bool {
+		n++
+		cancel()
+		return true
+	})
+	if !errors.Is(err, context.Canceled) || n != 1 {
+		t.Fatalf("cancel: n=%d err=%v", n, err)
+	}
+
+	if err := s.QueryStream(context.Background(), "players.missing", base, base.Add(time.Hour), nil, func(tsfile.Point) bool {
+		t.Fatal("unexpected point")
+		return false
+	}); err != nil {
+		t.Fatalf("missing series: %v", err)
+	}
+}
+
+func TestLatestPositionsPicksNewestPerTagSet(t *testing.T) {
+	s, _ := newStoreForTest(t)
+
+	now := time.Now().UTC()
+	a := map[string]string{"player_id": "P:A"}
+	b := map[string]string{"player_id": "P:B"}
+	c := map[string]string{"player_id": "P:C"}
+	for _, p := range []struct {
+		ago  time.Duration
+		v    float64
+		tags map[string]string
+	}{
+		{90 * time.Minute, 1, a},
+		{time.Minute, 3, a}, // 最新
+		{30 * time.Minute, 2, a},
+		{50 * time.Minute, 10, b},
+		{3 * time.Hour, 20, c}, // within の外
+	} {
+		if err := s.Append("players.x", tsfile.Point{T: now.Add(-p.ago), V: p.v, Tags: p.tags}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := s.FlushAll(); err != nil {
+		t.Fatalf("FlushAll: %v", err)
+	}
+
+	got, err := s.LatestPositions("players.x", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("LatestPositions: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 tag sets, got %d: %+v", len(got), got)
+	}
+	if p := got[tsfile.Tags(a).Canonical()]; p.V != 3 {
+		t.Fatalf("P:A latest = %+v, want V=3", p)
+	}
+	if p := got[tsfile.Tags(b).Canonical()]; p.V != 10 {
+		t.Fatalf("P:B latest = %+v, want V=10", p)
+	}
+
+	if got, err := s.LatestPositions("missing", time.Hour); err != nil || len(got) != 0 {
+		t.Fatalf("missing series: %v, %v", got, err)
+	}
+}
+
+func TestQueryIntsRoundTripsIntegersExactly(t *testing.T) {
+	s, _ := newStoreForTest(t)
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	want := []int64{0, 1, -7, tsfile.MaxExactInt, -tsfile.MaxExactInt}
+	for i, v := range want {
+		if err := s.Append("kills.count", tsfile.Point{T: base.Add(time.Duration(i) * time.Second), V: float64(v)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append("players.x", tsfile.Point{T: base, V: 1.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.QueryInts("kills.count", base, base.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatalf("QueryInts: %v", err)
+	}
+	var vs []int64
+	for _, p := range got {
+		vs = append(vs, p.V)
+	}
+	if !slices.Equal(vs, want) {
+		t.Fatalf("QueryInts = %v, want %v", vs, want)
+	}
+
+	// 整数でない値のシリーズはエラー
+	if _, err := s.QueryInts("players.x", base, base.Add(time.Minute), nil); err == nil || !strings.Contains(err.Error(), "1.5") {
+		t.Fatalf("want non-integer error, got %v", err)
+	}
+	for _, v := range []float64{0.5, tsfile.MaxExactInt * 2, math.NaN()} {
+		if _, ok := (tsfile.Point{V: v}).Int(); ok {
+			t.Errorf("Int(%v) should not be ok", v)
+		}
+	}
+}
+
+func TestQueryDayAcrossDSTTransitions(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		mid  time.Time // 切り替わる日
+		want int       // その日の 30 分おきの点数
+	}{
+		{"spring forward", time.Date(2025, 3, 9, 12, 0, 0, 0, ny), 46},
+		{"fall back", time.Date(2025, 11, 2, 12, 0, 0, 0, ny), 50},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newStoreForTest(t)
+			days := []time.Time{tc.mid.AddDate(0, 0, -1), tc.mid, tc.mid.AddDate(0, 0, 1)}
+			start, _ := DayRange(days[0], ny)
+			_, end := DayRange(days[2], ny)
+			total := 0
+			for ts := start; !ts.After(end); ts = ts.Add(30 * time.Minute) {
+				if err := s.Append("players.x", tsfile.Point{T: ts, V: float64(total)}); err != nil {
+					t.Fatal(err)
+				}
+				total++
+			}
+			if err := s.FlushAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			seen := map[time.Time]bool{}
+			var counts []int
+			for _, d := range days {
+				pts, err := s.QueryDay("players.x", d, ny, nil)
+				if err != nil {
+					t.Fatalf("QueryDay: %v", err)
+				}
+				for _, p := range pts {
+					if seen[p.T] {
+						t.Fatalf("point %s returned for two days", p.T)
+					}
+					seen[p.T] = true
+				}
+				counts = append(counts, len(pts))
+			}
+			if len(seen) != total || counts[1] != tc.want || counts[0] != 48 || counts[2] != 48 {
+				t.Fatalf("per-day counts = %v (total %d of %d), want [48 %d 48]", counts, len(seen), total, tc.want)
+			}
+
+			// 暦日ごとの集計はバケットがその地域の 0 時から始まる
+			agg, err := s.AggregateIn("players.x", start, end, nil, 24*time.Hour, ny)
+			if err != nil {
+				t.Fatalf("AggregateIn: %v", err)
+			}
+			if len(agg) != 3 {
+				t.Fatalf("daily buckets = %d, want 3", len(agg))
+			}
+			for i, p := range agg {
+				if from, _ := DayRange(days[i], ny); !p.T.Equal(from) {
+					t.Errorf("bucket %d starts at %s, want %s", i, p.T.In(ny), from.In(ny))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrThrottled は WithRateLimit の上限を超えた書き込みで返すエラーです（errors.Is で判定する）。
+// 点は書かれていないので、呼び出し側は間引くか次の周期まで待つ。
+var ErrThrottled = errors.New("storage: write rate limit exceeded")
+
+// WithRateLimit は Append（AppendVec・AppendEvent などを含む）の書き込み数をシリーズごとに毎秒 perSec 点までに制限します
+// （0 以下で無制限、既定は無制限）。burst は瞬間的に許す点数で、0 以下なら perSec を切り上げた値（最低 1）。
+// トークンバケットで判定し、超えた点は書かずに ErrThrottled を返します。壊れた上流が大量のプレイヤーを返したときなどに
+// ディスクを埋めないための安全弁で、通常の流量より十分大きく設定します。AppendVec は軸ごとのシリーズで別々に数えます。
+func WithRateLimit(perSec float64, burst int) Option {
+	return func(s *TSStore) {
+		if perSec <= 0 {
+			s.rate = nil
+			return
+		}
+		if burst <= 0 {
+			burst = max(1, int(math.Ceil(perSec)))
+		}
+		s.rate = &rateLimit{perSec: perSec, burst: float64(burst)}
+	}
+}
+
+// rateLimit はシリーズごとのトークンバケットです。
+type rateLimit struct {
+	perSec  float64
+	burst   float64
+	buckets sync.Map // series -> *bucket
+}
+
+type bucket struct {
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	throttled atomic.Int64
+}
+
+// allow は series に 1 点書けるならトークンを 1 つ使って true を返します。
+func (l *rateLimit) allow(series string, now time.Time) bool {
+	v, ok := l.buckets.Load(series)
+	if !ok {
+		v, _ = l.buckets.LoadOrStore(series, &bucket{tokens: l.burst, last: now})
+	}
+	b := v.(*bucket)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if el := now.Sub(b.last); el > 0 {
+		b.tokens = min(l.burst, b.tokens+el.Seconds()*l.perSec)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		b.throttled.Add(1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// checkRate は WithRateLimit の上限を超えていれば ErrThrottled を返します。
+func (s *TSStore) checkRate(series string) error {
+	if s.rate == nil || s.rate.allow(series, time.Now()) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrThrottled, series)
+}
+
+// Throttled は WithRateLimit で捨てた点の累積数をシリーズごとに返します（1 度も捨てていないシリーズは含まない）。
+func (s *TSStore) Throttled() map[string]int64 {
+	out := make(map[string]int64)
+	if s.rate == nil {
+		return out
+	}
+	s.rate.buckets.Range(func(k, v any) bool {
+		if n := v.(*bucket).throttled.Load(); n > 0 {
+			out[k.(string)] = n
+		}
+		return true
+	})
+	return out
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+// ErrShardedRouter は、シャード構成のストアでタグを指定せずに Router を取ろうとしたときに返ります（EnsureRouterFor を使う）。
+var ErrShardedRouter = errors.New("storage: sharded store needs tags to pick a router (use EnsureRouterFor)")
+
+// routerKey は routers のキーです（シャード無しなら shard は常に 0）。
+type routerKey struct {
+	series string
+	shard  int
+}
+
+func (k routerKey) String() string {
+	if k.shard == 0 {
+		return k.series
+	}
+	return k.series + "#" + strconv.Itoa(k.shard)
+}
+
+// NewTSStoreSharded: タグセットを tagHash で複数の root（別ディスクなど）に振り分けるストア。
+// 同じタグセットは常に同じ root に書かれる（roots の順序と数は変えないこと）。
+// 読み取り（Query/Aggregate）・Retention・ListSeries・Snapshot は全 root をまとめて扱う。
+// WithWAL を使う場合、RouterFactory が返す WAL パスはシャード間で共有されるため併用しないこと。
+// roots が空ならエラーを返します。
+func NewTSStoreSharded(roots []string, f RouterFactory, opts ...Option) (*TSStore, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("storage: NewTSStoreSharded needs at least one root")
+	}
+	s := NewTSStoreWithFactory(roots[0], f, opts...)
+	s.roots = append([]string(nil), roots...)
+	return s, nil
+}
+
+// shardFor は tags の書き込み先シャード番号を返す。
+func (s *TSStore) shardFor(tags tsfile.Tags) int {
+	if len(s.roots) == 1 {
+		return 0
+	}
+	h, _ := strconv.ParseUint(tags.Hash(), 16, 64)
+	return int(h % uint64(len(s.roots)))
+}
+
+// ListSeries: 全 root 直下のシリーズ名を重複なしで名前順に返す。
+func (s *TSStore) ListSeries() ([]string, error) {
+	seen := map[string]bool{}
+	for _, root := range s.roots {
+		ents, err := os.ReadDir(root)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range ents {
+			if e.IsDir() {
+				seen[e.Name()] = true
+			}
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for name := range seen {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
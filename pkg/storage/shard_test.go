@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/masahide/7dtd-stats/pkg/tsfile"
+)
+
+func TestShardedStoreSpreadsAndMerges(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	s, err := NewTSStoreSharded(roots, func(string) []tsfile.WriterOpt { return nil })
+	if err != nil {
+		t.Fatalf("NewTSStoreSharded: %v", err)
+	}
+	now := time.Now().UTC()
+
+	const n = 16
+	for i := 0; i < n; i++ {
+		p := tsfile.Point{T: now.Add(time.Duration(i) * time.Second), V: float64(i), Tags: tsfile.Tags{"player_id": fmt.Sprintf("P:%d", i)}}
+		if err := s.Append("players.x", p); err != nil {
+			t.Fatalf("Append error: %v", err)
+		}
+	}
+	if err := s.Append("events.count", tsfile.Point{T: now, V: 1, Tags: tsfile.Tags{"kind": "x"}}); err != nil {
+		t.Fatalf("Append error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	// 両方の root に書かれている
+	for _, root := range roots {
+		ents, _ := os.ReadDir(filepath.Join(root, "players.x"))
+		if len(ents) == 0 {
+			t.Fatalf("no tag sets written under %s", root)
+		}
+	}
+
+	pts, err := s.Query("players.x", now.Add(-time.Minute), now.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if len(pts) != n {
+		t.Fatalf("got %d points, want %d", len(pts), n)
+	}
+	for i, p := range pts {
+		if p.V != float64(i) {
+			t.Fatalf("point %d V=%v, want time-ordered merge", i, p.V)
+		}
+	}
+
+	series, err := s.ListSeries()
+	if err != nil {
+		t.Fatalf("ListSeries error: %v", err)
+	}
+	if !slices.Equal(series, []string{"events.count", "players.x"}) {
+		t.Fatalf("ListSeries = %v", series)
+	}
+}
+
+func TestShardedRetentionFansOut(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	s, err := NewTSStoreSharded(roots, func(string) []tsfile.WriterOpt { return nil })
+	if err != nil {
+		t.Fatalf("NewTSStoreSharded: %v", err)
+	}
+	old := time.Now().UTC().AddDate(0, 0, -10)
+
+	for i := 0; i < 16; i++ {
+		p := tsfile.Point{T: old, V: 1, Tags: tsfile.Tags{"player_id": fmt.Sprintf("P:%d", i)}}
+		if err := s.Append("players.x", p); err != nil {
+			t.Fatalf("Append error: %v", err)
+		}
+	}
+	if err := s.FlushAll(); err != nil {
+		t.Fatalf("FlushAll error: %v", err)
+	}
+	if err := s.Retention(3, time.UTC); err != nil {
+		t.Fatalf("Retention error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	pts, err := s.Query("players.x", old.Add(-time.Hour), time.Now(), nil)
+	if err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if len(pts) != 0 {
+		t.Fatalf("retention left %d points across shards", len(pts))
+	}
+}
+
+func TestShardedStoreRejectsEmptyRoots(t *testing.T) {
+	if s, err := NewTSStoreSharded(nil, nil); err == nil || s != nil {
+		t.Fatalf("NewTSStoreSharded(nil) = %v, %v; want an error", s, err)
+	}
+}
+
+func TestShardedStoreEnsureRouterNeedsTags(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir()}
+	s, err := NewTSStoreSharded(roots, func(string) []tsfile.WriterOpt { return nil })
+	if err != nil {
+		t.Fatalf("NewTSStoreSharded: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	if r, err := s.EnsureRouter("players.x"); !errors.Is(err, ErrShardedRouter) || r != nil {
+		t.Fatalf("EnsureRouter = %v, %v; want ErrShardedRouter", r, err)
+	}
+	// タグを渡せば書き込み先のシャードの Router が取れる
+	tags := tsfile.Tags{"player_id": "P:1"}
+	r, err := s.EnsureRouterFor("players.x", tags)
+	if err != nil {
+		t.Fatalf("EnsureRouterFor: %v", err)
+	}
+	if want := roots[s.shardFor(tags)]; r.Root() != want {
+		t.Fatalf("router root = %s, want %s", r.Root(), want)
+	}
+
+	// root が 1 つならシャード無しと同じく EnsureRouter が使える
+	one, err := NewTSStoreSharded(roots[:1], func(string) []tsfile.WriterOpt { return nil })
+	if err != nil {
+		t.Fatalf("NewTSStoreSharded: %v", err)
+	}
+	if _, err := one.EnsureRouter("players.x"); err != nil {
+		t.Fatalf("single-root EnsureRouter: %v", err)
+	}
+	_ = one.Close()
+}
@@ -2,8 +2,14 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"os"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
@@ -13,17 +19,37 @@ import (
 type RouterFactory func(series string) []tsfile.WriterOpt
 
 type TSStore struct {
-	root     string
+	roots    []string      // データルート（NewTSStoreSharded 以外は 1 つ）
 	factory  RouterFactory // シリーズごとに WriterOpt を与えたい場合に使う
-	routers  sync.Map      // map[string]*tsfile.Router  (シリーズ名 → Router)
+	routers  sync.Map      // map[routerKey]*tsfile.Router  (シリーズ名・シャード → Router)
 	closeMux sync.Mutex
 	closed   bool
+	inflight chan struct{} // AppendCtx の同時実行数セマフォ（nil なら無制限）
+	rate     *rateLimit    // WithRateLimit（nil なら無制限）
+	disk     *diskGuard    // WithMinFreeBytes（nil なら無効）
+
+	statDisk func() (uint64, error) // テスト用の DiskStatus の差し替え（nil なら DiskStatus）
+}
+
+// Option は TSStore のオプション設定です。
+type Option func(*TSStore)
+
+// WithMaxInFlight は AppendCtx の同時実行数の上限を設定します（0 以下で無制限）。
+// 上限に達すると AppendCtx は空きが出るか ctx が終了するまで待機します。
+func WithMaxInFlight(n int) Option {
+	return func(s *TSStore) {
+		if n <= 0 {
+			s.inflight = nil
+			return
+		}
+		s.inflight = make(chan struct{}, n)
+	}
 }
 
 // NewTSStore: 既定の WriterOpt を使う簡易コンストラクタ
 func NewTSStore(root string, defaultOpts ...tsfile.WriterOpt) *TSStore {
 	return &TSStore{
-		root: root,
+		roots: []string{root},
 		factory: func(_ string) []tsfile.WriterOpt {
 			return defaultOpts
 		},
@@ -31,21 +57,40 @@ func NewTSStore(root string, defaultOpts ...tsfile.WriterOpt) *TSStore {
 }
 
 // NewTSStoreWithFactory: シリーズごとに個別のオプションを付与したい場合
-func NewTSStoreWithFactory(root string, f RouterFactory) *TSStore {
-	return &TSStore{root: root, factory: f}
+// opts で TSStore 自体のオプション（WithMaxInFlight など）も指定できる。
+func NewTSStoreWithFactory(root string, f RouterFactory, opts ...Option) *TSStore {
+	s := &TSStore{roots: []string{root}, factory: f}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // EnsureRouter: シリーズ名に対応する Router を遅延生成（スレッド安全）
+// シャード構成（NewTSStoreSharded で root が 2 つ以上）ではどのシャードか決まらないので ErrShardedRouter を返す。
+// タグに応じた Router は EnsureRouterFor で取る。
 func (s *TSStore) EnsureRouter(series string) (*tsfile.Router, error) {
+	if len(s.roots) > 1 {
+		return nil, ErrShardedRouter
+	}
+	return s.ensureRouter(routerKey{series: series})
+}
+
+// EnsureRouterFor: tags の書き込み先シャードの Router を返す（シャード無しなら EnsureRouter と同じ）。
+func (s *TSStore) EnsureRouterFor(series string, tags tsfile.Tags) (*tsfile.Router, error) {
+	return s.ensureRouter(routerKey{series: series, shard: s.shardFor(tags)})
+}
+
+func (s *TSStore) ensureRouter(key routerKey) (*tsfile.Router, error) {
 	if s.isClosed() {
 		return nil, errors.New("TSStore closed")
 	}
-	if v, ok := s.routers.Load(series); ok {
+	if v, ok := s.routers.Load(key); ok {
 		return v.(*tsfile.Router), nil
 	}
 	// create new
-	r := tsfile.NewRouter(s.root, series, s.factory(series)...)
-	actual, loaded := s.routers.LoadOrStore(series, r)
+	r := tsfile.NewRouter(s.roots[key.shard], key.series, s.factory(key.series)...)
+	actual, loaded := s.routers.LoadOrStore(key, r)
 	if loaded {
 		// すでに他ゴルーチンが作っていたら今作った方を閉じる
 		_ = r.Close()
@@ -54,45 +99,194 @@ func (s *TSStore) EnsureRouter(series string) (*tsfile.Router, error) {
 }
 
 // Append: 汎用の 1点書き込み
+// WithRateLimit の上限を超えた場合は書かずに ErrThrottled、WithMinFreeBytes の下限を下回っていれば ErrLowDisk を返す。
 func (s *TSStore) Append(series string, p tsfile.Point) error {
-	r, err := s.EnsureRouter(series)
+	if err := s.checkDisk(series); err != nil {
+		return err
+	}
+	if err := s.checkRate(series); err != nil {
+		return err
+	}
+	r, err := s.EnsureRouterFor(series, p.Tags)
 	if err != nil {
 		return err
 	}
 	return r.Append(p)
 }
 
+// AppendCtx: ctx のキャンセルを尊重する 1点書き込み
+// WithMaxInFlight が設定されていれば、同時実行数が上限に達している間は空きが出るか
+// ctx が終了するまで待機する（ディスク停滞時に書き込みが際限なく積み上がるのを防ぐ）。
+// Append は従来通り上限の対象外。
+func (s *TSStore) AppendCtx(ctx context.Context, series string, p tsfile.Point) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.inflight != nil {
+		select {
+		case s.inflight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-s.inflight }()
+	}
+	return s.Append(series, p)
+}
+
 // AppendVec: ベクトル値（例: players の X/Z/Y）を任意軸だけ書く
 // 例: AppendVec("players", t, map[string]float64{"x":X, "z":Z}, tags)
+// 軸は別シリーズなので原子的ではない。1 軸が失敗しても残りの軸は書き、失敗した軸ごとの *AxisError を
+// errors.Join でまとめて返す（一部の軸だけ書かれた状態があり得る。どの軸かは FailedAxes で取り出せる）。
 func (s *TSStore) AppendVec(base string, t time.Time, axes map[string]float64, tags map[string]string) error {
-	for axis, v := range axes {
-		if err := s.Append(base+"."+axis, tsfile.Point{T: t, V: v, Tags: tags}); err != nil {
-			return err
+	var errs []error
+	for _, axis := range slices.Sorted(maps.Keys(axes)) {
+		if err := s.Append(base+"."+axis, tsfile.Point{T: t, V: axes[axis], Tags: tags}); err != nil {
+			errs = append(errs, &AxisError{Axis: axis, Err: err})
 		}
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// AppendMulti: 名前付きの複数の値（例: {"x":X, "z":Z}）を series に 1 点として書く（tsfile.Router.AppendMulti）。
+// AppendVec と違い 1 レコードなので原子的で、読むときに軸のシリーズを時刻で突き合わせる必要もない。
+// 値は Query などで返す Point.Values に入る（V は 0）。WithRateLimit では 1 点として数える。
+func (s *TSStore) AppendMulti(series string, t time.Time, values map[string]float64, tags map[string]string) error {
+	if err := s.checkDisk(series); err != nil {
+		return err
+	}
+	if err := s.checkRate(series); err != nil {
+		return err
+	}
+	r, err := s.EnsureRouterFor(series, tags)
+	if err != nil {
+		return err
+	}
+	return r.AppendMulti(t, values, tags)
+}
+
+// AxisError は AppendVec / AppendVecTagged で 1 軸の書き込みに失敗したことを表します。
+type AxisError struct {
+	Axis string
+	Err  error
+}
+
+func (e *AxisError) Error() string { return "storage: axis " + e.Axis + ": " + e.Err.Error() }
+func (e *AxisError) Unwrap() error { return e.Err }
+
+// FailedAxes は AppendVec / AppendVecTagged のエラーから失敗した軸を名前順で返します（無ければ nil）。
+func FailedAxes(err error) []string {
+	var out []string
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case *AxisError:
+			out = append(out, e.Axis)
+		case interface{ Unwrap() []error }:
+			for _, x := range e.Unwrap() {
+				walk(x)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	slices.Sort(out)
+	return out
+}
+
+// AxisValue は AppendVecTagged の 1 軸分の値と、その軸だけに重ねるタグです。
+type AxisValue struct {
+	V    float64
+	Tags map[string]string // 共通タグに上書きマージ（nil 可）
 }
 
-// AppendEvent: カウント系イベント（connect/death など）
+// AppendVecTagged: AppendVec の軸ごとタグ版。各軸のタグは共通の tags に AxisValue.Tags を重ねたもの。
+// 例: AppendVecTagged("players", t, map[string]AxisValue{"x": {V: X}, "health": {V: H, Tags: map[string]string{"unit": "hp"}}}, tags)
+// エラーの扱いは AppendVec と同じ（全軸を試し、失敗した軸の *AxisError をまとめて返す）。
+func (s *TSStore) AppendVecTagged(base string, t time.Time, axes map[string]AxisValue, tags map[string]string) error {
+	var errs []error
+	for _, axis := range slices.Sorted(maps.Keys(axes)) {
+		av := axes[axis]
+		merged := tags
+		if len(av.Tags) > 0 {
+			merged = make(map[string]string, len(tags)+len(av.Tags))
+			maps.Copy(merged, tags)
+			maps.Copy(merged, av.Tags)
+		}
+		if err := s.Append(base+"."+axis, tsfile.Point{T: t, V: av.V, Tags: merged}); err != nil {
+			errs = append(errs, &AxisError{Axis: axis, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AppendEvent: カウント系イベント（connect/death など）。プレイヤーのイベントは AppendPlayerEvent を推奨
 func (s *TSStore) AppendEvent(t time.Time, kind string, tags map[string]string) error {
 	if tags == nil {
 		tags = map[string]string{}
 	}
-	tags["kind"] = kind
-	return s.Append("events.count", tsfile.Point{T: t, V: 1, Tags: tags})
+	tags[TagKind] = kind
+	return s.Append(EventsSeries, tsfile.Point{T: t, V: 1, Tags: tags})
 }
 
+// FlushAll: 全 Router を Flush。途中で失敗しても残りの Router も処理し、
+// 発生したエラーは errors.Join でまとめて返す（全成功なら nil）。
 func (s *TSStore) FlushAll() error {
-	var err error
-	s.routers.Range(func(_, v any) bool {
-		if e := v.(*tsfile.Router).Flush(); e != nil && err == nil {
-			err = e
+	var errs []error
+	s.routers.Range(func(k, v any) bool {
+		if e := v.(*tsfile.Router).Flush(); e != nil {
+			errs = append(errs, fmt.Errorf("flush %s: %w", k, e))
 		}
 		return true
 	})
-	return err
+	return errors.Join(errs...)
+}
+
+// Sync: 全 Router の開いている時間ファイルの gzip メンバーを閉じて（フッターを書いて）fsync し、ディスク上のファイルを
+// 別プロセスの一般的な gzip リーダーでもそのまま読める状態にする（tsfile.Router.Sync）。FlushAll は Flush+fsync するだけで、
+// 書き込み中のファイルは gzip として完結しない（このパッケージの読み取りはデータ終端として扱えるが、gzip -t などは失敗する）。
+// writer もファイルも開いたままで、次の Append は同じ時間ファイルへ新しい gzip メンバーとして追記する。夜間メンテナンスなどで
+// Close せずに読める状態を作るためのもの。WithWAL の Router はその後 WAL も空にする。
+func (s *TSStore) Sync() error {
+	var errs []error
+	s.routers.Range(func(k, v any) bool {
+		if err := v.(*tsfile.Router).Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("sync %s: %w", k, err))
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// CloseIdle: 最後の Append から d 以上経った writer（タグセット）を全 Router で閉じ、閉じた数を返す（tsfile.Router.CloseIdleWriters）。
+// 閉じた時間ファイルは Sync と同じく gzip として完結する。書き込みの止まったプレイヤーのファイルだけを確定させたいときに使う。
+func (s *TSStore) CloseIdle(d time.Duration) (int, error) {
+	var errs []error
+	n := 0
+	s.routers.Range(func(k, v any) bool {
+		r := v.(*tsfile.Router)
+		c, err := r.CloseIdleWriters(d)
+		n += c
+		if err != nil {
+			errs = append(errs, fmt.Errorf("close idle %s: %w", k, err))
+		}
+		return true
+	})
+	return n, errors.Join(errs...)
+}
+
+// Snapshot: root 全体のバックアップを tar.gz で w に書き出す（tsfile.Snapshot）。
+// 先に FlushAll して、その時点までの点を確実に含める。書き込み中の時間ファイルは
+// Flush 済みの範囲まで（gzip フッター無し）が入り、Flush 後に追記された点は含まれないことがある。
+func (s *TSStore) Snapshot(w io.Writer) error {
+	if err := s.FlushAll(); err != nil {
+		return err
+	}
+	return tsfile.SnapshotRoots(w, s.roots)
 }
 
+// Close: 全 Router を Close（冪等）。FlushAll と同様に全 Router を閉じ切り、
+// エラーは errors.Join でまとめて返す。
 func (s *TSStore) Close() error {
 	s.closeMux.Lock()
 	defer s.closeMux.Unlock()
@@ -100,14 +294,28 @@ func (s *TSStore) Close() error {
 		return nil
 	}
 	s.closed = true
-	var err error
-	s.routers.Range(func(_, v any) bool {
-		if e := v.(*tsfile.Router).Close(); e != nil && err == nil {
-			err = e
+	var errs []error
+	s.routers.Range(func(k, v any) bool {
+		if e := v.(*tsfile.Router).Close(); e != nil {
+			errs = append(errs, fmt.Errorf("close %s: %w", k, e))
 		}
 		return true
 	})
-	return err
+	return errors.Join(errs...)
+}
+
+// Reopen: Close 済みのストアを再び書き込み可能にする。
+// Close 済みの Router は破棄され、次回アクセス時に遅延生成し直される。
+// Close 以前に EnsureRouter で取得した *tsfile.Router は無効になるため、再取得すること。
+// Close されていないストアに対しては何もしない。
+func (s *TSStore) Reopen() {
+	s.closeMux.Lock()
+	defer s.closeMux.Unlock()
+	if !s.closed {
+		return
+	}
+	s.routers.Clear()
+	s.closed = false
 }
 
 func (s *TSStore) isClosed() bool {
@@ -116,27 +324,89 @@ func (s *TSStore) isClosed() bool {
 	return s.closed
 }
 
-// Retention: 引数 series が空なら root 直下の全シリーズを自動列挙
+// Retention: 引数 series が空なら root 直下の全シリーズを自動列挙（シャード構成では各 root ごと）
+// シリーズごとに最大 retentionWorkers 並列で処理し、途中で失敗しても残りのシリーズは処理して errors.Join でまとめて返す。
+// 削除前に該当シリーズの Router を Flush し、削除対象日のファイルを開いている writer を閉じる
+// （閉じずに消すと、Unix では削除済みファイルへ書き続けてデータを失い、Windows では削除に失敗する）。
 func (s *TSStore) Retention(days int, loc *time.Location, series ...string) error {
+	_, err := s.retention(days, loc, false, series)
+	return err
+}
+
+// RetentionDryRun: Retention と同じ判定で削除対象の日ディレクトリを返す（削除も Flush もしない）。
+// 日境界（TZ）の確認用。
+func (s *TSStore) RetentionDryRun(days int, loc *time.Location, series ...string) ([]string, error) {
+	return s.retention(days, loc, true, series)
+}
+
+// retentionWorkers は Retention で同時に処理するシリーズ数の上限です。
+const retentionWorkers = 4
+
+func (s *TSStore) retention(days int, loc *time.Location, dryRun bool, series []string) ([]string, error) {
 	if loc == nil {
 		loc = time.UTC
 	}
 	boundary := time.Now().In(loc).AddDate(0, 0, -days)
 
-	list := series
-	if len(list) == 0 {
-		ents, _ := os.ReadDir(s.root)
-		for _, e := range ents {
-			if e.IsDir() {
-				list = append(list, e.Name())
+	var (
+		mu      sync.Mutex // deleted と errs を保護
+		deleted []string
+		errs    []error
+	)
+	opts := []tsfile.DeleteOpt{tsfile.WithOnDelete(func(p string) {
+		mu.Lock()
+		deleted = append(deleted, p)
+		mu.Unlock()
+	})}
+	if dryRun {
+		opts = append(opts, tsfile.WithDryRun())
+	}
+
+	// シリーズ（ディレクトリ）ごとに独立なので、上限付きで並列に処理する
+	sem := make(chan struct{}, retentionWorkers)
+	var wg sync.WaitGroup
+	for shard, root := range s.roots {
+		list := series
+		if len(list) == 0 {
+			ents, _ := os.ReadDir(root)
+			for _, e := range ents {
+				if e.IsDir() {
+					list = append(list, e.Name())
+				}
 			}
 		}
+		for _, sv := range list {
+			sem <- struct{}{}
+			wg.Go(func() {
+				defer func() { <-sem }()
+				if err := s.retainSeries(root, shard, sv, boundary, loc, dryRun, opts); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("retention %s: %w", sv, err))
+					mu.Unlock()
+				}
+			})
+		}
 	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errors.Join(errs...)
+}
 
-	for _, sv := range list {
-		if err := tsfile.DeleteBeforeDay(s.root, sv, boundary, loc); err != nil {
+// retainSeries は 1 シリーズ（1 シャード）分の Retention です。
+func (s *TSStore) retainSeries(root string, shard int, series string, boundary time.Time, loc *time.Location, dryRun bool, opts []tsfile.DeleteOpt) error {
+	var err error
+	if v, ok := s.routers.Load(routerKey{series: series, shard: shard}); ok && !dryRun {
+		r := v.(*tsfile.Router)
+		if err := r.Flush(); err != nil {
 			return err
 		}
+		// ファイルを閉じてから消すまで Router のロックを持つ（間に古い日のファイルを開き直させない）
+		err = r.DeleteBeforeDay(boundary, loc, opts...)
+	} else {
+		err = tsfile.DeleteBeforeDay(root, series, boundary, loc, opts...)
 	}
-	return nil
+	if err != nil && len(s.roots) > 1 && errors.Is(err, os.ErrNotExist) {
+		return nil // シャードにはそのシリーズが無いこともある
+	}
+	return err
 }
@@ -1,6 +1,17 @@
 package storage
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -159,7 +170,7 @@ func TestAppendEventAndScan(t *testing.T) {
 	pid := "P:test:2"
 	world := "RWG"
 	src := "test"
-	kind := "player_connect"
+	kind := EventPlayerConnect.String()
 
 	if err := s.AppendEvent(now, kind, map[string]string{
 		"player_id": pid, "world": world, "src": src,
@@ -227,6 +238,95 @@ func TestFlushCloseAndPostCloseBehavior(t *testing.T) {
 	}
 }
 
+func TestReopenAfterClose(t *testing.T) {
+	s, root := newStoreForTest(t)
+
+	base := time.Now().UTC()
+	tags := map[string]string{"player_id": "P:test:reopen"}
+
+	if err := s.Append("players.x", tsfile.Point{T: base, V: 1, Tags: tags}); err != nil {
+		t.Fatalf("Append(1) error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(1) error: %v", err)
+	}
+	if err := s.Append("players.x", tsfile.Point{T: base, V: 9, Tags: tags}); err == nil {
+		t.Fatalf("Append should fail while closed")
+	}
+
+	s.Reopen()
+	if err := s.Append("players.x", tsfile.Point{T: base.Add(time.Second), V: 2, Tags: tags}); err != nil {
+		t.Fatalf("Append(2) after Reopen error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(2) error: %v", err)
+	}
+
+	pts, err := collect(t, root, "players.x", base.Add(-time.Minute), base.Add(time.Minute), func(p tsfile.Point) bool {
+		return p.Tags["player_id"] == "P:test:reopen"
+	})
+	if err != nil {
+		t.Fatalf("ScanRange: %v", err)
+	}
+	if len(pts) != 2 {
+		t.Fatalf("want 2 points across reopen, got %d: %+v", len(pts), pts)
+	}
+	seen := map[float64]bool{}
+	for _, p := range pts {
+		seen[p.V] = true
+	}
+	if !seen[1] || !seen[2] {
+		t.Fatalf("both batches should be readable, got %+v", pts)
+	}
+}
+
+func TestAppendCtxBackpressure(t *testing.T) {
+	root := t.TempDir()
+	s := NewTSStoreWithFactory(root, func(string) []tsfile.WriterOpt {
+		return []tsfile.WriterOpt{tsfile.WithFlushEvery(1)}
+	}, WithMaxInFlight(1))
+	t.Cleanup(func() { _ = s.Close() })
+
+	now := time.Now().UTC()
+	p := tsfile.Point{T: now, V: 1, Tags: map[string]string{"player_id": "P:test:ctx"}}
+
+	// キャンセル済み ctx は即エラー
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.AppendCtx(canceled, "players.x", p); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+
+	// 上限いっぱい（スロットを占有）の間は期限切れまで待ってエラー
+	s.inflight <- struct{}{}
+	ctx, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	if err := s.AppendCtx(ctx, "players.x", p); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded while saturated, got %v", err)
+	}
+
+	// 空きが出れば待機中の書き込みが進む
+	done := make(chan error, 1)
+	go func() { done <- s.AppendCtx(context.Background(), "players.x", p) }()
+	time.Sleep(20 * time.Millisecond)
+	<-s.inflight
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("AppendCtx after release: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AppendCtx did not proceed after capacity freed")
+	}
+
+	// Append は上限の対象外
+	s.inflight <- struct{}{}
+	if err := s.Append("players.x", p); err != nil {
+		t.Fatalf("Append should not be bounded: %v", err)
+	}
+	<-s.inflight
+}
+
 func TestRetentionRemovesOldData(t *testing.T) {
 	s, root := newStoreForTest(t)
 
@@ -292,6 +392,40 @@ func TestRetentionRemovesOldData(t *testing.T) {
 	}
 }
 
+func TestRetentionWithOpenWriterForOldDay(t *testing.T) {
+	s, root := newStoreForTest(t)
+
+	jst, _ := time.LoadLocation("Asia/Tokyo")
+	oldT := time.Now().In(jst).Add(-48 * time.Hour).UTC()
+	tags := map[string]string{"player_id": "P:test:backfill"}
+
+	// 古い日のファイルを開いたまま（Close せずに）リテンションを実行
+	if err := s.Append("players.x", tsfile.Point{T: oldT, V: 1, Tags: tags}); err != nil {
+		t.Fatalf("Append old(1) error: %v", err)
+	}
+	if err := s.Retention(0, jst, "players.x"); err != nil {
+		t.Fatalf("Retention error: %v", err)
+	}
+
+	// バックフィル継続: 同じ古い日に追記しても、削除済みファイルに消えず新しいファイルに残ること
+	if err := s.Append("players.x", tsfile.Point{T: oldT.Add(time.Second), V: 2, Tags: tags}); err != nil {
+		t.Fatalf("Append old(2) error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	pts, err := collect(t, root, "players.x", oldT.Add(-time.Minute), oldT.Add(time.Minute), func(p tsfile.Point) bool {
+		return p.Tags["player_id"] == "P:test:backfill"
+	})
+	if err != nil {
+		t.Fatalf("ScanRange: %v", err)
+	}
+	if len(pts) != 1 || pts[0].V != 2 {
+		t.Fatalf("want only the post-retention point (V=2), got %+v", pts)
+	}
+}
+
 func TestRetentionEnumeratesSeries(t *testing.T) {
 	s, root := newStoreForTest(t)
 
@@ -391,3 +525,364 @@ func TestRetentionEnumeratesSeries(t *testing.T) {
 		}
 	}
 }
+
+func TestAppendMultiStoresValuesInOneRecord(t *testing.T) {
+	s, root := newStoreForTest(t)
+	base := time.Date(2025, 8, 26, 12, 0, 0, 0, time.UTC)
+	tags := map[string]string{"player_id": "P:1"}
+	for i, pos := range [][2]float64{{10, -20}, {14, -24}, {30, 0}} {
+		if err := s.AppendMulti("players.pos", base.Add(time.Duration(i)*20*time.Second), map[string]float64{"x": pos[0], "z": pos[1]}, tags); err != nil {
+			t.Fatalf("AppendMulti: %v", err)
+		}
+	}
+	if err := s.AppendMulti("players.pos", base, nil, tags); err == nil {
+		t.Fatal("want error for no values")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 タグセットにつき 1 つのディレクトリ（軸ごとのシリーズは作らない）
+	if entries, _ := os.ReadDir(root); len(entries) != 1 || entries[0].Name() != "players.pos" {
+		t.Fatalf("series dirs = %v", entries)
+	}
+	pts, err := s.Query("players.pos", base, base.Add(time.Minute), tsfile.Tags{"player_id": "P:1"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(pts) != 3 || pts[1].Values["x"] != 14 || pts[1].Values["z"] != -24 || pts[1].V != 0 {
+		t.Fatalf("points = %+v", pts)
+	}
+
+	agg, err := s.Aggregate("players.pos", base, base.Add(time.Minute), nil, 30*time.Second)
+	if err != nil {
+		t.Fatalf("Aggregate: %v", err)
+	}
+	if len(agg) != 2 || agg[0].Values["x"] != 12 || agg[0].Values["z"] != -22 || agg[1].Values["x"] != 30 {
+		t.Fatalf("aggregate = %+v", agg)
+	}
+}
+
+func TestAppendVecTaggedMergesAxisTags(t *testing.T) {
+	s, root := newStoreForTest(t)
+	now := time.Now().UTC()
+	common := map[string]string{"player_id": "P:1", "unit": "m"}
+
+	if err := s.AppendVecTagged("players", now, map[string]AxisValue{
+		"x":      {V: 1},
+		"health": {V: 80, Tags: map[string]string{"unit": "hp"}},
+	}, common); err != nil {
+		t.Fatalf("AppendVecTagged error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if common["unit"] != "m" {
+		t.Fatalf("common tags mutated: %v", common)
+	}
+
+	from, to := now.Add(-time.Minute), now.Add(time.Minute)
+	for series, wantUnit := range map[string]string{"players.x": "m", "players.health": "hp"} {
+		ps, err := collect(t, root, series, from, to, nil)
+		if err != nil {
+			t.Fatalf("ScanRange %s: %v", series, err)
+		}
+		if len(ps) != 1 || ps[0].Tags["unit"] != wantUnit || ps[0].Tags["player_id"] != "P:1" {
+			t.Fatalf("%s: got %+v, want unit=%s", series, ps, wantUnit)
+		}
+	}
+}
+
+func TestAppendVecWritesRemainingAxesAndNamesFailures(t *testing.T) {
+	s, root := newStoreForTest(t)
+	now := time.Now().UTC()
+	// players.z の場所にファイルを置き、z 軸の writer だけディレクトリを作れないようにする
+	if err := os.WriteFile(filepath.Join(root, "players.z"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]string{"player_id": "P:1"}
+	err := s.AppendVec("players", now, map[string]float64{"x": 1, "y": 2, "z": 3}, tags)
+	if err == nil {
+		t.Fatal("want error for axis z")
+	}
+	if got := FailedAxes(err); !slices.Equal(got, []string{"z"}) {
+		t.Fatalf("FailedAxes = %v, want [z] (err=%v)", got, err)
+	}
+	if !strings.Contains(err.Error(), "axis z") {
+		t.Fatalf("error should name the axis: %v", err)
+	}
+	if got := FailedAxes(fmt.Errorf("wrapped: %w", err)); !slices.Equal(got, []string{"z"}) {
+		t.Fatalf("FailedAxes through a wrapper = %v", got)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	// z より前でも後でも、他の軸は書かれている
+	for _, series := range []string{"players.x", "players.y"} {
+		ps, err := collect(t, root, series, now.Add(-time.Minute), now.Add(time.Minute), nil)
+		if err != nil || len(ps) != 1 {
+			t.Fatalf("%s: got %+v, %v", series, ps, err)
+		}
+	}
+	if FailedAxes(nil) != nil {
+		t.Fatal("FailedAxes(nil) should be nil")
+	}
+}
+
+func TestSnapshotWritesTarGzOfDataFiles(t *testing.T) {
+	s, _ := newStoreForTest(t)
+	now := time.Now().UTC()
+	if err := s.AppendVec("players", now, map[string]float64{"x": 1, "z": 2}, map[string]string{"player_id": "P:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close せずに（書き込み中のまま）スナップショットを取る
+	var buf bytes.Buffer
+	if err := s.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot error: %v", err)
+	}
+
+	// 展開して別の root から読めること
+	restored := t.TempDir()
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		dst := filepath.Join(restored, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		if err := os.WriteFile(dst, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var labels, data int
+	for _, n := range names {
+		switch {
+		case strings.HasSuffix(n, "/labels.json"):
+			labels++
+		case strings.HasSuffix(n, ".ndjson.gz"):
+			data++
+		default:
+			t.Errorf("unexpected entry %q", n)
+		}
+	}
+	if labels != 2 || data != 2 {
+		t.Fatalf("entries = %v, want labels.json and one hour file per series", names)
+	}
+	ps, err := collect(t, restored, "players.z", now.Add(-time.Minute), now.Add(time.Minute), nil)
+	if err != nil || len(ps) != 1 || ps[0].V != 2 {
+		t.Fatalf("restored players.z = %+v, %v", ps, err)
+	}
+}
+
+func TestSyncFinalizesOpenHourFiles(t *testing.T) {
+	s, root := newStoreForTest(t)
+	now := time.Now().UTC()
+	tags := tsfile.Tags{"player_id": "P:sync"}
+	_, file := tsfile.PathForHour(root, "players.x", tags, now)
+
+	// ファイル全体を厳密な gzip リーダーで読み、行数を返す（フッターが無ければ ErrUnexpectedEOF）
+	readLines := func() int {
+		t.Helper()
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("hour file is not a complete gzip stream: %v", err)
+		}
+		return strings.Count(string(b), "\n")
+	}
+
+	if err := s.Append("players.x", tsfile.Point{T: now, V: 1, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.CloseIdle(time.Hour); err != nil || n != 0 {
+		t.Fatalf("CloseIdle(1h) = %d, %v; want nothing closed", n, err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	if got := readLines(); got != 1 {
+		t.Fatalf("lines after Sync = %d, want 1", got)
+	}
+	// Sync は writer を閉じずにその場で確定させる
+	if r, err := s.EnsureRouter("players.x"); err != nil || r.WriterCount() != 1 {
+		t.Fatalf("writers after Sync: %v", err)
+	}
+
+	// Sync 後もストアは使え、同じ時間ファイルへ追記される
+	if err := s.Append("players.x", tsfile.Point{T: now.Add(time.Millisecond), V: 2, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.CloseIdle(0); err != nil || n != 1 {
+		t.Fatalf("CloseIdle(0) = %d, %v; want 1", n, err)
+	}
+	if got := readLines(); got != 2 {
+		t.Fatalf("lines after CloseIdle = %d, want 2", got)
+	}
+}
+
+func TestRetentionDryRunReportsWithoutDeleting(t *testing.T) {
+	s, root := newStoreForTest(t)
+	jst, _ := time.LoadLocation("Asia/Tokyo")
+	oldT := time.Now().In(jst).Add(-48 * time.Hour).UTC()
+	now := time.Now().UTC()
+	tags := map[string]string{"player_id": "P:test:dry"}
+	for _, ts := range []time.Time{oldT, now} {
+		if err := s.Append("players.x", tsfile.Point{T: ts, V: 1, Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	would, err := s.RetentionDryRun(0, jst)
+	if err != nil {
+		t.Fatalf("RetentionDryRun error: %v", err)
+	}
+	if len(would) != 1 {
+		t.Fatalf("would delete %v, want exactly the old day", would)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := collect(t, root, "players.x", oldT.Add(-time.Minute), oldT.Add(time.Minute), nil)
+	if err != nil || len(pts) != 1 {
+		t.Fatalf("old point after dry-run = %v, %v; want kept", pts, err)
+	}
+}
+
+func TestRetentionParallelAcrossSeries(t *testing.T) {
+	s, root := newStoreForTest(t)
+	old := time.Now().UTC().AddDate(0, 0, -10)
+	now := time.Now().UTC()
+
+	const nSeries = 12
+	for i := 0; i < nSeries; i++ {
+		series := fmt.Sprintf("s%02d.v", i)
+		for _, ts := range []time.Time{old, old.AddDate(0, 0, 1), now} {
+			if err := s.Append(series, tsfile.Point{T: ts, V: 1, Tags: map[string]string{"k": "v"}}); err != nil {
+				t.Fatalf("Append error: %v", err)
+			}
+		}
+	}
+
+	start := time.Now()
+	if err := s.Retention(3, time.UTC); err != nil {
+		t.Fatalf("Retention error: %v", err)
+	}
+	t.Logf("retention over %d series took %s", nSeries, time.Since(start))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	for i := 0; i < nSeries; i++ {
+		series := fmt.Sprintf("s%02d.v", i)
+		pts, err := collect(t, root, series, old.Add(-time.Hour), now.Add(time.Minute), func(tsfile.Point) bool { return true })
+		if err != nil {
+			t.Fatalf("%s: ScanRange error: %v", series, err)
+		}
+		if len(pts) != 1 || !pts[0].T.Equal(now) {
+			t.Fatalf("%s: got %d points after retention, want only the recent one", series, len(pts))
+		}
+	}
+
+	// 存在しないシリーズの失敗はほかのシリーズの処理を止めず、まとめて返る
+	err := s.Retention(3, time.UTC, "missing.a", "s00.v", "missing.b")
+	if err == nil || !strings.Contains(err.Error(), "missing.a") || !strings.Contains(err.Error(), "missing.b") {
+		t.Fatalf("want joined errors for both missing series, got %v", err)
+	}
+}
+
+func TestRateLimitThrottlesPerSeries(t *testing.T) {
+	root := t.TempDir()
+	s := NewTSStoreWithFactory(root, func(string) []tsfile.WriterOpt {
+		return []tsfile.WriterOpt{tsfile.WithLocation(time.UTC), tsfile.WithFlushInterval(0)}
+	}, WithRateLimit(0.001, 3)) // テスト中に補充されない速さ
+	t.Cleanup(func() { _ = s.Close() })
+
+	now := time.Now().UTC()
+	tags := map[string]string{"player_id": "P:flood"}
+	for i := range 3 {
+		if err := s.Append("players.x", tsfile.Point{T: now, V: float64(i), Tags: tags}); err != nil {
+			t.Fatalf("Append %d within burst: %v", i, err)
+		}
+	}
+	if err := s.Append("players.x", tsfile.Point{T: now, V: 3, Tags: tags}); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("want ErrThrottled, got %v", err)
+	}
+
+	// バケットはシリーズごと。AppendVec は上限に達した軸だけが失敗する
+	err := s.AppendVec("players", now, map[string]float64{"x": 4, "z": 4}, tags)
+	if !errors.Is(err, ErrThrottled) || !slices.Equal(FailedAxes(err), []string{"x"}) {
+		t.Fatalf("AppendVec: want only x throttled, got %v", err)
+	}
+	if got := s.Throttled(); len(got) != 1 || got["players.x"] != 2 {
+		t.Fatalf("Throttled = %v, want players.x: 2", got)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := collect(t, root, "players.x", now.Add(-time.Minute), now.Add(time.Minute), nil)
+	if err != nil || len(ps) != 3 {
+		t.Fatalf("stored players.x = %d points, %v; want 3", len(ps), err)
+	}
+}
+
+func TestMinFreeBytesRefusesNonCriticalSeries(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "data") // まだ無いディレクトリでも親で測る
+	s := NewTSStoreWithFactory(root, func(string) []tsfile.WriterOpt {
+		return []tsfile.WriterOpt{tsfile.WithLocation(time.UTC), tsfile.WithFlushInterval(0)}
+	}, WithMinFreeBytes(1<<30, EventsSeries))
+	t.Cleanup(func() { _ = s.Close() })
+
+	if free, err := s.DiskStatus(); errors.Is(err, errors.ErrUnsupported) {
+		t.Logf("DiskStatus unsupported on this OS")
+	} else if err != nil || free == 0 {
+		t.Fatalf("DiskStatus = %d, %v", free, err)
+	}
+	if s.MinFreeBytes() != 1<<30 {
+		t.Fatalf("MinFreeBytes = %d", s.MinFreeBytes())
+	}
+
+	free := uint64(10 << 20)
+	s.statDisk = func() (uint64, error) { return free, nil }
+	now := time.Now().UTC()
+	tags := map[string]string{"player_id": "P:1"}
+	if err := s.AppendVec("players", now, map[string]float64{"x": 1, "z": 2}, tags); !errors.Is(err, ErrLowDisk) || len(FailedAxes(err)) != 2 {
+		t.Fatalf("AppendVec: want ErrLowDisk on both axes, got %v", err)
+	}
+	if err := s.AppendMulti("players.pos", now, map[string]float64{"x": 1}, tags); !errors.Is(err, ErrLowDisk) {
+		t.Fatalf("AppendMulti: want ErrLowDisk, got %v", err)
+	}
+	if err := s.AppendPlayerEvent(now, EventPlayerDeath, "P:1", "alice", "", nil); err != nil {
+		t.Fatalf("critical series should still be written: %v", err)
+	}
+
+	// 空きが戻れば（次に測り直したときから）書ける
+	free = 2 << 30
+	s.disk.mu.Lock()
+	s.disk.checked = time.Time{}
+	s.disk.mu.Unlock()
+	if err := s.Append("players.x", tsfile.Point{T: now, V: 1, Tags: tags}); err != nil {
+		t.Fatalf("Append after space recovered: %v", err)
+	}
+}
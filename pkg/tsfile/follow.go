@@ -0,0 +1,188 @@
+package tsfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ---- 追従（tail -f 相当） ----
+
+// FollowOpt は Follow のオプションです。
+type FollowOpt func(*follower)
+
+// WithPollInterval は Follow がファイルの伸びを確認する間隔です（既定 1s、0 以下は無視）。
+func WithPollInterval(d time.Duration) FollowOpt {
+	return func(f *follower) {
+		if d > 0 {
+			f.interval = d
+		}
+	}
+}
+
+type follower struct {
+	interval time.Duration
+	from     time.Time
+	fn       func(Point) bool
+	cursors  map[string]*followCursor // tagHash ディレクトリ -> 読み位置
+}
+
+// followCursor は 1 タグセット分の読み位置（時間ファイルと展開後のオフセット）です。
+type followCursor struct {
+	hour   time.Time
+	offset int64 // 展開後のバイト数（最後に読めた完全な行の末尾）
+	size   int64 // 前回読んだときの圧縮ファイルサイズ（伸びていなければ読み直さない）
+}
+
+// Follow は series の既存の点を from から流したあと、ファイルへの追記を poll して新しい点を fn に渡し続けます。
+// ctx がキャンセルされると ctx.Err() を、fn が false を返すと nil を返します。
+//
+//   - 追記中の時間ファイルは伸びるたびに先頭から展開し直し、前回の位置より後ろの完全な行だけを読みます。
+//   - より新しい時間ファイルが現れたら（Writer がローテーションしたら）次の時間へ進みます。
+//   - 時間ファイルは UTC で区切られている前提です（WithLocation 未指定の Writer）。
+//   - 順序はタグセットごとには時刻順ですが、タグセットをまたいだ順序は保証しません。
+//   - series ディレクトリがまだ無くても、作られるまで待ちます。
+func Follow(ctx context.Context, root, series string, from time.Time, fn func(Point) bool, opts ...FollowOpt) error {
+	f := &follower{
+		interval: time.Second,
+		from:     from.UTC(),
+		fn:       fn,
+		cursors:  make(map[string]*followCursor),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	seriesDir := filepath.Join(root, series)
+	t := time.NewTicker(f.interval)
+	defer t.Stop()
+	for {
+		if err := f.poll(seriesDir, time.Now().UTC().Truncate(time.Hour)); err != nil {
+			if errors.Is(err, errEarlyStop) {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// poll は全タグセットについて、現在位置から読めるところまで読みます。
+func (f *follower) poll(seriesDir string, nowHour time.Time) error {
+	entries, err := os.ReadDir(seriesDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		tagDir := filepath.Join(seriesDir, e.Name())
+		c, ok := f.cursors[tagDir]
+		if !ok {
+			c = &followCursor{hour: f.from.Truncate(time.Hour)}
+			f.cursors[tagDir] = c
+		}
+		for {
+			if err := f.readCursor(tagDir, c); err != nil {
+				return err
+			}
+			// 次に存在する時間ファイルがあれば、現在のファイルは閉じられている
+			next, ok := nextHourFile(tagDir, c.hour, nowHour)
+			if !ok {
+				break
+			}
+			c.hour, c.offset, c.size = next, 0, 0
+		}
+	}
+	return nil
+}
+
+// readCursor は c の時間ファイルの、前回位置より後ろの完全な行を読みます。
+func (f *follower) readCursor(tagDir string, c *followCursor) error {
+	path := hourPath(tagDir, c.hour)
+	st, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if st.Size() == c.size {
+		return nil
+	}
+	c.size = st.Size()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil // 作成直後（未 Flush）の空ファイル
+		}
+		return err
+	}
+	defer gz.Close()
+	if _, err := io.CopyN(io.Discard, gz, c.offset); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		return err
+	}
+	br := bufio.NewReader(gz)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// 行の途中で終わった分は次回に回す（Flush 済みの範囲までを読む）
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		c.offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var p Point
+		if err := json.Unmarshal(line, &p); err != nil {
+			return err
+		}
+		if p.T.Before(f.from) {
+			continue
+		}
+		if !f.fn(p) {
+			return errEarlyStop
+		}
+	}
+}
+
+// nextHourFile は (cur, limit] で最初に存在する時間ファイルの時刻を返します。
+func nextHourFile(tagDir string, cur, limit time.Time) (time.Time, bool) {
+	for h := cur.Add(time.Hour); !h.After(limit); h = h.Add(time.Hour) {
+		if _, err := os.Stat(hourPath(tagDir, h)); err == nil {
+			return h, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func hourPath(tagDir string, h time.Time) string {
+	_, file := hourPaths(tagDir, h)
+	return file
+}
@@ -0,0 +1,149 @@
+package tsfile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- 逆順スキャン（新しい方から） ----
+
+// ScanReverse は series の match を含むタグセットから、before より前（before ちょうどは含まない）の点を
+// 新しい順に fn へ渡します（fn が false を返すと打ち切り、nil を返す）。タグセットをまたいでも全体で時刻の降順で、
+// 同時刻の点の順序は決まりません。
+//
+// 実在する日ディレクトリと時間ファイルだけを新しい方から 1 時間ずつ読むため、古い範囲へ遡るほど読む量は増えますが、
+// 打ち切った時点より古いファイルは開きません。「もっと古いものを読む」ページングで、数週間分のデータがあっても
+// 直近のページを安く返すためのものです。時間ファイルは UTC で区切られている前提です（WithLocation 未指定の Writer）。
+func ScanReverse(root, series string, before time.Time, match Tags, fn func(Point) bool) error {
+	before = before.UTC()
+	dirs, err := matchTagDirs(filepath.Join(root, series), match)
+	if err != nil {
+		return err
+	}
+	var days []time.Time
+	for _, d := range dirs {
+		ds, err := listDays(d.path)
+		if err != nil {
+			return err
+		}
+		for _, day := range ds {
+			if day.Before(before) && !slices.ContainsFunc(days, day.Equal) {
+				days = append(days, day)
+			}
+		}
+	}
+	slices.SortFunc(days, func(a, b time.Time) int { return b.Compare(a) })
+
+	to := before.Add(-time.Nanosecond) // scanFile は両端を含む
+	var buf []Point
+	for _, day := range days {
+		rel := filepath.Join(day.Format("2006"), day.Format("01"), day.Format("02"))
+		listings := make([][]os.DirEntry, len(dirs))
+		var hours []int
+		for i, d := range dirs {
+			entries, err := os.ReadDir(filepath.Join(d.path, rel))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			listings[i] = entries
+			for _, e := range entries {
+				if h, ok := fileHour(e); ok && !slices.Contains(hours, h) {
+					hours = append(hours, h)
+				}
+			}
+		}
+		slices.Sort(hours)
+		slices.Reverse(hours)
+		for _, hh := range hours {
+			start := day.Add(time.Duration(hh) * time.Hour)
+			if !start.Before(before) {
+				continue
+			}
+			buf = buf[:0]
+			for i, d := range dirs {
+				for _, path := range hourFiles(filepath.Join(d.path, rel), listings[i], start.Format("15")) {
+					if err := scanFile(path, start, to, func(p Point) bool {
+						if !d.checkTags || p.Tags.Contains(match) {
+							buf = append(buf, p)
+						}
+						return true
+					}); err != nil {
+						return err
+					}
+				}
+			}
+			slices.SortStableFunc(buf, func(a, b Point) int { return b.T.Compare(a.T) })
+			for _, p := range buf {
+				if !fn(p) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// listDays は tagHash ディレクトリ配下の YYYY/MM/DD ディレクトリを UTC の日付として返します（順不同）。
+// 日付として読めない名前は無視します。
+func listDays(tagDir string) ([]time.Time, error) {
+	var out []time.Time
+	years, err := subdirs(tagDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, y := range years {
+		months, err := subdirs(filepath.Join(tagDir, y))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range months {
+			days, err := subdirs(filepath.Join(tagDir, y, m))
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range days {
+				if t, err := time.Parse("2006/01/02", y+"/"+m+"/"+d); err == nil {
+					out = append(out, t)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// subdirs は dir 直下のディレクトリ名を返します（dir が無ければ空）。
+func subdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if e.IsDir() {
+			out = append(out, e.Name())
+		}
+	}
+	return out, nil
+}
+
+// fileHour は時間ファイル（HH.ndjson.gz / HH.partN.ndjson.gz）の名前から時間を返します。
+func fileHour(e os.DirEntry) (int, bool) {
+	name := e.Name()
+	if e.IsDir() || len(name) < 3 || name[2] != '.' || !strings.HasSuffix(name, ".ndjson.gz") {
+		return 0, false
+	}
+	h, err := strconv.Atoi(name[:2])
+	if err != nil || h < 0 || h > 23 {
+		return 0, false
+	}
+	return h, true
+}
@@ -0,0 +1,136 @@
+package tsfile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"sort"
+	"time"
+)
+
+// ---- ロールアップ（ダウンサンプリング） ----
+
+// Aggregator はバケット内の値（時刻順）を 1 つの値にまとめます。vals は空になりません。
+type Aggregator func(vals []float64) float64
+
+// 既定の Aggregator。
+var (
+	AggMean Aggregator = func(vals []float64) float64 { return AggSum(vals) / float64(len(vals)) }
+	AggSum  Aggregator = func(vals []float64) float64 {
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		return sum
+	}
+	AggMin Aggregator = func(vals []float64) float64 {
+		m := math.Inf(1)
+		for _, v := range vals {
+			m = min(m, v)
+		}
+		return m
+	}
+	AggMax Aggregator = func(vals []float64) float64 {
+		m := math.Inf(-1)
+		for _, v := range vals {
+			m = max(m, v)
+		}
+		return m
+	}
+	AggCount Aggregator = func(vals []float64) float64 { return float64(len(vals)) }
+	AggLast  Aggregator = func(vals []float64) float64 { return vals[len(vals)-1] }
+)
+
+// Rollup は srcSeries の [from, to) の点を、タグセットごとに bucket 幅（UTC で切り捨て）で agg にまとめ、
+// dstSeries に書き込みます（T はバケット先頭、タグは元のまま）。書き込んだ点の数を返します。
+// 複数値の点（Router.AppendMulti）の Values は名前ごとに agg でまとめます（AggCount はその名前を持つ点の数）。
+// 高解像度のシリーズは短いリテンションにし、ロールアップ先を長く残すことで階層化した保存ができます。
+//
+// 冪等性: dstSeries に既に点があるバケット（タグセット・時刻が一致）は書きません。同じ範囲で再実行しても重複しませんが、
+// 一度書いたバケットは後から増えた元データで更新されないので、from/to は bucket 境界に揃え、
+// 書き込み中の（まだ閉じていない）バケットを含めないでください。src は事前に Flush しておくこと。
+func Rollup(root, srcSeries, dstSeries string, from, to time.Time, bucket time.Duration, agg Aggregator) (int, error) {
+	if bucket <= 0 {
+		return 0, errors.New("tsfile: rollup bucket must be positive")
+	}
+	if srcSeries == dstSeries {
+		return 0, fmt.Errorf("tsfile: rollup into the source series %q", srcSeries)
+	}
+	from, to = from.UTC(), to.UTC()
+
+	type key struct {
+		tagHash string
+		t       time.Time
+	}
+	type acc struct {
+		tags Tags
+		pts  []Point
+	}
+	buckets := make(map[key]*acc)
+	err := ScanRange(root, srcSeries, from, to, func(p Point) bool {
+		if !p.T.Before(to) {
+			return true
+		}
+		k := key{tagHash: p.Tags.Hash(), t: p.T.Truncate(bucket)}
+		a, ok := buckets[k]
+		if !ok {
+			a = &acc{tags: p.Tags}
+			buckets[k] = a
+		}
+		a.pts = append(a.pts, p)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// 既に書かれているバケットは飛ばす（再実行で重複させない）
+	err = ScanRange(root, dstSeries, from.Truncate(bucket), to, func(p Point) bool {
+		delete(buckets, key{tagHash: p.Tags.Hash(), t: p.T})
+		return true
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	keys := make([]key, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tagHash != keys[j].tagHash {
+			return keys[i].tagHash < keys[j].tagHash
+		}
+		return keys[i].t.Before(keys[j].t)
+	})
+	r := NewRouter(root, dstSeries)
+	n := 0
+	for _, k := range keys {
+		a := buckets[k]
+		sort.SliceStable(a.pts, func(i, j int) bool { return a.pts[i].T.Before(a.pts[j].T) })
+		vals := make([]float64, len(a.pts))
+		var multi map[string][]float64 // 複数値の点は名前ごとに集約する
+		for i, p := range a.pts {
+			vals[i] = p.V
+			for name, v := range p.Values {
+				if multi == nil {
+					multi = make(map[string][]float64)
+				}
+				multi[name] = append(multi[name], v)
+			}
+		}
+		out := Point{T: k.t, V: agg(vals), Tags: a.tags}
+		if multi != nil {
+			out.Values = make(map[string]float64, len(multi))
+			for name, vs := range multi {
+				out.Values[name] = agg(vs)
+			}
+		}
+		if err := r.Append(out); err != nil {
+			return n, errors.Join(err, r.Close())
+		}
+		n++
+	}
+	return n, r.Close()
+}
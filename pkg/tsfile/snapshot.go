@@ -0,0 +1,185 @@
+package tsfile
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---- スナップショット（バックアップ） ----
+
+// Snapshot は root 配下の全時間ファイル（*.ndjson.gz）と labels.json を、root からの相対パスで
+// tar.gz として w に書き出します。ほかのファイル（*.tmp など）は含めません。
+//
+// 書き込み中のファイルは開いた時点のサイズまでを格納します。呼び出し前に Flush しておけば
+// Flush 済みの点はすべて含まれ、末尾は gzip フッター無しのまま（読み取り側はデータ終端として扱う）になります。
+// Flush 後に追記された点は含まれないことがあります。
+func Snapshot(w io.Writer, root string) error {
+	return SnapshotRoots(w, []string{root})
+}
+
+// SnapshotRoots は複数の root（シャード）を 1 つの tar.gz にまとめる Snapshot です。
+// 各 root からの相対パスで格納するので、Restore すると 1 つの root に統合されます。
+func SnapshotRoots(w io.Writer, roots []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) && p != root {
+					return nil // リテンションと競合して消えた
+				}
+				return err
+			}
+			if d.IsDir() || !isSnapshotFile(d.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			return addSnapshotFile(tw, p, filepath.ToSlash(rel))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func isSnapshotFile(name string) bool {
+	return name == "labels.json" || strings.HasSuffix(name, ".ndjson.gz")
+}
+
+func addSnapshotFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(st, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// 追記中でもヘッダに書いたサイズ分だけを写す
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// RestoreOpt は Restore のオプションです。
+type RestoreOpt func(*restoreConfig)
+
+type restoreConfig struct {
+	force bool
+}
+
+// WithForce は root が空でなくても展開します（同じパスのファイルは上書き、それ以外は残る）。
+func WithForce() RestoreOpt { return func(c *restoreConfig) { c.force = true } }
+
+// Restore は Snapshot が書いた tar.gz を読み、root 配下にディレクトリ構造ごと展開します。
+// root が既に存在して空でなければ、WithForce を指定しない限りエラーにします。
+// root の外を指すパス（絶対パス・"../"）や通常ファイル以外のエントリを含むアーカイブは拒否します。
+// WithForce で既存の root へ展開するとき、書き込み先やその途中のディレクトリ（root より下）がシンボリックリンクなら
+// root の外へ書かないようエラーにします。
+func Restore(r io.Reader, root string, opts ...RestoreOpt) error {
+	var cfg restoreConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !cfg.force {
+		ents, err := os.ReadDir(root)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(ents) > 0 {
+			return fmt.Errorf("tsfile: restore: %s is not empty (use WithForce to overwrite)", root)
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(filepath.FromSlash(hdr.Name)) {
+			return fmt.Errorf("tsfile: restore: unsafe path %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("tsfile: restore: unsupported entry %q (type %c)", hdr.Name, hdr.Typeflag)
+		}
+		rel := filepath.FromSlash(hdr.Name)
+		if err := rejectSymlinks(root, rel); err != nil {
+			return err
+		}
+		if err := restoreFile(tr, filepath.Join(root, rel)); err != nil {
+			return err
+		}
+	}
+}
+
+// rejectSymlinks は root/rel までの各要素（root 自身は除く）を Lstat し、シンボリックリンクがあればエラーを返します。
+// まだ存在しない要素から先は新しく作るので調べません。
+func rejectSymlinks(root, rel string) error {
+	p := root
+	for part := range strings.SplitSeq(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("tsfile: restore: %s is a symlink", p)
+		}
+	}
+	return nil
+}
+
+func restoreFile(r io.Reader, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
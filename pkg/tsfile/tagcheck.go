@@ -0,0 +1,76 @@
+package tsfile
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ---- タグの検証 ----
+
+// WithTagSanitizer は、Append 時に不正なタグを拒否する代わりに fn で置き換えます。
+// fn はキーと値それぞれに適用され、置き換え後もなお不正ならエラーになります。
+// 既定の置き換えには SanitizeTag を使えます。
+func WithTagSanitizer(fn func(string) string) WriterOpt {
+	return func(c *writerConfig) { c.sanitize = fn }
+}
+
+// isBadTagRune はタグのキー・値に使えない文字です。
+// パス区切り（/ \）は保存先のディレクトリ構造を、; と = は Canonical 形式（k=v;k=v）を壊し、
+// 改行などの制御文字は labels.json やログを読みにくくします。
+func isBadTagRune(r rune) bool {
+	switch r {
+	case '/', '\\', ';', '=':
+		return true
+	}
+	return unicode.IsControl(r)
+}
+
+// SanitizeTag は、タグに使えない文字をすべて '_' に置き換えます。
+func SanitizeTag(s string) string {
+	if strings.IndexFunc(s, isBadTagRune) < 0 {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if isBadTagRune(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// ValidateTags は、タグのキーと値にパス区切り・制御文字・';'・'=' が含まれていないか調べます。
+// キーは空にできません。
+func ValidateTags(t Tags) error {
+	for k, v := range t {
+		if k == "" {
+			return fmt.Errorf("tsfile: invalid tag: empty key (value %q)", v)
+		}
+		if i := strings.IndexFunc(k, isBadTagRune); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(k[i:])
+			return fmt.Errorf("tsfile: invalid tag key %q: forbidden character %q at byte %d", k, r, i)
+		}
+		if i := strings.IndexFunc(v, isBadTagRune); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(v[i:])
+			return fmt.Errorf("tsfile: invalid tag value %q for key %q: forbidden character %q at byte %d", v, k, r, i)
+		}
+	}
+	return nil
+}
+
+// checkTags は Append 前のタグを検証し、WithTagSanitizer があれば置き換えた複製を返します
+// （呼び出し元の map は変更しない）。
+func (c *writerConfig) checkTags(t Tags) (Tags, error) {
+	if c.sanitize != nil && ValidateTags(t) != nil {
+		cp := make(Tags, len(t))
+		for k, v := range t {
+			cp[c.sanitize(k)] = c.sanitize(v)
+		}
+		t = cp
+	}
+	if err := ValidateTags(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
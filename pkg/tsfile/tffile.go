@@ -7,13 +7,19 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -56,25 +62,65 @@ func (t Tags) Clone() Tags {
 }
 
 type Point struct {
-	T    time.Time `json:"t"` // UTC
-	V    float64   `json:"v"`
-	Tags Tags      `json:"tags,omitempty"` // 任意
+	T      time.Time          `json:"t"` // UTC
+	V      float64            `json:"v"`
+	Values map[string]float64 `json:"values,omitempty"` // 複数値の点（Router.AppendMulti）。単一値の点では nil
+	Tags   Tags               `json:"tags,omitempty"`   // 任意
+}
+
+// MaxExactInt は float64 の V で正確に表せる整数の絶対値の上限（2^53）です。
+// この範囲の整数は "v":3 のように小数点なしで保存され、読み取っても値は変わりません。
+const MaxExactInt = 1 << 53
+
+// Int は V が整数で絶対値が MaxExactInt 以下なら int64 で返します（件数・オンラインフラグなど整数のシリーズ用）。
+// 小数部がある・範囲外・NaN なら false。
+func (p Point) Int() (int64, bool) {
+	if p.V != math.Trunc(p.V) || math.Abs(p.V) > MaxExactInt {
+		return 0, false
+	}
+	return int64(p.V), true
 }
 
 // ---- 単一タグセット用 Writer ----
 
+// writerConfig は WriterOpt で設定する値です。Router が一度だけ組み立て、各 writer へ複製します。
+type writerConfig struct {
+	loc           *time.Location // ファイル名のタイムゾーン（UTC推奨）
+	flushEvery    int
+	flushInterval time.Duration
+	stats         *counters           // Router と共有する累積統計（nil 可）
+	walPath       string              // Router 単位の WAL（空なら無効）
+	sanitize      func(string) string // 不正なタグの置き換え（nil なら拒否）
+	idleTimeout   time.Duration       // Router 単位のアイドル writer 掃除（0 なら無効）
+	bufSize       int                 // writer ごとの bufio のサイズ（0 なら DefaultBufferSize）
+	rotateAtHour  bool                // 時間の境界でバックグラウンドにローテーションする
+	logger        *slog.Logger        // 内部の警告の出力先（nil なら slog.Default()）
+}
+
+// log は警告の出力先を返します。
+func (c *writerConfig) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
 type writer struct {
 	root, series, tagHash string
 	tags                  Tags
+	writerConfig
 
-	loc         *time.Location // ファイル名のタイムゾーン（UTC推奨）
 	curHour     time.Time
 	f           *os.File
 	gz          *gzip.Writer
+	out         io.Writer // gz の書き込み先（Sync の後に新しい gzip メンバーを始めるときに使う）
+	sealed      bool      // Sync で gzip メンバーを閉じた（次の Append で新しいメンバーを始める）
 	bw          *bufio.Writer
 	enc         *json.Encoder
-	pending     int
-	flushEvery  int
+	pending     int       // 最後の Flush 以降に書いた点の数
+	hourPoints  int       // 現在の時間ファイルへ書いた点の数（境界でのローテーションの判定用）
+	lastAppend  time.Time // 最後に Append した時刻（CloseIdleWriters の判定用）
+	evicted     bool      // CloseIdleWriters で Router から外された（以降の Append は拒否）
 	flushTicker *time.Ticker
 	flushStop   chan struct{}
 	flushWg     sync.WaitGroup
@@ -82,46 +128,78 @@ type writer struct {
 	mu          sync.Mutex
 }
 
-type WriterOpt func(*writer)
+type WriterOpt func(*writerConfig)
 
-func WithLocation(loc *time.Location) WriterOpt { return func(w *writer) { w.loc = loc } }
-func WithFlushEvery(n int) WriterOpt            { return func(w *writer) { w.flushEvery = n } }
+func WithLocation(loc *time.Location) WriterOpt { return func(c *writerConfig) { c.loc = loc } }
+func WithFlushEvery(n int) WriterOpt            { return func(c *writerConfig) { c.flushEvery = n } }
 func WithFlushInterval(d time.Duration) WriterOpt {
-	return func(w *writer) {
-		if d <= 0 {
-			return
-		}
-		w.flushTicker = time.NewTicker(d)
-		w.flushStop = make(chan struct{})
-	}
+	return func(c *writerConfig) { c.flushInterval = d }
 }
 
-func newWriter(root, series string, tags Tags, opts ...WriterOpt) *writer {
-	w := &writer{
-		root:    root,
-		series:  series,
-		tags:    tags.Clone(),
-		tagHash: tags.Hash(),
-		loc:     time.UTC,
+const (
+	DefaultBufferSize = 1 << 20 // writer ごとの書き込みバッファの既定サイズ
+	MinBufferSize     = 4 << 10 // WithBufferSize の下限
+)
+
+// WithBufferSize は writer（タグセット）ごとの書き込みバッファのサイズを設定します（既定 1MiB、MinBufferSize 未満は切り上げ）。
+// バッファは writer ごとに確保されるので、タグセットの多いシリーズ（プレイヤーごとの位置など）では小さくするとメモリを大きく減らせます。
+// タグセットが少なく書き込みの多いシリーズは既定のままの方が gzip への書き込み回数が減ります。
+func WithBufferSize(n int) WriterOpt {
+	return func(c *writerConfig) { c.bufSize = max(n, MinBufferSize) }
+}
+
+// WithIdleWriterTimeout は、最後の Append から d 以上経った writer を Router がバックグラウンドで
+// Flush+Close して外すようにします（d/2 ごとに CloseIdleWriters、0 以下で無効）。
+// 次の Append で writer は作り直され、既存の時間ファイルへ追記します。
+func WithIdleWriterTimeout(d time.Duration) WriterOpt {
+	return func(c *writerConfig) { c.idleTimeout = d }
+}
+
+// WithRotateAtBoundary は、次の時間の点が来るのを待たずに、時間の境界（WithLocation の時刻で毎正時）を過ぎたら
+// バックグラウンドで現在の時間ファイルを閉じ（gzip を完結させ）、新しい時間のファイルを作ります。
+// 前の時間を追っている Follow などの読み手が、その時間が完結したことをすぐに知れるようにするためのものです。
+// 判定は定期フラッシュと同じ goroutine で行うため、境界から最大 WithFlushInterval だけ遅れます（未指定なら 1 秒ごとに判定し、フラッシュはしない）。
+// 閉じた時間に点が 1 つも無かった writer は新しい時間のファイルを作らないので、書き込みの止まったタグセットの空ファイルは増えません。
+func WithRotateAtBoundary() WriterOpt { return func(c *writerConfig) { c.rotateAtHour = true } }
+
+// WithLogger は書き込みを止めない内部の警告（labels.json の書き込み失敗、tagHash の衝突、
+// 境界でのローテーションやアイドル writer の Close の失敗）の出力先を設定します（nil なら slog.Default()）。
+// 警告は "series" などの属性付きの Warn で出します。
+func WithLogger(l *slog.Logger) WriterOpt { return func(c *writerConfig) { c.logger = l } }
+
+func newWriter(root, series string, tags Tags, cfg writerConfig) *writer {
+	if cfg.loc == nil {
+		cfg.loc = time.UTC
 	}
-	for _, opt := range opts {
-		opt(w)
+	w := &writer{
+		root:         root,
+		series:       series,
+		tags:         tags.Clone(),
+		tagHash:      tags.Hash(),
+		writerConfig: cfg,
+		lastAppend:   time.Now(),
 	}
 	// ラベルメタを書いておく（同内容なら上書きでOK）
 	if err := w.writeLabelsMeta(); err != nil {
-		// メタ書き込み失敗は致命でなくても良いのでログ代わりに標準エラーへ
-		fmt.Fprintf(os.Stderr, "tsfile: labels meta write error: %v\n", err)
+		// メタ書き込み失敗は致命でなくても良いので警告だけ
+		cfg.log().Warn("tsfile: labels meta write error", "series", series, "tag_hash", w.tagHash, "err", err)
 	}
-	// 定期フラッシュ
-	if w.flushTicker != nil {
+	// 定期フラッシュ（と時間の境界でのローテーション）
+	if cfg.flushInterval > 0 || cfg.rotateAtHour {
+		interval := cfg.flushInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		w.flushTicker = time.NewTicker(interval)
+		w.flushStop = make(chan struct{})
 		w.flushWg.Add(1)
 		go func(ch <-chan time.Time, stop <-chan struct{}) {
 
 			defer w.flushWg.Done()
 			for {
 				select {
-				case <-ch:
-					_ = w.flushSync()
+				case now := <-ch:
+					w.tick(now)
 				case <-stop:
 					return
 				}
@@ -131,19 +209,63 @@ func newWriter(root, series string, tags Tags, opts ...WriterOpt) *writer {
 	return w
 }
 
+// tick はフラッシュ goroutine の 1 回分です。Append と同じ mu の中で行います。
+func (w *writer) tick(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.rotateAtHour && w.f != nil && !w.evicted {
+		if hour := now.In(w.loc).Truncate(time.Hour); hour.After(w.curHour) {
+			if w.hourPoints == 0 {
+				_ = w.closeCurrent()
+			} else if err := w.rotate(hour); err != nil {
+				w.log().Warn("tsfile: rotate at boundary", "series", w.series, "tag_hash", w.tagHash, "err", err)
+			}
+			return
+		}
+	}
+	if w.flushInterval > 0 {
+		_ = w.flushSync()
+	}
+}
+
 func (w *writer) pathForHour(h time.Time) (dir, file string) {
-	dir = filepath.Join(w.root, w.series, w.tagHash,
-		h.Format("2006"), h.Format("01"), h.Format("02"))
+	return PathForHour(w.root, w.series, w.tags, h)
+}
+
+// TagDir は series のタグセット tags のディレクトリ（root/series/tagHash。labels.json と日ディレクトリを置く）を返します。
+func TagDir(root, series string, tags Tags) string {
+	return filepath.Join(root, series, tags.Hash())
+}
+
+// PathForHour は時間 h の日ディレクトリ（TagDir/YYYY/MM/DD）と時間ファイル（HH.ndjson.gz）を返します。
+// 日付と時間は h の Location のまま使うので、WithLocation を指定した Writer のファイルは h.In(loc) を渡してください。
+// サイズで分割された時間の 2 つ目以降のパート（HH.partN.ndjson.gz）は同じ日ディレクトリに並びます。
+// テストや外部ツールがディレクトリ構成を自前で組み立てずにファイルを探すためのものです。
+func PathForHour(root, series string, tags Tags, h time.Time) (dir, file string) {
+	return hourPaths(TagDir(root, series, tags), h)
+}
+
+// hourPaths は tagDir 配下の時間 h の日ディレクトリと時間ファイルを返します。
+func hourPaths(tagDir string, h time.Time) (dir, file string) {
+	dir = filepath.Join(tagDir, h.Format("2006"), h.Format("01"), h.Format("02"))
 	file = filepath.Join(dir, h.Format("15")+".ndjson.gz")
 	return
 }
 
 func (w *writer) writeLabelsMeta() error {
-	dir := filepath.Join(w.root, w.series, w.tagHash)
+	dir := TagDir(w.root, w.series, w.tags)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
 	}
 	metaPath := filepath.Join(dir, "labels.json")
+	// 既に同じ内容なら書き直さない（再起動後の最初の点ごとの fsync/rename を避ける）
+	if cur, err := readLabels(dir); err == nil {
+		if maps.Equal(cur, w.tags) {
+			return nil
+		}
+		// 別のタグセットが同じ tagHash になった（または labels.json が書き換えられた）。点は混ざるが書き込みは続け、今のタグで上書きする
+		w.log().Warn("tsfile: tag hash collision", "series", w.series, "tag_hash", w.tagHash, "labels", cur, "tags", w.tags)
+	}
 	tmp := metaPath + ".tmp"
 	f, err := os.Create(tmp)
 	if err != nil {
@@ -173,14 +295,26 @@ func (w *writer) Append(p Point) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if w.evicted {
+		return errWriterEvicted
+	}
+	w.lastAppend = time.Now()
 	if w.f == nil || hour != w.curHour {
 		if err := w.rotate(hour); err != nil {
 			return err
 		}
 	}
+	if w.sealed {
+		w.gz.Reset(w.out)
+		w.sealed = false
+	}
 	if err := w.enc.Encode(&p); err != nil {
 		return err
 	}
+	w.hourPoints++
+	if w.stats != nil {
+		w.stats.points.Add(1)
+	}
 	w.pending++
 	if w.flushEvery > 0 && w.pending >= w.flushEvery {
 		if err := w.flushSync(); err != nil {
@@ -195,7 +329,7 @@ func (w *writer) rotate(hour time.Time) error {
 	if err := w.closeCurrent(); err != nil {
 		return err
 	}
-	w.curHour = hour
+	w.curHour, w.hourPoints = hour, 0
 	dir, file := w.pathForHour(hour)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
@@ -204,18 +338,48 @@ func (w *writer) rotate(hour time.Time) error {
 	if err != nil {
 		return err
 	}
-	gz, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	var out io.Writer = f
+	if w.stats != nil {
+		out = &countingWriter{w: f, n: &w.stats.bytes}
+	}
+	gz, err := gzip.NewWriterLevel(out, gzip.BestSpeed)
 	if err != nil {
 		f.Close()
 		return err
 	}
-	bw := bufio.NewWriterSize(gz, 1<<20)
-	w.f, w.gz, w.bw = f, gz, bw
+	size := w.bufSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	bw := bufio.NewWriterSize(gz, size)
+	w.f, w.gz, w.out, w.bw, w.sealed = f, gz, out, bw, false
 	w.enc = json.NewEncoder(bw)
 	return nil
 }
 
+// seal は開いている時間ファイルの gzip メンバーを閉じて（フッターを書いて）fsync します。
+// ファイルは開いたままで、次の Append は同じファイルへ新しいメンバーとして書きます。
+func (w *writer) seal() error {
+	if w.enc == nil || w.sealed {
+		return nil
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	w.sealed, w.pending = true, 0
+	if w.stats != nil {
+		w.stats.flushes.Add(1)
+	}
+	return w.f.Sync()
+}
+
 func (w *writer) flushSync() error {
+	if w.bw != nil && w.stats != nil {
+		w.stats.flushes.Add(1)
+	}
 	if w.bw != nil {
 		if err := w.bw.Flush(); err != nil {
 			return err
@@ -226,12 +390,25 @@ func (w *writer) flushSync() error {
 			return err
 		}
 	}
+	w.pending = 0
 	if w.f != nil {
 		return w.f.Sync()
 	}
 	return nil
 }
 
+// countingWriter は下位 Writer へ書き込んだバイト数を n に加算する。
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
 func (w *writer) closeCurrent() error {
 	if w.enc == nil {
 		return nil
@@ -241,6 +418,7 @@ func (w *writer) closeCurrent() error {
 		_ = w.gz.Close()
 	}
 	if w.f != nil {
+		_ = w.f.Sync() // gzip のフッターまで確定させる
 		_ = w.f.Close()
 	}
 	w.f, w.gz, w.bw, w.enc = nil, nil, nil, nil
@@ -268,58 +446,328 @@ func (w *writer) Close() error {
 	return cerr
 }
 
+// errWriterEvicted は CloseIdleWriters で閉じられた writer への Append です（Router が作り直して再試行する）。
+var errWriterEvicted = errors.New("tsfile: writer evicted")
+
+// evict は以降の Append を拒否してから writer を閉じます。
+func (w *writer) evict() error {
+	w.mu.Lock()
+	w.evicted = true
+	w.mu.Unlock()
+	return w.Close()
+}
+
 // ---- タグ付きマルチライター（推奨 API） ----
 
 type Router struct {
 	root, series string
-	loc          *time.Location
-	opts         []WriterOpt
+	cfg          writerConfig
 
 	mu      sync.Mutex
 	writers map[string]*writer // key = tagHash
+
+	walMu sync.Mutex // WithWAL 時の追記・checkpoint・Close を直列化（mu より先に取る）
+	wal   *walLog    // 最初の Append で開く
+
+	stats counters
+
+	sweepStop chan struct{} // WithIdleWriterTimeout の掃除 goroutine（nil なら無し）
+	sweepWg   sync.WaitGroup
+	stopOnce  sync.Once
+}
+
+// Counters は Router 配下の全 writer の累積書き込み統計です。
+type Counters struct {
+	Points  uint64 // 書き込んだ点数
+	Bytes   uint64 // ファイルへ書き込んだバイト数（gzip 圧縮後）
+	Flushes uint64 // Flush の回数（定期フラッシュ・Close 時を含む）
+}
+
+type counters struct {
+	points, bytes, flushes atomic.Uint64
 }
 
 func NewRouter(root, series string, opts ...WriterOpt) *Router {
 	r := &Router{
 		root:    root,
 		series:  series,
-		loc:     time.UTC,
-		opts:    append([]WriterOpt{WithLocation(time.UTC)}, opts...),
+		cfg:     writerConfig{loc: time.UTC},
 		writers: make(map[string]*writer),
 	}
+	for _, opt := range opts {
+		opt(&r.cfg)
+	}
+	r.cfg.stats = &r.stats
+	if r.cfg.idleTimeout > 0 {
+		r.sweepStop = make(chan struct{})
+		r.sweepWg.Add(1)
+		go r.sweepIdle(r.cfg.idleTimeout)
+	}
 	return r
 }
 
+// sweepIdle は Close まで d/2 ごとにアイドル writer を閉じる。
+func (r *Router) sweepIdle(d time.Duration) {
+	defer r.sweepWg.Done()
+	t := time.NewTicker(max(d/2, time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := r.CloseIdleWriters(d); err != nil {
+				r.cfg.log().Warn("tsfile: close idle writers", "series", r.series, "err", err)
+			}
+		case <-r.sweepStop:
+			return
+		}
+	}
+}
+
+// Counters は累積書き込み統計のスナップショットを返す（ロック不要）。
+func (r *Router) Counters() Counters {
+	return Counters{
+		Points:  r.stats.points.Load(),
+		Bytes:   r.stats.bytes.Load(),
+		Flushes: r.stats.flushes.Load(),
+	}
+}
+
+// Append は p をタグセットの writer へ書きます。
+// タグのキー・値にパス区切り・制御文字・';'・'=' が含まれていればエラー（WithTagSanitizer 指定時は置き換え）。
 func (r *Router) Append(p Point) error {
 	if p.Tags == nil {
 		p.Tags = Tags{}
 	}
-	key := p.Tags.Hash()
+	tags, err := r.cfg.checkTags(p.Tags)
+	if err != nil {
+		return err
+	}
+	p.Tags = tags
+	if r.cfg.walPath != "" {
+		return r.appendWAL(p)
+	}
+	return r.appendWriter(p)
+}
+
+// AppendMulti は名前付きの複数の値（位置の {"x":..,"z":..} など）を 1 つの点として 1 レコードに書きます。
+// 値は Point.Values に入り、V は 0 です。軸ごとに別シリーズへ書く（storage の AppendVec）のと比べてファイルとディレクトリが半分以下で済み、
+// 読むときに時刻で突き合わせる必要もありません。values が空・名前が空ならエラー。values はコピーして保存します。
+func (r *Router) AppendMulti(t time.Time, values map[string]float64, tags Tags) error {
+	if len(values) == 0 {
+		return errors.New("tsfile: AppendMulti: no values")
+	}
+	if _, ok := values[""]; ok {
+		return errors.New("tsfile: AppendMulti: empty value name")
+	}
+	return r.Append(Point{T: t, Values: maps.Clone(values), Tags: tags})
+}
+
+// appendWriter はタグセットの writer へ書きます。取得後に CloseIdleWriters で
+// 閉じられていたら、作り直した writer へ書き直します。
+func (r *Router) appendWriter(p Point) error {
+	for {
+		err := r.writerFor(p.Tags).Append(p)
+		if !errors.Is(err, errWriterEvicted) {
+			return err
+		}
+	}
+}
+
+// Series はこの Router のシリーズ名を返します。
+func (r *Router) Series() string { return r.series }
+
+// Root はこの Router のルートディレクトリを返します。
+func (r *Router) Root() string { return r.root }
 
+// RouterStats は Router の現在の状態です（Stats）。
+type RouterStats struct {
+	Writers       int // 開いている writer（タグセット）の数（WriterCount と同じ）
+	PendingPoints int // 全 writer で最後の Flush 以降に書いた点の合計（まだ fsync されていない）
+}
+
+// Stats は開いている writer 数と未 Flush の点数を返します。管理用・デバッグ用のエンドポイント向けです。
+func (r *Router) Stats() RouterStats {
 	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := RouterStats{Writers: len(r.writers)}
+	for _, w := range r.writers {
+		w.mu.Lock()
+		st.PendingPoints += w.pending
+		w.mu.Unlock()
+	}
+	return st
+}
+
+// WriterCount は開いている writer（= 書き込み中のタグセット）の数を返します。
+// writer ごとに 1MiB の bufio バッファと gzip の状態、ファイルハンドルを保持します。
+func (r *Router) WriterCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.writers)
+}
+
+// BufferedBytes は、全 writer の bufio にたまっている未 Flush のバイト数（圧縮前）の合計です。
+// gzip 内部に保持している分は含まないため、メモリ使用量の目安として使ってください。
+func (r *Router) BufferedBytes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, w := range r.writers {
+		w.mu.Lock()
+		if w.bw != nil {
+			n += w.bw.Buffered()
+		}
+		w.mu.Unlock()
+	}
+	return n
+}
+
+// CloseIdleWriters は、最後の Append から olderThan 以上経った writer を Flush+Close して Router から外し、
+// 閉じた数を返します。同じタグセットへ次に Append すると writer を作り直し、既存の時間ファイルへ追記します。
+// プレイヤーの入れ替わりが多いサーバーで writer が増え続けるのを抑えるためのものです。
+func (r *Router) CloseIdleWriters(olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	n := 0
+	for key, w := range r.writers {
+		w.mu.Lock()
+		idle := w.lastAppend.Before(cutoff)
+		w.mu.Unlock()
+		if !idle {
+			continue
+		}
+		// r.mu を持ったまま閉じる（WAL の checkpoint が閉じかけの writer を飛ばさないように）
+		delete(r.writers, key)
+		if err := w.evict(); err != nil {
+			errs = append(errs, err)
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+// writerFor はタグセットの writer を返す（無ければ作る）。
+func (r *Router) writerFor(tags Tags) *writer {
+	key := tags.Hash()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	w, ok := r.writers[key]
 	if !ok {
-		w = newWriter(r.root, r.series, p.Tags, r.opts...)
+		w = newWriter(r.root, r.series, tags, r.cfg)
 		r.writers[key] = w
 	}
-	r.mu.Unlock()
-
-	return w.Append(p)
+	return w
 }
 
-// すべての内部 writer を Flush+Sync
+// すべての内部 writer を Flush+Sync（WAL 有効時はその後 WAL を空にする）
 func (r *Router) Flush() error {
+	if r.cfg.walPath != "" {
+		r.walMu.Lock()
+		defer r.walMu.Unlock()
+		if r.wal != nil {
+			return r.checkpointLocked()
+		}
+	}
+	return r.flushWriters()
+}
+
+func (r *Router) flushWriters() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	for _, w := range r.writers {
-		if err := w.flushSync(); err != nil {
+		w.mu.Lock()
+		err := w.flushSync()
+		w.mu.Unlock()
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Sync は全 writer の開いている時間ファイルの gzip メンバーを閉じて fsync し、別プロセスの一般的な gzip リーダーでも
+// そのまま読める状態にします（WAL 有効時はその後 WAL を空にする）。Flush と違い gzip のフッターまで書きますが、
+// writer もファイルも開いたままなので、次の Append は同じ時間ファイルへ新しい gzip メンバーとして追記します。
+func (r *Router) Sync() error {
+	if r.cfg.walPath != "" {
+		r.walMu.Lock()
+		defer r.walMu.Unlock()
+	}
+	r.mu.Lock()
+	var errs []error
+	for _, w := range r.writers {
+		w.mu.Lock()
+		if err := w.seal(); err != nil {
+			errs = append(errs, err)
+		}
+		w.mu.Unlock()
+	}
+	r.mu.Unlock()
+	if err := errors.Join(errs...); err != nil {
+		return err // WAL は次回起動時の再投入用に残す
+	}
+	if r.wal != nil {
+		return r.checkpointLocked()
+	}
+	return nil
+}
+
+// CloseFilesBeforeDay は、loc の日境界で boundaryDay より前の日（= DeleteBeforeDay の削除対象）
+// の時間ファイルを開いている writer について、そのファイルを Flush+Close する。
+// writer 自体は Router に残り、次回 Append で必要なファイルを開き直す。
+// 削除前に呼ぶことで、削除済みファイルへの書き込み継続（Unix）や削除失敗（Windows）を防ぐ。
+func (r *Router) CloseFilesBeforeDay(boundaryDay time.Time, loc *time.Location) error {
+	cut := cutYMD(boundaryDay, loc)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, w := range r.writers {
+		w.mu.Lock()
+		if w.f != nil && ymd(w.curHour) < cut {
+			if err := w.closeCurrent(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		w.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteBeforeDay は CloseFilesBeforeDay と DeleteBeforeDay(r.Root(), r.Series(), ...) を、Router と全 writer のロックを
+// 持ったまま続けて行う。閉じてから消すまでの間に Append が削除対象日のファイルを開き直し、削除済みのファイルへ
+// 書き続ける（Unix）・削除に失敗する（Windows）ことがない。その間の Append は削除が終わるまで待つ。
+func (r *Router) DeleteBeforeDay(boundaryDay time.Time, loc *time.Location, opts ...DeleteOpt) error {
+	cut := cutYMD(boundaryDay, loc)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, w := range r.writers {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.f != nil && ymd(w.curHour) < cut {
+			if err := w.closeCurrent(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return DeleteBeforeDay(r.root, r.series, boundaryDay, loc, opts...)
+}
+
 func (r *Router) Close() error {
+	// 掃除 goroutine は r.mu を取るので、ロックより先に止める
+	r.stopOnce.Do(func() {
+		if r.sweepStop != nil {
+			close(r.sweepStop)
+			r.sweepWg.Wait()
+		}
+	})
+	r.walMu.Lock()
+	defer r.walMu.Unlock()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	var firstErr error
@@ -328,7 +776,10 @@ func (r *Router) Close() error {
 			firstErr = err
 		}
 	}
-	return firstErr
+	if firstErr != nil {
+		return firstErr // WAL は次回起動時の再投入用に残す
+	}
+	return r.closeWALLocked()
 }
 
 // ---- 範囲スキャン（必要なときに） ----
@@ -336,23 +787,55 @@ func (r *Router) Close() error {
 // ScanRange は series 配下の全タグセットを舐めて [from,to] をストリーム処理。
 // fn が false を返すと早期終了。
 func ScanRange(root, series string, from, to time.Time, fn func(Point) bool) error {
+	return ScanRangeMatch(root, series, from, to, nil, fn)
+}
+
+// ScanRangeMatch は ScanRange のタグフィルタ版。match の全キー/値を含むタグセットだけを読む。
+// 判定は tagHash ディレクトリの labels.json で行うため、一致しないタグセットのファイルは
+// 展開しない（labels.json が無い場合は点ごとのタグで判定）。match が空なら ScanRange と同じ。
+func ScanRangeMatch(root, series string, from, to time.Time, match Tags, fn func(Point) bool) error {
+	return scanRange(root, series, from, to, match, func(p Point, _ string) bool { return fn(p) })
+}
+
+// ScanRangeWithSource は ScanRange と同じ順で点を渡し、あわせてその点を読んだ時間ファイルの root からの相対パス
+// （例: "pos/3f2a.../2025/08/26/12.ndjson.gz"、区切りは OS のもの）を source として渡します。
+// 異常な点がどの時間・どのタグセットのファイルにあるかを調べるためのものです。
+func ScanRangeWithSource(root, series string, from, to time.Time, fn func(p Point, source string) bool) error {
+	var lastPath, lastRel string
+	return scanRange(root, series, from, to, nil, func(p Point, path string) bool {
+		if path != lastPath {
+			lastPath, lastRel = path, path
+			if rel, err := filepath.Rel(root, path); err == nil {
+				lastRel = rel
+			}
+		}
+		return fn(p, lastRel)
+	})
+}
+
+// scanRange は ScanRangeMatch の本体です。fn には点と、その点を読んだファイルのパスを渡します。
+func scanRange(root, series string, from, to time.Time, match Tags, fn func(Point, string) bool) error {
 	if to.Before(from) {
 		return errors.New("invalid range")
 	}
 	from = from.UTC()
 	to = to.UTC()
 
-	seriesDir := filepath.Join(root, series)
-	entries, err := os.ReadDir(seriesDir)
+	dirs, err := matchTagDirs(filepath.Join(root, series), match)
 	if err != nil {
 		return err
 	}
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
+	for _, d := range dirs {
+		cb := fn
+		if d.checkTags {
+			cb = func(p Point, path string) bool {
+				if !p.Tags.Contains(match) {
+					return true
+				}
+				return fn(p, path)
+			}
 		}
-		// e.Name() は tagHash ディレクトリ
-		if err := scanTagDir(filepath.Join(seriesDir, e.Name()), from, to, fn); err != nil {
+		if err := scanTagDir(d.path, from, to, cb); err != nil {
 			if errors.Is(err, errEarlyStop) {
 				return nil
 			}
@@ -362,24 +845,141 @@ func ScanRange(root, series string, from, to time.Time, fn func(Point) bool) err
 	return nil
 }
 
-func scanTagDir(tagDir string, from, to time.Time, fn func(Point) bool) error {
-	// YYYY/MM/DD/HH.ndjson.gz を辿る
-	for h := from.Truncate(time.Hour); !h.After(to); h = h.Add(time.Hour) {
-		path := filepath.Join(tagDir,
-			h.Format("2006"), h.Format("01"), h.Format("02"), h.Format("15")+".ndjson.gz")
-		if _, err := os.Stat(path); err != nil {
+// matchedTagDir は読む対象の tagHash ディレクトリです。
+type matchedTagDir struct {
+	path      string
+	checkTags bool // labels.json が読めないので、点ごとのタグで match を判定する
+}
+
+// matchTagDirs は seriesDir 配下の tagHash ディレクトリのうち、labels.json が match を含むものを返します
+// （labels.json が無ければ checkTags を立てて含める）。match が空なら全ディレクトリ。
+func matchTagDirs(seriesDir string, match Tags) ([]matchedTagDir, error) {
+	entries, err := os.ReadDir(seriesDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []matchedTagDir
+	for _, e := range entries {
+		if !e.IsDir() {
 			continue
 		}
-		if err := scanFile(path, from, to, fn); err != nil {
-			if errors.Is(err, errEarlyStop) {
+		d := matchedTagDir{path: filepath.Join(seriesDir, e.Name())}
+		if len(match) > 0 {
+			if labels, err := readLabels(d.path); err == nil {
+				if !labels.Contains(match) {
+					continue
+				}
+			} else {
+				d.checkTags = true
+			}
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// Contains は sub の全キー/値が t に含まれるかを返す（sub が空なら true）。
+func (t Tags) Contains(sub Tags) bool {
+	for k, v := range sub {
+		if got, ok := t[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// readLabels は tagHash ディレクトリの labels.json を読む。
+func readLabels(tagDir string) (Tags, error) {
+	b, err := os.ReadFile(filepath.Join(tagDir, "labels.json"))
+	if err != nil {
+		return nil, err
+	}
+	var t Tags
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// scanTagDir は [from, to] の各時間について、その時間のファイル（分割されていれば全パート）を読み、
+// 範囲内の点を時刻順に fn へ渡します。パートをまたいだり追記順が前後したりしても、1 タグセット内では時刻の昇順になります
+// （同時刻の点は読んだ順）。並べ替えのため 1 時間分の点をまとめて読んでから渡します。fn の 2 つ目の引数は点を読んだファイルです。
+func scanTagDir(tagDir string, from, to time.Time, fn func(Point, string) bool) error {
+	type sourced struct {
+		p    Point
+		file int // files の添字
+	}
+	var (
+		buf     []sourced
+		dayDir  string
+		entries []os.DirEntry // dayDir の一覧（日が変わったときだけ読み直す）
+	)
+	for h := from.Truncate(time.Hour); !h.After(to); h = h.Add(time.Hour) {
+		if d, _ := hourPaths(tagDir, h); d != dayDir {
+			var err error
+			dayDir = d
+			if entries, err = os.ReadDir(d); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		buf = buf[:0]
+		files := hourFiles(dayDir, entries, h.Format("15"))
+		for i, path := range files {
+			if err := scanFile(path, from, to, func(p Point) bool {
+				buf = append(buf, sourced{p, i})
+				return true
+			}); err != nil {
+				return err
+			}
+		}
+		slices.SortStableFunc(buf, func(a, b sourced) int { return a.p.T.Compare(b.p.T) })
+		for _, s := range buf {
+			if !fn(s.p, files[s.file]) {
 				return errEarlyStop
 			}
-			return err
 		}
 	}
 	return nil
 }
 
+// hourFiles は日ディレクトリ dayDir の一覧 entries から時間 hh（"15" など）のファイルを読む順に返します。
+// サイズで分割された時間は HH.ndjson.gz, HH.part2.ndjson.gz, HH.part3.ndjson.gz, … の順（パート番号は数値で比較）。
+// 番号が読めない名前は無視し、ファイルが 1 つも無ければ空を返します。
+func hourFiles(dayDir string, entries []os.DirEntry, hh string) []string {
+	type part struct {
+		n    int
+		path string
+	}
+	var parts []part
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if name == hh+".ndjson.gz" {
+			parts = append(parts, part{1, filepath.Join(dayDir, name)})
+			continue
+		}
+		rest, ok := strings.CutPrefix(name, hh+".part")
+		if !ok {
+			continue
+		}
+		num, ok := strings.CutSuffix(rest, ".ndjson.gz")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(num); err == nil && n >= 2 {
+			parts = append(parts, part{n, filepath.Join(dayDir, name)})
+		}
+	}
+	slices.SortFunc(parts, func(a, b part) int { return a.n - b.n })
+	out := make([]string, len(parts))
+	for i, p := range parts {
+		out[i] = p.path
+	}
+	return out
+}
+
 func scanFile(path string, from, to time.Time, fn func(Point) bool) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -389,6 +989,9 @@ func scanFile(path string, from, to time.Time, fn func(Point) bool) error {
 
 	gz, err := gzip.NewReader(f)
 	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil // 作成直後（未 Flush）の空ファイル
+		}
 		return err
 	}
 	defer gz.Close()
@@ -397,7 +1000,8 @@ func scanFile(path string, from, to time.Time, fn func(Point) bool) error {
 	for {
 		var p Point
 		if err := dec.Decode(&p); err != nil {
-			if errors.Is(err, io.EOF) {
+			// 書き込み中（gzip フッター未確定）のファイルは Flush 済みの範囲までを読む
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 				return nil
 			}
 			return err
@@ -418,12 +1022,12 @@ var errEarlyStop = errors.New("tsfile: early stop")
 // DeleteBeforeDay は、指定 loc の日境界で boundaryDay の「その日より前」の日ディレクトリ
 // (YYYY/MM/DD) を series 配下の全 tagHash について再帰削除する。
 // 例: boundaryDay=JSTで 2025-08-26 の場合、2025/08/25 以前のディレクトリを削除。
-func DeleteBeforeDay(root, series string, boundaryDay time.Time, loc *time.Location) error {
-	if loc == nil {
-		loc = time.UTC
+func DeleteBeforeDay(root, series string, boundaryDay time.Time, loc *time.Location, opts ...DeleteOpt) error {
+	var cfg deleteConfig
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	by, bm, bd := boundaryDay.In(loc).Date()
-	cutYMD := by*10000 + int(bm)*100 + bd
+	cut := cutYMD(boundaryDay, loc)
 
 	seriesDir := filepath.Join(root, series)
 	tagDirs, err := os.ReadDir(seriesDir)
@@ -475,9 +1079,16 @@ func DeleteBeforeDay(root, series string, boundaryDay time.Time, loc *time.Locat
 						continue
 					}
 					ymd := y*10000 + m*100 + d
-					if ymd < cutYMD {
+					if ymd < cut {
 						// 対象日ディレクトリを削除
-						if err := os.RemoveAll(filepath.Join(mdir, dentry.Name())); err != nil {
+						dayDir := filepath.Join(mdir, dentry.Name())
+						if cfg.onDelete != nil {
+							cfg.onDelete(dayDir)
+						}
+						if cfg.dryRun {
+							continue
+						}
+						if err := os.RemoveAll(dayDir); err != nil {
 							return err
 						}
 					}
@@ -487,3 +1098,31 @@ func DeleteBeforeDay(root, series string, boundaryDay time.Time, loc *time.Locat
 	}
 	return nil
 }
+
+// DeleteOpt は DeleteBeforeDay のオプションです。
+type DeleteOpt func(*deleteConfig)
+
+type deleteConfig struct {
+	dryRun   bool
+	onDelete func(path string)
+}
+
+// WithDryRun は削除対象を数える（WithOnDelete に渡す）だけで、実際には削除しません。
+func WithDryRun() DeleteOpt { return func(c *deleteConfig) { c.dryRun = true } }
+
+// WithOnDelete は削除する（dry-run では削除するはずの）日ディレクトリごとに fn を呼びます。
+func WithOnDelete(fn func(path string)) DeleteOpt { return func(c *deleteConfig) { c.onDelete = fn } }
+
+// cutYMD は loc で日切りした boundaryDay を YYYYMMDD 形式の整数にする（nil は UTC）。
+func cutYMD(boundaryDay time.Time, loc *time.Location) int {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return ymd(boundaryDay.In(loc))
+}
+
+// ymd は t（のタイムゾーン）での日付を YYYYMMDD 形式の整数にする。
+func ymd(t time.Time) int {
+	y, m, d := t.Date()
+	return y*10000 + int(m)*100 + d
+}
@@ -1,17 +1,24 @@
 package tsfile
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -112,6 +119,30 @@ func TestRouterAppendCreatesFilesAndLabels(t *testing.T) {
 	}
 }
 
+func TestPathForHour(t *testing.T) {
+	root := filepath.FromSlash("/data")
+	tags := Tags{"app": "srv", "env": "prod"}
+	tagDir := filepath.Join(root, "metrics", tags.Hash())
+	if got := TagDir(root, "metrics", tags); got != tagDir {
+		t.Fatalf("TagDir = %q, want %q", got, tagDir)
+	}
+
+	// 日付と時間は h の Location のまま使う（UTC 15:30 は JST で翌日の 0 時台）
+	h := time.Date(2025, 8, 26, 15, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		h             time.Time
+		wantDir, file string
+	}{
+		{h, filepath.Join(tagDir, "2025", "08", "26"), "15.ndjson.gz"},
+		{h.In(time.FixedZone("JST", 9*3600)), filepath.Join(tagDir, "2025", "08", "27"), "00.ndjson.gz"},
+	} {
+		dir, file := PathForHour(root, "metrics", tags, tt.h)
+		if dir != tt.wantDir || file != filepath.Join(tt.wantDir, tt.file) {
+			t.Fatalf("PathForHour(%s) = %q, %q; want %q, %q", tt.h, dir, file, tt.wantDir, filepath.Join(tt.wantDir, tt.file))
+		}
+	}
+}
+
 func TestRotationAcrossHour(t *testing.T) {
 	dir := t.TempDir()
 	series := "metrics"
@@ -382,6 +413,61 @@ func TestWithFlushIntervalAutoFlush(t *testing.T) {
 	}
 }
 
+func TestRotateAtBoundaryFinalizesPreviousHour(t *testing.T) {
+	dir := t.TempDir()
+	series := "metrics"
+	tags := Tags{"app": "srv"}
+	r := NewRouter(dir, series, WithFlushInterval(10*time.Millisecond), WithRotateAtBoundary())
+	defer r.Close()
+
+	// 2 時間前の点を書く: 次の点を待たずに、次の tick で現在の時間へ移るはず
+	now := time.Now().UTC()
+	old := now.Add(-2 * time.Hour)
+	if err := r.Append(Point{T: old, V: 1, Tags: tags}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	path := func(h time.Time) string {
+		return filepath.Join(dir, series, tags.Hash(), h.Format("2006"), h.Format("01"), h.Format("02"), h.Format("15")+".ndjson.gz")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path(now)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("current hour file was not created at the boundary")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Close 前でも前の時間のファイルは gzip として完結している（末尾まで読んでも unexpected EOF にならない）
+	f, err := os.Open(path(old))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if _, err := io.ReadAll(gz); err != nil {
+		t.Fatalf("previous hour is not finalized: %v", err)
+	}
+
+	if err := r.Append(Point{T: now, V: 2, Tags: tags}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := readAllNDJSONGz(t, path(old)); len(got) != 1 || got[0].V != 1 {
+		t.Fatalf("previous hour = %+v", got)
+	}
+	if got := readAllNDJSONGz(t, path(now)); len(got) != 1 || got[0].V != 2 {
+		t.Fatalf("current hour = %+v", got)
+	}
+}
+
 func sizeOrZero(fi os.FileInfo) int64 {
 	if fi == nil {
 		return 0
@@ -431,6 +517,66 @@ func TestDeleteBeforeDayUTC(t *testing.T) {
 	}
 }
 
+func TestRouterDeleteBeforeDayWithConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+	series := "players.x"
+	tags := Tags{"player_id": "P:1"}
+	old := time.Date(2025, 8, 24, 12, 0, 0, 0, time.UTC)
+	boundary := time.Date(2025, 8, 26, 0, 0, 0, 0, time.UTC)
+
+	r := NewRouter(dir, series, WithLocation(time.UTC))
+	if err := r.Append(Point{T: old, V: 0, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 削除対象日へ追記し続ける（バックフィル）。削除が終わった後に始めた追記は必ずディスクに残る
+	var deleted atomic.Bool
+	var after atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			done := deleted.Load()
+			if err := r.Append(Point{T: old.Add(time.Duration(i) * time.Millisecond), V: float64(i), Tags: tags}); err != nil {
+				t.Error(err)
+				return
+			}
+			if done {
+				after.Add(1)
+			}
+		}
+	})
+	time.Sleep(5 * time.Millisecond)
+	if err := r.DeleteBeforeDay(boundary, time.UTC); err != nil {
+		t.Fatalf("Router.DeleteBeforeDay: %v", err)
+	}
+	deleted.Store(true)
+	for after.Load() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	if err := ScanRange(dir, series, old.Add(-time.Hour), boundary, func(Point) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if int64(n) < after.Load() {
+		t.Fatalf("points on disk = %d, want at least the %d appended after the delete", n, after.Load())
+	}
+}
+
 func TestDeleteBeforeDayJST(t *testing.T) {
 	dir := t.TempDir()
 	series := "metrics"
@@ -507,3 +653,978 @@ func TestScanRangeEarlyStop(t *testing.T) {
 		t.Fatalf("expected early stop after 1 point, got %d", count)
 	}
 }
+
+func TestScanRangeMatchSkipsOtherTagSets(t *testing.T) {
+	dir := t.TempDir()
+	series := "metrics"
+	r := NewRouter(dir, series, WithLocation(time.UTC), WithFlushEvery(1))
+	defer r.Close()
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	tokyo := Tags{"region": "tokyo", "host": "game01"}
+	osaka := Tags{"region": "osaka", "host": "game02"}
+	for i := 0; i < 3; i++ {
+		_ = r.Append(Point{T: base.Add(time.Minute * time.Duration(i)), V: float64(i), Tags: tokyo})
+		_ = r.Append(Point{T: base.Add(time.Minute * time.Duration(i)), V: float64(i + 100), Tags: osaka})
+	}
+	_ = r.Close()
+
+	// osaka の中身を壊しておく: labels.json で除外されれば展開されずエラーにならない
+	osakaFile := filepath.Join(dir, series, osaka.Hash(), "2025", "08", "26", "10.ndjson.gz")
+	if err := os.WriteFile(osakaFile, []byte("not gzip"), 0o644); err != nil {
+		t.Fatalf("corrupt osaka: %v", err)
+	}
+
+	count := 0
+	err := ScanRangeMatch(dir, series, base, base.Add(time.Hour), Tags{"region": "tokyo"}, func(p Point) bool {
+		if p.Tags["region"] != "tokyo" {
+			t.Fatalf("unexpected tags: %+v", p.Tags)
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanRangeMatch: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("want 3 tokyo points, got %d", count)
+	}
+}
+
+func TestScanRangeReadsOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	series := "metrics"
+	r := NewRouter(dir, series, WithLocation(time.UTC), WithFlushEvery(1))
+	defer r.Close()
+
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	tags := Tags{"host": "game01"}
+	for i := 0; i < 3; i++ {
+		if err := r.Append(Point{T: base.Add(time.Second * time.Duration(i)), V: float64(i), Tags: tags}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	// Close 前（gzip フッター未確定）でも Flush 済みの点は読める
+	count := 0
+	if err := ScanRange(dir, series, base, base.Add(time.Minute), func(Point) bool { count++; return true }); err != nil {
+		t.Fatalf("ScanRange on open file: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("want 3 points, got %d", count)
+	}
+}
+
+func TestScanRangeReadsRotatedPartsInTimeOrder(t *testing.T) {
+	dir := t.TempDir()
+	series := "metrics"
+	tags := Tags{"host": "game01"}
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	r := NewRouter(dir, series, WithLocation(time.UTC))
+	for _, m := range []int{0, 5, 40} {
+		if err := r.Append(Point{T: base.Add(time.Duration(m) * time.Minute), V: float64(m), Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Append(Point{T: base.Add(70 * time.Minute), V: 70, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+
+	// サイズで分割されたパートを模して追加する（part10 は part2 の後、名前の壊れたものは読まない）
+	dayDir := filepath.Join(dir, series, tags.Hash(), "2025", "08", "26")
+	writePart := func(name string, minutes ...int) {
+		t.Helper()
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		for _, m := range minutes {
+			line, _ := json.Marshal(Point{T: base.Add(time.Duration(m) * time.Minute), V: float64(m), Tags: tags})
+			gz.Write(append(line, '\n'))
+		}
+		gz.Close()
+		if err := os.WriteFile(filepath.Join(dayDir, name), b.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePart("10.part2.ndjson.gz", 10, 3) // 追記順が前後した点
+	writePart("10.part10.ndjson.gz", 59, 20)
+	writePart("10.partx.ndjson.gz", 1) // 無視される
+	writePart("11.part2.ndjson.gz", 65)
+
+	var got []float64
+	if err := ScanRange(dir, series, base, base.Add(2*time.Hour), func(p Point) bool {
+		got = append(got, p.V)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRange: %v", err)
+	}
+	want := []float64{0, 3, 5, 10, 20, 40, 59, 65, 70}
+	if !slices.Equal(got, want) {
+		t.Fatalf("points = %v, want %v", got, want)
+	}
+
+	// 早期終了は並べ替えた順で効く
+	got = got[:0]
+	_ = ScanRange(dir, series, base, base.Add(2*time.Hour), func(p Point) bool {
+		got = append(got, p.V)
+		return len(got) < 2
+	})
+	if !slices.Equal(got, []float64{0, 3}) {
+		t.Fatalf("early stop points = %v, want [0 3]", got)
+	}
+
+	// 各点を読んだファイル（root からの相対パス）
+	rel := func(name string) string { return filepath.Join(series, tags.Hash(), "2025", "08", "26", name) }
+	wantSrc := map[float64]string{
+		0: rel("10.ndjson.gz"), 3: rel("10.part2.ndjson.gz"), 5: rel("10.ndjson.gz"), 10: rel("10.part2.ndjson.gz"),
+		20: rel("10.part10.ndjson.gz"), 40: rel("10.ndjson.gz"), 59: rel("10.part10.ndjson.gz"),
+		65: rel("11.part2.ndjson.gz"), 70: rel("11.ndjson.gz"),
+	}
+	got = got[:0]
+	if err := ScanRangeWithSource(dir, series, base, base.Add(2*time.Hour), func(p Point, source string) bool {
+		got = append(got, p.V)
+		if source != wantSrc[p.V] {
+			t.Errorf("point %v: source = %q, want %q", p.V, source, wantSrc[p.V])
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRangeWithSource: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("points with source = %v, want %v", got, want)
+	}
+}
+
+func TestScanReverseNewestFirstAcrossHoursAndTagSets(t *testing.T) {
+	dir := t.TempDir()
+	series := "events"
+	r := NewRouter(dir, series, WithFlushEvery(1))
+	// 日をまたぐ 23:50 〜 翌 00:10 に 2 つのタグセットを交互に書く
+	base := time.Date(2025, 8, 26, 23, 50, 0, 0, time.UTC)
+	kill := Tags{"kind": "kill"}
+	death := Tags{"kind": "death"}
+	for i := range 5 {
+		tags := kill
+		if i%2 == 1 {
+			tags = death
+		}
+		if err := r.Append(Point{T: base.Add(time.Duration(i) * 5 * time.Minute), V: float64(i), Tags: tags}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	_ = r.Close()
+
+	collect := func(before time.Time, match Tags, max int) []float64 {
+		var got []float64
+		err := ScanReverse(dir, series, before, match, func(p Point) bool {
+			got = append(got, p.V)
+			return len(got) < max
+		})
+		if err != nil {
+			t.Fatalf("ScanReverse: %v", err)
+		}
+		return got
+	}
+	// 00:10 ちょうど（V=4）は含まない
+	if got := collect(base.Add(20*time.Minute), nil, 10); !slices.Equal(got, []float64{3, 2, 1, 0}) {
+		t.Fatalf("all = %v", got)
+	}
+	if got := collect(base.Add(time.Hour), Tags{"kind": "kill"}, 10); !slices.Equal(got, []float64{4, 2, 0}) {
+		t.Fatalf("kill = %v", got)
+	}
+	if got := collect(base.Add(time.Hour), nil, 2); !slices.Equal(got, []float64{4, 3}) {
+		t.Fatalf("early stop = %v", got)
+	}
+	if got := collect(base, nil, 10); len(got) != 0 {
+		t.Fatalf("before the first point = %v", got)
+	}
+}
+
+func TestFollowStreamsExistingAndAppendedPoints(t *testing.T) {
+	dir := t.TempDir()
+	series := "pos"
+	r := NewRouter(dir, series, WithLocation(time.UTC), WithFlushEvery(1))
+	t.Cleanup(func() { _ = r.Close() })
+
+	h0 := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	h1 := h0.Add(time.Hour)
+	tags := Tags{"pid": "p1"}
+	mustAppend := func(ts time.Time, v float64) {
+		t.Helper()
+		if err := r.Append(Point{T: ts, V: v, Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustAppend(h0.Add(time.Minute), 1) // from より前
+	mustAppend(h0.Add(2*time.Minute), 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan float64, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- Follow(ctx, dir, series, h0.Add(2*time.Minute), func(p Point) bool {
+			got <- p.V
+			return p.V < 5
+		}, WithPollInterval(10*time.Millisecond))
+	}()
+	next := func() float64 {
+		t.Helper()
+		select {
+		case v := <-got:
+			return v
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for point")
+			return 0
+		}
+	}
+
+	if v := next(); v != 2 {
+		t.Fatalf("first point = %v, want 2 (existing, from inclusive)", v)
+	}
+	mustAppend(h0.Add(3*time.Minute), 3) // 同じ時間ファイルへの追記
+	if v := next(); v != 3 {
+		t.Fatalf("appended point = %v, want 3", v)
+	}
+	mustAppend(h1.Add(time.Minute), 4) // ローテーション後の新しい時間ファイル
+	if v := next(); v != 4 {
+		t.Fatalf("rotated point = %v, want 4", v)
+	}
+	mustAppend(h1.Add(2*time.Minute), 5) // fn が false を返すと終了
+	if v := next(); v != 5 {
+		t.Fatalf("last point = %v, want 5", v)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Follow returned %v, want nil after fn=false", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Follow did not stop after fn returned false")
+	}
+}
+
+func TestFollowReturnsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// series ディレクトリが無くても待ち続ける
+	err := Follow(ctx, t.TempDir(), "missing", time.Now(), func(Point) bool { return true }, WithPollInterval(10*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestLabelsMetaNotRewrittenWhenUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	series := "pos"
+	tags := Tags{"pid": "p1"}
+	meta := filepath.Join(dir, series, tags.Hash(), "labels.json")
+	now := time.Now().UTC()
+
+	r := NewRouter(dir, series)
+	if err := r.Append(Point{T: now, V: 1, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+
+	// 再起動相当: 同じタグなら labels.json を書き直さない
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(meta, old, old); err != nil {
+		t.Fatal(err)
+	}
+	r = NewRouter(dir, series)
+	if err := r.Append(Point{T: now, V: 2, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+	if st, err := os.Stat(meta); err != nil || !st.ModTime().Equal(old) {
+		t.Fatalf("labels.json rewritten (mtime=%v err=%v)", st.ModTime(), err)
+	}
+
+	// 内容が違えば書き直す
+	if err := os.WriteFile(meta, []byte(`{"pid":"other"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r = NewRouter(dir, series)
+	if err := r.Append(Point{T: now, V: 3, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+	if got, err := readLabels(filepath.Dir(meta)); err != nil || got["pid"] != "p1" {
+		t.Fatalf("labels.json = %v, %v; want rewritten", got, err)
+	}
+}
+
+func TestWithLoggerReceivesWriterWarnings(t *testing.T) {
+	dir := t.TempDir()
+	series := "pos"
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	// tagHash の衝突（別のタグの labels.json が既にある）
+	collided := Tags{"pid": "p1"}
+	if err := os.MkdirAll(TagDir(dir, series, collided), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(TagDir(dir, series, collided), "labels.json"), []byte(`{"pid":"other"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// labels.json の書き込み失敗（一時ファイルの場所がディレクトリ）
+	broken := Tags{"pid": "p2"}
+	if err := os.MkdirAll(filepath.Join(TagDir(dir, series, broken), "labels.json.tmp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter(dir, series, WithLogger(logger))
+	for _, tags := range []Tags{collided, broken} {
+		if err := r.Append(Point{T: now, V: 1, Tags: tags}); err != nil {
+			t.Fatalf("append %v: %v", tags, err)
+		}
+	}
+	_ = r.Close()
+
+	out := buf.String()
+	for _, want := range []string{
+		"level=WARN msg=\"tsfile: tag hash collision\" series=pos tag_hash=" + collided.Hash(),
+		"level=WARN msg=\"tsfile: labels meta write error\" series=pos tag_hash=" + broken.Hash(),
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in log:\n%s", want, out)
+		}
+	}
+}
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	series := "players.x"
+	r := NewRouter(src, series, WithLocation(time.UTC))
+	now := time.Now().UTC()
+	for i := range 3 {
+		if err := r.Append(Point{T: now.Add(time.Duration(i) * time.Second), V: float64(i), Tags: Tags{"pid": "p1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Snapshot(&buf, src); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	archive := buf.Bytes()
+
+	dst := filepath.Join(t.TempDir(), "restored") // 未作成の root でもよい
+	if err := Restore(bytes.NewReader(archive), dst); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	var got []float64
+	if err := ScanRange(dst, series, now.Add(-time.Minute), now.Add(time.Minute), func(p Point) bool {
+		got = append(got, p.V)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRange restored: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("restored points = %v, want 3", got)
+	}
+
+	// 空でない root は WithForce が無ければ拒否
+	if err := Restore(bytes.NewReader(archive), dst); err == nil {
+		t.Fatal("Restore into non-empty root succeeded without WithForce")
+	}
+	if err := Restore(bytes.NewReader(archive), dst, WithForce()); err != nil {
+		t.Fatalf("Restore WithForce: %v", err)
+	}
+}
+
+func TestRestoreRejectsPathTraversal(t *testing.T) {
+	for _, name := range []string{"../evil.ndjson.gz", "/abs/evil.ndjson.gz", "a/../../evil.ndjson.gz"} {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		body := []byte("x")
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tw.Write(body)
+		_ = tw.Close()
+		_ = zw.Close()
+
+		parent := t.TempDir()
+		root := filepath.Join(parent, "root")
+		if err := Restore(&buf, root); err == nil {
+			t.Fatalf("%q: Restore succeeded, want error", name)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "evil.ndjson.gz")); err == nil {
+			t.Fatalf("%q: file written outside root", name)
+		}
+	}
+}
+
+func TestRestoreForceRejectsSymlinks(t *testing.T) {
+	archive := func(name string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		body := []byte("x")
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tw.Write(body)
+		_ = tw.Close()
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 途中のディレクトリがシンボリックリンク
+	root := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "series")); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+	if err := Restore(bytes.NewReader(archive("series/2024/evil.ndjson.gz")), root, WithForce()); err == nil {
+		t.Fatal("Restore through symlinked dir succeeded, want error")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "2024")); err == nil {
+		t.Fatal("directory created outside root")
+	}
+
+	// 書き込み先そのものがシンボリックリンク
+	root = t.TempDir()
+	if err := os.Symlink(victim, filepath.Join(root, "evil.ndjson.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(bytes.NewReader(archive("evil.ndjson.gz")), root, WithForce()); err == nil {
+		t.Fatal("Restore onto symlinked file succeeded, want error")
+	}
+	if b, _ := os.ReadFile(victim); string(b) != "keep" {
+		t.Fatalf("file outside root overwritten: %q", b)
+	}
+}
+
+func TestWALReplaysUnflushedPointsAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	series := "events.count"
+	walPath := filepath.Join(dir, "wal", series+".wal")
+	now := time.Now().UTC()
+
+	// 1 回目: Flush も Close もせずに「クラッシュ」（gzip 側はバッファに残ったまま）
+	crashed := NewRouter(dir, series, WithWAL(walPath))
+	for i := range 3 {
+		if err := crashed.Append(Point{T: now.Add(time.Duration(i) * time.Second), V: 1, Tags: Tags{"kind": "player_death"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, err := os.Stat(walPath); err != nil || st.Size() == 0 {
+		t.Fatalf("wal not written: %v", err)
+	}
+
+	// 2 回目: 最初の Append で WAL を再投入する
+	r := NewRouter(dir, series, WithWAL(walPath))
+	if err := r.Append(Point{T: now.Add(10 * time.Second), V: 1, Tags: Tags{"kind": "player_connect"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(walPath); err != nil || st.Size() != 0 {
+		t.Fatalf("wal not truncated on Close: size=%d err=%v", st.Size(), err)
+	}
+
+	n := 0
+	if err := ScanRange(dir, series, now.Add(-time.Minute), now.Add(time.Minute), func(Point) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("points = %d, want 4 (3 replayed + 1 new)", n)
+	}
+}
+
+func TestRouterSyncSealsFilesInPlace(t *testing.T) {
+	dir := t.TempDir()
+	series := "players.x"
+	walPath := filepath.Join(dir, "wal", series+".wal")
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	tags := Tags{"player_id": "P:1"}
+	_, file := PathForHour(dir, series, tags, now)
+
+	r := NewRouter(dir, series, WithWAL(walPath))
+	for i := range 2 {
+		if err := r.Append(Point{T: now.Add(time.Duration(i) * time.Second), V: float64(i), Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		// 厳密な gzip リーダーで末尾まで読める（フッターまで書かれている）
+		if got := readAllNDJSONGz(t, file); len(got) != i+1 {
+			t.Fatalf("after Sync %d: %d points, want %d", i, len(got), i+1)
+		}
+		// writer は開いたまま、WAL は空
+		if n := r.WriterCount(); n != 1 {
+			t.Fatalf("WriterCount after Sync = %d, want 1", n)
+		}
+		if st, err := os.Stat(walPath); err != nil || st.Size() != 0 {
+			t.Fatalf("wal not truncated on Sync: %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllNDJSONGz(t, file); len(got) != 2 || got[1].V != 1 {
+		t.Fatalf("after Close: %+v", got)
+	}
+}
+
+func TestDeleteBeforeDayDryRun(t *testing.T) {
+	dir := t.TempDir()
+	series := "metrics"
+	tags := Tags{"host": "game01"}
+	r := NewRouter(dir, series, WithLocation(time.UTC))
+	for _, d := range []int{24, 25, 26} {
+		if err := r.Append(Point{T: time.Date(2025, 8, d, 12, 0, 0, 0, time.UTC), V: 1, Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = r.Close()
+
+	var would []string
+	if err := DeleteBeforeDay(dir, series, time.Date(2025, 8, 26, 0, 0, 0, 0, time.UTC), time.UTC,
+		WithDryRun(), WithOnDelete(func(p string) { would = append(would, p) })); err != nil {
+		t.Fatalf("DeleteBeforeDay dry-run: %v", err)
+	}
+	base := filepath.Join(dir, series, tags.Hash(), "2025", "08")
+	want := []string{filepath.Join(base, "24"), filepath.Join(base, "25")}
+	sort.Strings(would)
+	if fmt.Sprint(would) != fmt.Sprint(want) {
+		t.Fatalf("dry-run paths = %v, want %v", would, want)
+	}
+	for _, d := range []string{"24", "25", "26"} {
+		if _, err := os.Stat(filepath.Join(base, d)); err != nil {
+			t.Fatalf("dry-run removed %s: %v", d, err)
+		}
+	}
+}
+
+func TestRouterRejectsHostileTags(t *testing.T) {
+	root := t.TempDir()
+	r := NewRouter(root, "players.x")
+	defer r.Close()
+	now := time.Now().UTC()
+
+	hostile := []Tags{
+		{"name": "../../etc"},
+		{"name": `a\b`},
+		{"name": "line\nbreak"},
+		{"name": "nul\x00"},
+		{"name": "a;b=c"},
+		{"k=v": "x"},
+		{"a/b": "x"},
+		{"": "x"},
+	}
+	for _, tags := range hostile {
+		err := r.Append(Point{T: now, V: 1, Tags: tags})
+		if err == nil {
+			t.Fatalf("Append(%q) succeeded, want error", tags)
+		}
+	}
+	if err := r.Append(Point{T: now, V: 1, Tags: Tags{"name": "ok-名前 1"}}); err != nil {
+		t.Fatalf("Append with valid tags error: %v", err)
+	}
+	// 拒否された点はディレクトリを作らない
+	ents, err := os.ReadDir(filepath.Join(root, "players.x"))
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("got %d tag dirs, want 1", len(ents))
+	}
+}
+
+func TestRouterTagSanitizerReplaces(t *testing.T) {
+	root := t.TempDir()
+	r := NewRouter(root, "players.x", WithTagSanitizer(SanitizeTag))
+	now := time.Now().UTC()
+
+	tags := Tags{"name": "../x\ny;z", "a=b": "v"}
+	if err := r.Append(Point{T: now, V: 1, Tags: tags}); err != nil {
+		t.Fatalf("Append error: %v", err)
+	}
+	if tags["name"] != "../x\ny;z" {
+		t.Fatalf("caller's tags were modified: %q", tags)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	var got []Point
+	if err := ScanRange(root, "players.x", now.Add(-time.Minute), now.Add(time.Minute), func(p Point) bool {
+		got = append(got, p)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRange error: %v", err)
+	}
+	want := Tags{"name": ".._x_y_z", "a_b": "v"}
+	if len(got) != 1 || got[0].Tags.Canonical() != want.Canonical() {
+		t.Fatalf("got %+v, want tags %v", got, want)
+	}
+}
+
+func TestRouterWriterCountAndCloseIdleWriters(t *testing.T) {
+	root := t.TempDir()
+	r := NewRouter(root, "players.x")
+	defer r.Close()
+	now := time.Now().UTC()
+
+	for _, id := range []string{"P:1", "P:2"} {
+		if err := r.Append(Point{T: now, V: 1, Tags: Tags{"player_id": id}}); err != nil {
+			t.Fatalf("Append error: %v", err)
+		}
+	}
+	if n := r.WriterCount(); n != 2 {
+		t.Fatalf("WriterCount = %d, want 2", n)
+	}
+	if b := r.BufferedBytes(); b <= 0 {
+		t.Fatalf("BufferedBytes = %d, want >0 before Flush", b)
+	}
+	if st := r.Stats(); st != (RouterStats{Writers: 2, PendingPoints: 2}) {
+		t.Fatalf("Stats = %+v", st)
+	}
+	if r.Series() != "players.x" || r.Root() != root {
+		t.Fatalf("Series/Root = %q %q", r.Series(), r.Root())
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if st := r.Stats(); st.PendingPoints != 0 {
+		t.Fatalf("PendingPoints after Flush = %d", st.PendingPoints)
+	}
+
+	// まだ新しいので閉じない
+	if n, err := r.CloseIdleWriters(time.Hour); err != nil || n != 0 {
+		t.Fatalf("CloseIdleWriters(1h) = %d, %v; want 0, nil", n, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := r.Append(Point{T: now.Add(time.Second), V: 2, Tags: Tags{"player_id": "P:2"}}); err != nil {
+		t.Fatalf("Append error: %v", err)
+	}
+	n, err := r.CloseIdleWriters(10 * time.Millisecond)
+	if err != nil || n != 1 {
+		t.Fatalf("CloseIdleWriters = %d, %v; want 1, nil", n, err)
+	}
+	if n := r.WriterCount(); n != 1 {
+		t.Fatalf("WriterCount after eviction = %d, want 1", n)
+	}
+
+	// 閉じたタグセットへ再び書ける（同じ時間ファイルへ追記）
+	if err := r.Append(Point{T: now.Add(2 * time.Second), V: 3, Tags: Tags{"player_id": "P:1"}}); err != nil {
+		t.Fatalf("Append after eviction error: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	var got []float64
+	if err := ScanRangeMatch(root, "players.x", now.Add(-time.Minute), now.Add(time.Minute), Tags{"player_id": "P:1"}, func(p Point) bool {
+		got = append(got, p.V)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRangeMatch error: %v", err)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Fatalf("P:1 points = %v, want [1 3]", got)
+	}
+}
+
+func TestIdleWriterTimeoutClosesAndReopens(t *testing.T) {
+	root := t.TempDir()
+	r := NewRouter(root, "players.x", WithIdleWriterTimeout(30*time.Millisecond))
+	now := time.Now().UTC()
+	tags := Tags{"player_id": "P:idle"}
+
+	if err := r.Append(Point{T: now, V: 1, Tags: tags}); err != nil {
+		t.Fatalf("Append error: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for r.WriterCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle writer was not closed (WriterCount=%d)", r.WriterCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 閉じた時点で Flush 済み
+	if pts := readAllNDJSONGz(t, hourPath(filepath.Join(root, "players.x", tags.Hash()), now.Truncate(time.Hour))); len(pts) != 1 {
+		t.Fatalf("got %d points on disk after idle close, want 1", len(pts))
+	}
+
+	if err := r.Append(Point{T: now.Add(time.Second), V: 2, Tags: tags}); err != nil {
+		t.Fatalf("Append after idle close error: %v", err)
+	}
+	if n := r.WriterCount(); n != 1 {
+		t.Fatalf("WriterCount after reuse = %d, want 1", n)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("second Close error: %v", err)
+	}
+	var got []float64
+	if err := ScanRange(root, "players.x", now.Add(-time.Minute), now.Add(time.Minute), func(p Point) bool {
+		got = append(got, p.V)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRange error: %v", err)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("points = %v, want [1 2]", got)
+	}
+}
+
+func TestRollupAggregatesPerTagSetAndIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	a := Tags{"player_id": "1"}
+	b := Tags{"player_id": "2"}
+
+	r := NewRouter(dir, "raw", WithLocation(time.UTC))
+	// 10:00〜10:09 に 1 分ごと。a は i、b は 100+i
+	for i := 0; i < 10; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute)
+		_ = r.Append(Point{T: ts, V: float64(i), Tags: a})
+		_ = r.Append(Point{T: ts, V: float64(100 + i), Tags: b})
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Rollup(dir, "raw", "raw_5m", base, base.Add(10*time.Minute), 5*time.Minute, AggMax)
+	if err != nil {
+		t.Fatalf("Rollup: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("want 4 rolled points, got %d", n)
+	}
+
+	read := func() map[string][]Point {
+		got := map[string][]Point{}
+		err := ScanRange(dir, "raw_5m", base, base.Add(time.Hour), func(p Point) bool {
+			got[p.Tags["player_id"]] = append(got[p.Tags["player_id"]], p)
+			return true
+		})
+		if err != nil {
+			t.Fatalf("ScanRange: %v", err)
+		}
+		for _, ps := range got {
+			sort.Slice(ps, func(i, j int) bool { return ps[i].T.Before(ps[j].T) })
+		}
+		return got
+	}
+	got := read()
+	want := map[string][]float64{"1": {4, 9}, "2": {104, 109}}
+	for id, vs := range want {
+		ps := got[id]
+		if len(ps) != len(vs) {
+			t.Fatalf("player %s: got %d points, want %d", id, len(ps), len(vs))
+		}
+		for i, v := range vs {
+			if ps[i].V != v || !ps[i].T.Equal(base.Add(time.Duration(i)*5*time.Minute)) {
+				t.Fatalf("player %s point %d = %+v, want V=%v", id, i, ps[i], v)
+			}
+		}
+	}
+
+	// 同じ範囲で再実行しても重複しない
+	n, err = Rollup(dir, "raw", "raw_5m", base, base.Add(10*time.Minute), 5*time.Minute, AggMax)
+	if err != nil || n != 0 {
+		t.Fatalf("rerun: n=%d err=%v, want 0 nil", n, err)
+	}
+	if got := read(); len(got["1"]) != 2 || len(got["2"]) != 2 {
+		t.Fatalf("rerun duplicated points: %v", got)
+	}
+}
+
+// writeTruncatedGz は content を gzip で書き、フッターを書かずに（クラッシュ相当で）閉じる。
+func TestAppendMultiRoundTripsThroughWALAndRollup(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	tags := Tags{"player_id": "1"}
+
+	r := NewRouter(dir, "pos", WithWAL(filepath.Join(t.TempDir(), "pos.wal")))
+	for i := range 4 {
+		if err := r.AppendMulti(base.Add(time.Duration(i)*time.Minute), map[string]float64{"x": float64(i), "z": float64(-10 * i)}, tags); err != nil {
+			t.Fatalf("AppendMulti: %v", err)
+		}
+	}
+	if err := r.Append(Point{T: base.Add(5 * time.Minute), V: 7, Tags: tags}); err != nil { // 単一値の点も混在できる
+		t.Fatal(err)
+	}
+	for _, bad := range []map[string]float64{nil, {"": 1}} {
+		if err := r.AppendMulti(base, bad, tags); err == nil {
+			t.Fatalf("want error for values %v", bad)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Point
+	if err := ScanRange(dir, "pos", base, base.Add(time.Hour), func(p Point) bool {
+		got = append(got, p)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanRange: %v", err)
+	}
+	if len(got) != 5 || got[2].Values["x"] != 2 || got[2].Values["z"] != -20 || got[4].Values != nil || got[4].V != 7 {
+		t.Fatalf("points = %+v", got)
+	}
+
+	if n, err := Rollup(dir, "pos", "pos.5m", base, base.Add(10*time.Minute), 5*time.Minute, AggMean); err != nil || n != 2 {
+		t.Fatalf("Rollup = %d, %v", n, err)
+	}
+	got = got[:0]
+	_ = ScanRange(dir, "pos.5m", base, base.Add(time.Hour), func(p Point) bool {
+		got = append(got, p)
+		return true
+	})
+	if len(got) != 2 || got[0].Values["x"] != 1.5 || got[0].Values["z"] != -15 || got[1].Values != nil || got[1].V != 7 {
+		t.Fatalf("rollup points = %+v", got)
+	}
+}
+
+func writeTruncatedGz(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	if _, err := io.WriteString(gz, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyFileAndSeriesReportTruncation(t *testing.T) {
+	dir := t.TempDir()
+	series := "metrics"
+	base := time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC)
+	r := NewRouter(dir, series, WithLocation(time.UTC))
+	for i := 0; i < 3; i++ {
+		if err := r.Append(Point{T: base.Add(time.Duration(i) * time.Second), V: float64(i), Tags: Tags{"host": "a"}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	clean := filepath.Join(dir, series, Tags{"host": "a"}.Hash(), "2025", "08", "26", "10.ndjson.gz")
+	if n, truncated, err := VerifyFile(clean); n != 3 || truncated || err != nil {
+		t.Fatalf("clean file: %d, %v, %v", n, truncated, err)
+	}
+
+	// 2 行と、途中で切れた 3 行目を書いたところで落ちたファイル
+	crashed := filepath.Join(dir, series, "crashed", "2025", "08", "26", "11.ndjson.gz")
+	writeTruncatedGz(t, crashed, `{"t":"2025-08-26T11:00:00Z","v":1}`+"\n"+`{"t":"2025-08-26T11:00:01Z","v":2}`+"\n"+`{"t":"2025-08-26T1`)
+	if n, truncated, err := VerifyFile(crashed); n != 2 || !truncated || err != nil {
+		t.Fatalf("crashed file: %d, %v, %v", n, truncated, err)
+	}
+
+	// フッターの CRC が壊れたファイル（途切れではない破損）
+	b, err := os.ReadFile(clean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-8] ^= 0xff
+	corrupt := filepath.Join(dir, series, "corrupt", "2025", "08", "26", "12.ndjson.gz")
+	if err := os.MkdirAll(filepath.Dir(corrupt), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(corrupt, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := VerifySeries(dir, series)
+	if err != nil {
+		t.Fatalf("VerifySeries: %v", err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("want 2 problems, got %+v", problems)
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	if p := problems[0]; p.Path != corrupt || p.Truncated || p.Err == nil {
+		t.Fatalf("corrupt: %+v", p)
+	}
+	if p := problems[1]; p.Path != crashed || !p.Truncated || p.Points != 2 || p.Err != nil {
+		t.Fatalf("crashed: %+v", p)
+	}
+}
+
+func TestRepairFileKeepsIntactPoints(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics", "h", "2025", "08", "26", "11.ndjson.gz")
+	writeTruncatedGz(t, path, `{"t":"2025-08-26T11:00:00Z","v":1}`+"\n"+`{"t":"2025-08-26T11:00:01Z","v":2}`+"\n"+`{"t":"2025-08-26T1`)
+
+	if err := RepairFile(path); err != nil {
+		t.Fatalf("RepairFile: %v", err)
+	}
+	if n, truncated, err := VerifyFile(path); n != 2 || truncated || err != nil {
+		t.Fatalf("after repair: %d, %v, %v", n, truncated, err)
+	}
+	pts := readAllNDJSONGz(t, path)
+	if len(pts) != 2 || pts[1].V != 2 {
+		t.Fatalf("unexpected points: %+v", pts)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("leftover temp files: %v, %v", entries, err)
+	}
+
+	// 問題の無いファイルはそのまま（書き直さない）
+	before, _ := os.Stat(path)
+	if err := RepairFile(path); err != nil {
+		t.Fatalf("RepairFile on clean file: %v", err)
+	}
+	if after, _ := os.Stat(path); !os.SameFile(before, after) {
+		t.Fatal("clean file was rewritten")
+	}
+}
+
+func TestWithBufferSizeSetsWriterBuffer(t *testing.T) {
+	tags := Tags{"player_id": "P:1"}
+	p := Point{T: time.Date(2025, 8, 26, 10, 0, 0, 0, time.UTC), V: 1, Tags: tags}
+	for _, c := range []struct {
+		opts []WriterOpt
+		want int
+	}{
+		{nil, DefaultBufferSize},
+		{[]WriterOpt{WithBufferSize(64 << 10)}, 64 << 10},
+		{[]WriterOpt{WithBufferSize(10)}, MinBufferSize}, // 下限に切り上げ
+	} {
+		r := NewRouter(t.TempDir(), "players.x", c.opts...)
+		if err := r.Append(p); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		r.mu.Lock()
+		got := r.writers[tags.Hash()].bw.Size()
+		r.mu.Unlock()
+		if got != c.want {
+			t.Errorf("buffer size = %d, want %d", got, c.want)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
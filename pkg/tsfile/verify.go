@@ -0,0 +1,157 @@
+package tsfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileProblem は VerifySeries が見つけた問題のある時間ファイルです。
+type FileProblem struct {
+	Path      string
+	Points    int   // 読めた点の数
+	Truncated bool  // gzip フッターが無い（書き込み中に落ちた・まだ Close されていない）
+	Err       error // 途中で壊れていて読めなかった（CRC 不一致や JSON の破損など）
+}
+
+// VerifyFile は時間ファイル（*.ndjson.gz）を最後まで展開し、読めた点の数と、
+// gzip がフッターで正しく終わらずに途切れているか（truncated）を返します。
+// 途切れたファイルでは、最後の改行までの完全な行だけを数えます（途中で切れた最後の行は数えない）。
+// gzip の CRC 不一致や JSON として読めない行など、途切れ以外の破損は err で返します。
+// 作成直後で何も書かれていない空ファイルも truncated とみなします。
+func VerifyFile(path string) (points int, truncated bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	err = readRecords(f, path, func([]byte) error {
+		points++
+		return nil
+	})
+	if errors.Is(err, errTruncated) {
+		return points, true, nil
+	}
+	return points, false, err
+}
+
+// VerifySeries は root/series 配下の全時間ファイルを VerifyFile で検査し、
+// 途切れている・壊れているファイルを返します（問題が無ければ空）。
+// 書き込み中の時間ファイルもフッターが無いので truncated になります。Router を閉じてから実行してください。
+func VerifySeries(root, series string) ([]FileProblem, error) {
+	var out []FileProblem
+	err := filepath.WalkDir(filepath.Join(root, series), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".ndjson.gz") {
+			return nil
+		}
+		n, truncated, verr := VerifyFile(path)
+		if truncated || verr != nil {
+			out = append(out, FileProblem{Path: path, Points: n, Truncated: truncated, Err: verr})
+		}
+		return nil
+	})
+	return out, err
+}
+
+// errTruncated は gzip がフッターの前で途切れていることを表します。
+var errTruncated = errors.New("tsfile: truncated gzip stream")
+
+// readRecords は r の gzip を（連結メンバーも含めて）最後まで展開し、完全な 1 行（1 点）ごとに fn を呼びます。
+// 空行は飛ばし、JSON の Point として読めない行はエラーにします（path はエラー表示用）。
+// フッターの前で途切れていれば、それまでの完全な行を渡したうえで errTruncated を返します。
+func readRecords(r io.Reader, path string, fn func(line []byte) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errTruncated // 空ファイル・ヘッダ途中
+		}
+		return err
+	}
+	defer gz.Close()
+
+	br := bufio.NewReader(gz)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return errTruncated // 改行で終わっていない最後の行は捨てる
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var p Point
+			if jerr := json.Unmarshal(trimmed, &p); jerr != nil {
+				return fmt.Errorf("%s: line %d: %w", path, n, jerr)
+			}
+			if ferr := fn(trimmed); ferr != nil {
+				return ferr
+			}
+		}
+		if err != nil {
+			return nil // io.EOF: フッターまで正しく読めた
+		}
+	}
+}
+
+// RepairFile は途切れた・壊れた時間ファイルを、読める完全な点だけの正しい gzip に書き直します。
+// 先頭から読める限りの完全な行を残し、途中で切れた最後の行と、壊れた箇所以降は捨てます。
+// 一時ファイルに書いて rename で置き換えるので、途中で失敗しても元のファイルは残ります。
+// 問題の無いファイルは書き直しません。書き込み中のファイル（Router が開いているもの）には使わないでください。
+func RepairFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var buf bytes.Buffer
+	rerr := readRecords(f, path, func(line []byte) error {
+		buf.Write(line)
+		buf.WriteByte('\n')
+		return nil
+	})
+	f.Close()
+	if rerr == nil {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".repair-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // rename 後は存在しないので無害
+	gz := gzip.NewWriter(tmp)
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,140 @@
+package tsfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ---- WAL（先行書き込みログ） ----
+
+// walCheckpointBytes を超えたら全 writer を Flush して WAL を空にする（WAL の肥大化防止）。
+const walCheckpointBytes = 4 << 20
+
+// WithWAL は Router に先行書き込みログを付けます（既定は無効）。
+// Append の点はまず path へ非圧縮の 1 行として追記・fsync され、そのあと gzip の writer にバッファされます。
+// Flush/Close（と WAL が一定サイズを超えたとき）に writer を Flush してから WAL を空にし、
+// 次回起動時の最初の Append で残っている WAL を再投入します（クラッシュ時は重複することがあります）。
+// path は Router ごとに別のファイルにしてください（TSStore では RouterFactory でシリーズ別に指定）。
+func WithWAL(path string) WriterOpt { return func(c *writerConfig) { c.walPath = path } }
+
+// walLog は Router ごとの WAL ファイルです。Router.walMu で追記と checkpoint を直列化する
+// （WAL に書いた点を writer へ渡し終える前に WAL を空にしないため）。
+type walLog struct {
+	f    *os.File
+	size int64
+}
+
+// appendWAL は WAL 付きの Append です。r.walMu を保持したまま WAL 追記 → writer への書き込みを行います。
+func (r *Router) appendWAL(p Point) error {
+	r.walMu.Lock()
+	defer r.walMu.Unlock()
+	if err := r.openWALLocked(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := r.wal.f.Write(b); err != nil {
+		return fmt.Errorf("tsfile: wal write: %w", err)
+	}
+	if err := r.wal.f.Sync(); err != nil {
+		return fmt.Errorf("tsfile: wal sync: %w", err)
+	}
+	r.wal.size += int64(len(b))
+	if err := r.appendWriter(p); err != nil {
+		return err
+	}
+	if r.wal.size >= walCheckpointBytes {
+		return r.checkpointLocked()
+	}
+	return nil
+}
+
+// openWALLocked は初回だけ WAL を開き、前回から残っている点を writer へ再投入します。
+func (r *Router) openWALLocked() error {
+	if r.wal != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(r.cfg.walPath), 0o755); err != nil {
+		return err
+	}
+	replayed, err := r.replayWAL()
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		// 再投入した点をファイルへ確定させてから WAL を空にする
+		if err := r.flushWriters(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(r.cfg.walPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	r.wal = &walLog{f: f}
+	return nil
+}
+
+// replayWAL は WAL の完全な行を writer へ書き戻します（書きかけの最終行は捨てる）。
+func (r *Router) replayWAL() (int, error) {
+	f, err := os.Open(r.cfg.walPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return n, nil // EOF（改行の無い最終行はクラッシュ時の書きかけ）
+		}
+		var p Point
+		if err := json.Unmarshal(line, &p); err != nil {
+			return n, fmt.Errorf("tsfile: wal replay %s: %w", r.cfg.walPath, err)
+		}
+		if p.Tags == nil {
+			p.Tags = Tags{}
+		}
+		if err := r.appendWriter(p); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// checkpointLocked は全 writer を Flush+Sync してから WAL を空にします（r.walMu 保持中に呼ぶ）。
+func (r *Router) checkpointLocked() error {
+	if r.wal == nil {
+		return nil
+	}
+	if err := r.flushWriters(); err != nil {
+		return err
+	}
+	if err := r.wal.f.Truncate(0); err != nil {
+		return err
+	}
+	r.wal.size = 0
+	return nil
+}
+
+// closeWALLocked は WAL を空にして閉じます（全 writer を Close した後に呼ぶ）。
+func (r *Router) closeWALLocked() error {
+	if r.wal == nil {
+		return nil
+	}
+	err := errors.Join(r.wal.f.Truncate(0), r.wal.f.Close())
+	r.wal = nil
+	return err
+}